@@ -0,0 +1,587 @@
+package phonelab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go-easyfiles"
+)
+
+// Archives are .tar, .tar.gz, .tgz or .zip files of logs, e.g. the bundles
+// that devices upload. Each member is a source of its own.
+
+type ArchiveSourceInfo struct {
+	Archive string
+	// The member's name within the archive
+	Member string
+}
+
+func (info *ArchiveSourceInfo) Type() string {
+	return "archive"
+}
+
+func (info *ArchiveSourceInfo) Context() string {
+	if len(info.Member) == 0 {
+		return info.Archive
+	}
+	return info.Archive + "/" + info.Member
+}
+
+type archiveKind int
+
+const (
+	archiveUnknown archiveKind = iota
+	archiveTar
+	archiveTarGz
+	archiveZip
+)
+
+func archiveKindOf(p string) archiveKind {
+	switch {
+	case strings.HasSuffix(p, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(p, ".tar.gz"), strings.HasSuffix(p, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(p, ".zip"):
+		return archiveZip
+	}
+	return archiveUnknown
+}
+
+// Check the member patterns, so that bad ones are caught before anything is
+// read.
+func checkArchiveMembers(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid member pattern '%v': %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Whether a member matches any of the patterns. Patterns without a '/' also
+// match the member's base name, so '*.log' finds logs in any directory. No
+// patterns match everything.
+func matchArchiveMember(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(name)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// An open archive, shared by the processors for its members.
+type archiveHandle interface {
+	// Open the member at index. The member's processor holds on to the
+	// archive until the Closer is closed.
+	openMember(index int) (io.Reader, io.Closer, error)
+	// Called once for every member that is listed, after it is read.
+	// The archive is closed after the last one.
+	release()
+	// Close the archive, whether or not its members have all been read.
+	close()
+}
+
+// Tar archives can only be read in order, so like zip archives they're read
+// from a file, which for compressed or remote archives is a temporary copy.
+// Listing the archive notes where each member starts, so that members can be
+// read at the same time and in any order.
+type tarArchive struct {
+	mu        sync.Mutex
+	file      *os.File
+	offsets   map[int]int64 // Where the headers of the listed entries start
+	remaining int
+}
+
+func openTarArchive(fs FileSystem, archive string, gz bool) (*tarArchive, error) {
+	if !gz {
+		file, err := openSourceFile(fs, archive)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{file: file}, nil
+	}
+
+	r, err := openSourceReader(fs, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	file, err := spoolTempFile(gzr)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchive{file: file}, nil
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+const tarBlockSize = 512
+
+// Find the members to read, by index
+func (t *tarArchive) list(match func(string) bool) ([]int, []string, error) {
+	indexes := make([]int, 0)
+	names := make([]string, 0)
+	t.offsets = make(map[int]int64)
+
+	counter := &countingReader{r: io.NewSectionReader(t.file, 0, math.MaxInt64)}
+	reader := tar.NewReader(counter)
+	for index := 0; ; index++ {
+		// The previous entry has been read to the end, so the next header
+		// starts at the block after it.
+		offset := (counter.n + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if hdr.FileInfo().Mode().IsRegular() && match(hdr.Name) {
+			indexes = append(indexes, index)
+			names = append(names, hdr.Name)
+			t.offsets[index] = offset
+		}
+		if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	t.remaining = len(indexes)
+	return indexes, names, nil
+}
+
+// Whether a tar archive has any members to read, found by reading it through
+// once rather than copying it
+func tarHasMembers(fs FileSystem, archive string, gz bool, match func(string) bool) (bool, error) {
+	r, err := openSourceReader(fs, archive)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	var reader io.Reader = r
+	if gz {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return false, err
+		}
+		reader = gzr
+	}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if hdr.FileInfo().Mode().IsRegular() && match(hdr.Name) {
+			return true, nil
+		}
+	}
+}
+
+func (t *tarArchive) openMember(index int) (io.Reader, io.Closer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return nil, nil, fmt.Errorf("Archive is closed")
+	}
+
+	offset, ok := t.offsets[index]
+	if !ok {
+		return nil, nil, fmt.Errorf("Member %v is missing", index)
+	}
+	reader := tar.NewReader(io.NewSectionReader(t.file, offset, math.MaxInt64-offset))
+	if _, err := reader.Next(); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("Member %v is missing", index)
+		}
+		return nil, nil, err
+	}
+	return reader, closerFunc(func() {}), nil
+}
+
+func (t *tarArchive) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remaining -= 1
+	if t.remaining <= 0 {
+		t.closeFile()
+	}
+}
+
+func (t *tarArchive) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeFile()
+}
+
+func (t *tarArchive) closeFile() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// Zip archives can be read in any order, but need to be seekable. Local
+// ones are read in place and others are copied to a temporary file first.
+type zipArchive struct {
+	mu        sync.Mutex
+	file      *os.File
+	reader    *zip.Reader
+	remaining int
+}
+
+// The local path of a file, if it is local
+func localSourcePath(fs FileSystem, p string) (string, bool) {
+	if u, ok := fs.(*urlFileSystem); ok {
+		return localSourcePath(u.fs, u.strip(p))
+	}
+	if fs == easyfiles.LocalFS {
+		return p, true
+	}
+	return "", false
+}
+
+// Open a file that needs to be read out of order. Files that aren't local
+// are copied to a temporary file first, which is gone once it's closed.
+func openSourceFile(fs FileSystem, p string) (*os.File, error) {
+	if local, ok := localSourcePath(fs, p); ok {
+		return os.Open(local)
+	}
+
+	r, err := openSourceReader(fs, p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return spoolTempFile(r)
+}
+
+// Copy r to a temporary file, which is gone once it's closed. The file is
+// read from the start.
+func spoolTempFile(r io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile("", "phonelab-source")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func openZipArchive(fs FileSystem, archive string) (*zipArchive, error) {
+	file, err := openSourceFile(fs, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader, err := zip.NewReader(file, stat.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &zipArchive{file: file, reader: reader}, nil
+}
+
+func (z *zipArchive) list(match func(string) bool) ([]int, []string) {
+	indexes := make([]int, 0)
+	names := make([]string, 0)
+	for index, f := range z.reader.File {
+		if f.FileInfo().Mode().IsRegular() && match(f.Name) {
+			indexes = append(indexes, index)
+			names = append(names, f.Name)
+		}
+	}
+	z.remaining = len(indexes)
+	return indexes, names
+}
+
+func (z *zipArchive) openMember(index int) (io.Reader, io.Closer, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.file == nil {
+		return nil, nil, fmt.Errorf("Archive is closed")
+	}
+	r, err := z.reader.File[index].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, r, nil
+}
+
+func (z *zipArchive) release() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.remaining -= 1
+	if z.remaining <= 0 {
+		z.closeFile()
+	}
+}
+
+func (z *zipArchive) close() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.closeFile()
+}
+
+func (z *zipArchive) closeFile() {
+	if z.file != nil {
+		z.file.Close()
+		z.file = nil
+	}
+}
+
+// Reads the lines of one member of an archive. Members ending in .gz are
+// gunzipped.
+type ArchiveMemberProcessor struct {
+	Info *ArchiveSourceInfo
+	ErrHandler
+	archive archiveHandle
+	index   int
+}
+
+func (p *ArchiveMemberProcessor) processMember(ctx context.Context, outChan chan interface{}) {
+	defer p.archive.release()
+
+	onError := func(err error, line int) {
+		reportSourceError(ctx, p.ErrHandler, &SourceError{
+			Info: p.Info,
+			File: p.Info.Context(),
+			Line: line,
+			Err:  err,
+		})
+	}
+
+	member, closer, err := p.archive.openMember(p.index)
+	if err != nil {
+		onError(fmt.Errorf("Error opening member: %v", err), 0)
+		return
+	}
+	defer closer.Close()
+
+	if strings.HasSuffix(p.Info.Member, ".gz") {
+		gzr, err := gzip.NewReader(member)
+		if err != nil {
+			onError(fmt.Errorf("Error opening member: %v", err), 0)
+			return
+		}
+		member = gzr
+	}
+
+	metrics := nodeMetrics(ctx, "ArchiveMemberProcessor")
+	scanner := newLineScanner(member)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		metrics.itemIn()
+		line := scanner.Text()
+		if !metrics.send(ctx, outChan, line) {
+			return
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		onError(fmt.Errorf("Error scanning member: %v", err), lineNum+1)
+	}
+}
+
+// The archive is closed once each of its members has been read, so members
+// can't have more than one reader.
+func (p *ArchiveMemberProcessor) SinglePass() {}
+
+func (p *ArchiveMemberProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *ArchiveMemberProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		p.processMember(ctx, outChan)
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+// A source generator that generates one ArchiveMemberProcessor for each
+// member of each archive that matches Members.
+type ArchiveSourceGenerator struct {
+	Archives []string
+	// Glob patterns for the members to read. See matchArchiveMember.
+	Members    []string
+	ErrHandler ErrHandler
+	// Finds the filesystem each archive is on. nil for the Environment's
+	// defaults.
+	Resolve FileSystemResolver
+}
+
+func NewArchiveSourceGenerator(archives []string, members []string, errHandler ErrHandler) *ArchiveSourceGenerator {
+	return &ArchiveSourceGenerator{
+		Archives:   archives,
+		Members:    members,
+		ErrHandler: errHandler,
+	}
+}
+
+// Open an archive and list the members to read. Members the Runner skips
+// because they're already done aren't listed, as nothing would release the
+// archive for them. If there are no members to read, the archive is nil.
+func (ag *ArchiveSourceGenerator) openArchive(ctx context.Context, archive string) (archiveHandle, []int, []string, error) {
+	resolve := ag.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(ctx, "")
+	}
+	fs, err := resolve(archive)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	match := func(name string) bool {
+		return matchArchiveMember(ag.Members, name) &&
+			!sourceSkipped(ctx, &ArchiveSourceInfo{Archive: archive, Member: name})
+	}
+
+	switch archiveKindOf(archive) {
+	case archiveTar, archiveTarGz:
+		gz := archiveKindOf(archive) == archiveTarGz
+		// On resume, don't copy an archive that may be done already
+		if _, local := localSourcePath(fs, archive); gz || !local {
+			if j := journalFromContext(ctx); j != nil && j.anyDone((&ArchiveSourceInfo{}).Type(), archive+"/") {
+				if ok, err := tarHasMembers(fs, archive, gz, match); err != nil {
+					return nil, nil, nil, err
+				} else if !ok {
+					return nil, nil, nil, nil
+				}
+			}
+		}
+
+		t, err := openTarArchive(fs, archive, gz)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		indexes, names, err := t.list(match)
+		if err != nil {
+			t.close()
+			return nil, nil, nil, err
+		}
+		return t, indexes, names, nil
+	case archiveZip:
+		z, err := openZipArchive(fs, archive)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		indexes, names := z.list(match)
+		return z, indexes, names, nil
+	}
+	return nil, nil, nil, fmt.Errorf("Unknown archive type. Expected .tar, .tar.gz, .tgz or .zip")
+}
+
+func (ag *ArchiveSourceGenerator) Process() <-chan *PipelineSourceInstance {
+	return ag.ProcessContext(context.Background())
+}
+
+func (ag *ArchiveSourceGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
+	sourceChan := make(chan *PipelineSourceInstance)
+
+	go func() {
+		defer close(sourceChan)
+
+		for _, archive := range ag.Archives {
+			handle, indexes, names, err := ag.openArchive(ctx, archive)
+			if err != nil {
+				policy := reportSourceError(ctx, ag.ErrHandler, &SourceError{
+					Info: &ArchiveSourceInfo{Archive: archive},
+					File: archive,
+					Err:  fmt.Errorf("Error opening archive: %v", err),
+				})
+				if policy == ErrorPolicyFailFast {
+					return
+				}
+				continue
+			}
+			if len(indexes) == 0 {
+				if handle != nil {
+					handle.close()
+				}
+				continue
+			}
+
+			// Members that are never processed, e.g. because the run
+			// is canceled, would keep it open.
+			if done := ctx.Done(); done != nil {
+				go func() {
+					<-done
+					handle.close()
+				}()
+			}
+
+			for i, index := range indexes {
+				info := &ArchiveSourceInfo{
+					Archive: archive,
+					Member:  names[i],
+				}
+				source := &PipelineSourceInstance{
+					Processor: &ArchiveMemberProcessor{
+						Info:       info,
+						ErrHandler: ag.ErrHandler,
+						archive:    handle,
+						index:      index,
+					},
+					Info: info,
+				}
+				if !sendSourceContext(ctx, sourceChan, source) {
+					return
+				}
+			}
+		}
+	}()
+
+	return sourceChan
+}
@@ -0,0 +1,326 @@
+package phonelab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shaseley/phonelab-go/serialize/s3test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The members of the test archives, in order
+var archiveTestMembers = []struct {
+	name string
+	data string
+}{
+	{"logs/a.log", "1\n2\n3\n"},
+	{"logs/b.log.gz", "4\n5\n"},
+	{"notes.txt", "6\n"},
+	{"c.log", "7\n8\n9\n10\n"},
+}
+
+func gzipString(t *testing.T, s string) []byte {
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	_, err := gzw.Write([]byte(s))
+	require.Nil(t, err)
+	require.Nil(t, gzw.Close())
+	return buf.Bytes()
+}
+
+func archiveTestData(t *testing.T, name string, data string) []byte {
+	if filepath.Ext(name) == ".gz" {
+		return gzipString(t, data)
+	}
+	return []byte(data)
+}
+
+// Write test.tar.gz and test.zip to dir
+func writeTestArchives(t *testing.T, dir string) {
+	require := require.New(t)
+
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	require.Nil(tw.WriteHeader(&tar.Header{Name: "logs/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, member := range archiveTestMembers {
+		data := archiveTestData(t, member.name, member.data)
+		require.Nil(tw.WriteHeader(&tar.Header{
+			Name:     member.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.Nil(err)
+	}
+	require.Nil(tw.Close())
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "test.tar.gz"), gzipString(t, tarBuf.String()), 0644))
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	_, err := zw.Create("logs/")
+	require.Nil(err)
+	for _, member := range archiveTestMembers {
+		w, err := zw.Create(member.name)
+		require.Nil(err)
+		_, err = w.Write(archiveTestData(t, member.name, member.data))
+		require.Nil(err)
+	}
+	require.Nil(zw.Close())
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "test.zip"), zipBuf.Bytes(), 0644))
+}
+
+func TestArchiveSources(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-archive")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+	writeTestArchives(t, tmpDir)
+
+	errHandler := func(err error) {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"test.tar.gz", "test.zip"} {
+		archive := filepath.Join(tmpDir, name)
+
+		// Everything but the directory
+		gen := NewArchiveSourceGenerator([]string{archive}, nil, errHandler)
+		assert.Equal(map[string]int{
+			archive + "/logs/a.log":    3,
+			archive + "/logs/b.log.gz": 2,
+			archive + "/notes.txt":     1,
+			archive + "/c.log":         4,
+		}, countSourceLines(t, gen))
+
+		// Patterns without a '/' match in any directory
+		gen = NewArchiveSourceGenerator([]string{archive}, []string{"*.log", "*.gz"}, errHandler)
+		assert.Equal(map[string]int{
+			archive + "/logs/a.log":    3,
+			archive + "/logs/b.log.gz": 2,
+			archive + "/c.log":         4,
+		}, countSourceLines(t, gen))
+
+		gen = NewArchiveSourceGenerator([]string{archive}, []string{"logs/*"}, errHandler)
+		assert.Equal(map[string]int{
+			archive + "/logs/a.log":    3,
+			archive + "/logs/b.log.gz": 2,
+		}, countSourceLines(t, gen))
+
+		// Members can be read in any order, and some not at all
+		sources := make([]*PipelineSourceInstance, 0)
+		for source := range NewArchiveSourceGenerator([]string{archive}, nil, errHandler).Process() {
+			sources = append(sources, source)
+		}
+		require.Equal(4, len(sources))
+		for _, i := range []int{3, 0, 1} {
+			lines := make([]string, 0)
+			for line := range sources[i].Processor.Process() {
+				lines = append(lines, line.(string))
+			}
+			info := sources[i].Info.(*ArchiveSourceInfo)
+			assert.Equal(archiveTestMembers[i].name, info.Member)
+			assert.Equal(archiveTestMembers[i].data, strings.Join(lines, "\n")+"\n")
+		}
+	}
+}
+
+func TestArchiveMembersConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-archive")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+	writeTestArchives(t, tmpDir)
+
+	// An uncompressed tar is read in place
+	tarFile := filepath.Join(tmpDir, "test.tar")
+	gz, err := os.Open(filepath.Join(tmpDir, "test.tar.gz"))
+	require.Nil(err)
+	defer gz.Close()
+	gzr, err := gzip.NewReader(gz)
+	require.Nil(err)
+	data, err := ioutil.ReadAll(gzr)
+	require.Nil(err)
+	require.Nil(ioutil.WriteFile(tarFile, data, 0644))
+
+	errHandler := func(err error) {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"test.tar", "test.tar.gz", "test.zip"} {
+		archive := filepath.Join(tmpDir, name)
+
+		// Start reading every member, then read them from last to first
+		resChans := make([]<-chan interface{}, 0)
+		for source := range NewArchiveSourceGenerator([]string{archive}, nil, errHandler).Process() {
+			resChans = append(resChans, source.Processor.Process())
+		}
+		require.Equal(len(archiveTestMembers), len(resChans), name)
+		for i := len(resChans) - 1; i >= 0; i-- {
+			lines := make([]string, 0)
+			for line := range resChans[i] {
+				lines = append(lines, line.(string))
+			}
+			assert.Equal(archiveTestMembers[i].data, strings.Join(lines, "\n")+"\n", name)
+		}
+	}
+}
+
+func TestArchiveSourceConf(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-archive")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+	writeTestArchives(t, tmpDir)
+
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceArchive,
+		Sources: []string{filepath.Join(tmpDir, "test.*")},
+		Args: map[string]interface{}{
+			"members": "c.log",
+		},
+	}
+	gen, err := conf.ToPipelineSourceGenerator()
+	require.Nil(err)
+	assert.Equal(map[string]int{
+		filepath.Join(tmpDir, "test.tar.gz") + "/c.log": 4,
+		filepath.Join(tmpDir, "test.zip") + "/c.log":    4,
+	}, countSourceLines(t, gen))
+
+	conf.Args["members"] = []interface{}{"[abc"}
+	_, err = conf.ToPipelineSourceGenerator()
+	require.NotNil(err)
+	assert.Contains(err.Error(), "Invalid member pattern '[abc'")
+
+	conf.Args["members"] = 1
+	_, err = conf.ToPipelineSourceGenerator()
+	require.NotNil(err)
+	assert.Contains(err.Error(), "Unexpected type for 'members'")
+
+	// Not an archive
+	conf.Args = nil
+	conf.Sources = []string{"test/test.log"}
+	gen, err = conf.ToPipelineSourceGenerator()
+	require.Nil(err)
+	errs := make([]error, 0)
+	gen.(*ArchiveSourceGenerator).ErrHandler = func(err error) {
+		errs = append(errs, err)
+	}
+	assert.Equal(0, len(countSourceLines(t, gen)))
+	require.Equal(1, len(errs))
+	assert.Contains(errs[0].Error(), "Unknown archive type")
+
+	// Remote archives
+	server, err := s3test.NewServer("bucket")
+	require.Nil(err)
+	defer server.Close()
+	require.Nil(server.PutFile("s3://bucket/test.zip", filepath.Join(tmpDir, "test.zip")))
+	require.Nil(server.PutFile("s3://bucket/test.tar.gz", filepath.Join(tmpDir, "test.tar.gz")))
+
+	conf.Sources = []string{"s3://bucket/test.*"}
+	conf.Args = map[string]interface{}{
+		"members": []interface{}{"logs/*.log", "notes.txt"},
+	}
+	gen, err = conf.ToPipelineSourceGenerator()
+	require.Nil(err)
+	assert.Equal(map[string]int{
+		"s3://bucket/test.tar.gz/logs/a.log": 3,
+		"s3://bucket/test.tar.gz/notes.txt":  1,
+		"s3://bucket/test.zip/logs/a.log":    3,
+		"s3://bucket/test.zip/notes.txt":     1,
+	}, countSourceLines(t, gen))
+}
+
+func TestValidateArchiveSource(t *testing.T) {
+	conf := `
+source:
+  type: archive
+  sources: ["./test/*.log"]
+  args:
+    members: ["*.log", "[abc"]
+processors:
+  - name: main
+    generator: passthrough
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(conf, newValidateTestEnv(), &ValidateOptions{SkipSources: true})
+	require.Equal(t, 1, len(diags), "%v", diags)
+	assert.Equal(t, 6, diags[0].Line)
+	assert.Contains(t, diags[0].Message, "Invalid member pattern '[abc'")
+}
+
+func TestArchiveSourcesResume(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-archive")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+	writeTestArchives(t, tmpDir)
+
+	j, err := OpenJournal(filepath.Join(tmpDir, "journal"), false)
+	require.Nil(err)
+	defer j.Close()
+
+	tarGz := filepath.Join(tmpDir, "test.tar.gz")
+	zipFile := filepath.Join(tmpDir, "test.zip")
+	for _, member := range []string{"logs/a.log", "notes.txt"} {
+		require.Nil(j.Record(&JournalEntry{Type: "archive", Context: tarGz + "/" + member}))
+		require.Nil(j.Record(&JournalEntry{Type: "archive", Context: zipFile + "/" + member}))
+	}
+
+	errHandler := func(err error) {
+		t.Error(err)
+	}
+	ctx := withJournal(context.Background(), j)
+
+	// Done members aren't listed, so the rest release the archive
+	for _, archive := range []string{tarGz, zipFile} {
+		sources := make([]*PipelineSourceInstance, 0)
+		for source := range NewArchiveSourceGenerator([]string{archive}, nil, errHandler).ProcessContext(ctx) {
+			sources = append(sources, source)
+		}
+		require.Equal(2, len(sources), archive)
+		assert.Equal("logs/b.log.gz", sources[0].Info.(*ArchiveSourceInfo).Member)
+		assert.Equal("c.log", sources[1].Info.(*ArchiveSourceInfo).Member)
+		for _, source := range sources {
+			for _ = range source.Processor.Process() {
+			}
+		}
+
+		switch handle := sources[0].Processor.(*ArchiveMemberProcessor).archive.(type) {
+		case *tarArchive:
+			assert.Nil(handle.file, archive)
+		case *zipArchive:
+			assert.Nil(handle.file, archive)
+		default:
+			t.Errorf("Unexpected archive %T", handle)
+		}
+	}
+
+	// An archive that's all done has no sources
+	for _, member := range []string{"logs/b.log.gz", "c.log"} {
+		require.Nil(j.Record(&JournalEntry{Type: "archive", Context: tarGz + "/" + member}))
+	}
+	count := 0
+	for _ = range NewArchiveSourceGenerator([]string{tarGz}, nil, errHandler).ProcessContext(ctx) {
+		count += 1
+	}
+	assert.Equal(0, count)
+}
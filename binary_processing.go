@@ -0,0 +1,206 @@
+package phonelab
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Binary log sources are files of logger_entry or pmsg records, e.g. from
+// logcat -B. Files ending in .gz are gunzipped. Rather than lines, they send
+// on *Loglines, which the logstream's parser only has to parse the payloads
+// of.
+
+type BinaryLogSourceInfo struct {
+	Filename string
+}
+
+func (info *BinaryLogSourceInfo) Type() string {
+	return "binary"
+}
+
+func (info *BinaryLogSourceInfo) Context() string {
+	return info.Filename
+}
+
+// Reads the entries of a binary log as *Loglines
+type BinaryLogProcessor struct {
+	Filename string
+	ErrHandler
+	Framing LoggerFraming
+	// The buffer of every entry, or LogIdUnknown to go by the entries. See
+	// LoggerEntryParser.
+	Buffer    int
+	EventTags EventLogTags
+	// Finds the filesystem the file is on. nil for the Environment's
+	// defaults.
+	Resolve FileSystemResolver
+}
+
+func NewBinaryLogProcessor(file string, errHandler ErrHandler) *BinaryLogProcessor {
+	return &BinaryLogProcessor{
+		Filename:   file,
+		ErrHandler: errHandler,
+		Framing:    LoggerFramingLogger,
+		Buffer:     LogIdUnknown,
+	}
+}
+
+func (p *BinaryLogProcessor) processFile(ctx context.Context, outChan chan interface{}) {
+	// The entries are framed, so there's no going on after a bad one.
+	onError := func(err error) {
+		reportSourceError(ctx, p.ErrHandler, &SourceError{
+			Info: &BinaryLogSourceInfo{p.Filename},
+			File: p.Filename,
+			Err:  err,
+		})
+	}
+
+	resolve := p.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(ctx, "")
+	}
+	fs, err := resolve(p.Filename)
+	if err != nil {
+		onError(fmt.Errorf("Error opening file: %v", err))
+		return
+	}
+	r, err := openSourceReader(fs, p.Filename)
+	if err != nil {
+		onError(fmt.Errorf("Error opening file: %v", err))
+		return
+	}
+	defer r.Close()
+
+	var reader io.Reader = r
+	if strings.HasSuffix(p.Filename, ".gz") {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			onError(fmt.Errorf("Error opening file: %v", err))
+			return
+		}
+		reader = gzr
+	}
+
+	parser := NewLoggerEntryParser()
+	parser.Buffer = p.Buffer
+	if p.EventTags != nil {
+		parser.EventTags = p.EventTags
+	}
+
+	metrics := nodeMetrics(ctx, "BinaryLogProcessor")
+	entries := NewLoggerEntryReader(reader, p.Framing)
+	entryNum := 0
+	for {
+		entry, err := entries.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			onError(fmt.Errorf("Error reading entry %v: %v", entryNum+1, err))
+			return
+		}
+		entryNum += 1
+		metrics.itemIn()
+
+		ll, err := parser.Parse(entry)
+		if err != nil {
+			// The next entry is fine, though.
+			metrics.AddParseErrors(1)
+			log.Debugf("Error parsing entry %v of %v: %v", entryNum, p.Filename, err)
+			continue
+		}
+		if !metrics.send(ctx, outChan, ll) {
+			return
+		}
+	}
+}
+
+func (p *BinaryLogProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *BinaryLogProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		p.processFile(ctx, outChan)
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+// A source generator that generates one BinaryLogProcessor for each file.
+type BinaryLogSourceGenerator struct {
+	Files      []string
+	ErrHandler ErrHandler
+	Framing    LoggerFraming
+	Buffer     int
+	EventTags  EventLogTags
+	// Finds the filesystem each file is on. nil for the Environment's
+	// defaults.
+	Resolve FileSystemResolver
+}
+
+func NewBinaryLogSourceGenerator(files []string, errHandler ErrHandler) *BinaryLogSourceGenerator {
+	return &BinaryLogSourceGenerator{
+		Files:      files,
+		ErrHandler: errHandler,
+		Framing:    LoggerFramingLogger,
+		Buffer:     LogIdUnknown,
+	}
+}
+
+// Read the event log tags from a file, which can be on any filesystem.
+func (bg *BinaryLogSourceGenerator) LoadEventTags(file string) error {
+	resolve := bg.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(context.Background(), "")
+	}
+	fs, err := resolve(file)
+	if err != nil {
+		return err
+	}
+	data, err := fs.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Error reading event tags: %v", err)
+	}
+	if bg.EventTags, err = ParseEventLogTags(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("Error reading event tags: %v", err)
+	}
+	return nil
+}
+
+func (bg *BinaryLogSourceGenerator) Process() <-chan *PipelineSourceInstance {
+	return bg.ProcessContext(context.Background())
+}
+
+func (bg *BinaryLogSourceGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
+	sourceChan := make(chan *PipelineSourceInstance)
+
+	go func() {
+		for _, file := range bg.Files {
+			processor := NewBinaryLogProcessor(file, bg.ErrHandler)
+			processor.Framing = bg.Framing
+			processor.Buffer = bg.Buffer
+			processor.EventTags = bg.EventTags
+			processor.Resolve = bg.Resolve
+
+			source := &PipelineSourceInstance{
+				Processor: processor,
+				Info:      &BinaryLogSourceInfo{file},
+			}
+			if !sendSourceContext(ctx, sourceChan, source) {
+				break
+			}
+		}
+		close(sourceChan)
+	}()
+
+	return sourceChan
+}
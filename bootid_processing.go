@@ -2,15 +2,16 @@ package phonelab
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gurupras/go-daterange"
 	"github.com/gurupras/go-easyfiles"
-	"github.com/gurupras/go-easyfiles/easyhdfs"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,6 +28,16 @@ type PhonelabSourceInfo struct {
 	BootId      string
 	FSInterface easyfiles.FileSystemInterface
 	DateRange   *daterange.DateRange
+	// The filesystem the device is on, which may not be an
+	// easyfiles.FileSystemInterface, e.g. S3. If nil, FSInterface is used.
+	FS FileSystem
+}
+
+func (info *PhonelabSourceInfo) fileSystem() FileSystem {
+	if info.FS != nil {
+		return info.FS
+	}
+	return info.FSInterface
 }
 
 func (info *PhonelabSourceInfo) Type() string {
@@ -34,6 +45,10 @@ func (info *PhonelabSourceInfo) Type() string {
 }
 
 func (info *PhonelabSourceInfo) Context() string {
+	// Errors about a whole device don't have a boot ID
+	if len(info.BootId) == 0 {
+		return info.DeviceId
+	}
 	return fmt.Sprintf("%v_%v", info.DeviceId, info.BootId)
 }
 
@@ -42,35 +57,79 @@ func NewPhonelabSourceProcessor(sourceInfo *PhonelabSourceInfo, errHandler ErrHa
 	device := sourceInfo.DeviceId
 	bootId := sourceInfo.BootId
 
-	bootPath := filepath.Join(path, device, bootId)
+	bootPath := joinSourcePath(path, device, bootId)
 
-	bootFiles, err := sourceInfo.FSInterface.Glob(filepath.Join(bootPath, "*.gz"))
+	bootFiles, err := sourceInfo.fileSystem().Glob(joinSourcePath(bootPath, "*.gz"))
 	if err != nil {
 		return nil, err
 	}
-	sort.Strings(bootFiles)
+	sortChunkFiles(bootFiles)
 	return &PhonelabSourceProcessor{sourceInfo, bootFiles, errHandler}, nil
 }
 
+// Chunks are named N.gz, so sort them numerically rather than by name.
+// Otherwise 10.gz would come before 2.gz.
+func sortChunkFiles(files []string) {
+	index := func(file string) int {
+		idx, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".gz"))
+		if err != nil {
+			return -1
+		}
+		return idx
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		lhs, rhs := index(files[i]), index(files[j])
+		if lhs < 0 || rhs < 0 {
+			return files[i] < files[j]
+		}
+		return lhs < rhs
+	})
+}
+
 func (psp *PhonelabSourceProcessor) Process() <-chan interface{} {
+	return psp.ProcessContext(context.Background())
+}
+
+func (psp *PhonelabSourceProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
 	outChan := make(chan interface{})
 
+	// Report an error. Returns true if we should carry on with the next file.
+	onError := func(file string, line int, err error) bool {
+		policy := reportSourceError(ctx, psp.ErrHandler, &SourceError{
+			Info: psp.PhonelabSourceInfo,
+			File: file,
+			Line: line,
+			Err:  err,
+		})
+		return policy == ErrorPolicySkipFile
+	}
+
 	go func() {
+		defer close(outChan)
+
 		var startIdx int = 0
 		var endIdx int = len(psp.bootFiles)
 		// Get as close to the requested daterange as possible
-		bootPath := filepath.Join(psp.Path, psp.DeviceId, psp.BootId)
+		bootPath := joinSourcePath(psp.Path, psp.DeviceId, psp.BootId)
 		if psp.DateRange != nil {
 			for idx, bootFile := range psp.bootFiles {
 				rel, err := filepath.Rel(bootPath, bootFile)
 				if err != nil {
-					if psp.ErrHandler != nil {
-						psp.ErrHandler(err)
-					} else {
-						panic(fmt.Sprintf("Failed to get relative path to: %v: %v", bootFile, err))
+					err = fmt.Errorf("Failed to get relative path: %v", err)
+					if onError(bootFile, 0, err) {
+						continue
+					}
+					return
+				}
+				fileInfo, ok := psp.BootInfo[psp.BootId][rel]
+				if !ok {
+					if onError(bootFile, 0, errors.New("File not found in info.json")) {
+						continue
 					}
+					return
 				}
-				startTimestamp := psp.BootInfo[psp.BootId][rel].Start
+				startTimestamp := fileInfo.Start
 				if startTimestamp < psp.DateRange.Start.Time.UnixNano() {
 					startIdx = idx
 				}
@@ -83,44 +142,64 @@ func (psp *PhonelabSourceProcessor) Process() <-chan interface{} {
 		log.Debugf("%v->%v range=%v-%v", psp.DeviceId, psp.BootId, startIdx, endIdx)
 
 		for _, bootFile := range psp.bootFiles[startIdx:endIdx] {
-			file, err := psp.PhonelabSourceInfo.FSInterface.Open(bootFile, os.O_RDONLY, easyfiles.GZ_TRUE)
-			if err != nil {
-				if psp.ErrHandler != nil {
-					psp.ErrHandler(err)
-				} else {
-					panic(fmt.Sprintf("Failed to Open '%v': %v", bootFile, err))
-				}
-			}
-			scanner, err := file.Reader(0)
-			if err != nil {
-				if psp.ErrHandler != nil {
-					psp.ErrHandler(err)
-				} else {
-					panic(fmt.Sprintf("Failed to get scanner to '%v': %v", bootFile, err))
-				}
-			}
-			scanner.Split(bufio.ScanLines)
-			for scanner.Scan() {
-				line := scanner.Text()
-				outChan <- line
+			if !psp.sendFile(ctx, outChan, bootFile, onError) {
+				return
 			}
 		}
-		close(outChan)
 	}()
 	return outChan
 }
 
+// Send every line in bootFile. Returns false if we should stop.
+func (psp *PhonelabSourceProcessor) sendFile(ctx context.Context, outChan chan interface{},
+	bootFile string, onError func(string, int, error) bool) bool {
+
+	scanner, closer, err := openSourceScanner(psp.PhonelabSourceInfo.fileSystem(), bootFile, true)
+	if err != nil {
+		return onError(bootFile, 0, fmt.Errorf("Failed to open: %v", err))
+	}
+	defer closer.Close()
+
+	scanner.Split(bufio.ScanLines)
+
+	metrics := nodeMetrics(ctx, "PhonelabSourceProcessor")
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		metrics.itemIn()
+		if !metrics.send(ctx, outChan, scanner.Text()) {
+			return false
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return onError(bootFile, lineNum+1, fmt.Errorf("Error scanning: %v", err))
+	}
+	return true
+}
+
 type PhonelabSourceGenerator struct {
 	devicePaths map[string][]string
 	Args        map[string]interface{}
 	ErrHandler
+	// Finds the filesystem each device path is on. nil for the
+	// Environment's defaults, with the hdfs_addr arg.
+	Resolve FileSystemResolver
 }
 
 func NewPhonelabSourceGenerator(devicePaths map[string][]string, args map[string]interface{}, errHandler ErrHandler) *PhonelabSourceGenerator {
-	return &PhonelabSourceGenerator{devicePaths, args, errHandler}
+	return &PhonelabSourceGenerator{
+		devicePaths: devicePaths,
+		Args:        args,
+		ErrHandler:  errHandler,
+	}
 }
 
 func (psg *PhonelabSourceGenerator) Process() <-chan *PipelineSourceInstance {
+	return psg.ProcessContext(context.Background())
+}
+
+func (psg *PhonelabSourceGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
 	sourceChan := make(chan *PipelineSourceInstance)
 
 	// Parse hdfs address
@@ -128,74 +207,106 @@ func (psg *PhonelabSourceGenerator) Process() <-chan *PipelineSourceInstance {
 	if v, ok := psg.Args["hdfs_addr"]; ok {
 		hdfsAddr = v.(string)
 	}
-
-	// Initialize FS
-	var fs easyfiles.FileSystemInterface
-	if strings.Compare(hdfsAddr, "") == 0 {
-		// No HDFS address. Local FS
-		fs = easyfiles.LocalFS
-	} else {
-		fs = easyhdfs.NewHDFSFileSystem(hdfsAddr)
-	}
-
-	// Parse date range
-	var dateRange *daterange.DateRange
-	if v, ok := psg.Args["daterange"]; ok {
-		var err error
-		if dateRange, err = ParseDateRange(v.(string)); err != nil {
-			panic(fmt.Sprintf("Unable to parse daterange: %v", err))
-		}
+	resolve := psg.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(ctx, hdfsAddr)
 	}
 
 	log.Debugf("Paths: %v", psg.devicePaths)
 
 	go func() {
+		defer close(sourceChan)
+
+		// Parse date range
+		var dateRange *daterange.DateRange
+		if v, ok := psg.Args["daterange"]; ok {
+			var err error
+			if dateRange, err = ParseDateRange(v.(string)); err != nil {
+				// Nothing we can do without it
+				reportSourceError(ctx, psg.ErrHandler, &SourceError{
+					Err: fmt.Errorf("Unable to parse daterange: %v", err),
+				})
+				return
+			}
+		}
+
+		// Report an error for the device. Returns true if we should carry on
+		// with the next one.
+		onError := func(info *PhonelabSourceInfo, file string, err error) bool {
+			policy := reportSourceError(ctx, psg.ErrHandler, &SourceError{
+				Info: info,
+				File: file,
+				Err:  err,
+			})
+			return policy != ErrorPolicyFailFast
+		}
+
 		for device, basePaths := range psg.devicePaths {
 			for _, basePath := range basePaths {
-				infoJsonPath := filepath.Join(basePath, device, "info.json")
-				if data, err := fs.ReadFile(infoJsonPath); err != nil {
-					if psg.ErrHandler != nil {
-						psg.ErrHandler(err)
-					} else {
-						panic(fmt.Sprintf("Error reading '%v': %v", infoJsonPath, err))
+				deviceInfo := &PhonelabSourceInfo{
+					DeviceId:  device,
+					Path:      basePath,
+					DateRange: dateRange,
+				}
+
+				// Each path can be on a different filesystem
+				fs, err := resolve(basePath)
+				if err != nil {
+					if onError(deviceInfo, basePath, err) {
+						continue
 					}
-				} else {
-					var info *StitchInfo
-					if info, err = GetInfoFromBytes(data); err != nil {
-						if psg.ErrHandler != nil {
-							psg.ErrHandler(err)
-						} else {
-							panic(fmt.Sprintf("Error unmarshaling '%v': %v", infoJsonPath, err))
-						}
+					return
+				}
+				deviceInfo.FS = fs
+				deviceInfo.FSInterface, _ = fs.(easyfiles.FileSystemInterface)
+
+				infoJsonPath := joinSourcePath(basePath, device, "info.json")
+				data, err := fs.ReadFile(infoJsonPath)
+				if err != nil {
+					if onError(deviceInfo, infoJsonPath, fmt.Errorf("Error reading: %v", err)) {
+						continue
 					}
-					bootids := info.BootIds()
-					for _, bootid := range bootids {
-						sourceInfo := &PhonelabSourceInfo{
-							DeviceId:    device,
-							BootId:      bootid,
-							Path:        basePath,
-							DateRange:   dateRange,
-							FSInterface: fs,
-							StitchInfo:  info,
-						}
+					return
+				}
 
-						psp, err := NewPhonelabSourceProcessor(sourceInfo, psg.ErrHandler)
-						if err != nil {
-							if psg.ErrHandler != nil {
-								psg.ErrHandler(err)
-							} else {
-								panic(fmt.Sprintf("Error creating new PhonelabSourceProcessor: %v", err))
-							}
-						}
-						sourceChan <- &PipelineSourceInstance{
-							Processor: psp,
-							Info:      sourceInfo,
+				info, err := GetInfoFromBytes(data)
+				if err != nil {
+					if onError(deviceInfo, infoJsonPath, fmt.Errorf("Error unmarshaling: %v", err)) {
+						continue
+					}
+					return
+				}
+
+				bootids := info.BootIds()
+				for _, bootid := range bootids {
+					sourceInfo := &PhonelabSourceInfo{
+						DeviceId:    device,
+						BootId:      bootid,
+						Path:        basePath,
+						DateRange:   dateRange,
+						FSInterface: deviceInfo.FSInterface,
+						FS:          fs,
+						StitchInfo:  info,
+					}
+
+					psp, err := NewPhonelabSourceProcessor(sourceInfo, psg.ErrHandler)
+					if err != nil {
+						err = fmt.Errorf("Error creating new PhonelabSourceProcessor: %v", err)
+						if onError(sourceInfo, "", err) {
+							continue
 						}
+						return
+					}
+					source := &PipelineSourceInstance{
+						Processor: psp,
+						Info:      sourceInfo,
+					}
+					if !sendSourceContext(ctx, sourceChan, source) {
+						return
 					}
 				}
 			}
 		}
-		close(sourceChan)
 	}()
 	return sourceChan
 }
@@ -63,6 +63,9 @@ func TestMultPhonelabSourceProcessor(t *testing.T) {
 		sourceInfo, ok := sourceInst.Info.(*PhonelabSourceInfo)
 		assert.True(ok)
 		assert.Equal("phonelab-device", sourceInfo.Type())
+		// Local devices still have an easyfiles.FileSystemInterface
+		assert.NotNil(sourceInfo.FSInterface)
+		assert.NotNil(sourceInfo.FS)
 
 		expected := 0
 
@@ -6,11 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
 	"github.com/gurupras/go-easyfiles"
-	"github.com/gurupras/go-easyfiles/easyhdfs"
 	"github.com/shaseley/depgraph"
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
@@ -41,12 +41,25 @@ const (
 	PipelineSourceFile        PipelineSourceType = "files"
 	PipelineSourcePhonelab                       = "phonelab"
 	PipelineSourcePhonelabRaw                    = "phonelab-raw"
+	// Tar and zip archives, with a source for each member. The members
+	// arg selects them with glob patterns.
+	PipelineSourceArchive = "archive"
+	// Live logs from stdin, named pipes or sockets, read until they close.
+	// See StreamSourceGenerator.
+	PipelineSourceStream = "stream"
+	// Binary logs from logcat -B, saved logd buffers or pmsg. See
+	// BinaryLogSourceGenerator.
+	PipelineSourceBinary = "binary"
+	// Raw ftrace output: trace_pipe dumps and trace.dat files. See
+	// FtraceSourceGenerator.
+	PipelineSourceFtrace = "ftrace"
 )
 
 type PipelineSourceConf struct {
-	Type    PipelineSourceType     `yaml:"type"`
-	Args    map[string]interface{} `yaml:"args"`
-	Sources []string               `yaml:"sources"`
+	Type        PipelineSourceType     `yaml:"type"`
+	Args        map[string]interface{} `yaml:"args"`
+	Sources     []string               `yaml:"sources"`
+	ErrorPolicy string                 `yaml:"error_policy,omitempty"` // fail_fast (default), skip_source or skip_file
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -55,6 +68,16 @@ type PipelineSourceConf struct {
 // If the DataCollectorConf Name field is set to 'default', set to
 const DataCollectorDefaultName = "default"
 
+// The DataCollectors we know how to build, by name. These take precedence
+// over the ones in the Environment.
+var builtinDataCollectors = map[string]func(args map[string]interface{}) (DataCollector, error){
+	DataCollectorDefaultName: NewDefaultCollector,
+	DataCollectorCSVName:     NewCSVCollector,
+	DataCollectorTSVName:     NewTSVCollector,
+	DataCollectorSQLiteName:  NewSQLiteCollector,
+	DataCollectorParquetName: NewParquetCollector,
+}
+
 type DataCollectorConf struct {
 	Name string                 `yaml:"name"`
 	Args map[string]interface{} `yaml:"args"`
@@ -69,6 +92,10 @@ const (
 	FilterTypeSimple FilterType = "simple"
 	FilterTypeRegex             = "regex"
 	FilterTypeCustom            = "custom"
+	// An expression over the fields of the parsed logline and its payload,
+	// e.g. tag == "Kernel-Trace" && payload.Cpu == 2. These run after the
+	// parser. See CompileLoglineExpr.
+	FilterTypeExpr = "expr"
 )
 
 type FilterConf struct {
@@ -97,6 +124,8 @@ type ProcessorConf struct {
 	Preprocessors []*ProcessorInputConf `yaml:"preprocessors"` // A list of preprocessor node names
 	Parsers       []string              `yaml:"parsers"`       // A list of parsers to use
 	Generator     string                `yaml:"generator"`     // The generator name for the processor. If empty, use name.
+	LogcatFormat  string                `yaml:"logcat_format"` // The format of the loglines, e.g. threadtime. If empty, work it out from each line.
+	LogcatYear    int                   `yaml:"logcat_year"`   // The year for the stock formats that leave it out. If 0, those loglines are marked NoYear.
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -184,32 +213,30 @@ func ProcessorConfsFromFile(file string) ([]*ProcessorConf, error) {
 	return ProcessorConfsFromString(string(data))
 }
 
-// Expand the conf into multiple confs, resolving globbing, etc.
+// Expand the conf into multiple confs, resolving globbing, etc. Only the
+// built-in filesystems are known; see ExpandEnv.
 func (conf *PipelineSourceConf) Expand() ([]string, error) {
-	allFiles := make([]string, 0)
+	return conf.ExpandEnv(builtinEnvironment())
+}
 
-	var hdfsAddr string
-	if v, ok := conf.Args["hdfs_addr"]; ok {
-		hdfsAddr = v.(string)
-	}
-	var fs easyfiles.FileSystemInterface
-	if strings.Compare(hdfsAddr, "") == 0 {
-		fs = easyfiles.LocalFS
-	} else {
-		fs = easyhdfs.NewHDFSFileSystem(hdfsAddr)
-	}
+// Expand, with the filesystems in env.
+func (conf *PipelineSourceConf) ExpandEnv(env *Environment) ([]string, error) {
+	allFiles := make([]string, 0)
+	resolve := env.fileSystemResolver(conf.hdfsAddr())
 
 	switch conf.Type {
 	default:
 		return nil, errors.New("Invalid type specification: " + string(conf.Type))
-	case PipelineSourceFile:
-		fallthrough
-	case PipelineSourcePhonelab:
+	case PipelineSourceFile, PipelineSourcePhonelab, PipelineSourceArchive, PipelineSourceBinary, PipelineSourceFtrace:
 		for _, source := range conf.Sources {
 			if len(source) == 0 {
 				return nil, fmt.Errorf("Invalid source file: empty name")
 			}
 
+			fs, err := resolve(source)
+			if err != nil {
+				return nil, err
+			}
 			files, err := fs.Glob(source)
 			if err != nil {
 				return nil, fmt.Errorf("Error globbing files: %v", err)
@@ -223,6 +250,14 @@ func (conf *PipelineSourceConf) Expand() ([]string, error) {
 			if len(source) == 0 {
 				return nil, fmt.Errorf("Invalid source file: empty name")
 			}
+			fs, err := resolve(source)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := fs.(easyfiles.FileSystemInterface); !ok {
+				// The processed files are written next to the raw ones
+				return nil, fmt.Errorf("Unsupported source '%v'. phonelab-raw sources must be plain paths on a filesystem that can be written to", source)
+			}
 			files, err := fs.Glob(source)
 			if err != nil {
 				return nil, fmt.Errorf("Error globbing files: %v", err)
@@ -231,33 +266,183 @@ func (conf *PipelineSourceConf) Expand() ([]string, error) {
 				allFiles = append(allFiles, files...)
 			}
 		}
+	case PipelineSourceStream:
+		// Nothing to glob; they're read as they are.
+		for _, source := range conf.Sources {
+			if err := checkStreamSource(source); err != nil {
+				return nil, err
+			}
+			allFiles = append(allFiles, source)
+		}
 	}
 	sort.Strings(allFiles)
 	return allFiles, nil
 }
 
-// Convert the source specification into something that can generate loglines.
-func (conf *PipelineSourceConf) ToPipelineSourceGenerator() (PipelineSourceGenerator, error) {
+func (conf *PipelineSourceConf) hdfsAddr() string {
+	if v, ok := conf.Args["hdfs_addr"]; ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// The member patterns of an archive source: a pattern or a list of them.
+func (conf *PipelineSourceConf) archiveMembers() ([]string, error) {
+	members := make([]string, 0)
+	switch v := conf.Args["members"].(type) {
+	case nil:
+	case string:
+		members = append(members, v)
+	case []interface{}:
+		for _, elem := range v {
+			if pattern, ok := elem.(string); ok {
+				members = append(members, pattern)
+			} else {
+				return nil, fmt.Errorf("Unexpected type for 'members'. Expected string, got %T", elem)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected type for 'members'. Expected string or list, got %T", v)
+	}
+	if err := checkArchiveMembers(members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// The args of a binary source: framing (logger or pmsg), buffer (the buffer
+// of every entry, for entries that don't say) and event_tags (the path of an
+// event-log-tags file). Every bad arg is in errs.
+func (conf *PipelineSourceConf) binaryLogArgs() (framing LoggerFraming, buffer int, eventTags string,
+	errs []*confFieldError) {
+
+	errs = make([]*confFieldError, 0)
+	args := make(map[string]string)
+	for _, name := range []string{"framing", "buffer", "event_tags"} {
+		switch v := conf.Args[name].(type) {
+		case nil:
+		case string:
+			args[name] = v
+		default:
+			errs = append(errs, fieldErrorf("args."+name, "",
+				"Unexpected type for '%v'. Expected string, got %T", name, v))
+		}
+	}
+
+	var err error
+	if framing, err = ParseLoggerFraming(args["framing"]); err != nil {
+		errs = append(errs, &confFieldError{"args.framing", suggestName(args["framing"], loggerFramings), err})
+	}
+	if buffer, err = ParseLogBuffer(args["buffer"]); err != nil {
+		errs = append(errs, &confFieldError{"args.buffer", suggestName(args["buffer"], logBuffers), err})
+	}
+	return framing, buffer, args["event_tags"], errs
+}
+
+// The most items a Tee queues for each logstream of a source that can only be
+// read once: the tee_max_queue arg. The default, 0, is no limit. See Tee for
+// the trade-off.
+func (conf *PipelineSourceConf) teeMaxQueue() (int, error) {
+	switch v := conf.Args["tee_max_queue"].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		if v < 0 {
+			return 0, fmt.Errorf("Invalid 'tee_max_queue' %v. Expected 0 (no limit) or more", v)
+		}
+		return v, nil
+	default:
+		return 0, fmt.Errorf("Unexpected type for 'tee_max_queue'. Expected int, got %T", v)
+	}
+}
+
+var pipelineSourceTypes = []string{
+	string(PipelineSourceFile), PipelineSourcePhonelab, PipelineSourcePhonelabRaw, PipelineSourceArchive,
+	PipelineSourceStream, PipelineSourceBinary, PipelineSourceFtrace,
+}
+
+// Check everything about the source conf that can be checked without looking
+// for the sources.
+func (conf *PipelineSourceConf) check() []*confFieldError {
+	errs := make([]*confFieldError, 0)
+
+	known := false
+	for _, t := range pipelineSourceTypes {
+		known = known || string(conf.Type) == t
+	}
+	if !known {
+		return append(errs, fieldErrorf("type", suggestName(string(conf.Type), pipelineSourceTypes),
+			"Invalid source type '%v'. Expected one of: %v", conf.Type, strings.Join(pipelineSourceTypes, ", ")))
+	}
+
+	switch conf.Type {
+	case PipelineSourceArchive:
+		if _, err := conf.archiveMembers(); err != nil {
+			errs = append(errs, &confFieldError{Field: "args.members", Err: err})
+		}
+	case PipelineSourceStream:
+		if v, ok := conf.Args["max_connections"]; ok {
+			if _, ok := v.(int); !ok {
+				errs = append(errs, fieldErrorf("args.max_connections", "",
+					"Unexpected type for 'max_connections'. Expected int, got %T", v))
+			}
+		}
+	case PipelineSourceBinary:
+		_, _, _, argErrs := conf.binaryLogArgs()
+		errs = append(errs, argErrs...)
+	}
+
+	if _, err := conf.teeMaxQueue(); err != nil {
+		errs = append(errs, &confFieldError{Field: "args.tee_max_queue", Err: err})
+	}
+
+	if _, err := ParseErrorPolicy(conf.ErrorPolicy); err != nil {
+		policies := []string{string(ErrorPolicyFailFast), string(ErrorPolicySkipSource), string(ErrorPolicySkipFile)}
+		errs = append(errs, &confFieldError{"error_policy", suggestName(conf.ErrorPolicy, policies), err})
+	}
+
 	if len(conf.Sources) == 0 {
-		return nil, errors.New("Missing sources specification in runner conf.")
+		errs = append(errs, fieldErrorf("sources", "", "Missing sources specification in runner conf."))
+	}
+	for i, source := range conf.Sources {
+		if len(source) == 0 {
+			errs = append(errs, fieldErrorf(indexConfPath("sources", i), "", "Invalid source file: empty name"))
+		}
 	}
 
-	errHandler := func(err error) {
-		panic(err)
+	return errs
+}
+
+// Convert the source specification into something that can generate loglines.
+func (conf *PipelineSourceConf) ToPipelineSourceGenerator() (PipelineSourceGenerator, error) {
+	return conf.ToPipelineSourceGeneratorEnv(builtinEnvironment())
+}
+
+// ToPipelineSourceGenerator, with the filesystems in env.
+func (conf *PipelineSourceConf) ToPipelineSourceGeneratorEnv(env *Environment) (PipelineSourceGenerator, error) {
+	if errs := conf.check(); len(errs) > 0 {
+		return nil, errs[0]
 	}
-	expanded, err := conf.Expand()
+
+	// Errors go to the Runner, which handles them according to the
+	// ErrorPolicy.
+	var errHandler ErrHandler
+
+	expanded, err := conf.ExpandEnv(env)
 	if err != nil {
 		return nil, err
 	}
 	if len(expanded) == 0 {
 		return nil, errors.New("No files resolved from sources")
 	}
+	resolve := env.fileSystemResolver(conf.hdfsAddr())
 
 	log.Debugf("conf.Args=%v", conf.Args)
 
 	switch conf.Type {
 	case PipelineSourceFile:
 		gen := NewTextFileSourceGenerator(expanded, errHandler)
+		gen.Resolve = resolve
 		if v, ok := conf.Args["max_concurrency"]; ok {
 			fmt.Println("Set max_concurrency")
 			gen.MaxConcurrency = v.(int)
@@ -269,18 +454,20 @@ func (conf *PipelineSourceConf) ToPipelineSourceGenerator() (PipelineSourceGener
 		// the parent directory to each info.json.
 		devicePaths := make(map[string][]string)
 		for _, file := range expanded {
-			parent, err := filepath.Abs(filepath.Dir(file))
+			parent, err := sourcePathParent(file)
 			if err != nil {
 				return nil, fmt.Errorf("Failed to find absolute path: %v", err)
 			}
 			device := filepath.Base(parent)
-			basePath := filepath.Dir(parent)
+			basePath := sourcePathDir(parent)
 			if _, ok := devicePaths[device]; !ok {
 				devicePaths[device] = make([]string, 0)
 			}
 			devicePaths[device] = append(devicePaths[device], basePath)
 		}
-		return NewPhonelabSourceGenerator(devicePaths, conf.Args, errHandler), nil
+		gen := NewPhonelabSourceGenerator(devicePaths, conf.Args, errHandler)
+		gen.Resolve = resolve
+		return gen, nil
 	case PipelineSourcePhonelabRaw:
 		// Each 'source' is finding a 'time' directory. Given this
 		// assumption, the deviec is the parent directory to each
@@ -298,10 +485,46 @@ func (conf *PipelineSourceConf) ToPipelineSourceGenerator() (PipelineSourceGener
 			if _, ok := devicePaths[device]; !ok {
 				devicePaths[device] = basePath
 			} else {
-				panic(fmt.Sprintf("Multiple paths for single device: %v \n\t%s\n\t%s\n", device, devicePaths[device], basePath))
+				return nil, fmt.Errorf("Multiple paths for single device: %v \n\t%s\n\t%s\n", device, devicePaths[device], basePath)
+			}
+		}
+		gen := NewPhonelabRawGenerator(devicePaths, conf.Args, errHandler)
+		gen.Resolve = resolve
+		return gen, nil
+	case PipelineSourceArchive:
+		members, err := conf.archiveMembers()
+		if err != nil {
+			return nil, err
+		}
+		gen := NewArchiveSourceGenerator(expanded, members, errHandler)
+		gen.Resolve = resolve
+		return gen, nil
+	case PipelineSourceStream:
+		gen := NewStreamSourceGenerator(expanded, errHandler)
+		if v, ok := conf.Args["max_connections"]; ok {
+			// Already checked
+			gen.MaxConnections = v.(int)
+		}
+		return gen, nil
+	case PipelineSourceBinary:
+		// Already checked
+		framing, buffer, eventTags, _ := conf.binaryLogArgs()
+		gen := NewBinaryLogSourceGenerator(expanded, errHandler)
+		gen.Framing = framing
+		gen.Buffer = buffer
+		gen.Resolve = resolve
+		if len(eventTags) > 0 {
+			if err := gen.LoadEventTags(eventTags); err != nil {
+				return nil, err
 			}
 		}
-		return NewPhonelabRawGenerator(devicePaths, conf.Args, errHandler), nil
+		return gen, nil
+	case PipelineSourceFtrace:
+		gen := NewFtraceSourceGenerator(expanded, errHandler)
+		// The same parser, and subparsers, as Kernel-Trace loglines get
+		gen.Parser = env.Parsers[TAG_TRACE]
+		gen.Resolve = resolve
+		return gen, nil
 	}
 	return nil, errors.New("Invalid type specification: " + string(conf.Type))
 }
@@ -314,65 +537,129 @@ func (conf *ProcessorConf) GeneratorName() string {
 	}
 }
 
-// Validate the ProcessorConf fields EXCEPT for the Inputs - those are validated
-// separately when the input processor conf is validated.
-func (conf *ProcessorConf) validate(env *Environment) error {
+// An error in one field of a conf, e.g. filters[0].type of a ProcessorConf.
+// Suggestion is the name the value is likely a typo of, if any.
+type confFieldError struct {
+	Field      string
+	Suggestion string
+	Err        error
+}
+
+func (e *confFieldError) Error() string {
+	return e.Err.Error()
+}
+
+func fieldErrorf(field, suggestion string, format string, args ...interface{}) *confFieldError {
+	return &confFieldError{
+		Field:      field,
+		Suggestion: suggestion,
+		Err:        fmt.Errorf(format, args...),
+	}
+}
+
+func joinConfPath(parent, key string) string {
+	if len(parent) == 0 {
+		return key
+	}
+	return parent + "." + key
+}
+
+func indexConfPath(parent string, i int) string {
+	return fmt.Sprintf("%v[%v]", parent, i)
+}
+
+// Check the ProcessorConf fields EXCEPT for the Inputs - those are checked
+// when the dependency graph is built. Every problem found is returned.
+func (conf *ProcessorConf) check(env *Environment) []*confFieldError {
+	errs := make([]*confFieldError, 0)
 
 	// Processor generator name
 	genName := conf.GeneratorName()
+	genField := "name"
+	if len(conf.Generator) > 0 {
+		genField = "generator"
+	}
 	if len(strings.TrimSpace(genName)) == 0 {
-		return errors.New("Invalid processor name: name cannot be empty")
+		errs = append(errs, fieldErrorf(genField, "", "Invalid processor name: name cannot be empty"))
 	} else if _, ok := env.Processors[genName]; !ok {
-		return errors.New("Unknown Processor: " + genName)
+		errs = append(errs, fieldErrorf(genField, suggestName(genName, envNames(env.Processors)),
+			"Unknown Processor '%v'", genName))
 	}
 
 	// Preprocessors are "dumb" and don't require a configuration. These are
 	// designed to be chained together linearly, rather than as a tree.
-	for _, dep := range conf.Preprocessors {
-		if len(dep.Name) == 0 {
-			return errors.New("Invalid preprocessor name: name cannot be empty.")
+	for i, dep := range conf.Preprocessors {
+		field := indexConfPath("preprocessors", i)
+		if dep == nil || len(dep.Name) == 0 {
+			errs = append(errs, fieldErrorf(field, "", "Invalid preprocessor name: name cannot be empty"))
 		} else if _, ok := env.Processors[dep.Name]; !ok {
-			return errors.New("Unknown Processor: " + dep.Name)
+			errs = append(errs, fieldErrorf(joinConfPath(field, "name"),
+				suggestName(dep.Name, envNames(env.Processors)), "Unknown Processor '%v'", dep.Name))
 		}
 	}
 
 	// Filters
-	if len(conf.Filters) > 0 {
-		for _, filterSpec := range conf.Filters {
-			if len(filterSpec.Filter) == 0 {
-				return errors.New("Filter must not be empty.")
-			} else {
-				switch filterSpec.Type {
-				default:
-					return errors.New("Invalid filter type: " + string(filterSpec.Type))
-				case FilterTypeSimple:
-					// OK
-					break
-				case FilterTypeRegex:
-					// Looking for side effects.
-					_ = makeRegexFilter(filterSpec.Filter)
-					break
-				case FilterTypeCustom:
-					// Check if we have a function already
-					if _, ok := env.Filters[filterSpec.Filter]; !ok {
-						return errors.New("Unknown custom filter: " + filterSpec.Filter)
-					}
-				}
+	for i, filterSpec := range conf.Filters {
+		field := indexConfPath("filters", i)
+		if filterSpec == nil || len(filterSpec.Filter) == 0 {
+			errs = append(errs, fieldErrorf(field, "", "Filter must not be empty"))
+			continue
+		}
+
+		specField := joinConfPath(field, "filter")
+		switch filterSpec.Type {
+		case FilterTypeSimple:
+			// OK
+		case FilterTypeRegex:
+			if _, err := regexp.Compile(filterSpec.Filter); err != nil {
+				errs = append(errs, fieldErrorf(specField, "", "Invalid regex filter: %v", err))
 			}
+		case FilterTypeCustom:
+			// Check if we have a function already
+			if _, ok := env.Filters[filterSpec.Filter]; !ok {
+				errs = append(errs, fieldErrorf(specField, suggestName(filterSpec.Filter, envNames(env.Filters)),
+					"Unknown custom filter '%v'", filterSpec.Filter))
+			}
+		case FilterTypeExpr:
+			if conf.RawStrings {
+				errs = append(errs, fieldErrorf(specField, "",
+					"expr filters need parsed loglines and cannot be used with raw_strings"))
+			} else if _, err := CompileLoglineExpr(filterSpec.Filter); err != nil {
+				errs = append(errs, fieldErrorf(specField, "", "Invalid expr filter '%v': %v", filterSpec.Filter, err))
+			}
+		default:
+			types := []string{string(FilterTypeSimple), FilterTypeRegex, FilterTypeCustom, FilterTypeExpr}
+			errs = append(errs, fieldErrorf(joinConfPath(field, "type"), suggestName(string(filterSpec.Type), types),
+				"Invalid filter type '%v'. Expected one of: %v", filterSpec.Type, strings.Join(types, ", ")))
 		}
 	}
 
+	if _, err := ParseLogcatFormat(conf.LogcatFormat); err != nil {
+		errs = append(errs, &confFieldError{"logcat_format", suggestName(conf.LogcatFormat, logcatFormats), err})
+	}
+	if conf.LogcatYear < 0 {
+		errs = append(errs, fieldErrorf("logcat_year", "", "Invalid logcat year: %v", conf.LogcatYear))
+	}
+
 	// Parsers
-	if len(conf.Parsers) > 0 {
-		for _, parser := range conf.Parsers {
-			if len(parser) == 0 {
-				return errors.New("Invalid tag: tag cannot be empty.")
-			} else if _, ok := env.Parsers[parser]; !ok {
-				return errors.New("Unknown parser: " + parser)
-			}
+	for i, parser := range conf.Parsers {
+		field := indexConfPath("parsers", i)
+		if len(parser) == 0 {
+			errs = append(errs, fieldErrorf(field, "", "Invalid tag: tag cannot be empty"))
+		} else if _, ok := env.Parsers[parser]; !ok {
+			errs = append(errs, fieldErrorf(field, suggestName(parser, envNames(env.Parsers)),
+				"Unknown parser '%v'", parser))
 		}
 	}
 
+	return errs
+}
+
+// check, stopping at the first problem
+func (conf *ProcessorConf) validate(env *Environment) error {
+	if errs := conf.check(env); len(errs) > 0 {
+		return errs[0]
+	}
 	return nil
 }
 
@@ -417,11 +704,17 @@ func (conf *ProcessorConf) buildFilterProc(env *Environment, source Processor) P
 	}
 }
 
-func (conf *ProcessorConf) buildParserProc(env *Environment, source Processor) Processor {
+func (conf *ProcessorConf) buildParserProc(env *Environment, source Processor) (Processor, error) {
 
 	// Parsers: Get these from the environment instead of the conf; we'll parse
 	// anything we know how to.
 	parser := NewLoglineParser()
+	format, err := ParseLogcatFormat(conf.LogcatFormat)
+	if err != nil {
+		return nil, err
+	}
+	parser.LogcatParser.Format = format
+	parser.LogcatParser.Year = conf.LogcatYear
 
 	for _, tag := range conf.Parsers {
 		if parserGen, ok := env.Parsers[tag]; ok {
@@ -429,38 +722,91 @@ func (conf *ProcessorConf) buildParserProc(env *Environment, source Processor) P
 		}
 	}
 
-	return NewLoglineProcessor(source, parser)
+	return NewLoglineProcessor(source, parser), nil
+}
+
+// Build the expr filters, if any. Unlike the string filters, these run on
+// parsed loglines.
+func (conf *ProcessorConf) buildExprFilterProc(source Processor) (Processor, error) {
+	filters := make([]LoglineFilter, 0)
+
+	for _, filterSpec := range conf.Filters {
+		if filterSpec.Type == FilterTypeExpr {
+			expr, err := CompileLoglineExpr(filterSpec.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid expr filter '%v': %v", filterSpec.Filter, err)
+			}
+			filters = append(filters, expr.Match)
+		}
+	}
+
+	if len(filters) > 0 {
+		return NewLoglineFilterProcessor(source, filters), nil
+	} else {
+		return nil, nil
+	}
 }
 
 // Build a logline input pipeline processor. This processor is a simple chain
 // consting of the followin:
-//		source (disk) -> string filters -> parser -> [preprocessor p1, p2, ..., pn]
+//		source (disk) -> string filters -> parser -> expr filters ->
+//			[preprocessor p1, p2, ..., pn]
+// Each step is drawn on g, if it isn't nil, and the id of the last one is
+// returned with the processor.
 func (conf *ProcessorConf) buildLoglineSource(env *Environment, source Processor,
-	info PipelineSourceInfo) (Processor, error) {
+	info PipelineSourceInfo, g *PipelineGraph) (Processor, string, error) {
+
+	// Ftrace sources send on traces rather than lines or loglines, so
+	// there's nothing for the filters to look at.
+	if _, ok := info.(*FtraceSourceInfo); ok && len(conf.Filters) > 0 {
+		return nil, "", fmt.Errorf("Processor '%v' has filters, which can't be used with ftrace sources", conf.Name)
+	}
+
+	last := g.sourceNode()
+	prefix := conf.Name + "/"
 
 	// Build the string filters, if any.
 	if filter := conf.buildFilterProc(env, source); filter != nil {
 		source = filter
+		last = g.addNode(prefix+"filter", GraphNodeFilter, []string{last}, conf.filterLabel(false)...)
 	}
 
 	// We'll have at least one parser for loglines
 	if !conf.RawStrings {
-		source = conf.buildParserProc(env, source)
+		if parserProc, err := conf.buildParserProc(env, source); err != nil {
+			return nil, "", err
+		} else {
+			source = parserProc
+		}
+		label := []string{"parser"}
+		if len(conf.Parsers) > 0 {
+			label = append(label, strings.Join(conf.Parsers, ", "))
+		}
+		last = g.addNode(prefix+"parser", GraphNodeParser, []string{last}, label...)
+
+		if filter, err := conf.buildExprFilterProc(source); err != nil {
+			return nil, "", err
+		} else if filter != nil {
+			source = filter
+			last = g.addNode(prefix+"expr_filter", GraphNodeExprFilter, []string{last}, conf.filterLabel(true)...)
+		}
 	}
 
 	// Add on any preprocessors
-	for _, proc := range conf.Preprocessors {
+	for i, proc := range conf.Preprocessors {
 		if procGen, ok := env.Processors[proc.Name]; !ok {
-			return nil, errors.New("Cannot find processor " + proc.Name)
+			return nil, "", errors.New("Cannot find processor " + proc.Name)
 		} else {
 			source = procGen.GenerateProcessor(&PipelineSourceInstance{
 				Info:      info,
 				Processor: source,
 			}, proc.Args)
+			last = g.addNode(fmt.Sprintf("%vpreprocessor/%v", prefix, i), GraphNodePreprocessor, []string{last},
+				"preprocessor: "+proc.Name)
 		}
 	}
 
-	return source, nil
+	return source, last, nil
 }
 
 func (conf *RunnerConf) findProcessor(name string) *ProcessorConf {
@@ -469,23 +815,60 @@ func (conf *RunnerConf) findProcessor(name string) *ProcessorConf {
 	// To bootstrap things, just look at what is embedded.
 
 	for _, proc := range conf.Processors {
-		if proc.Name == name {
+		if proc != nil && proc.Name == name {
 			return proc
 		}
 	}
 	return nil
 }
 
+// The names of the processors in the conf
+func (conf *RunnerConf) processorNames() []string {
+	names := make([]string, 0, len(conf.Processors))
+	for _, proc := range conf.Processors {
+		if proc != nil {
+			names = append(names, proc.Name)
+		}
+	}
+	return names
+}
+
 func (p *ProcessorConf) Key() string {
 	return p.Name
 }
 
+var errPipelineCycle = errors.New("Cycle detected in the pipeline dependency graph!")
+
 func (conf *RunnerConf) dependencyGraph(env *Environment) (*depgraph.DependencyGraph, error) {
+	var inputErr error
+	graph, err := conf.buildDependencyGraph(func(proc *ProcessorConf, err *confFieldError) {
+		if inputErr == nil {
+			inputErr = err
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if inputErr != nil {
+		return nil, inputErr
+	}
+	return graph, nil
+}
+
+// Build the graph of the sink and everything it depends on. Each input that
+// can't be found is passed to badInput, with the field of proc it's in, and
+// left out of the graph.
+func (conf *RunnerConf) buildDependencyGraph(
+	badInput func(proc *ProcessorConf, err *confFieldError)) (*depgraph.DependencyGraph, error) {
+
 	seen := make(map[string]bool)
 
+	if conf.Sink == nil {
+		return nil, fieldErrorf("", "", "Missing sink")
+	}
 	root := conf.findProcessor(conf.Sink.Name)
 	if root == nil {
-		return nil, errors.New("Cannot find sink processor '" + conf.Sink.Name + "'.")
+		return nil, fieldErrorf("name", suggestName(conf.Sink.Name, conf.processorNames()),
+			"Cannot find sink processor '%v'", conf.Sink.Name)
 	}
 
 	graph := depgraph.New(make([]depgraph.Keyer, 0))
@@ -507,11 +890,18 @@ func (conf *RunnerConf) dependencyGraph(env *Environment) (*depgraph.DependencyG
 		}
 
 		// Handle its sources
-		for _, dep := range n.Inputs {
+		for i, dep := range n.Inputs {
+			field := indexConfPath("inputs", i)
+			if dep == nil || len(dep.Name) == 0 {
+				badInput(n, fieldErrorf(field, "", "Invalid input name: name cannot be empty"))
+				continue
+			}
 			if !seen[dep.Name] {
 				proc := conf.findProcessor(dep.Name)
 				if proc == nil {
-					return nil, fmt.Errorf("Cannot find input processor '%v' for processor '%v'", dep, n.Key())
+					badInput(n, fieldErrorf(joinConfPath(field, "name"), suggestName(dep.Name, conf.processorNames()),
+						"Cannot find input processor '%v' for processor '%v'", dep.Name, n.Key()))
+					continue
 				}
 				seen[dep.Name] = true
 				toProcess = append(toProcess, proc)
@@ -558,9 +948,10 @@ func (conf *RunnerConf) ShallowSplit() ([]*RunnerConf, error) {
 
 	for _, src := range expanded {
 		newSource := &PipelineSourceConf{
-			Type:    origSource.Type,
-			Args:    origSource.Args,
-			Sources: []string{src},
+			Type:        origSource.Type,
+			Args:        origSource.Args,
+			Sources:     []string{src},
+			ErrorPolicy: origSource.ErrorPolicy,
 		}
 		// Can't do this in C!
 		newConf := *conf
@@ -582,7 +973,7 @@ func (conf *RunnerConf) ToRunner(env *Environment) (*Runner, error) {
 
 	// Check for cycles
 	if _, err = graph.TopSort(); err != nil {
-		return nil, errors.New("Cycle detected in the pipeline dependency graph!")
+		return nil, errPipelineCycle
 	}
 
 	// Now, validate each processor conf
@@ -592,11 +983,14 @@ func (conf *RunnerConf) ToRunner(env *Environment) (*Runner, error) {
 
 	// Sources
 	log.Debugf("SourceConf: %v", conf.SourceConf)
-	gen, err := conf.SourceConf.ToPipelineSourceGenerator()
+	gen, err := conf.SourceConf.ToPipelineSourceGeneratorEnv(env)
 	if err != nil {
 		return nil, err
 	}
 
+	// Already validated by ToPipelineSourceGenerator
+	policy, _ := ParseErrorPolicy(conf.SourceConf.ErrorPolicy)
+
 	proc := NewRunnerConfProcssor(conf, env, graph)
 
 	// If there was a custom data collector specified, use it. Otherwise,
@@ -604,24 +998,40 @@ func (conf *RunnerConf) ToRunner(env *Environment) (*Runner, error) {
 	var collector DataCollector = proc
 
 	if conf.DataCollector != nil && len(conf.DataCollector.Name) > 0 {
-		if conf.DataCollector.Name == DataCollectorDefaultName {
-			// We know how to build these
-			collector, err = NewDefaultCollector(conf.DataCollector.Args)
-			if err != nil {
-				return nil, err
-			}
-		} else if cgen, ok := env.DataCollectors[conf.DataCollector.Name]; ok {
-			collector = cgen(conf.DataCollector.Args)
-		} else {
-			return nil, errors.New("Unknown DataCollector: " + conf.DataCollector.Name)
+		if collector, err = conf.DataCollector.newDataCollector(env); err != nil {
+			return nil, err
 		}
 	}
 
+	if sn, ok := collector.(SinkNameCollector); ok && conf.Sink != nil {
+		sn.SetSinkName(conf.Sink.Name)
+	}
+
 	// At this point the runner *should* work, though we haven't built an
 	// actual pipeline. But, we've validated that we can find each processor and
 	// its configuration and that there are no cycles, so we're in OK
 	// shape.
-	return NewRunner(gen, collector, proc), nil
+	runner := NewRunner(gen, collector, proc)
+	runner.ErrorPolicy = policy
+	runner.Env = env
+	return runner, nil
+}
+
+// Make the DataCollector the conf names
+func (conf *DataCollectorConf) newDataCollector(env *Environment) (DataCollector, error) {
+	if newCollector, ok := builtinDataCollectors[conf.Name]; ok {
+		// We know how to build these
+		collector, err := newCollector(conf.Args)
+		if err != nil {
+			return nil, &confFieldError{Field: "args", Err: err}
+		}
+		return collector, nil
+	} else if cgen, ok := env.DataCollectors[conf.Name]; ok {
+		return cgen(conf.Args), nil
+	}
+
+	names := append(envNames(env.DataCollectors), envNames(builtinDataCollectors)...)
+	return nil, fieldErrorf("name", suggestName(conf.Name, names), "Unknown DataCollector '%v'", conf.Name)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -658,6 +1068,8 @@ type plBuilderState struct {
 	sourceInst *PipelineSourceInstance
 	env        *Environment
 	graph      *depgraph.DependencyGraph
+	// What has been built so far, when drawing the pipeline. nil otherwise.
+	drawing *PipelineGraph
 }
 
 // Stich multiple (input) processors into a single processor
@@ -667,13 +1079,9 @@ func stitchInputs(processors []Processor) Processor {
 	} else if len(processors) == 1 {
 		return processors[0]
 	} else {
-		// Combine the inputs using TimeWeaverProcessors. They get combined
-		// like this: (((0 1) 2) 3).
-		proc := processors[0]
-		for i := 1; i < len(processors); i++ {
-			proc = NewTimeweaverProcessor(proc, processors[i])
-		}
-		return proc
+		// Combine the inputs by timestamp. Ties go to the earlier input, the
+		// same as the TimeweaverProcessor.
+		return NewMergeProcessor(processors)
 	}
 }
 
@@ -709,15 +1117,17 @@ func (conf *ProcessorConf) buildProcessor(state *plBuilderState,
 	// until we can process it. TODO: Can we do better?
 
 	inputs := make([]Processor, 0)
+	inputIds := make([]string, 0)
 
 	// (1) Build the logline input processing chain for _this_ processor.
 	// This will get stitches with other input (if needed) later.
 	if conf.HasLogstream {
-		if logPipeline, err := conf.buildLoglineSource(state.env, state.sourceInst.Processor,
-			state.sourceInst.Info); err != nil {
+		if logPipeline, id, err := conf.buildLoglineSource(state.env, state.sourceInst.Processor,
+			state.sourceInst.Info, state.drawing); err != nil {
 			return nil, err
 		} else {
 			inputs = append(inputs, logPipeline)
+			inputIds = append(inputIds, id)
 		}
 	}
 
@@ -729,6 +1139,7 @@ func (conf *ProcessorConf) buildProcessor(state *plBuilderState,
 			return nil, err
 		} else {
 			inputs = append(inputs, otherProc)
+			inputIds = append(inputIds, state.drawing.builtNode(dep.Name))
 		}
 	}
 
@@ -737,6 +1148,11 @@ func (conf *ProcessorConf) buildProcessor(state *plBuilderState,
 	if input == nil {
 		return nil, fmt.Errorf("No inputs and no log processor for '%v'", conf.Name)
 	}
+	inputId := inputIds[0]
+	if len(inputIds) > 1 {
+		inputId = state.drawing.addNode(conf.Name+"/merge", GraphNodeMerge, inputIds,
+			"merge", fmt.Sprintf("%v inputs", len(inputIds)))
+	}
 
 	// (4) Finally, make an instance of our processor with the newly stitched inputs.
 	genName := conf.GeneratorName()
@@ -750,6 +1166,11 @@ func (conf *ProcessorConf) buildProcessor(state *plBuilderState,
 		Info:      state.sourceInst.Info,
 		Processor: input,
 	}, args)
+	label := []string{conf.Name}
+	if genName != conf.Name {
+		label = append(label, "generator: "+genName)
+	}
+	id := state.drawing.addNode(conf.Name, GraphNodeProcessor, []string{inputId}, label...)
 
 	// (5) One last thing: we might need to multiplex our output. If we have
 	// more than one in edge in the dependency graph, then our output goes to
@@ -759,15 +1180,40 @@ func (conf *ProcessorConf) buildProcessor(state *plBuilderState,
 	} else if len(node.EdgesIn) > 1 {
 		// yep, we need to put a multiplexer in front of the output
 		proc = NewMuxer(proc, len(node.EdgesIn))
+		id = state.drawing.addNode(conf.Name+"/muxer", GraphNodeMuxer, []string{id},
+			"muxer", fmt.Sprintf("%v outputs", len(node.EdgesIn)))
 	}
 
+	// Count the nodes we just built under our own name, so processors with
+	// the same generator don't share counters.
+	proc = &metricsScopeProcessor{Scope: conf.Name, Source: proc}
+
 	// Lastly, cache it
 	state.procMap[conf.Key()] = proc
+	state.drawing.setBuiltNode(conf.Key(), id)
 
 	return proc, nil
 }
 
+// The number of processors in the graph that read the source
+func countLogstreams(graph *depgraph.DependencyGraph) int {
+	count := 0
+	for _, node := range graph.NodeMap {
+		if node.Value.(*ProcessorConf).HasLogstream {
+			count += 1
+		}
+	}
+	return count
+}
+
 func (proc *RunnerConfProcessor) BuildPipeline(sourceInst *PipelineSourceInstance) (*Pipeline, error) {
+	return proc.buildPipeline(sourceInst, nil)
+}
+
+// BuildPipeline, drawing what is built on g if it isn't nil
+func (proc *RunnerConfProcessor) buildPipeline(sourceInst *PipelineSourceInstance,
+	g *PipelineGraph) (*Pipeline, error) {
+
 	// First, get the sink processor conf. We'll build the actual pipeline graph
 	// from there.
 	sinkProc := proc.Conf.findProcessor(proc.Conf.Sink.Name)
@@ -775,12 +1221,34 @@ func (proc *RunnerConfProcessor) BuildPipeline(sourceInst *PipelineSourceInstanc
 		return nil, fmt.Errorf("Cannot find sink processor '%v'", proc.Conf.Sink.Name)
 	}
 
+	// Every logstream reads the source. If it can only be read once, they
+	// share it through a Tee.
+	if isSinglePass(sourceInst.Processor) {
+		if n := countLogstreams(proc.DepGraph); n > 1 {
+			tee := NewTee(sourceInst.Processor, n)
+			if proc.Conf.SourceConf != nil {
+				// Already checked
+				tee.MaxQueue, _ = proc.Conf.SourceConf.teeMaxQueue()
+			}
+			label := []string{"tee", fmt.Sprintf("%v logstreams", n)}
+			if tee.MaxQueue > 0 {
+				label = append(label, fmt.Sprintf("max queue: %v", tee.MaxQueue))
+			}
+			g.setSourceNode(g.addNode("<tee>", GraphNodeTee, []string{g.sourceNode()}, label...))
+			sourceInst = &PipelineSourceInstance{
+				Info:      sourceInst.Info,
+				Processor: tee,
+			}
+		}
+	}
+
 	// Heavy lifting is done by buildProcessor; we just provide the context.
 	source, err := sinkProc.buildProcessor(&plBuilderState{
 		procMap:    make(map[string]Processor),
 		sourceInst: sourceInst,
 		env:        proc.Env,
 		graph:      proc.DepGraph,
+		drawing:    g,
 	}, proc.Conf.Sink.Args)
 
 	if err != nil {
@@ -0,0 +1,215 @@
+package phonelab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Checkpointing
+//
+// A Runner with a Journal records each source that finishes without errors,
+// along with where its output went. If the run dies partway through, it can be
+// started again with the same journal and the sources that already finished
+// are skipped.
+
+// JournalEntry records a source that finished.
+type JournalEntry struct {
+	Type    string `json:"type"`
+	Context string `json:"context"`
+	// Where the DataCollector put the output for the source, if it knows.
+	Outputs []string `json:"outputs,omitempty"`
+	// Anything else the DataCollector needs to pick up where it left off,
+	// e.g. the source's share of an aggregate.
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// DataCollectors that implement Checkpointer can take part in checkpointing.
+type Checkpointer interface {
+	// Called once the DataCollector has seen all of the data for a source.
+	// The outputs and state (which must marshal to JSON) are recorded in the
+	// journal.
+	Checkpoint(info PipelineSourceInfo) (outputs []string, state interface{}, err error)
+	// Called before the run starts with the entries for the sources that have
+	// already finished.
+	Restore(entries []*JournalEntry) error
+}
+
+// Journal is an append-only file of JournalEntries, one JSON object per line.
+type Journal struct {
+	Path    string
+	file    *os.File
+	entries []*JournalEntry
+	done    map[string]bool
+	sync.Mutex
+}
+
+func journalKey(sourceType, context string) string {
+	return sourceType + "/" + context
+}
+
+// Open the journal at path. If resume is set, the sources in the journal are
+// treated as done and new entries are appended. Otherwise, the journal starts
+// out empty.
+func OpenJournal(path string, resume bool) (*Journal, error) {
+	j := &Journal{
+		Path:    path,
+		entries: make([]*JournalEntry, 0),
+		done:    make(map[string]bool),
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open journal '%v': %v", path, err)
+	}
+
+	if resume {
+		if err := j.load(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	j.file = f
+	return j, nil
+}
+
+// Read the entries in f and leave it ready to be appended to.
+func (j *Journal) load(f *os.File) error {
+	reader := bufio.NewReader(f)
+	var offset int64 = 0
+
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left over is a write that didn't finish. Drop it.
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading journal '%v': %v", j.Path, err)
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			entry := &JournalEntry{}
+			if err := json.Unmarshal(line, entry); err != nil {
+				return fmt.Errorf("Bad journal entry at %v:%v: %v", j.Path, lineNum, err)
+			}
+			j.entries = append(j.entries, entry)
+			j.done[journalKey(entry.Type, entry.Context)] = true
+		}
+		offset += int64(len(line))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("Failed to truncate journal '%v': %v", j.Path, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("Failed to seek in journal '%v': %v", j.Path, err)
+	}
+	return nil
+}
+
+// The entries read when the journal was opened
+func (j *Journal) Entries() []*JournalEntry {
+	j.Lock()
+	defer j.Unlock()
+	return append([]*JournalEntry{}, j.entries...)
+}
+
+// Whether the source has already finished
+func (j *Journal) Done(info PipelineSourceInfo) bool {
+	j.Lock()
+	defer j.Unlock()
+	return j.done[journalKey(info.Type(), info.Context())]
+}
+
+// Append an entry and sync it to disk.
+func (j *Journal) Record(entry *JournalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal journal entry: %v", err)
+	}
+	b = append(b, '\n')
+
+	j.Lock()
+	defer j.Unlock()
+
+	if _, err := j.file.Write(b); err != nil {
+		return fmt.Errorf("Failed to write journal '%v': %v", j.Path, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync journal '%v': %v", j.Path, err)
+	}
+	j.done[journalKey(entry.Type, entry.Context)] = true
+	return nil
+}
+
+// Whether any source of sourceType whose context starts with prefix has
+// finished
+func (j *Journal) anyDone(sourceType, prefix string) bool {
+	j.Lock()
+	defer j.Unlock()
+	for key := range j.done {
+		if strings.HasPrefix(key, journalKey(sourceType, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+type journalContextKey struct{}
+
+// The Runner passes its Journal on to the sources through the context, so
+// that they can leave out what it will skip.
+func withJournal(ctx context.Context, j *Journal) context.Context {
+	return context.WithValue(ctx, journalContextKey{}, j)
+}
+
+func journalFromContext(ctx context.Context) *Journal {
+	j, _ := ctx.Value(journalContextKey{}).(*Journal)
+	return j
+}
+
+// Whether the Runner under ctx skips the source, as it's already done
+func sourceSkipped(ctx context.Context, info PipelineSourceInfo) bool {
+	j := journalFromContext(ctx)
+	return j != nil && info != nil && journaled(info) && j.Done(info)
+}
+
+// Record that the source finished in the runner's journal.
+func (runner *Runner) checkpoint(info PipelineSourceInfo) error {
+	entry := &JournalEntry{
+		Type:    info.Type(),
+		Context: info.Context(),
+	}
+
+	if cp, ok := runner.Collector.(Checkpointer); ok {
+		outputs, state, err := cp.Checkpoint(info)
+		if err != nil {
+			return fmt.Errorf("Failed to checkpoint: %v", err)
+		}
+		entry.Outputs = outputs
+
+		if state != nil {
+			if entry.State, err = json.Marshal(state); err != nil {
+				return fmt.Errorf("Failed to marshal checkpoint state: %v", err)
+			}
+		}
+	}
+
+	return runner.Journal.Record(entry)
+}
@@ -0,0 +1,227 @@
+package phonelab
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-journal")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	journalPath := filepath.Join(tmpDir, "run.journal")
+
+	j, err := OpenJournal(journalPath, false)
+	require.Nil(err)
+	assert.Equal(0, len(j.Entries()))
+
+	require.Nil(j.Record(&JournalEntry{Type: "file", Context: "a", Outputs: []string{"file:///out/a.json"}}))
+	require.Nil(j.Record(&JournalEntry{Type: "file", Context: "b", State: json.RawMessage(`[1,2,3]`)}))
+	assert.True(j.Done(&TextFileSourceInfo{"a"}))
+	require.Nil(j.Close())
+
+	// Simulate dying partway through a write
+	f, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(err)
+	_, err = f.Write([]byte(`{"type":"file","cont`))
+	require.Nil(err)
+	f.Close()
+
+	j, err = OpenJournal(journalPath, true)
+	require.Nil(err)
+	entries := j.Entries()
+	require.Equal(2, len(entries))
+	assert.Equal("a", entries[0].Context)
+	assert.Equal([]string{"file:///out/a.json"}, entries[0].Outputs)
+	assert.Equal(`[1,2,3]`, string(entries[1].State))
+	assert.True(j.Done(&TextFileSourceInfo{"a"}))
+	assert.True(j.Done(&TextFileSourceInfo{"b"}))
+	assert.False(j.Done(&TextFileSourceInfo{"c"}))
+	assert.False(j.Done(&PhonelabSourceInfo{DeviceId: "a"}))
+
+	require.Nil(j.Record(&JournalEntry{Type: "file", Context: "c"}))
+	require.Nil(j.Close())
+
+	// The partial entry is gone
+	j, err = OpenJournal(journalPath, true)
+	require.Nil(err)
+	assert.Equal(3, len(j.Entries()))
+	require.Nil(j.Close())
+
+	// Starting over
+	j, err = OpenJournal(journalPath, false)
+	require.Nil(err)
+	assert.Equal(0, len(j.Entries()))
+	require.Nil(j.Close())
+}
+
+// Counts the lines in each source and remembers which sources it built.
+type countingBuilder struct {
+	built []string
+	sync.Mutex
+}
+
+func (b *countingBuilder) BuildPipeline(source *PipelineSourceInstance) (*Pipeline, error) {
+	b.Lock()
+	b.built = append(b.built, source.Info.Context())
+	b.Unlock()
+
+	return &Pipeline{
+		LastHop: &totalProcessor{source.Processor},
+	}, nil
+}
+
+type checkpointTest struct {
+	files       []string
+	outPath     string
+	journalPath string
+}
+
+func newCheckpointTest(t *testing.T, tmpDir string) *checkpointTest {
+	ct := &checkpointTest{
+		outPath:     "file://" + filepath.Join(tmpDir, "out"),
+		journalPath: filepath.Join(tmpDir, "run.journal"),
+	}
+
+	for i, name := range []string{"a.gz", "b.gz", "c.gz"} {
+		file := filepath.Join(tmpDir, name)
+		ct.files = append(ct.files, file)
+		// Leave the last one out so the first run fails
+		if i < 2 {
+			require.Nil(t, writeErrorTestFile(file, (i+1)*10, false))
+		}
+	}
+	return ct
+}
+
+func (ct *checkpointTest) run(t *testing.T, aggregate, resume bool) (*DefaultCollector, *countingBuilder, []error) {
+	collector, err := NewDefaultCollector(map[string]interface{}{
+		"path":      ct.outPath,
+		"aggregate": aggregate,
+	})
+	require.Nil(t, err)
+
+	journal, err := OpenJournal(ct.journalPath, resume)
+	require.Nil(t, err)
+	defer journal.Close()
+
+	builder := &countingBuilder{}
+	runner := NewRunner(NewTextFileSourceGenerator(ct.files, nil), collector, builder)
+	runner.ErrorPolicy = ErrorPolicySkipSource
+	runner.Journal = journal
+
+	errs := runner.Run()
+	sort.Strings(builder.built)
+	return collector.(*DefaultCollector), builder, errs
+}
+
+func TestRunnerResume(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-resume")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	ct := newCheckpointTest(t, tmpDir)
+
+	collector, builder, errs := ct.run(t, false, false)
+	assert.Equal(1, len(errs))
+	assert.Equal(ct.files, builder.built)
+
+	// The two good files are in the journal along with their outputs
+	journal, err := OpenJournal(ct.journalPath, true)
+	require.Nil(err)
+	entries := journal.Entries()
+	journal.Close()
+	require.Equal(2, len(entries))
+
+	for _, entry := range entries {
+		require.Equal(1, len(entry.Outputs))
+		assert.Equal(collector.makeOutPath(entry.Context), entry.Outputs[0])
+	}
+
+	// Fix the bad source and pick up where we left off
+	require.Nil(writeErrorTestFile(ct.files[2], 30, false))
+
+	collector, builder, errs = ct.run(t, false, true)
+	assert.Equal(0, len(errs))
+	assert.Equal([]string{ct.files[2]}, builder.built)
+
+	journal, err = OpenJournal(ct.journalPath, true)
+	require.Nil(err)
+	assert.Equal(3, len(journal.Entries()))
+	journal.Close()
+
+	b, err := ioutil.ReadFile(collector.makeOutPath(ct.files[2])[len("file://"):])
+	require.Nil(err)
+	assert.Equal("30", string(b))
+
+	// Nothing left to do
+	_, builder, errs = ct.run(t, false, true)
+	assert.Equal(0, len(errs))
+	assert.Equal(0, len(builder.built))
+}
+
+func TestRunnerResumeAggregate(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-resume")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	ct := newCheckpointTest(t, tmpDir)
+
+	_, _, errs := ct.run(t, true, false)
+	assert.Equal(1, len(errs))
+
+	// The partial aggregates are in the journal
+	journal, err := OpenJournal(ct.journalPath, true)
+	require.Nil(err)
+	entries := journal.Entries()
+	journal.Close()
+	require.Equal(2, len(entries))
+
+	states := make(map[string]string)
+	for _, entry := range entries {
+		states[entry.Context] = string(entry.State)
+	}
+	assert.Equal("[10]", states[ct.files[0]])
+	assert.Equal("[20]", states[ct.files[1]])
+
+	// A new process would start with an empty collector. The aggregate
+	// should still have all three totals.
+	require.Nil(writeErrorTestFile(ct.files[2], 30, false))
+
+	collector, builder, errs := ct.run(t, true, true)
+	assert.Equal(0, len(errs))
+	assert.Equal([]string{ct.files[2]}, builder.built)
+
+	// Named after the smallest context, whichever source got there first
+	b, err := ioutil.ReadFile(collector.makeOutPath(ct.files[0])[len("file://"):])
+	require.Nil(err)
+
+	var totals []int
+	require.Nil(json.Unmarshal(b, &totals))
+	sort.Ints(totals)
+	assert.Equal([]int{10, 20, 30}, totals)
+}
@@ -0,0 +1,142 @@
+// Package cli is the phonelab-go command line tool.
+//
+// The stock phonelab-go binary gets custom processors, parsers and collectors
+// from a plugin (built with -buildmode=plugin) that exports InitEnv. Plugins
+// only load into a binary built with exactly the same toolchain and
+// dependencies, so the alternative is to build your own binary with them
+// compiled in:
+//
+//	package main
+//
+//	import (
+//		phonelab "github.com/shaseley/phonelab-go"
+//		"github.com/shaseley/phonelab-go/cli"
+//	)
+//
+//	func main() {
+//		cli.Main(func(env *phonelab.Environment) {
+//			env.Processors["my_processor"] = &myProcessorGen{}
+//		})
+//	}
+//
+// The plugin argument is then optional. If one is given as well, its InitEnv
+// runs after the built-in one.
+package cli
+
+import (
+	"fmt"
+	phonelab "github.com/shaseley/phonelab-go"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// EnvInit registers processors, parsers, filters and collectors on an
+// Environment. It has the same signature as a plugin's InitEnv.
+type EnvInit func(env *phonelab.Environment)
+
+// Create the command tree. initEnv (which may be nil) is run on every
+// Environment the commands create.
+func NewRootCommand(initEnv EnvInit) *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:   "phoneLab-go",
+		Short: "PhoneLab-Go! CLI",
+	}
+
+	splitCmd := &cobra.Command{
+		Use:     "split <conf_file> <output_dir>",
+		Short:   "Split a yaml runner conf into individual source confs",
+		Run:     splitCmdRun,
+		PreRunE: splitCmdPreRunE,
+	}
+
+	runCmd := &cobra.Command{
+		Use:     "run <conf_file> [plugin]",
+		Short:   "Run a phonelab-go experiment.",
+		Long:    "Run a phonelab-go experiment using a yaml conf file and, optionally, a go plugin implementing InitEnv()",
+		PreRunE: runCmdPreRunE,
+		Run:     runCmdRun(initEnv),
+	}
+
+	submitCmd := &cobra.Command{
+		Use:   "submit <conf_file> <plugin>",
+		Short: "Submit a phonelab-go experiment.",
+		Long: `Submit a phonelab-go experiment using a yaml conf file and go plugin implementing InitEnv().
+The plugin is required, since the workers run the stock phonelab-go binary.`,
+		PreRunE: submitCmdPreRunE,
+		Run:     submitCmdRun,
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate <conf_file> [plugin]",
+		Short: "Check a yaml runner conf without running it.",
+		Long: `Check a yaml runner conf against the environment, including anything set up by a go plugin
+implementing InitEnv(). All problems are reported, with line numbers. Exits with 0 if the conf is
+valid, 1 if it isn't, and 2 if it couldn't be checked.`,
+		PreRunE: validateCmdPreRunE,
+		Run:     validateCmdRun(initEnv),
+	}
+
+	graphCmd := &cobra.Command{
+		Use:   "graph <conf_file> [plugin]",
+		Short: "Draw the pipeline a yaml runner conf builds.",
+		Long: `Draw the pipeline a yaml runner conf builds for each source, as Graphviz DOT or a Mermaid flowchart.
+The processors come from the environment, including anything set up by a go plugin implementing InitEnv().`,
+		PreRunE: graphCmdPreRunE,
+		Run:     graphCmdRun(initEnv),
+	}
+
+	splitCmdInitFlags(splitCmd)
+	runCmdInitFlags(runCmd)
+	submitCmdInitFlags(submitCmd)
+	validateCmdInitFlags(validateCmd)
+	graphCmdInitFlags(graphCmd)
+
+	rootCmd.AddCommand(runCmd, splitCmd, submitCmd, validateCmd, graphCmd)
+
+	return rootCmd
+}
+
+// Run the command line tool and exit.
+func Main(initEnv EnvInit) {
+	if err := NewRootCommand(initEnv).Execute(); err != nil {
+		os.Exit(-1)
+	}
+	os.Exit(0)
+}
+
+// Create an Environment with everything from initEnv (the built-in EnvInit,
+// which may be nil) and, if pluginFile isn't empty, the plugin's InitEnv.
+func newEnvironment(initEnv EnvInit, pluginFile string) (*phonelab.Environment, error) {
+	env := phonelab.NewEnvironment()
+
+	if initEnv != nil {
+		initEnv(env)
+	}
+
+	if len(pluginFile) > 0 {
+		initFunc, err := getPluginInitFunc(pluginFile)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := initFunc.(func(*phonelab.Environment)); !ok {
+			return nil, fmt.Errorf("%v in plugin has the wrong type: %T", PluginInitFuncName, initFunc)
+		} else {
+			f(env)
+		}
+	}
+
+	return env, nil
+}
+
+// The optional plugin argument after the conf file
+func pluginArg(args []string) string {
+	if len(args) > 1 {
+		return args[1]
+	}
+	return ""
+}
+
+func fatalError(err error) {
+	fmt.Fprintf(os.Stderr, "Error processing command: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	phonelab "github.com/shaseley/phonelab-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopProcessorGen struct{}
+
+func (g *nopProcessorGen) GenerateProcessor(source *phonelab.PipelineSourceInstance,
+	kwargs map[string]interface{}) phonelab.Processor {
+	return source.Processor
+}
+
+// Processors registered with NewRootCommand are available without a plugin.
+func TestBuiltinEnvInit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-cli")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	confFile := filepath.Join(tmpDir, "conf.yaml")
+	require.Nil(ioutil.WriteFile(confFile, []byte(`
+source:
+  type: files
+  sources: ["`+confFile+`"]
+processors:
+  - name: builtin
+    has_logstream: true
+sink:
+  name: builtin
+`), 0644))
+
+	cmd := NewRootCommand(nil)
+	require.NotNil(cmd)
+
+	var out bytes.Buffer
+	assert.Equal(validateExitInvalid, doValidate(nil, confFile, "", &out))
+	assert.Contains(out.String(), "Unknown Processor 'builtin'")
+
+	initEnv := func(env *phonelab.Environment) {
+		env.Processors["builtin"] = &nopProcessorGen{}
+	}
+	require.NotNil(NewRootCommand(initEnv))
+
+	out.Reset()
+	assert.Equal(validateExitOK, doValidate(initEnv, confFile, "", &out))
+	assert.Contains(out.String(), "OK")
+
+	env, err := newEnvironment(initEnv, "")
+	require.Nil(err)
+	assert.Contains(env.Processors, "builtin")
+
+	// Each command tree has its own
+	env, err = newEnvironment(nil, "")
+	require.Nil(err)
+	assert.NotContains(env.Processors, "builtin")
+
+	_, err = newEnvironment(initEnv, filepath.Join(tmpDir, "missing.so"))
+	assert.NotNil(err)
+
+	assert.Nil(validateConfAndPluginArgs([]string{confFile}))
+	assert.NotNil(validateConfAndPluginArgs([]string{}))
+	assert.NotNil(submitCmdPreRunE(nil, []string{confFile}))
+}
@@ -1,4 +1,4 @@
-package main
+package cli
 
 import (
 	"errors"
@@ -59,16 +59,18 @@ func getPluginInitFunc(file string) (plugin.Symbol, error) {
 	}
 }
 
-// Validate args of the form <conf_file> <plugin>
+// Validate args of the form <conf_file> [plugin]
 func validateConfAndPluginArgs(args []string) error {
-	if len(args) != 2 {
+	if len(args) < 1 || len(args) > 2 {
 		return errors.New("Invalid command syntax")
 	}
 
 	if err := validateFile(args[0], "conf file"); err != nil {
 		return err
-	} else if _, err := getPluginInitFunc(args[1]); err != nil {
-		return err
+	} else if len(args) == 2 {
+		if _, err := getPluginInitFunc(args[1]); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	phonelab "github.com/shaseley/phonelab-go"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+)
+
+var (
+	graphFormat string
+	graphOutput string
+)
+
+func graphCmdInitFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&graphFormat, "format", "f", "dot", "Output format: dot or mermaid")
+	cmd.Flags().StringVarP(&graphOutput, "output", "o", "", "File to write the graph to. Defaults to stdout")
+}
+
+func doGraph(initEnv EnvInit, confFile, pluginFile string) error {
+	conf, err := phonelab.RunnerConfFromFile(confFile)
+	if err != nil {
+		return err
+	}
+
+	env, err := newEnvironment(initEnv, pluginFile)
+	if err != nil {
+		return err
+	}
+
+	graph, err := conf.PipelineGraph(env)
+	if err != nil {
+		return fmt.Errorf("Error building graph: %v", err)
+	}
+
+	var out string
+	switch graphFormat {
+	case "dot":
+		out = graph.DOT()
+	case "mermaid":
+		out = graph.Mermaid()
+	}
+
+	if len(graphOutput) == 0 {
+		fmt.Print(out)
+		return nil
+	}
+	if err := ioutil.WriteFile(graphOutput, []byte(out), 0644); err != nil {
+		return fmt.Errorf("Error writing file: %v", err)
+	}
+	return nil
+}
+
+func graphCmdRun(initEnv EnvInit) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if err := doGraph(initEnv, args[0], pluginArg(args)); err != nil {
+			fatalError(err)
+		}
+	}
+}
+
+func graphCmdPreRunE(cmd *cobra.Command, args []string) error {
+	if graphFormat != "dot" && graphFormat != "mermaid" {
+		return fmt.Errorf("Invalid format '%v'. Expected dot or mermaid", graphFormat)
+	}
+	return validateConfAndPluginArgs(args)
+}
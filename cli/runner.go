@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	phonelab "github.com/shaseley/phonelab-go"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	runTimeout time.Duration
+	runJournal string
+	runResume  bool
+	// "-" means stderr. Empty means no summary.
+	runMetricsFile      string
+	runMetricsAddr      string
+	runMetricsPerSource bool
+)
+
+func runCmdInitFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVarP(&runTimeout, "timeout", "t", 0, "Stop the run after this long (e.g. 90m). 0 means no limit")
+	cmd.Flags().StringVarP(&runJournal, "journal", "j", "", "Checkpoint journal recording finished sources, so that the run can be resumed. With --resume, defaults to <conf_file>.journal")
+	cmd.Flags().BoolVarP(&runResume, "resume", "r", false, "Skip the sources that the journal says are finished, and keep journaling")
+	cmd.Flags().StringVarP(&runMetricsFile, "metrics", "m", "", "Write the JSON metrics summary here at the end of the run, or to stderr for -")
+	cmd.Flags().StringVar(&runMetricsAddr, "metrics-addr", "", "Serve Prometheus metrics on http://<addr>/metrics while running (e.g. :9090)")
+	cmd.Flags().BoolVar(&runMetricsPerSource, "metrics-per-source", false, "Include the metrics for each source in the JSON summary, not just the totals")
+}
+
+// Cancel the run on SIGINT/SIGTERM or when the timeout (if any) is up.
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigChan:
+			fmt.Fprintf(os.Stderr, "Got %v, stopping...\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigChan)
+	}()
+
+	return ctx, cancel
+}
+
+// Serve metrics on addr/metrics until the run is over.
+func serveMetrics(addr string, metrics *phonelab.RunMetrics) (io.Closer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening for metrics requests: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go http.Serve(listener, mux)
+
+	return listener, nil
+}
+
+// Write the metrics summary to file, or stderr if file is "-". Without
+// perSource, only the totals are written.
+func writeMetricsSummary(file string, metrics *phonelab.RunMetrics, perSource bool) error {
+	out := io.Writer(os.Stderr)
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("Error writing metrics: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	summary := metrics.Summary()
+	if !perSource {
+		summary.Sources = nil
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
+
+func doRun(initEnv EnvInit, confFile, pluginFile string, timeout time.Duration, journalFile string, resume bool,
+	metricsFile, metricsAddr string, metricsPerSource bool) error {
+
+	// Load conf
+	conf, err := phonelab.RunnerConfFromFile(confFile)
+	if err != nil {
+		return err
+	}
+
+	// Create and initialize runner environment
+	env, err := newEnvironment(initEnv, pluginFile)
+	if err != nil {
+		return err
+	}
+
+	// Create runner
+	runner, err := conf.ToRunner(env)
+	if err != nil {
+		return fmt.Errorf("Error creating runner: %v\n", err)
+	}
+
+	// Keep track of where we are in case we need to resume. Only when
+	// asked, as the journal has all of an aggregate's data in it.
+	if len(journalFile) > 0 || resume {
+		if len(journalFile) == 0 {
+			journalFile = confFile + ".journal"
+		}
+		journal, err := phonelab.OpenJournal(journalFile, resume)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		runner.Journal = journal
+	}
+
+	// Only count when someone is going to look at the numbers
+	if len(metricsFile) > 0 || len(metricsAddr) > 0 {
+		runner.Metrics = phonelab.NewRunMetrics()
+	}
+	if len(metricsAddr) > 0 {
+		listener, err := serveMetrics(metricsAddr, runner.Metrics)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+	}
+
+	// Run experiment
+	ctx, cancel := runContext(timeout)
+	defer cancel()
+
+	errs := runner.RunContext(ctx)
+
+	// Partial runs are the ones we most want the numbers for.
+	if len(metricsFile) > 0 {
+		if err := writeMetricsSummary(metricsFile, runner.Metrics, metricsPerSource); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	return nil
+}
+
+func runCmdRun(initEnv EnvInit) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if err := doRun(initEnv, args[0], pluginArg(args), runTimeout, runJournal, runResume,
+			runMetricsFile, runMetricsAddr, runMetricsPerSource); err != nil {
+			fatalError(err)
+		}
+	}
+}
+
+func runCmdPreRunE(cmd *cobra.Command, args []string) error {
+	return validateConfAndPluginArgs(args)
+}
@@ -1,4 +1,4 @@
-package main
+package cli
 
 import (
 	"errors"
@@ -32,8 +32,9 @@ func doSplitSingleFile(conf *phonelab.RunnerConf, outDir string) error {
 	}
 
 	conf.SourceConf = &phonelab.PipelineSourceConf{
-		Type:    origSource.Type,
-		Sources: []string{sources[0]},
+		Type:        origSource.Type,
+		Sources:     []string{sources[0]},
+		ErrorPolicy: origSource.ErrorPolicy,
 	}
 
 	confs := []*phonelab.RunnerConf{conf}
@@ -50,6 +51,9 @@ func doSplitSingleFile(conf *phonelab.RunnerConf, outDir string) error {
     type: files
     sources: [%v]
 `, sources[i])
+			if len(origSource.ErrorPolicy) > 0 {
+				outStr += fmt.Sprintf("    error_policy: %v\n", origSource.ErrorPolicy)
+			}
 		}
 
 		outFile := path.Join(outDir, fmt.Sprintf("conf_%v.yaml", splitConfPrefix))
@@ -1,6 +1,7 @@
-package main
+package cli
 
 import (
+	"errors"
 	"fmt"
 	phonelab "github.com/shaseley/phonelab-go"
 	"github.com/spf13/cobra"
@@ -68,5 +69,9 @@ func submitCmdRun(cmd *cobra.Command, args []string) {
 }
 
 func submitCmdPreRunE(cmd *cobra.Command, args []string) error {
+	// The workers need the plugin
+	if len(args) != 2 {
+		return errors.New("Invalid command syntax: submit needs a plugin")
+	}
 	return validateConfAndPluginArgs(args)
 }
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	phonelab "github.com/shaseley/phonelab-go"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Exit codes for validate, so it can be used in CI.
+const (
+	validateExitOK = 0
+	// The conf has errors (or warnings, with --strict)
+	validateExitInvalid = 1
+	// We couldn't check the conf, e.g. the plugin failed to load.
+	validateExitFailed = 2
+)
+
+var (
+	validateNoResolve bool
+	validateStrict    bool
+	validateFormat    string
+)
+
+func validateCmdInitFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&validateNoResolve, "no-resolve", "n", false, "Don't resolve the source globs (nothing is read from disk or HDFS)")
+	cmd.Flags().BoolVarP(&validateStrict, "strict", "s", false, "Treat warnings as errors")
+	cmd.Flags().StringVarP(&validateFormat, "format", "f", "text", "Output format: text or json")
+}
+
+type validateResult struct {
+	File        string                     `json:"file"`
+	Valid       bool                       `json:"valid"`
+	Errors      int                        `json:"errors"`
+	Warnings    int                        `json:"warnings"`
+	Diagnostics []*phonelab.ConfDiagnostic `json:"diagnostics"`
+}
+
+func doValidate(initEnv EnvInit, confFile, pluginFile string, out io.Writer) int {
+	data, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading conf file: %v\n", err)
+		return validateExitFailed
+	}
+
+	env, err := newEnvironment(initEnv, pluginFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return validateExitFailed
+	}
+
+	diags := phonelab.ValidateRunnerConf(string(data), env, &phonelab.ValidateOptions{
+		SkipSources: validateNoResolve,
+	})
+
+	res := &validateResult{
+		File:        confFile,
+		Diagnostics: diags,
+	}
+	for _, d := range diags {
+		if d.Severity == phonelab.SeverityError {
+			res.Errors += 1
+		} else {
+			res.Warnings += 1
+		}
+	}
+	res.Valid = res.Errors == 0 && (!validateStrict || res.Warnings == 0)
+
+	switch validateFormat {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding results: %v\n", err)
+			return validateExitFailed
+		}
+	default:
+		for _, d := range diags {
+			if d.Line > 0 {
+				fmt.Fprintf(out, "%v:%v\n", confFile, d)
+			} else {
+				fmt.Fprintf(out, "%v: %v\n", confFile, d)
+			}
+		}
+		if len(diags) == 0 {
+			fmt.Fprintf(out, "%v: OK\n", confFile)
+		} else {
+			fmt.Fprintf(out, "%v error(s), %v warning(s)\n", res.Errors, res.Warnings)
+		}
+	}
+
+	if !res.Valid {
+		return validateExitInvalid
+	}
+	return validateExitOK
+}
+
+func validateCmdRun(initEnv EnvInit) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		os.Exit(doValidate(initEnv, args[0], pluginArg(args), os.Stdout))
+	}
+}
+
+func validateCmdPreRunE(cmd *cobra.Command, args []string) error {
+	if validateFormat != "text" && validateFormat != "json" {
+		return fmt.Errorf("Invalid format '%v'. Expected text or json", validateFormat)
+	}
+	return cobra.RangeArgs(1, 2)(cmd, args)
+}
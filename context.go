@@ -0,0 +1,105 @@
+package phonelab
+
+import "context"
+
+// Cancellation
+//
+// Processors are connected by unbuffered channels, so a goroutine that sends
+// to a consumer that has gone away blocks forever. To be able to stop a run
+// partway through, the processor primitives and sources can be started with a
+// context.Context. When the context is canceled, a processor stops sending,
+// drains and discards whatever is still coming down its input channels so that
+// nothing upstream is left blocked, and then closes its output channel.
+//
+// Sources stop reading when the context is canceled, so the inputs dry up
+// quickly and every goroutine in the pipeline exits, even ones that don't know
+// about contexts.
+
+// ContextProcessor is a Processor that can be stopped early. Process() is
+// equivalent to ProcessContext(context.Background()).
+type ContextProcessor interface {
+	Processor
+	ProcessContext(ctx context.Context) <-chan interface{}
+}
+
+// Start proc, handing it ctx if it knows what to do with it.
+func ProcessContext(ctx context.Context, proc Processor) <-chan interface{} {
+	if cp, ok := proc.(ContextProcessor); ok {
+		return cp.ProcessContext(ctx)
+	}
+	return proc.Process()
+}
+
+// ContextSourceGenerator is a PipelineSourceGenerator that stops generating
+// sources when ctx is canceled.
+type ContextSourceGenerator interface {
+	PipelineSourceGenerator
+	ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance
+}
+
+// Start gen, handing it ctx if it knows what to do with it.
+func processSourcesContext(ctx context.Context, gen PipelineSourceGenerator) <-chan *PipelineSourceInstance {
+	if cg, ok := gen.(ContextSourceGenerator); ok {
+		return cg.ProcessContext(ctx)
+	}
+	return gen.Process()
+}
+
+// DataCollectors that want to know whether the run finished can implement
+// PartialDataCollector. If the run is canceled or times out, the Runner calls
+// FinishPartial with the reason instead of Finish. The collector will not get
+// any more data from the run.
+type PartialDataCollector interface {
+	DataCollector
+	FinishPartial(err error)
+}
+
+// Send obj on outChan unless ctx is done first. Returns false if obj wasn't
+// sent.
+func sendContext(ctx context.Context, outChan chan<- interface{}, obj interface{}) bool {
+	// Don't leave it up to select if both are ready.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case outChan <- obj:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Same as sendContext, for source generators.
+func sendSourceContext(ctx context.Context, sourceChan chan<- *PipelineSourceInstance,
+	source *PipelineSourceInstance) bool {
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case sourceChan <- source:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Read and throw away everything left on inChan.
+func drain(inChan <-chan interface{}) {
+	for _ = range inChan {
+	}
+}
+
+// contextSource ties a context to the source processor of a pipeline. The
+// source is started with the context even if the processors between it and
+// the Runner only call Process().
+type contextSource struct {
+	ctx context.Context
+	Processor
+}
+
+func (cs *contextSource) Process() <-chan interface{} {
+	return ProcessContext(cs.ctx, cs.Processor)
+}
@@ -0,0 +1,306 @@
+package phonelab
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Emits sequence numbers until its context is canceled.
+type endlessEmitter struct {
+	wg *sync.WaitGroup
+}
+
+func (e *endlessEmitter) Process() <-chan interface{} {
+	return e.ProcessContext(context.Background())
+}
+
+func (e *endlessEmitter) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+		for i := 0; ; i++ {
+			if !sendContext(ctx, outChan, sequenceNum(i)) {
+				break
+			}
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+// A pass-through processor that doesn't know about contexts.
+type unawareProcessor struct {
+	source Processor
+}
+
+func (p *unawareProcessor) Process() <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		for obj := range p.source.Process() {
+			outChan <- obj
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+// Wait for wg, failing the test if it takes too long.
+func waitOrFail(t *testing.T, wg *sync.WaitGroup, what string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %v", what)
+	}
+}
+
+func TestProcessContextCancel(t *testing.T) {
+	t.Parallel()
+
+	builders := map[string]func(ctx context.Context, source Processor) Processor{
+		"simple": func(ctx context.Context, source Processor) Processor {
+			return NewSimpleProcessor(source, &passThroughHandler{})
+		},
+		"demuxer": func(ctx context.Context, source Processor) Processor {
+			return NewDemuxer([]Processor{source, source, source})
+		},
+		"timeweaver": func(ctx context.Context, source Processor) Processor {
+			return NewTimeweaverProcessor(source, NewTimeweaverProcessor(source, source))
+		},
+		"merge": func(ctx context.Context, source Processor) Processor {
+			return NewMergeProcessor([]Processor{source, source, source})
+		},
+		"muxer": func(ctx context.Context, source Processor) Processor {
+			mux := NewMuxer(source, 2)
+			return NewMergeProcessor([]Processor{mux, mux})
+		},
+		"unaware": func(ctx context.Context, source Processor) Processor {
+			// The source is bound to ctx, so it stops even though the
+			// processor in the middle never sees it.
+			unaware := &unawareProcessor{&contextSource{ctx, source}}
+			return NewSimpleProcessor(unaware, &passThroughHandler{})
+		},
+	}
+
+	for name, build := range builders {
+		name, build := name, build
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			wg := &sync.WaitGroup{}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			resChan := ProcessContext(ctx, build(ctx, &endlessEmitter{wg}))
+			for i := 0; i < 10; i++ {
+				<-resChan
+			}
+			cancel()
+
+			// Everything should shut down and close
+			closed := &sync.WaitGroup{}
+			closed.Add(1)
+			go func() {
+				drain(resChan)
+				closed.Done()
+			}()
+			waitOrFail(t, closed, name+" output to close")
+			waitOrFail(t, wg, name+" sources to stop")
+		})
+	}
+}
+
+func TestProcessContextBackground(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	// Processors that don't know about contexts are started with Process()
+	count := 0
+	for _ = range ProcessContext(context.Background(), &emitter{100}) {
+		count += 1
+	}
+	assert.Equal(100, count)
+}
+
+func TestTextFileProcessorCancel(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resChan := NewTextFileProcessor("./test/test.log", nil, nil).ProcessContext(ctx)
+	_, ok := <-resChan
+	require.True(ok)
+	cancel()
+
+	closed := &sync.WaitGroup{}
+	closed.Add(1)
+	go func() {
+		drain(resChan)
+		closed.Done()
+	}()
+	waitOrFail(t, closed, "file source to close")
+}
+
+// Generates endless sources
+type endlessGenerator struct {
+	wg *sync.WaitGroup
+}
+
+func (g *endlessGenerator) Process() <-chan *PipelineSourceInstance {
+	return g.ProcessContext(context.Background())
+}
+
+func (g *endlessGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
+	sourceChan := make(chan *PipelineSourceInstance)
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+		for {
+			source := &PipelineSourceInstance{
+				Processor: &endlessEmitter{g.wg},
+				Info:      &TextFileSourceInfo{"endless"},
+			}
+			if !sendSourceContext(ctx, sourceChan, source) {
+				break
+			}
+		}
+		close(sourceChan)
+	}()
+
+	return sourceChan
+}
+
+type partialCollector struct {
+	sync.Mutex
+	count      int
+	onData     func()
+	finished   bool
+	partialErr error
+}
+
+func (c *partialCollector) BuildPipeline(source *PipelineSourceInstance) (*Pipeline, error) {
+	// Don't make it easy: put a processor that doesn't know about contexts
+	// between the source and the Runner.
+	return &Pipeline{
+		LastHop: NewSimpleProcessor(&unawareProcessor{source.Processor}, &passThroughHandler{}),
+	}, nil
+}
+
+func (c *partialCollector) OnData(data interface{}, info PipelineSourceInfo) {
+	c.Lock()
+	c.count += 1
+	c.Unlock()
+	if c.onData != nil {
+		c.onData()
+	}
+}
+
+func (c *partialCollector) Finish() {
+	c.finished = true
+}
+
+func (c *partialCollector) FinishPartial(err error) {
+	c.partialErr = err
+}
+
+func runContextOrFail(t *testing.T, ctx context.Context, runner *Runner) []error {
+	var errs []error
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		errs = runner.RunContext(ctx)
+		wg.Done()
+	}()
+	waitOrFail(t, wg, "RunContext to return")
+	return errs
+}
+
+func TestRunContextCancel(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	collector := &partialCollector{}
+	collector.onData = func() {
+		collector.Lock()
+		defer collector.Unlock()
+		if collector.count == 100 {
+			cancel()
+		}
+	}
+
+	runner := NewRunner(&endlessGenerator{wg}, collector, collector)
+	runner.MaxConcurrency = 4
+
+	errs := runContextOrFail(t, ctx, runner)
+	waitOrFail(t, wg, "sources to stop")
+
+	assert.Equal([]error{context.Canceled}, errs)
+	assert.Equal(context.Canceled, collector.partialErr)
+	assert.False(collector.finished)
+}
+
+func TestRunContextDeadline(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	collector := &partialCollector{}
+	runner := NewRunner(&endlessGenerator{wg}, collector, collector)
+
+	// Not a PartialDataCollector, so Finish gets called.
+	type plainCollector struct{ DataCollector }
+	runner.Collector = &plainCollector{collector}
+
+	errs := runContextOrFail(t, ctx, runner)
+	waitOrFail(t, wg, "sources to stop")
+
+	assert.Equal([]error{context.DeadlineExceeded}, errs)
+	assert.Nil(collector.partialErr)
+	assert.True(collector.finished)
+	assert.True(collector.count > 0)
+}
+
+func TestRunContextComplete(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	collector := &partialCollector{}
+	gen := &emitterGenerator{sizes: []int{10, 20, 50}}
+	runner := NewRunner(gen, collector, collector)
+
+	errs := runContextOrFail(t, context.Background(), runner)
+	assert.Equal(0, len(errs))
+	assert.Equal(80, collector.count)
+	assert.True(collector.finished)
+	assert.Nil(collector.partialErr)
+}
@@ -0,0 +1,505 @@
+package phonelab
+
+import (
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/shaseley/phonelab-go/serialize"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DataCollectorCSVName = "csv"
+	DataCollectorTSVName = "tsv"
+)
+
+// CSVCollector is a DataCollector that writes flat tables for pandas, R and
+// friends. Each source gets a file per record type:
+//
+//	<path>/<context>/<type>.csv
+//
+// Records are flattened into columns. Struct fields are named by their json
+// tag, then their logcat tag, then their Go name in snake_case. Fields of
+// embedded structs (e.g. Trace, PrintkLog) are prefixed with the embedded
+// struct's name, e.g. trace_cpu, and so are the fields of other nested
+// structs. Loglines are flattened along with their payload, under payload_,
+// and their type is Logline_<payload type>, so each payload type gets its own
+// table. Maps and slices inside records are written as JSON.
+//
+// The header comes from the first record of each type. Columns that later
+// records have and the first one didn't are dropped (with a warning), and
+// columns they don't have are left empty.
+//
+// The path can be file://, hdfs:// or s3://. Files are kept open until the
+// Runner is done with the source.
+type CSVCollector struct {
+	// Base URL of the output. The final filename includes the source context
+	// and the record type.
+	Path string
+	// Whether the files should be gzipped
+	Compressed bool
+	// ',' for CSV, '\t' for TSV
+	Delimiter rune
+
+	// Open tables, by context and then type
+	tables map[string]map[string]*csvTable
+	// The files written for each source that's done
+	outputs map[string][]string
+	sync.Mutex
+}
+
+type csvTable struct {
+	url     string
+	columns []string
+	index   map[string]int
+	stream  io.WriteCloser
+	csv     *csv.Writer
+	// Columns we've already warned about dropping
+	dropped map[string]bool
+	sync.Mutex
+}
+
+// Create a CSVCollector from generic args: path (required) and compressed.
+func NewCSVCollector(args map[string]interface{}) (DataCollector, error) {
+	return newCSVCollector(args, ',')
+}
+
+// Same as NewCSVCollector, but tab-separated.
+func NewTSVCollector(args map[string]interface{}) (DataCollector, error) {
+	return newCSVCollector(args, '\t')
+}
+
+func newCSVCollector(args map[string]interface{}, delimiter rune) (*CSVCollector, error) {
+	pathOrUrl := ""
+	if v, ok := args["path"]; ok {
+		if pathOrUrl, ok = v.(string); !ok {
+			return nil, fmt.Errorf("Unexpected type for 'path'. Expected string, got %T", v)
+		}
+	} else {
+		return nil, errors.New("Missing 'path' argument. A path is required for the csv collector")
+	}
+
+	u, err := url.Parse(pathOrUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid path '%v': %v", pathOrUrl, err)
+	}
+	if u.Scheme != "file" && u.Scheme != "hdfs" && u.Scheme != "s3" {
+		return nil, fmt.Errorf("Unsupported protocol in path '%v'. Expected file://, hdfs:// or s3://", pathOrUrl)
+	}
+
+	compressed := false
+	for _, s := range []string{"compress", "compressed"} {
+		if v, ok := args[s]; ok {
+			if compressed, ok = v.(bool); !ok {
+				return nil, fmt.Errorf("Unexpected type for '%v'. Expected bool, got %T", s, v)
+			}
+		}
+	}
+
+	return &CSVCollector{
+		Path:       pathOrUrl,
+		Compressed: compressed,
+		Delimiter:  delimiter,
+		tables:     make(map[string]map[string]*csvTable),
+		outputs:    make(map[string][]string),
+	}, nil
+}
+
+func (c *CSVCollector) makeOutUrl(context, typeName string) string {
+	ext := ".csv"
+	if c.Delimiter == '\t' {
+		ext = ".tsv"
+	}
+	if c.Compressed {
+		ext += ".gz"
+	}
+
+	u, _ := url.Parse(c.Path)
+	u.Path = path.Join(u.Path, context, typeName+ext)
+	return u.String()
+}
+
+// Sources run concurrently, so OnData may be called from multiple goroutines.
+func (c *CSVCollector) OnData(data interface{}, info PipelineSourceInfo) {
+	typeName, columns, values := flattenRecord(data)
+
+	table, err := c.table(info.Context(), typeName, columns)
+	if err != nil {
+		log.Errorf("Error writing %v: %v", typeName, err)
+		return
+	}
+
+	if err := table.write(columns, values); err != nil {
+		log.Errorf("Error writing %v: %v", table.url, err)
+	}
+}
+
+// Get the table for a type, creating it with the columns of its first record
+// if it doesn't exist yet.
+func (c *CSVCollector) table(context, typeName string, columns []string) (*csvTable, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	tables, ok := c.tables[context]
+	if !ok {
+		tables = make(map[string]*csvTable)
+		c.tables[context] = tables
+	}
+	if table, ok := tables[typeName]; ok {
+		return table, nil
+	}
+
+	table := &csvTable{
+		url:     c.makeOutUrl(context, typeName),
+		columns: columns,
+		index:   make(map[string]int),
+		dropped: make(map[string]bool),
+	}
+	for i, col := range columns {
+		table.index[col] = i
+	}
+
+	var err error
+	if table.stream, err = serialize.OpenStream(table.url); err != nil {
+		return nil, fmt.Errorf("Failed to open %v: %v", table.url, err)
+	}
+	table.csv = csv.NewWriter(table.stream)
+	table.csv.Comma = c.Delimiter
+
+	if err := table.csv.Write(columns); err != nil {
+		table.close()
+		return nil, fmt.Errorf("Failed to write header to %v: %v", table.url, err)
+	}
+
+	tables[typeName] = table
+	return table, nil
+}
+
+func (t *csvTable) write(columns, values []string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	row := make([]string, len(t.columns))
+	for i, col := range columns {
+		if j, ok := t.index[col]; ok {
+			row[j] = values[i]
+		} else if !t.dropped[col] {
+			t.dropped[col] = true
+			log.Warnf("Dropping column '%v' from %v: it wasn't in the first record", col, t.url)
+		}
+	}
+	return t.csv.Write(row)
+}
+
+func (t *csvTable) close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.csv.Flush()
+	err := t.csv.Error()
+	if cerr := t.stream.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close the files for the source.
+func (c *CSVCollector) SourceDone(info PipelineSourceInfo) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closeTables(info.Context())
+}
+
+// Must be called with the lock held.
+func (c *CSVCollector) closeTables(context string) {
+	tables := c.tables[context]
+	delete(c.tables, context)
+
+	typeNames := make([]string, 0, len(tables))
+	for typeName := range tables {
+		typeNames = append(typeNames, typeName)
+	}
+	sort.Strings(typeNames)
+
+	for _, typeName := range typeNames {
+		table := tables[typeName]
+		if err := table.close(); err != nil {
+			log.Errorf("Error closing %v: %v", table.url, err)
+		} else {
+			c.outputs[context] = append(c.outputs[context], table.url)
+		}
+	}
+}
+
+// Close anything still open, e.g. when used without a Runner.
+func (c *CSVCollector) Finish() {
+	c.Lock()
+	defer c.Unlock()
+
+	for context := range c.tables {
+		c.closeTables(context)
+	}
+}
+
+// The files of the sources that didn't finish are closed with whatever made it
+// into them.
+func (c *CSVCollector) FinishPartial(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	for context := range c.tables {
+		log.Warnf("Run did not finish (%v), tables for '%v' are incomplete", err, context)
+		c.closeTables(context)
+	}
+}
+
+// The output for a source is its files.
+func (c *CSVCollector) Checkpoint(info PipelineSourceInfo) ([]string, interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	outputs := c.outputs[info.Context()]
+	delete(c.outputs, info.Context())
+	return outputs, nil, nil
+}
+
+// Finished sources' files are already where they belong.
+func (c *CSVCollector) Restore(entries []*JournalEntry) error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Flattening
+
+type recordFlattener struct {
+	columns []string
+	values  []string
+	// The kind of each column's value, for typed outputs
+	kinds []reflect.Kind
+}
+
+// Flatten a record into columns. Returns the name of the record type, which
+// is the Go type name, or Logline_<payload type> for Loglines with a parsed
+// payload.
+func flattenRecord(obj interface{}) (string, []string, []string) {
+	typeName, f := flattenRecordKinds(obj)
+	return typeName, f.columns, f.values
+}
+
+// Same as flattenRecord, but also keeps the kinds of the values.
+func flattenRecordKinds(obj interface{}) (string, *recordFlattener) {
+	f := &recordFlattener{
+		columns: make([]string, 0),
+		values:  make([]string, 0),
+		kinds:   make([]reflect.Kind, 0),
+	}
+
+	v := reflect.ValueOf(obj)
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		f.add("value", "", reflect.Invalid)
+		return "nil", f
+	}
+
+	typeName := v.Type().Name()
+	if len(typeName) == 0 {
+		typeName = v.Kind().String()
+	}
+
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f.flatten(key, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())), false)
+		}
+	case v.Kind() == reflect.Struct && !isTextValue(v):
+		if ll, ok := obj.(*Logline); ok && ll.Payload != nil {
+			if _, isString := ll.Payload.(string); !isString {
+				pt := reflect.TypeOf(ll.Payload)
+				for pt.Kind() == reflect.Ptr {
+					pt = pt.Elem()
+				}
+				typeName += "_" + pt.Name()
+			}
+		}
+		f.flattenStruct("", v, false)
+	default:
+		f.flatten("value", v, false)
+	}
+
+	return typeName, f
+}
+
+func (f *recordFlattener) add(column, value string, kind reflect.Kind) {
+	f.columns = append(f.columns, column)
+	f.values = append(f.values, value)
+	f.kinds = append(f.kinds, kind)
+}
+
+func joinColumn(prefix, name string) string {
+	if len(prefix) == 0 {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+// Whether v is written as text, e.g. time.Time
+func isTextValue(v reflect.Value) bool {
+	if !v.CanInterface() {
+		return false
+	}
+	_, ok := v.Interface().(encoding.TextMarshaler)
+	if !ok && v.CanAddr() {
+		_, ok = v.Addr().Interface().(encoding.TextMarshaler)
+	}
+	return ok
+}
+
+// Add the column(s) for v. If empty is set, v is only used for its type and
+// the values are left empty.
+func (f *recordFlattener) flatten(column string, v reflect.Value, empty bool) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			f.add(column, "", reflect.Invalid)
+		} else {
+			f.flatten(column, v.Elem(), empty)
+		}
+		return
+	case reflect.Ptr:
+		if !v.IsNil() {
+			f.flatten(column, v.Elem(), empty)
+		} else if v.Type().Elem().Kind() == reflect.Struct && !isTextValue(reflect.New(v.Type().Elem())) {
+			f.flattenStruct(column, reflect.Zero(v.Type().Elem()), true)
+		} else {
+			f.add(column, "", v.Type().Elem().Kind())
+		}
+		return
+	case reflect.Struct:
+		if !isTextValue(v) {
+			f.flattenStruct(column, v, empty)
+			return
+		}
+	}
+
+	if empty {
+		f.add(column, "", v.Kind())
+	} else {
+		f.add(column, csvValue(v), v.Kind())
+	}
+}
+
+func (f *recordFlattener) flattenStruct(prefix string, v reflect.Value, empty bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 && !field.Anonymous {
+			// Unexported
+			continue
+		}
+		name, skip := csvColumnName(field)
+		if skip {
+			continue
+		}
+		fv := v.Field(i)
+		if field.Anonymous {
+			// Embedded structs get a prefix so that their fields don't
+			// collide with the outer struct's, e.g. Trace.Cpu is trace_cpu.
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				f.flatten(joinColumn(prefix, name), fv, empty)
+				continue
+			}
+			if len(field.PkgPath) > 0 {
+				continue
+			}
+		}
+		f.flatten(joinColumn(prefix, name), fv, empty)
+	}
+}
+
+// The column name for a struct field: its json tag, its logcat tag, or its
+// name in snake_case. skip is set for json:"-".
+func csvColumnName(field reflect.StructField) (name string, skip bool) {
+	if tag, ok := field.Tag.Lookup("json"); ok {
+		name = strings.Split(tag, ",")[0]
+		if name == "-" {
+			return "", true
+		} else if len(name) > 0 {
+			return name, false
+		}
+	}
+	if tag := field.Tag.Get("logcat"); len(tag) > 0 && tag != "-" {
+		return tag, false
+	}
+	return snakeCase(field.Name), false
+}
+
+// CpuId -> cpu_id, PLLog -> pl_log
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func csvValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 32)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.String:
+		return v.String()
+	}
+
+	if v.CanInterface() {
+		if tm, ok := v.Interface().(encoding.TextMarshaler); ok {
+			if b, err := tm.MarshalText(); err == nil {
+				return string(b)
+			}
+		}
+		if b, err := json.Marshal(v.Interface()); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,202 @@
+package phonelab
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlattenRecord(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	typeName, columns, values := flattenRecord(&Healthd{
+		PrintkLog: PrintkLog{LogLevel: 6, Timestamp: 12.5, TimestampUs: 12500000, Sequence: 3},
+		L:         87,
+		Chg:       "u",
+	})
+	assert.Equal("Healthd", typeName)
+	assert.Equal([]string{
+		"printk_log_log_level", "printk_log_timestamp", "printk_log_timestamp_us", "printk_log_sequence",
+		"l", "v", "t", "h", "st", "c", "chg",
+	}, columns)
+	assert.Equal([]string{"6", "12.5", "12500000", "3", "87", "0", "0", "0", "0", "0", "u"}, values)
+
+	// The embedded Trace's cpu doesn't collide with the record's
+	_, columns, values = flattenRecord(&PhonelabPeriodicCtxSwitchInfo{
+		Trace: Trace{Thread: "kworker/2:2H-10277", Cpu: 2},
+		Cpu:   1,
+		Comm:  "a,b",
+	})
+	assert.Equal([]string{"trace_thread", "trace_cpu", "trace_unknown", "trace_timestamp", "trace_tag"}, columns[:5])
+	assert.Equal([]string{"kworker/2:2H-10277", "2"}, values[:2])
+	assert.Equal("cpu", columns[5])
+	assert.Equal("1", values[5])
+
+	// Loglines are typed by their payload
+	typeName, columns, values = flattenRecord(&Logline{
+		Tag:     "Kernel-Trace",
+		Payload: &CpuFrequency{State: 1497600, CpuId: 2},
+	})
+	assert.Equal("Logline_CpuFrequency", typeName)
+	assert.Equal([]string{"line", "boot_id", "datetime", "datetime_nanos", "LogcatToken", "tracetime",
+		"pid", "tid", "level", "tag"}, columns[:10])
+	assert.Equal("0001-01-01T00:00:00Z", values[2])
+	assert.Equal("Kernel-Trace", values[9])
+	assert.Contains(columns, "payload_trace_cpu")
+	assert.Equal("1497600", values[len(values)-2])
+	assert.Equal("payload_cpu_id", columns[len(columns)-1])
+
+	typeName, columns, values = flattenRecord(&Logline{Tag: "foo", Payload: "bar"})
+	assert.Equal("Logline", typeName)
+	assert.Equal("payload", columns[len(columns)-1])
+	assert.Equal("bar", values[len(values)-1])
+
+	// Nested structs get a prefix, nil pointers leave the columns empty and
+	// anything else is JSON.
+	type inner struct {
+		A int `json:"a"`
+	}
+	type outer struct {
+		In      inner  `json:"in"`
+		Ptr     *inner `json:"ptr"`
+		List    []int  `json:"list"`
+		Skipped string `json:"-"`
+		private int
+	}
+	typeName, columns, values = flattenRecord(outer{In: inner{1}, List: []int{1, 2}})
+	assert.Equal("outer", typeName)
+	assert.Equal([]string{"in_a", "ptr_a", "list"}, columns)
+	assert.Equal([]string{"1", "", "[1,2]"}, values)
+
+	typeName, columns, values = flattenRecord(map[string]interface{}{"b": 1.5, "a": "x"})
+	assert.Equal("map", typeName)
+	assert.Equal([]string{"a", "b"}, columns)
+	assert.Equal([]string{"x", "1.5"}, values)
+
+	typeName, columns, values = flattenRecord(42)
+	assert.Equal("int", typeName)
+	assert.Equal([]string{"value"}, columns)
+	assert.Equal([]string{"42"}, values)
+
+	for in, out := range map[string]string{
+		"CpuId":         "cpu_id",
+		"PLLog":         "pl_log",
+		"DatetimeNanos": "datetime_nanos",
+		"St":            "st",
+	} {
+		assert.Equal(out, snakeCase(in))
+	}
+}
+
+// Emits the parsed payloads, or the loglines themselves if kwargs has
+// loglines set.
+type payloadHandler struct {
+	loglines bool
+}
+
+func (h *payloadHandler) Handle(data interface{}) interface{} {
+	if ll, ok := data.(*Logline); ok && ll != nil {
+		if h.loglines {
+			return ll
+		}
+		return ll.Payload
+	}
+	return nil
+}
+
+func (h *payloadHandler) Finish() {}
+
+func readCSV(t *testing.T, file string, delimiter rune, gz bool) [][]string {
+	f, err := os.Open(file)
+	require.Nil(t, err)
+	defer f.Close()
+
+	var r io.Reader = f
+	if gz {
+		gzr, err := gzip.NewReader(f)
+		require.Nil(t, err)
+		r = gzr
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	records, err := reader.ReadAll()
+	require.Nil(t, err)
+	return records
+}
+
+func TestCSVCollector(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-csv")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	env := NewEnvironment()
+	env.Processors["payloads"] = &ProcessorGenWrapper{
+		Gen: func(source *PipelineSourceInstance, kwargs map[string]interface{}) Processor {
+			_, loglines := kwargs["loglines"]
+			return NewSimpleProcessor(source.Processor, &payloadHandler{loglines})
+		},
+	}
+
+	run := func(collector, args string) {
+		conf, err := RunnerConfFromString(`
+processors:
+  - name: payloads
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: simple
+        filter: "cpu_frequency"
+source:
+  type: files
+  sources: ["./test/test.log"]
+sink:
+  name: payloads
+  args: ` + args + `
+data_collector:
+  name: ` + collector + `
+  args:
+    path: file://` + filepath.Join(tmpDir, collector) + `
+    compressed: ` + map[string]string{"csv": "false", "tsv": "true"}[collector] + `
+`)
+		require.Nil(err)
+		runner, err := conf.ToRunner(env)
+		require.Nil(err)
+		require.Equal(0, len(runner.Run()))
+	}
+
+	run("csv", "{}")
+	records := readCSV(t, filepath.Join(tmpDir, "csv/test/test.log/CpuFrequency.csv"), ',', false)
+	require.Equal(428, len(records))
+	assert.Equal([]string{"trace_thread", "trace_cpu", "trace_unknown", "trace_timestamp", "trace_tag",
+		"state", "cpu_id"}, records[0])
+	assert.Equal([]string{"kworker/2:2H-10277", "2", "...1", "56250.330631", "cpu_frequency",
+		"1497600", "2"}, records[1])
+
+	run("tsv", "{loglines: true}")
+	records = readCSV(t, filepath.Join(tmpDir, "tsv/test/test.log/Logline_CpuFrequency.tsv.gz"), '\t', true)
+	require.Equal(428, len(records))
+	assert.Equal("line", records[0][0])
+	assert.Equal("payload_cpu_id", records[0][len(records[0])-1])
+	assert.Equal("Kernel-Trace", records[1][9])
+	assert.Equal("2", records[1][len(records[1])-1])
+
+	_, err = NewCSVCollector(map[string]interface{}{"path": "ftp://example.com/out"})
+	assert.NotNil(err)
+	_, err = NewTSVCollector(map[string]interface{}{})
+	assert.NotNil(err)
+}
@@ -1,11 +1,21 @@
 package phonelab
 
 import (
+	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/gurupras/go-easyfiles"
 	"github.com/shaseley/phonelab-go/serialize"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,6 +23,22 @@ import (
 // DefaultCollector is a DataCollector that passes data to a configured
 // serialize.Serializer. The serializer can be configured by the builder through
 // yaml arguments.
+//
+// By default, the output for a source goes to <path>/<context>. With a
+// path_template, it goes wherever the template says instead, e.g.
+//
+//	path_template: device={device}/date={date}/{boot_id}
+//
+// The template has {device}, {boot_id}, {context}, {source_type}, {file} (the
+// base name of a file source), {date} (of the result's Datetime),
+// {processor} (the sink) and {seq} (the number of the result within its
+// source, so that each result gets its own file). When streaming, the template
+// needs {context}, since each source's streams are closed when it is done.
+//
+// Every file is written to a temporary name and moved into place when it is
+// complete. write_mode says what happens to a file that is already there:
+// overwrite (the default), no_overwrite or skip_identical (leave it alone if
+// it has the same content, so that reruns don't touch unchanged outputs).
 type DefaultCollector struct {
 	// Base path or URL of the output destination. The final filename will include
 	// contextual information.
@@ -23,9 +49,75 @@ type DefaultCollector struct {
 	AggregateData bool
 	// The serializer to use for serializing data.
 	Serializer serialize.Serializer
+	// Whether or not data should be written as newline-delimited JSON as it
+	// arrives instead of being serialized as a whole
+	Stream bool
+	// Local directory for the per-source parts of a streamed aggregate. The
+	// parts are concatenated in Finish().
+	PartsDir string
+	// Where in Path the output goes, instead of the source's context. nil
+	// for the context.
+	Template *pathTemplate
 
-	firstContext string
-	allData      []interface{}
+	// Name of the sink processor, for {processor}
+	sinkName string
+	// Number of results so far by source context, for {seq}
+	seqs map[string]int
+	// The contexts with data in the aggregate. It's named after the smallest
+	// one, so that the name doesn't depend on which source finishes first.
+	aggregateContexts map[string]bool
+	// Aggregated data, by source context. It's kept per source so that each
+	// source's share can be checkpointed.
+	sourceData  map[string][]interface{}
+	sourceOrder []string
+	// Where the data for each source went when not aggregating
+	outputs map[string]map[string]bool
+	// Open streams by path, their paths by source context, and the aggregate
+	// parts in order.
+	streams       map[string]*recordStream
+	sourceStreams map[string][]string
+	parts         []string
+	sync.Mutex
+}
+
+// An NDJSON stream to a single path. It has its own lock, so that writing to
+// one stream doesn't hold up the others.
+type recordStream struct {
+	path    string
+	stream  io.WriteCloser
+	encoder *json.Encoder
+	closed  bool
+	sync.Mutex
+}
+
+func openRecordStream(serializer serialize.StreamSerializer, path string) (*recordStream, error) {
+	stream, err := serializer.OpenStream(path)
+	if err != nil {
+		return nil, err
+	}
+	return &recordStream{
+		path:    path,
+		stream:  stream,
+		encoder: serialize.NewRecordEncoder(stream),
+	}, nil
+}
+
+func (rs *recordStream) encode(data interface{}) {
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.closed {
+		log.Errorf("Error streaming data to %v: stream is closed", rs.path)
+	} else if err := rs.encoder.Encode(data); err != nil {
+		log.Errorf("Error streaming data to %v: %v", rs.path, err)
+	}
+}
+
+// Waits for a write in progress
+func (rs *recordStream) close() error {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.closed = true
+	return rs.stream.Close()
 }
 
 // Create and return a new DefaultDataCollector from generic args.
@@ -34,7 +126,7 @@ func NewDefaultCollector(args map[string]interface{}) (DataCollector, error) {
 	pathOrUrl := ""
 	if v, ok := args["path"]; ok {
 		if pathOrUrl, ok = v.(string); !ok {
-			return nil, fmt.Errorf("Unexpected type for 'compressed'. Expected bool, got %t", v)
+			return nil, fmt.Errorf("Unexpected type for 'path'. Expected string, got %T", v)
 		}
 	} else {
 		return nil, errors.New("Missing 'path' argument. A path is required for the default collector")
@@ -45,7 +137,7 @@ func NewDefaultCollector(args map[string]interface{}) (DataCollector, error) {
 	for _, s := range []string{"compress", "compressed"} {
 		if v, ok := args[s]; ok {
 			if compressed, ok = v.(bool); !ok {
-				return nil, fmt.Errorf("Unexpected type for 'compressed'. Expected bool, got %t", v)
+				return nil, fmt.Errorf("Unexpected type for 'compressed'. Expected bool, got %T", v)
 			}
 		}
 	}
@@ -53,7 +145,49 @@ func NewDefaultCollector(args map[string]interface{}) (DataCollector, error) {
 	aggregate := false
 	if v, ok := args["aggregate"]; ok {
 		if aggregate, ok = v.(bool); !ok {
-			return nil, fmt.Errorf("Unexpected type for 'aggregate'. Expected bool, got %t", v)
+			return nil, fmt.Errorf("Unexpected type for 'aggregate'. Expected bool, got %T", v)
+		}
+	}
+
+	stream := false
+	if v, ok := args["stream"]; ok {
+		if stream, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("Unexpected type for 'stream'. Expected bool, got %T", v)
+		}
+	}
+
+	// The parts of a streamed aggregate need to outlive the run for resume,
+	// so by default they go somewhere that only depends on the output path.
+	partsDir := ""
+	if v, ok := args["parts_dir"]; ok {
+		if partsDir, ok = v.(string); !ok {
+			return nil, fmt.Errorf("Unexpected type for 'parts_dir'. Expected string, got %T", v)
+		}
+	} else {
+		partsDir = filepath.Join(os.TempDir(), fmt.Sprintf("phonelab-parts-%x", sha1.Sum([]byte(pathOrUrl))))
+	}
+
+	var template *pathTemplate
+	if v, ok := args["path_template"]; ok {
+		templateString, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected type for 'path_template'. Expected string, got %T", v)
+		}
+		var err error
+		if template, err = parseDefaultCollectorTemplate(templateString, aggregate, stream); err != nil {
+			return nil, err
+		}
+	}
+
+	writeMode := serialize.WriteOverwrite
+	if v, ok := args["write_mode"]; ok {
+		modeString, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected type for 'write_mode'. Expected string, got %T", v)
+		}
+		var err error
+		if writeMode, err = serialize.ParseWriteMode(modeString); err != nil {
+			return nil, err
 		}
 	}
 
@@ -61,29 +195,138 @@ func NewDefaultCollector(args map[string]interface{}) (DataCollector, error) {
 	if err != nil {
 		return nil, err
 	}
+	if ms, ok := serializer.(serialize.ModeSerializer); ok {
+		ms.SetWriteMode(writeMode)
+	} else if writeMode != serialize.WriteOverwrite {
+		return nil, fmt.Errorf("Write mode '%v' is not supported for '%v'", writeMode, pathOrUrl)
+	}
+	if _, ok := serializer.(serialize.StreamSerializer); stream && !ok {
+		return nil, fmt.Errorf("Streaming is not supported for '%v'", pathOrUrl)
+	}
 
 	return &DefaultCollector{
-		Path:          pathOrUrl,
-		Compressed:    compressed,
-		Serializer:    serializer,
-		AggregateData: aggregate,
-		allData:       make([]interface{}, 0),
+		Path:              pathOrUrl,
+		Compressed:        compressed,
+		Serializer:        serializer,
+		AggregateData:     aggregate,
+		Stream:            stream,
+		PartsDir:          partsDir,
+		Template:          template,
+		seqs:              make(map[string]int),
+		aggregateContexts: make(map[string]bool),
+		sourceData:        make(map[string][]interface{}),
+		sourceOrder:       make([]string, 0),
+		outputs:           make(map[string]map[string]bool),
+		streams:           make(map[string]*recordStream),
+		sourceStreams:     make(map[string][]string),
+		parts:             make([]string, 0),
 	}, nil
 }
 
-func (dc *DefaultCollector) makeOutPath(context string) string {
-	// We start with a base path or URL. Tack on the context.
+var defaultCollectorPathVars = []string{
+	PathVarDevice,
+	PathVarBootId,
+	PathVarContext,
+	PathVarSourceType,
+	PathVarFile,
+	PathVarDate,
+	PathVarProcessor,
+	PathVarSeq,
+}
 
-	//context = strings.Replace(context, "/", "_", -1)
+// An aggregate has everything in one output, so only what's the same for
+// every result makes sense in its path. A stream is per source, so there's
+// no {seq}, and it needs {context} so that no two sources share one.
+func parseDefaultCollectorTemplate(templateString string, aggregate, stream bool) (*pathTemplate, error) {
+	template, err := parsePathTemplate(templateString, defaultCollectorPathVars)
+	if err != nil {
+		return nil, err
+	}
 
+	for _, name := range defaultCollectorPathVars {
+		if !template.Has(name) {
+			continue
+		}
+		if aggregate && name != PathVarProcessor {
+			return nil, fmt.Errorf("Can't use '{%v}' in path template when aggregating. Only '{%v}' applies to the whole output",
+				name, PathVarProcessor)
+		} else if stream && name == PathVarSeq {
+			return nil, fmt.Errorf("Can't use '{%v}' in path template when streaming", name)
+		}
+	}
+	if stream && !aggregate && !template.Has(PathVarContext) {
+		return nil, fmt.Errorf("Path template '%v' needs '{%v}' when streaming", templateString, PathVarContext)
+	}
+	return template, nil
+}
+
+// Told by the builder, for {processor}
+func (dc *DefaultCollector) SetSinkName(name string) {
+	dc.sinkName = name
+}
+
+// The output path for a result. Must be called with the lock held.
+func (dc *DefaultCollector) resultOutPath(data interface{}, info PipelineSourceInfo) string {
+	if dc.Template == nil {
+		return dc.makeOutPath(info.Context())
+	}
+
+	vars := sourcePathVars(info)
+	vars[PathVarProcessor] = dc.sinkName
+	if dc.Template.Has(PathVarDate) {
+		vars[PathVarDate] = recordDate(data)
+	}
+	if dc.Template.Has(PathVarSeq) {
+		context := info.Context()
+		vars[PathVarSeq] = strconv.Itoa(dc.seqs[context])
+		dc.seqs[context]++
+	}
+	return dc.expandOutPath(vars)
+}
+
+// The output path for the aggregate. Must be called with the lock held.
+func (dc *DefaultCollector) aggregateOutPath() string {
+	aggregateContext := ""
+	for context := range dc.aggregateContexts {
+		if len(aggregateContext) == 0 || context < aggregateContext {
+			aggregateContext = context
+		}
+	}
+	return dc.expandOutPath(map[string]string{
+		PathVarContext:   aggregateContext,
+		PathVarProcessor: dc.sinkName,
+	})
+}
+
+// Must be called with the lock held.
+func (dc *DefaultCollector) addAggregateContext(context string) {
+	dc.aggregateContexts[context] = true
+}
+
+func (dc *DefaultCollector) makeOutPath(context string) string {
+	return dc.expandOutPath(map[string]string{PathVarContext: context})
+}
+
+func (dc *DefaultCollector) expandOutPath(vars map[string]string) string {
+	// We start with a base path or URL. Tack on the context, or whatever the
+	// template has.
 	log.Debugf("dc.Path=%v\n", dc.Path)
 
 	u, _ := url.Parse(dc.Path)
-	u.Path = path.Join(u.Path, context)
+	if dc.Template != nil {
+		u.Path = path.Join(u.Path, dc.Template.Expand(vars))
+	} else {
+		u.Path = path.Join(u.Path, vars[PathVarContext])
+	}
 	outPath := u.String()
 
 	// Tack on the file type
-	if dc.Compressed {
+	if dc.Stream {
+		outPath += ".ndjson"
+		if dc.Compressed {
+			outPath += ".gz"
+		}
+	} else if dc.Compressed {
 		outPath += ".gz"
 	} else {
 		outPath += ".json"
@@ -93,29 +336,334 @@ func (dc *DefaultCollector) makeOutPath(context string) string {
 	return outPath
 }
 
+// Sources run concurrently, so OnData may be called from multiple goroutines.
 func (dc *DefaultCollector) OnData(data interface{}, info PipelineSourceInfo) {
-	if dc.AggregateData {
-		// Just save it for later
-		dc.allData = append(dc.allData, data)
-		if len(dc.firstContext) == 0 {
-			dc.firstContext = info.Context()
+	if dc.Stream {
+		// The collector is only locked to find the stream. Writes to
+		// different streams, e.g. to HDFS or S3, go on at the same time.
+		dc.Lock()
+		rs := dc.dataStream(data, info)
+		dc.Unlock()
+		if rs != nil {
+			rs.encode(data)
 		}
+	} else if dc.AggregateData {
+		// Just save it for later
+		dc.Lock()
+		dc.addData(info.Context(), data)
+		dc.Unlock()
 	} else {
 		// Persist now.
 		// FIXME: Can we use a goroutine here so we don't block the pipeline
-		outPath := dc.makeOutPath(info.Context())
+		dc.Lock()
+		outPath := dc.resultOutPath(data, info)
+		dc.Unlock()
 		if err := dc.Serializer.Serialize(data, outPath); err != nil {
 			fmt.Println("Error serializing data:", err)
+		} else {
+			dc.Lock()
+			dc.addOutput(info.Context(), outPath)
+			dc.Unlock()
 		}
 	}
 }
 
-func (dc *DefaultCollector) Finish() {
+// Must be called with the lock held.
+func (dc *DefaultCollector) addOutput(context, outPath string) {
+	if _, ok := dc.outputs[context]; !ok {
+		dc.outputs[context] = make(map[string]bool)
+	}
+	dc.outputs[context][outPath] = true
+}
+
+// Must be called with the lock held.
+func (dc *DefaultCollector) addData(context string, data ...interface{}) {
+	dc.addAggregateContext(context)
+	if _, ok := dc.sourceData[context]; !ok {
+		dc.sourceOrder = append(dc.sourceOrder, context)
+	}
+	dc.sourceData[context] = append(dc.sourceData[context], data...)
+}
+
+// The stream for the data, opened if needed, or nil if it couldn't be. When
+// aggregating, the stream is to a local part for the source that Finish()
+// puts together with the others. Must be called with the lock held.
+func (dc *DefaultCollector) dataStream(data interface{}, info PipelineSourceInfo) *recordStream {
+	context := info.Context()
+
+	var outPath string
+	if dc.AggregateData {
+		dc.addAggregateContext(context)
+		outPath = dc.partPath(context)
+	} else {
+		outPath = dc.resultOutPath(data, info)
+	}
+
+	rs, ok := dc.streams[outPath]
+	if !ok {
+		var err error
+		// The parts are ours, so they're always overwritten.
+		var serializer serialize.StreamSerializer = &serialize.LocalSerializer{}
+		if !dc.AggregateData {
+			serializer = dc.Serializer.(serialize.StreamSerializer)
+		}
+		if rs, err = openRecordStream(serializer, outPath); err != nil {
+			// Don't try again for every record
+			log.Errorf("Error opening stream to %v: %v", outPath, err)
+		} else if dc.AggregateData {
+			dc.parts = append(dc.parts, outPath)
+		}
+		dc.streams[outPath] = rs
+		dc.sourceStreams[context] = append(dc.sourceStreams[context], outPath)
+	}
+	return rs
+}
+
+func (dc *DefaultCollector) partPath(context string) string {
+	return "file://" + filepath.Join(dc.PartsDir, fmt.Sprintf("%x.ndjson", sha1.Sum([]byte(context))))
+}
+
+// Close the context's streams, if there are any. Must be called with the
+// lock held.
+func (dc *DefaultCollector) closeStreams(context string) {
+	for _, outPath := range dc.sourceStreams[context] {
+		rs := dc.streams[outPath]
+		delete(dc.streams, outPath)
+		if rs == nil {
+			continue
+		}
+
+		if err := rs.close(); err != nil {
+			log.Errorf("Error closing stream to %v: %v", rs.path, err)
+		} else if !dc.AggregateData {
+			dc.addOutput(context, rs.path)
+		}
+	}
+	delete(dc.sourceStreams, context)
+}
+
+// Close everything left open, in case sources were not reported done. Must
+// be called with the lock held.
+func (dc *DefaultCollector) closeAllStreams() {
+	for context := range dc.sourceStreams {
+		dc.closeStreams(context)
+	}
+}
+
+// The source is done, so its stream is complete.
+func (dc *DefaultCollector) SourceDone(info PipelineSourceInfo) {
+	if dc.Stream {
+		dc.Lock()
+		defer dc.Unlock()
+		dc.closeStreams(info.Context())
+	}
+}
+
+// The source failed, so what it sent is incomplete. Its share of an aggregate
+// is dropped. Results that were already written out stay, with a warning, as
+// there's no taking them back from every kind of destination.
+func (dc *DefaultCollector) SourceFailed(info PipelineSourceInfo) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	context := info.Context()
 	if dc.AggregateData {
+		delete(dc.aggregateContexts, context)
+		if dc.Stream {
+			part := dc.partPath(context)
+			for i := range dc.parts {
+				if dc.parts[i] == part {
+					dc.parts = append(dc.parts[:i], dc.parts[i+1:]...)
+					break
+				}
+			}
+			if err := os.Remove(strings.TrimPrefix(part, "file://")); err != nil && !os.IsNotExist(err) {
+				log.Errorf("Error removing aggregate part for failed source %v: %v", context, err)
+			}
+		} else if _, ok := dc.sourceData[context]; ok {
+			delete(dc.sourceData, context)
+			for i := range dc.sourceOrder {
+				if dc.sourceOrder[i] == context {
+					dc.sourceOrder = append(dc.sourceOrder[:i], dc.sourceOrder[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+
+	if outputs, ok := dc.outputs[context]; ok {
+		paths := make([]string, 0, len(outputs))
+		for outPath := range outputs {
+			paths = append(paths, outPath)
+		}
+		sort.Strings(paths)
+		log.Warnf("Source %v failed, its output is incomplete: %v", context, strings.Join(paths, ", "))
+	}
+}
+
+// Put the parts of a streamed aggregate together in order. Only one part is
+// open at a time, so memory use doesn't grow with the amount of data.
+func (dc *DefaultCollector) finishStream() error {
+	dc.closeAllStreams()
+	if !dc.AggregateData {
+		return nil
+	}
+
+	outPath := dc.aggregateOutPath()
+	out, err := dc.Serializer.(serialize.StreamSerializer).OpenStream(outPath)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range dc.parts {
+		if err = appendPart(out, part); err != nil {
+			break
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dc.PartsDir)
+}
+
+func appendPart(w io.Writer, part string) error {
+	f, err := os.Open(strings.TrimPrefix(part, "file://"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (dc *DefaultCollector) Finish() {
+	if dc.Stream {
+		dc.Lock()
+		defer dc.Unlock()
+		if err := dc.finishStream(); err != nil {
+			log.Errorf("Error streaming all data: %v", err)
+		}
+	} else if dc.AggregateData {
+		dc.Lock()
+		defer dc.Unlock()
+
+		allData := make([]interface{}, 0)
+		for _, context := range dc.sourceOrder {
+			allData = append(allData, dc.sourceData[context]...)
+		}
+
 		// Serialize the whole list
-		outPath := dc.makeOutPath(dc.firstContext)
-		if err := dc.Serializer.Serialize(dc.allData, outPath); err != nil {
+		outPath := dc.aggregateOutPath()
+		if err := dc.Serializer.Serialize(allData, outPath); err != nil {
 			fmt.Println("Error serializing all data:", err)
 		}
 	}
 }
+
+// The run was cut short. Whatever was persisted in OnData stays where it is,
+// but we don't write out an aggregate that is missing data. If the run has a
+// Journal, the data from the sources that finished is in it, and will be
+// restored on resume.
+func (dc *DefaultCollector) FinishPartial(err error) {
+	if dc.Stream {
+		dc.Lock()
+		defer dc.Unlock()
+		dc.closeAllStreams()
+		if dc.AggregateData {
+			log.Warnf("Run did not finish (%v), keeping %v aggregate parts in %v", err, len(dc.parts), dc.PartsDir)
+		}
+	} else if dc.AggregateData {
+		dc.Lock()
+		defer dc.Unlock()
+
+		count := 0
+		for _, data := range dc.sourceData {
+			count += len(data)
+		}
+		log.Warnf("Run did not finish (%v), not writing %v aggregated results", err, count)
+	}
+}
+
+// When not aggregating, the output for the source is already written out. When
+// aggregating, the source's data becomes the checkpoint state. If streaming,
+// that's the path to the source's part instead.
+func (dc *DefaultCollector) Checkpoint(info PipelineSourceInfo) ([]string, interface{}, error) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	context := info.Context()
+
+	if dc.AggregateData && dc.Stream {
+		path := dc.partPath(context)
+		for _, part := range dc.parts {
+			if part == path {
+				return nil, path, nil
+			}
+		}
+		return nil, nil, nil
+	} else if dc.AggregateData {
+		if data, ok := dc.sourceData[context]; ok {
+			return nil, data, nil
+		}
+		return nil, nil, nil
+	}
+
+	if paths, ok := dc.outputs[context]; ok {
+		delete(dc.outputs, context)
+		outputs := make([]string, 0, len(paths))
+		for outPath := range paths {
+			outputs = append(outputs, outPath)
+		}
+		sort.Strings(outputs)
+		return outputs, nil, nil
+	}
+	return nil, nil, nil
+}
+
+// Put the data from the sources that finished in an earlier run back into the
+// aggregate. The data comes back as generic JSON values, which serialize the
+// same way as the originals.
+func (dc *DefaultCollector) Restore(entries []*JournalEntry) error {
+	if !dc.AggregateData {
+		return nil
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	for _, entry := range entries {
+		if len(entry.State) == 0 {
+			continue
+		}
+		if dc.Stream {
+			if err := dc.restorePart(entry); err != nil {
+				return err
+			}
+			continue
+		}
+		var data []interface{}
+		if err := json.Unmarshal(entry.State, &data); err != nil {
+			return fmt.Errorf("Bad aggregate state for '%v': %v", entry.Context, err)
+		}
+		dc.addData(entry.Context, data...)
+	}
+	return nil
+}
+
+// Must be called with the lock held.
+func (dc *DefaultCollector) restorePart(entry *JournalEntry) error {
+	var part string
+	if err := json.Unmarshal(entry.State, &part); err != nil {
+		return fmt.Errorf("Bad aggregate part for '%v': %v", entry.Context, err)
+	}
+	if !easyfiles.Exists(strings.TrimPrefix(part, "file://")) {
+		return fmt.Errorf("Aggregate part for '%v' is missing: %v", entry.Context, part)
+	}
+	dc.addAggregateContext(entry.Context)
+	dc.parts = append(dc.parts, part)
+	return nil
+}
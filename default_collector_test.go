@@ -1,9 +1,19 @@
 package phonelab
 
 import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gurupras/go-easyfiles"
+	"github.com/shaseley/phonelab-go/serialize"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -82,3 +92,360 @@ sink:
 	// The processors handle the checking.
 	runner.Run()
 }
+
+// Decode every line of an NDJSON file
+func readNDJSON(t *testing.T, file string) []*lineMapEntry {
+	f, err := easyfiles.Open(file, os.O_RDONLY, easyfiles.GZ_UNKNOWN)
+	require.Nil(t, err)
+	defer f.Close()
+
+	reader, err := f.RawReader()
+	require.Nil(t, err)
+	return decodeNDJSON(t, reader)
+}
+
+func decodeNDJSON(t *testing.T, reader io.Reader) []*lineMapEntry {
+	entries := make([]*lineMapEntry, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var entry lineMapEntry
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, &entry)
+	}
+	require.Nil(t, scanner.Err())
+	return entries
+}
+
+func TestDefaultCollectorStream(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stream")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	env := NewEnvironment()
+	env.Processors["test"] = &lineTimeMapGen{}
+
+	run := func(args string) {
+		conf, err := RunnerConfFromString(`
+data_collector:
+  name: "default"
+  args: ` + args + `
+source:
+  type: files
+  sources: ["./test/test.log", "./test/test.10000.log"]
+processors:
+  - name: main
+    generator: test
+    has_logstream: true
+sink:
+  name: main
+`)
+		require.Nil(err)
+		runner, err := conf.ToRunner(env)
+		require.Nil(err)
+		require.Equal(0, len(runner.Run()))
+	}
+
+	// One file per source, written as the data arrives
+	run(`{path: "file://` + filepath.Join(tmpDir, "single") + `", stream: true}`)
+	first := readNDJSON(t, filepath.Join(tmpDir, "single/test/test.log.ndjson"))
+	second := readNDJSON(t, filepath.Join(tmpDir, "single/test/test.10000.log.ndjson"))
+	require.True(len(first) > 0)
+	require.True(len(second) > 0)
+
+	// Everything in one, by way of the parts
+	partsDir := filepath.Join(tmpDir, "parts")
+	run(`{path: "file://` + filepath.Join(tmpDir, "all") + `", stream: true, aggregate: true, compress: true, parts_dir: "` + partsDir + `"}`)
+	// Named after the smallest context, whichever source got there first
+	all := readNDJSON(t, filepath.Join(tmpDir, "all/test/test.10000.log.ndjson.gz"))
+	assert.Equal(len(first)+len(second), len(all))
+	assert.False(easyfiles.Exists(partsDir))
+
+	_, err = NewDefaultCollector(map[string]interface{}{"path": "file:///tmp", "stream": "yes"})
+	assert.NotNil(err)
+}
+
+// Streams whose writes to "slow" paths wait until something has been written
+// to another path
+type gatedStreamSerializer struct {
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *gatedStreamSerializer) Serialize(obj interface{}, path string) error { return nil }
+func (s *gatedStreamSerializer) OutPath(path string) (string, error)          { return path, nil }
+
+func (s *gatedStreamSerializer) OpenStream(path string) (io.WriteCloser, error) {
+	return &gatedStream{s, strings.Contains(path, "slow")}, nil
+}
+
+type gatedStream struct {
+	s    *gatedStreamSerializer
+	slow bool
+}
+
+func (g *gatedStream) Write(b []byte) (int, error) {
+	if g.slow {
+		close(g.s.writing)
+		<-g.s.release
+	} else {
+		g.s.once.Do(func() { close(g.s.release) })
+	}
+	return len(b), nil
+}
+
+func (g *gatedStream) Close() error { return nil }
+
+func TestDefaultCollectorStreamConcurrent(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	collector, err := NewDefaultCollector(map[string]interface{}{"path": "file:///tmp/out", "stream": true})
+	require.Nil(err)
+	dc := collector.(*DefaultCollector)
+	gate := &gatedStreamSerializer{writing: make(chan struct{}), release: make(chan struct{})}
+	dc.Serializer = gate
+
+	slow := &PhonelabSourceInfo{DeviceId: "slow"}
+	fast := &PhonelabSourceInfo{DeviceId: "fast"}
+
+	done := make(chan struct{})
+	go func() {
+		dc.OnData(&lineMapEntry{Logline: 1}, slow)
+		close(done)
+	}()
+	<-gate.writing
+
+	// A slow write doesn't hold up the other sources
+	go dc.OnData(&lineMapEntry{Logline: 2}, fast)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write to one stream waited for another")
+	}
+	dc.SourceDone(slow)
+	dc.SourceDone(fast)
+}
+
+func TestDefaultCollectorStreamRestore(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stream")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	args := map[string]interface{}{
+		"path":      "file://" + filepath.Join(tmpDir, "out"),
+		"stream":    true,
+		"aggregate": true,
+		"parts_dir": filepath.Join(tmpDir, "parts"),
+	}
+
+	// The first run gets through a, but not b
+	collector, err := NewDefaultCollector(args)
+	require.Nil(err)
+	dc := collector.(*DefaultCollector)
+
+	a := &TextFileSourceInfo{"a"}
+	b := &TextFileSourceInfo{"b"}
+	dc.OnData(&lineMapEntry{Logline: 1}, a)
+	dc.OnData(&lineMapEntry{Logline: 2}, a)
+	dc.SourceDone(a)
+	outputs, state, err := dc.Checkpoint(a)
+	require.Nil(err)
+	assert.Nil(outputs)
+	require.NotNil(state)
+
+	dc.OnData(&lineMapEntry{Logline: 3}, b)
+	dc.FinishPartial(io.ErrUnexpectedEOF)
+	assert.False(easyfiles.Exists(filepath.Join(tmpDir, "out/a.ndjson")))
+
+	// The second picks up a's part and redoes b
+	b2, err := json.Marshal(state)
+	require.Nil(err)
+
+	collector, err = NewDefaultCollector(args)
+	require.Nil(err)
+	dc = collector.(*DefaultCollector)
+	require.Nil(dc.Restore([]*JournalEntry{{Context: "a", State: b2}}))
+
+	dc.OnData(&lineMapEntry{Logline: 3}, b)
+	dc.OnData(&lineMapEntry{Logline: 4}, b)
+	dc.SourceDone(b)
+	dc.Finish()
+
+	entries := readNDJSON(t, filepath.Join(tmpDir, "out/a.ndjson"))
+	require.Equal(4, len(entries))
+	for i, entry := range entries {
+		assert.Equal(int64(i+1), entry.Logline)
+	}
+
+	// A missing part can't be restored
+	collector, err = NewDefaultCollector(args)
+	require.Nil(err)
+	assert.NotNil(collector.(*DefaultCollector).Restore([]*JournalEntry{{Context: "a", State: b2}}))
+}
+
+func TestDefaultCollectorPathTemplate(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-template")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	env := NewEnvironment()
+	env.Processors["test"] = &lineTimeMapGen{}
+
+	// The builder tells the collector the sink's name
+	conf, err := RunnerConfFromString(`
+data_collector:
+  name: "default"
+  args:
+    path: "file://` + filepath.Join(tmpDir, "files") + `"
+    stream: true
+    path_template: "processor={processor}/{source_type}/{file}/date={date}/{context}"
+source:
+  type: files
+  sources: ["./test/test.log"]
+processors:
+  - name: main
+    generator: test
+    has_logstream: true
+sink:
+  name: main
+`)
+	require.Nil(err)
+	runner, err := conf.ToRunner(env)
+	require.Nil(err)
+	require.Equal(0, len(runner.Run()))
+	assert.True(len(readNDJSON(t, filepath.Join(tmpDir, "files/processor=main/file/test.log/date=unknown/test/test.log.ndjson"))) > 0)
+
+	// A file per result
+	collector, err := NewDefaultCollector(map[string]interface{}{
+		"path":          "file://" + filepath.Join(tmpDir, "seq"),
+		"path_template": "device={device}/boot={boot_id}/{seq}",
+	})
+	require.Nil(err)
+	dc := collector.(*DefaultCollector)
+
+	info := &PhonelabSourceInfo{DeviceId: "dev", BootId: "b"}
+	dc.OnData(&lineMapEntry{Logline: 1}, info)
+	dc.OnData(&lineMapEntry{Logline: 2}, info)
+	outputs, _, err := dc.Checkpoint(info)
+	require.Nil(err)
+	assert.Equal([]string{
+		"file://" + filepath.Join(tmpDir, "seq/device=dev/boot=b/0.json"),
+		"file://" + filepath.Join(tmpDir, "seq/device=dev/boot=b/1.json"),
+	}, outputs)
+	assert.True(easyfiles.Exists(filepath.Join(tmpDir, "seq/device=dev/boot=b/1.json")))
+
+	// A stream per date
+	collector, err = NewDefaultCollector(map[string]interface{}{
+		"path":          "file://" + filepath.Join(tmpDir, "dates"),
+		"path_template": "{device}/{date}/{context}",
+		"stream":        true,
+	})
+	require.Nil(err)
+	dc = collector.(*DefaultCollector)
+
+	day := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	dc.OnData(&Logline{LogcatToken: 1, Datetime: day}, info)
+	dc.OnData(&Logline{LogcatToken: 2, Datetime: day.Add(24 * time.Hour)}, info)
+	dc.OnData(&Logline{LogcatToken: 3, Datetime: day}, info)
+	dc.SourceDone(info)
+	outputs, _, err = dc.Checkpoint(info)
+	require.Nil(err)
+	require.Equal(2, len(outputs))
+	assert.Equal(2, len(readNDJSON(t, filepath.Join(tmpDir, "dates/dev/2017-03-01/dev_b.ndjson"))))
+	assert.Equal(1, len(readNDJSON(t, filepath.Join(tmpDir, "dates/dev/2017-03-02/dev_b.ndjson"))))
+
+	// Two sources from one device don't share a stream, so the second to
+	// finish doesn't overwrite the first
+	_, err = NewDefaultCollector(map[string]interface{}{
+		"path":          "file://" + filepath.Join(tmpDir, "devices"),
+		"path_template": "device={device}",
+		"stream":        true,
+	})
+	assert.NotNil(err)
+	collector, err = NewDefaultCollector(map[string]interface{}{
+		"path":          "file://" + filepath.Join(tmpDir, "devices"),
+		"path_template": "device={device}/{context}",
+		"stream":        true,
+	})
+	require.Nil(err)
+	dc = collector.(*DefaultCollector)
+
+	other := &PhonelabSourceInfo{DeviceId: "dev", BootId: "c"}
+	dc.OnData(&Logline{LogcatToken: 1}, info)
+	dc.OnData(&Logline{LogcatToken: 2}, other)
+	dc.SourceDone(info)
+	dc.OnData(&Logline{LogcatToken: 3}, other)
+	dc.SourceDone(other)
+	assert.Equal(1, len(readNDJSON(t, filepath.Join(tmpDir, "devices/device=dev/dev_b.ndjson"))))
+	assert.Equal(2, len(readNDJSON(t, filepath.Join(tmpDir, "devices/device=dev/dev_c.ndjson"))))
+
+	// Only {processor} goes with an aggregate
+	collector, err = NewDefaultCollector(map[string]interface{}{
+		"path":          "file://" + filepath.Join(tmpDir, "all"),
+		"path_template": "{processor}/all",
+		"aggregate":     true,
+	})
+	require.Nil(err)
+	dc = collector.(*DefaultCollector)
+	dc.SetSinkName("main")
+	dc.OnData(&lineMapEntry{Logline: 1}, info)
+	dc.Finish()
+	assert.True(easyfiles.Exists(filepath.Join(tmpDir, "all/main/all.json")))
+
+	for message, bad := range map[string]map[string]interface{}{
+		"Can't use '{device}' in path template when aggregating": {"path_template": "{device}", "aggregate": true},
+		"Can't use '{seq}' in path template when streaming":      {"path_template": "{device}/{seq}", "stream": true},
+		"needs '{context}' when streaming":                       {"path_template": "{device}/{date}", "stream": true},
+		"Did you mean '{boot_id}'?":                              {"path_template": "{bootid}"},
+	} {
+		args := map[string]interface{}{"path": "file:///tmp/out"}
+		for k, v := range bad {
+			args[k] = v
+		}
+		_, err := NewDefaultCollector(args)
+		if assert.NotNil(err, message) {
+			assert.Contains(err.Error(), message)
+		}
+	}
+}
+
+func TestDefaultCollectorWriteMode(t *testing.T) {
+	require := require.New(t)
+
+	dc, err := NewDefaultCollector(map[string]interface{}{
+		"path":       "file:///tmp/out",
+		"write_mode": "skip_identical",
+	})
+	require.Nil(err)
+	serializer := dc.(*DefaultCollector).Serializer.(*serialize.LocalSerializer)
+	require.Equal(serialize.WriteSkipIdentical, serializer.Mode)
+
+	_, err = NewDefaultCollector(map[string]interface{}{
+		"path":       "file:///tmp/out",
+		"write_mode": "sometimes",
+	})
+	require.NotNil(err)
+
+	_, err = NewDefaultCollector(map[string]interface{}{
+		"path":       "file:///tmp/out",
+		"write_mode": true,
+	})
+	require.NotNil(err)
+}
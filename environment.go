@@ -1,5 +1,16 @@
 package phonelab
 
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/gurupras/go-easyfiles/easyhdfs"
+	"github.com/shaseley/phonelab-go/s3"
+)
+
 // The environment maintains state about what we know how to create/run
 type ParserGen func() Parser
 
@@ -7,6 +18,12 @@ type ProcessorGen interface {
 	GenerateProcessor(info *PipelineSourceInstance, kwargs map[string]interface{}) Processor
 }
 
+// ProcessorGens that take args can implement ProcessorArgsChecker so that bad
+// args are caught by the validate command instead of partway through a run.
+type ProcessorArgsChecker interface {
+	CheckArgs(kwargs map[string]interface{}) error
+}
+
 type ProcessorGenFunc func(info *PipelineSourceInstance, kwargs map[string]interface{}) Processor
 
 type ProcessorGenWrapper struct {
@@ -21,23 +38,40 @@ func (g *ProcessorGenWrapper) GenerateProcessor(info *PipelineSourceInstance,
 
 type DataCollectorGen func(kwargs map[string]interface{}) DataCollector
 
+// FileSystemGen makes the filesystem for a path with its scheme, e.g.
+// hdfs://namenode:9000/logs/*.gz. The filesystem is given paths as they are
+// written, scheme and all, and Glob returns them that way too (see
+// NewURLFileSystem).
+type FileSystemGen func(path string) (FileSystem, error)
+
+// FileSystemResolver finds the filesystem a path is on.
+type FileSystemResolver func(path string) (FileSystem, error)
+
 type Environment struct {
 	// Parsers we know about
 	Parsers        map[string]ParserGen
 	Processors     map[string]ProcessorGen
 	DataCollectors map[string]DataCollectorGen
 	Filters        map[string]StringFilter
+	// Filesystems by URL scheme
+	FileSystems map[string]FileSystemGen
+	// Extra Kernel-Trace subparsers by trace tag
+	TraceSubparsers map[string]ParserGen
 }
 
 func NewEnvironment() *Environment {
 	env := &Environment{
-		Parsers:        make(map[string]ParserGen),
-		Processors:     make(map[string]ProcessorGen),
-		DataCollectors: make(map[string]DataCollectorGen),
-		Filters:        make(map[string]StringFilter),
+		Parsers:         make(map[string]ParserGen),
+		Processors:      make(map[string]ProcessorGen),
+		DataCollectors:  make(map[string]DataCollectorGen),
+		Filters:         make(map[string]StringFilter),
+		FileSystems:     make(map[string]FileSystemGen),
+		TraceSubparsers: make(map[string]ParserGen),
 	}
 
 	env.RegisterKnownParsers()
+	env.RegisterKnownProcessors()
+	env.RegisterKnownFileSystems()
 
 	return env
 }
@@ -55,6 +89,9 @@ func (env *Environment) RegisterKnownParsers() {
 		func() Parser {
 			tparser := NewKernelTraceParser()
 			tparser.ErrOnUnknownTag = false
+			for tag, gen := range env.TraceSubparsers {
+				tparser.RegisterSubparser(tag, gen())
+			}
 			return tparser
 		})
 
@@ -65,9 +102,116 @@ func (env *Environment) RegisterKnownParsers() {
 		NewQoEActivityLifecycleParser)
 }
 
+// Add a generator for all of the built-in processors.
+func (env *Environment) RegisterKnownProcessors() {
+	env.Processors[PhonelabRawStitcherName] = &PhonelabRawStitcherGen{}
+	env.Processors[WindowProcessorName] = &WindowProcessorGen{}
+}
+
 // Add a parser generator for a given log tag.
 // By default, all known parsers are registered when the environment is created.
 // Client code can register any custom parsers
 func (env *Environment) RegisterParserGenerator(tag string, gen ParserGen) {
 	env.Parsers[tag] = gen
 }
+
+// Add a parser for the payload of the traces with the given tag to the
+// Kernel-Trace parser, e.g. from a plugin's InitEnv. It replaces the built-in
+// subparser for the tag, if there is one. See
+// KernelTraceParser.RegisterSubparser.
+func (env *Environment) RegisterTraceSubparser(tag string, gen ParserGen) {
+	env.TraceSubparsers[tag] = gen
+}
+
+// Add the built-in filesystems: file://, hdfs:// and s3://.
+func (env *Environment) RegisterKnownFileSystems() {
+	env.RegisterFileSystem("file", func(path string) (FileSystem, error) {
+		return NewURLFileSystem(easyfiles.LocalFS, "file://"), nil
+	})
+
+	env.RegisterFileSystem("hdfs", func(path string) (FileSystem, error) {
+		_, rest := splitScheme(path)
+		addr := rest
+		if idx := strings.Index(rest, "/"); idx != -1 {
+			addr = rest[:idx]
+		}
+		if len(addr) == 0 {
+			return nil, fmt.Errorf("Missing HDFS address in path '%v'", path)
+		}
+		return NewURLFileSystem(easyhdfs.NewHDFSFileSystem(addr), "hdfs://"+addr), nil
+	})
+
+	env.RegisterFileSystem("s3", func(path string) (FileSystem, error) {
+		client, err := s3.DefaultClient()
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	})
+}
+
+// Add a filesystem for paths starting with scheme://. Client code can
+// register its own, or replace the built-in ones.
+func (env *Environment) RegisterFileSystem(scheme string, gen FileSystemGen) {
+	env.FileSystems[scheme] = gen
+}
+
+// Find the filesystem a path is on. Paths without a scheme are on the HDFS
+// at hdfsAddr if it is set, and local otherwise.
+func (env *Environment) ResolveFileSystem(path string, hdfsAddr string) (FileSystem, error) {
+	scheme, _ := splitScheme(path)
+	if len(scheme) == 0 {
+		if len(hdfsAddr) == 0 {
+			return easyfiles.LocalFS, nil
+		}
+		return easyhdfs.NewHDFSFileSystem(hdfsAddr), nil
+	}
+
+	scheme = strings.TrimSuffix(scheme, "://")
+	gen, ok := env.FileSystems[scheme]
+	if !ok {
+		names := envNames(env.FileSystems)
+		if suggestion := suggestName(scheme, names); len(suggestion) > 0 {
+			return nil, fmt.Errorf("Unknown filesystem '%v' in path '%v'. Did you mean '%v'?", scheme, path, suggestion)
+		}
+		return nil, fmt.Errorf("Unknown filesystem '%v' in path '%v'. Expected one of: %v",
+			scheme, path, strings.Join(names, ", "))
+	}
+	return gen(path)
+}
+
+func (env *Environment) fileSystemResolver(hdfsAddr string) FileSystemResolver {
+	return func(path string) (FileSystem, error) {
+		return env.ResolveFileSystem(path, hdfsAddr)
+	}
+}
+
+type environmentKey struct{}
+
+// The Runner passes its Environment on to the sources through the context.
+func withEnvironment(ctx context.Context, env *Environment) context.Context {
+	return context.WithValue(ctx, environmentKey{}, env)
+}
+
+var (
+	builtinEnv     *Environment
+	builtinEnvOnce sync.Once
+)
+
+// A shared Environment with nothing but the built-ins, for when there isn't
+// one to hand. It must not be changed.
+func builtinEnvironment() *Environment {
+	builtinEnvOnce.Do(func() {
+		builtinEnv = NewEnvironment()
+	})
+	return builtinEnv
+}
+
+// For sources that weren't given a FileSystemResolver: the filesystems of the
+// run's Environment, or the built-in ones if there isn't one.
+func defaultFileSystemResolver(ctx context.Context, hdfsAddr string) FileSystemResolver {
+	if env, ok := ctx.Value(environmentKey{}).(*Environment); ok && env != nil {
+		return env.fileSystemResolver(hdfsAddr)
+	}
+	return builtinEnvironment().fileSystemResolver(hdfsAddr)
+}
@@ -0,0 +1,154 @@
+package phonelab
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorPolicy decides what happens to a run when a source hits an error, e.g.
+// a corrupt gzip file or a missing info.json.
+type ErrorPolicy string
+
+const (
+	// Stop the whole run on the first error. This is the default.
+	ErrorPolicyFailFast ErrorPolicy = "fail_fast"
+	// Give up on the source that hit the error, but keep running the others.
+	// Whatever the source already sent stays out of the results, as far as
+	// the DataCollector can manage (see FailedSourceCollector).
+	ErrorPolicySkipSource ErrorPolicy = "skip_source"
+	// Skip the rest of the file that hit the error and move on to the next
+	// file from the same source.
+	ErrorPolicySkipFile ErrorPolicy = "skip_file"
+)
+
+const DEFAULT_ERROR_POLICY = ErrorPolicyFailFast
+
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch ErrorPolicy(s) {
+	case "":
+		return DEFAULT_ERROR_POLICY, nil
+	case ErrorPolicyFailFast, ErrorPolicySkipSource, ErrorPolicySkipFile:
+		return ErrorPolicy(s), nil
+	}
+	return "", fmt.Errorf("Invalid error policy '%v'. Expected one of: %v, %v, %v",
+		s, ErrorPolicyFailFast, ErrorPolicySkipSource, ErrorPolicySkipFile)
+}
+
+// SourceError is an error from a source or pipeline, along with where it
+// happened. Info, File and Line are filled in when they are known.
+type SourceError struct {
+	// The source the error came from, e.g. a *PhonelabSourceInfo which has
+	// the device and boot ID.
+	Info PipelineSourceInfo
+	// The file being read, if any
+	File string
+	// 1-based line number in File, if any
+	Line int
+	Err  error
+}
+
+func (e *SourceError) Error() string {
+	where := make([]string, 0)
+	if e.Info != nil {
+		where = append(where, fmt.Sprintf("%v %v", e.Info.Type(), e.Info.Context()))
+	}
+	if len(e.File) > 0 {
+		if e.Line > 0 {
+			where = append(where, fmt.Sprintf("%v:%v", e.File, e.Line))
+		} else {
+			where = append(where, e.File)
+		}
+	}
+
+	if len(where) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %v", strings.Join(where, ": "), e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// Collects the errors for a Runner, and cancels the run if the policy says so.
+type errorReporter struct {
+	policy ErrorPolicy
+	cancel context.CancelFunc
+	errs   []error
+	// Sources that had errors, by journalKey
+	failed map[string]bool
+	// Whether failed has anything in it, to check without the lock
+	anyFailed int32
+	sync.Mutex
+}
+
+func (r *errorReporter) report(err error) {
+	r.Lock()
+	r.errs = append(r.errs, err)
+	if srcErr, ok := err.(*SourceError); ok && srcErr.Info != nil {
+		r.failed[journalKey(srcErr.Info.Type(), srcErr.Info.Context())] = true
+		atomic.StoreInt32(&r.anyFailed, 1)
+	}
+	r.Unlock()
+
+	if r.policy == ErrorPolicyFailFast {
+		r.cancel()
+	}
+}
+
+// Whether the source had any errors
+func (r *errorReporter) sourceFailed(info PipelineSourceInfo) bool {
+	if atomic.LoadInt32(&r.anyFailed) == 0 {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.failed[journalKey(info.Type(), info.Context())]
+}
+
+func (r *errorReporter) errors() []error {
+	r.Lock()
+	defer r.Unlock()
+	return append([]error{}, r.errs...)
+}
+
+type errorReporterKey struct{}
+
+func withErrorReporter(ctx context.Context, r *errorReporter) context.Context {
+	return context.WithValue(ctx, errorReporterKey{}, r)
+}
+
+// Whether a Runner is listening for source errors under ctx
+func hasErrorReporter(ctx context.Context) bool {
+	_, ok := ctx.Value(errorReporterKey{}).(*errorReporter)
+	return ok
+}
+
+// Report an error from a source and return the policy the source should
+// follow. An ErrHandler set on the source is told first. If the source is
+// running under a Runner, the error goes to the Runner too, and the Runner's
+// policy applies. Otherwise the policy is ErrorPolicyFailFast, and if there's
+// no ErrHandler either, the error is logged, as there's nobody to tell.
+//
+// The source should stop after the error unless the policy is
+// ErrorPolicySkipFile, in which case it should move on to its next file.
+func reportSourceError(ctx context.Context, errHandler ErrHandler, err *SourceError) ErrorPolicy {
+	if errHandler != nil {
+		errHandler(err)
+	}
+
+	if r, ok := ctx.Value(errorReporterKey{}).(*errorReporter); ok {
+		r.report(err)
+		return r.policy
+	}
+
+	if errHandler == nil {
+		log.Errorf("Source error: %v", err)
+	}
+	return ErrorPolicyFailFast
+}
@@ -0,0 +1,351 @@
+package phonelab
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorPolicy(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	for _, s := range []string{"fail_fast", "skip_source", "skip_file"} {
+		policy, err := ParseErrorPolicy(s)
+		assert.Nil(err)
+		assert.Equal(ErrorPolicy(s), policy)
+	}
+
+	policy, err := ParseErrorPolicy("")
+	assert.Nil(err)
+	assert.Equal(ErrorPolicyFailFast, policy)
+
+	_, err = ParseErrorPolicy("skip_everything")
+	assert.NotNil(err)
+}
+
+func TestSourceError(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	cause := errors.New("unexpected EOF")
+	info := &PhonelabSourceInfo{
+		DeviceId: "device",
+		BootId:   "boot",
+	}
+
+	err := &SourceError{
+		Info: info,
+		File: "/data/device/boot/3.gz",
+		Line: 1234,
+		Err:  cause,
+	}
+	assert.Equal("phonelab-device device_boot: /data/device/boot/3.gz:1234: unexpected EOF", err.Error())
+	assert.True(errors.Is(err, cause))
+
+	err = &SourceError{
+		Info: &PhonelabSourceInfo{DeviceId: "device"},
+		File: "/data/device/info.json",
+		Err:  cause,
+	}
+	assert.Equal("phonelab-device device: /data/device/info.json: unexpected EOF", err.Error())
+
+	err = &SourceError{Err: cause}
+	assert.Equal("unexpected EOF", err.Error())
+}
+
+// Write n numbered lines to a gzip file. If corrupt is set, the file is cut
+// off partway through.
+func writeErrorTestFile(file string, n int, corrupt bool) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(gz, "line %v\n", i)
+	}
+	gz.Close()
+
+	b := buf.Bytes()
+	if corrupt {
+		b = b[:len(b)/2]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+func runWithPolicy(t *testing.T, gen PipelineSourceGenerator, policy ErrorPolicy) ([]error, *partialCollector) {
+	collector := &partialCollector{}
+	runner := NewRunner(gen, collector, collector)
+	runner.ErrorPolicy = policy
+	return runContextOrFail(t, context.Background(), runner), collector
+}
+
+func TestTextFileErrorPolicy(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-errors")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	const lines = 10000
+
+	good := []string{
+		filepath.Join(tmpDir, "good1.gz"),
+		filepath.Join(tmpDir, "good2.gz"),
+	}
+	for _, file := range good {
+		require.Nil(t, writeErrorTestFile(file, lines, false))
+	}
+	corrupt := filepath.Join(tmpDir, "corrupt.gz")
+	require.Nil(t, writeErrorTestFile(corrupt, lines, true))
+	missing := filepath.Join(tmpDir, "missing.gz")
+
+	files := []string{good[0], corrupt, missing, good[1]}
+
+	t.Run("skip_source", func(t *testing.T) {
+		assert := assert.New(t)
+
+		errs, collector := runWithPolicy(t, NewTextFileSourceGenerator(files, nil), ErrorPolicySkipSource)
+
+		require.Equal(t, 2, len(errs))
+		errFiles := make(map[string]*SourceError)
+		for _, err := range errs {
+			srcErr, ok := err.(*SourceError)
+			require.True(t, ok)
+			errFiles[srcErr.File] = srcErr
+		}
+		require.Contains(t, errFiles, corrupt)
+		require.Contains(t, errFiles, missing)
+
+		assert.True(errFiles[corrupt].Line > 0)
+		assert.Equal(0, errFiles[missing].Line)
+		assert.Equal(corrupt, errFiles[corrupt].Info.Context())
+
+		// Both good files made it, plus whatever we got out of the corrupt one.
+		assert.True(collector.count >= 2*lines)
+		assert.True(collector.count < 3*lines)
+		assert.True(collector.finished)
+	})
+
+	t.Run("fail_fast", func(t *testing.T) {
+		assert := assert.New(t)
+
+		errs, collector := runWithPolicy(t, NewTextFileSourceGenerator(files, nil), ErrorPolicyFailFast)
+
+		require.True(t, len(errs) > 0)
+		_, ok := errs[0].(*SourceError)
+		assert.True(ok)
+		assert.False(collector.finished)
+		assert.Equal(errs[0], collector.partialErr)
+	})
+}
+
+func TestSkipSourceDropsPartialData(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-errors")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	good := filepath.Join(tmpDir, "good.gz")
+	corrupt := filepath.Join(tmpDir, "corrupt.gz")
+	require.Nil(writeErrorTestFile(good, 1000, false))
+	require.Nil(writeErrorTestFile(corrupt, 10000, true))
+
+	dc, err := NewDefaultCollector(map[string]interface{}{
+		"path":      "file://" + filepath.Join(tmpDir, "out"),
+		"aggregate": true,
+	})
+	require.Nil(err)
+	collector := dc.(*DefaultCollector)
+
+	runner := NewRunner(NewTextFileSourceGenerator([]string{corrupt, good}, nil), collector, &partialCollector{})
+	runner.ErrorPolicy = ErrorPolicySkipSource
+	errs := runner.Run()
+	require.Equal(1, len(errs))
+
+	// Only the good file is in the aggregate, which is named after it
+	assert.Equal([]string{good}, collector.sourceOrder)
+	assert.Equal(1000, len(collector.sourceData[good]))
+	assert.Equal(map[string]bool{good: true}, collector.aggregateContexts)
+}
+
+// Build a processed device with a single boot ID. The second chunk is corrupt.
+func makeErrorTestDevice(basePath, device, bootId string, lines int) error {
+	info := NewStitchInfo()
+	info.BootInfo[bootId] = make(map[string]*StitchFileInfo)
+
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("%v.gz", i)
+		file := filepath.Join(basePath, device, bootId, name)
+		if err := writeErrorTestFile(file, lines, i == 2); err != nil {
+			return err
+		}
+		info.BootInfo[bootId][name] = &StitchFileInfo{}
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(basePath, device, "info.json"), b, 0644)
+}
+
+func TestPhonelabSourceErrorPolicy(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-errors")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	const lines = 10000
+	const bootId = "43424168-e44e-473a-bf12-dba8a4a4453a"
+
+	require.Nil(t, makeErrorTestDevice(tmpDir, "device1", bootId, lines))
+	require.Nil(t, os.MkdirAll(filepath.Join(tmpDir, "device2"), 0755))
+
+	devicePaths := map[string][]string{
+		"device1": []string{tmpDir},
+		// No info.json
+		"device2": []string{tmpDir},
+	}
+
+	check := func(t *testing.T, errs []error) *SourceError {
+		require.Equal(t, 2, len(errs))
+
+		var chunkErr *SourceError
+		for _, err := range errs {
+			srcErr := err.(*SourceError)
+			info := srcErr.Info.(*PhonelabSourceInfo)
+			if info.DeviceId == "device1" {
+				chunkErr = srcErr
+			} else {
+				assert.Equal(t, "device2", info.DeviceId)
+				assert.Equal(t, filepath.Join(tmpDir, "device2", "info.json"), srcErr.File)
+			}
+		}
+		require.NotNil(t, chunkErr)
+		assert.Equal(t, bootId, chunkErr.Info.(*PhonelabSourceInfo).BootId)
+		assert.Equal(t, filepath.Join(tmpDir, "device1", bootId, "2.gz"), chunkErr.File)
+		assert.True(t, chunkErr.Line > 0)
+		return chunkErr
+	}
+
+	t.Run("skip_source", func(t *testing.T) {
+		errs, collector := runWithPolicy(t, NewPhonelabSourceGenerator(devicePaths, nil, nil),
+			ErrorPolicySkipSource)
+		check(t, errs)
+
+		// We stopped at the bad chunk
+		assert.True(t, collector.count >= lines)
+		assert.True(t, collector.count < 2*lines)
+		assert.True(t, collector.finished)
+	})
+
+	t.Run("skip_file", func(t *testing.T) {
+		errs, collector := runWithPolicy(t, NewPhonelabSourceGenerator(devicePaths, nil, nil),
+			ErrorPolicySkipFile)
+		check(t, errs)
+
+		// We kept going after the bad chunk
+		assert.True(t, collector.count >= 2*lines)
+		assert.True(t, collector.count < 3*lines)
+		assert.True(t, collector.finished)
+	})
+
+	t.Run("skip_file with an ErrHandler", func(t *testing.T) {
+		// The handler hears about the errors, and the Runner's policy still
+		// applies
+		var handled []error
+		var l sync.Mutex
+		errHandler := func(err error) {
+			l.Lock()
+			handled = append(handled, err)
+			l.Unlock()
+		}
+		errs, collector := runWithPolicy(t, NewPhonelabSourceGenerator(devicePaths, nil, errHandler),
+			ErrorPolicySkipFile)
+		check(t, errs)
+		l.Lock()
+		assert.Equal(t, 2, len(handled))
+		l.Unlock()
+
+		assert.True(t, collector.count >= 2*lines)
+		assert.True(t, collector.finished)
+	})
+}
+
+func TestSourceErrorWithoutRunner(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-errors")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	missing := filepath.Join(tmpDir, "missing.gz")
+
+	// With nobody to tell, the error is logged rather than a panic
+	count := 0
+	for range NewTextFileProcessor(missing, nil, nil).Process() {
+		count += 1
+	}
+	assert.Equal(0, count)
+
+	handled := 0
+	for range NewTextFileProcessor(missing, nil, func(err error) { handled += 1 }).Process() {
+		count += 1
+	}
+	assert.Equal(0, count)
+	assert.Equal(1, handled)
+}
+
+func TestPhonelabSourceBadDateRange(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	gen := NewPhonelabSourceGenerator(map[string][]string{"device": []string{"/nonexistent"}},
+		map[string]interface{}{"daterange": "not a date range"}, nil)
+
+	errs, collector := runWithPolicy(t, gen, ErrorPolicySkipSource)
+	require.Equal(t, 1, len(errs))
+	assert.Contains(errs[0].Error(), "daterange")
+	assert.Equal(0, collector.count)
+}
+
+func TestErrorPolicyConf(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	conf := &PipelineSourceConf{
+		Type:        PipelineSourceFile,
+		Sources:     []string{"./test/test.log"},
+		ErrorPolicy: "skip_everything",
+	}
+	_, err := conf.ToPipelineSourceGenerator()
+	assert.NotNil(err)
+
+	conf.ErrorPolicy = "skip_file"
+	_, err = conf.ToPipelineSourceGenerator()
+	assert.Nil(err)
+}
@@ -1,18 +1,19 @@
 package phonelab
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"strings"
-
-	"github.com/gurupras/go-easyfiles"
 )
 
 type TextFileProcessor struct {
 	Filename string
 	ErrHandler
 	MaxConcurrency int
-	semChannel     chan int
+	// Finds the filesystem the file is on. nil for the Environment's
+	// defaults.
+	Resolve    FileSystemResolver
+	semChannel chan int
 }
 
 type TextFileSourceInfo struct {
@@ -37,57 +38,71 @@ func NewTextFileProcessor(file string, semChannel chan int, errHandler ErrHandle
 	}
 }
 
-func (p *TextFileProcessor) processFile(outChan chan interface{}) {
+func (p *TextFileProcessor) processFile(ctx context.Context, outChan chan interface{}) {
 	if p.semChannel != nil {
-		p.semChannel <- 1
+		select {
+		case p.semChannel <- 1:
+		case <-ctx.Done():
+			return
+		}
 		defer func() {
 			<-p.semChannel
 		}()
 	}
 
-	gz := easyfiles.GZ_FALSE
-	if strings.HasSuffix(p.Filename, ".gz") || strings.HasSuffix(p.Filename, ".tgz") {
-		gz = easyfiles.GZ_TRUE
+	gz := strings.HasSuffix(p.Filename, ".gz") || strings.HasSuffix(p.Filename, ".tgz")
+
+	// It's a single file, so there's nothing to skip to.
+	onError := func(err error, line int) {
+		reportSourceError(ctx, p.ErrHandler, &SourceError{
+			Info: &TextFileSourceInfo{p.Filename},
+			File: p.Filename,
+			Line: line,
+			Err:  err,
+		})
 	}
 
-	file, err := easyfiles.LocalFS.Open(p.Filename, os.O_RDONLY, gz)
+	resolve := p.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(ctx, "")
+	}
+	fs, err := resolve(p.Filename)
 	if err != nil {
-		if p.ErrHandler != nil {
-			p.ErrHandler(err)
-		} else {
-			panic(fmt.Sprintf("Error opening file: %v", err))
-		}
+		onError(fmt.Errorf("Error opening file: %v", err), 0)
+		return
 	}
-	defer file.Close()
-
-	scanner, err := file.Reader(0)
+	scanner, closer, err := openSourceScanner(fs, p.Filename, gz)
 	if err != nil {
-		if p.ErrHandler != nil {
-			p.ErrHandler(err)
-		} else {
-			panic(fmt.Sprintf("Failed to get scanner to '%v': %v", p.Filename, err))
-		}
+		onError(fmt.Errorf("Error opening file: %v", err), 0)
+		return
 	}
+	defer closer.Close()
 
+	metrics := nodeMetrics(ctx, "TextFileProcessor")
+	lineNum := 0
 	for scanner.Scan() {
+		lineNum += 1
+		metrics.itemIn()
 		line := scanner.Text()
-		outChan <- line
+		if !metrics.send(ctx, outChan, line) {
+			return
+		}
 	}
 
 	if err = scanner.Err(); err != nil {
-		if p.ErrHandler != nil {
-			p.ErrHandler(err)
-		} else {
-			panic(fmt.Sprintf("Error scanning file: %v", err))
-		}
+		onError(fmt.Errorf("Error scanning file: %v", err), lineNum+1)
 	}
 }
 
 func (p *TextFileProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *TextFileProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
 	outChan := make(chan interface{})
 
 	go func() {
-		p.processFile(outChan)
+		p.processFile(ctx, outChan)
 		close(outChan)
 	}()
 
@@ -99,6 +114,9 @@ type TextFileSourceGenerator struct {
 	Files          []string
 	ErrHandler     ErrHandler
 	MaxConcurrency int
+	// Finds the filesystem each file is on. nil for the Environment's
+	// defaults.
+	Resolve FileSystemResolver
 }
 
 func NewTextFileSourceGenerator(files []string, errFunc ErrHandler) *TextFileSourceGenerator {
@@ -110,6 +128,10 @@ func NewTextFileSourceGenerator(files []string, errFunc ErrHandler) *TextFileSou
 }
 
 func (tf *TextFileSourceGenerator) Process() <-chan *PipelineSourceInstance {
+	return tf.ProcessContext(context.Background())
+}
+
+func (tf *TextFileSourceGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
 	sourceChan := make(chan *PipelineSourceInstance)
 
 	var semChannel chan int = nil
@@ -124,10 +146,15 @@ func (tf *TextFileSourceGenerator) Process() <-chan *PipelineSourceInstance {
 				Filename: file,
 			}
 
-			sourceChan <- &PipelineSourceInstance{
-				Processor: NewTextFileProcessor(file, semChannel, tf.ErrHandler),
+			processor := NewTextFileProcessor(file, semChannel, tf.ErrHandler)
+			processor.Resolve = tf.Resolve
+			source := &PipelineSourceInstance{
+				Processor: processor,
 				Info:      info,
 			}
+			if !sendSourceContext(ctx, sourceChan, source) {
+				break
+			}
 		}
 		close(sourceChan)
 	}()
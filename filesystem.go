@@ -0,0 +1,196 @@
+package phonelab
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gurupras/go-easyfiles"
+)
+
+// FileSystem is what sources need to find and read their files. Any
+// easyfiles.FileSystemInterface is one, and so is s3.Client.
+// Filesystems for other kinds of paths can be added to the Environment (see
+// RegisterFileSystem).
+type FileSystem interface {
+	Glob(pattern string) ([]string, error)
+	ReadFile(path string) ([]byte, error)
+	Exists(path string) (bool, error)
+}
+
+// ReaderFileSystem is a FileSystem that opens files itself. Sources need
+// every FileSystem that isn't an easyfiles.FileSystemInterface to be one.
+type ReaderFileSystem interface {
+	FileSystem
+	// Open a file for reading. Nothing is decompressed.
+	OpenReader(path string) (io.ReadCloser, error)
+}
+
+// A filesystem that takes plain paths, used with URLs that start with
+// prefix, e.g. an HDFS filesystem for hdfs://namenode:9000 URLs.
+type urlFileSystem struct {
+	fs     FileSystem
+	prefix string
+}
+
+// Wrap a filesystem that works with plain paths so that it can be given
+// URLs starting with prefix, which is taken off on the way in and put back on
+// the paths that Glob returns.
+func NewURLFileSystem(fs FileSystem, prefix string) FileSystem {
+	return &urlFileSystem{fs, prefix}
+}
+
+func (u *urlFileSystem) strip(p string) string {
+	return strings.TrimPrefix(p, u.prefix)
+}
+
+func (u *urlFileSystem) Glob(pattern string) ([]string, error) {
+	matches, err := u.fs.Glob(u.strip(pattern))
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, len(matches))
+	for i, match := range matches {
+		urls[i] = u.prefix + match
+	}
+	return urls, nil
+}
+
+func (u *urlFileSystem) ReadFile(p string) ([]byte, error) {
+	return u.fs.ReadFile(u.strip(p))
+}
+
+func (u *urlFileSystem) Exists(p string) (bool, error) {
+	return u.fs.Exists(u.strip(p))
+}
+
+func (u *urlFileSystem) OpenReader(p string) (io.ReadCloser, error) {
+	return openSourceReader(u.fs, u.strip(p))
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Lines can be long, e.g. for big trace events.
+const maxSourceLineLength = 1024 * 1024
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+// Open a file for reading as is, whatever filesystem it's on.
+func openSourceReader(fs FileSystem, p string) (io.ReadCloser, error) {
+	if opener, ok := fs.(ReaderFileSystem); ok {
+		return opener.OpenReader(p)
+	}
+
+	efs, ok := fs.(easyfiles.FileSystemInterface)
+	if !ok {
+		return nil, fmt.Errorf("Can't open files on %T", fs)
+	}
+	file, err := efs.Open(p, os.O_RDONLY, easyfiles.GZ_FALSE)
+	if err != nil {
+		return nil, err
+	}
+	closer := closerFunc(func() { file.Close() })
+	reader, err := file.RawReader()
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	return &readCloser{reader, closer}, nil
+}
+
+// A scanner for the lines of r
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSourceLineLength)
+	return scanner
+}
+
+// Open a file for scanning line by line, gunzipping it as it is read if gz is
+// set. The Closer closes the file.
+func openSourceScanner(fs FileSystem, p string, gz bool) (*bufio.Scanner, io.Closer, error) {
+	if opener, ok := fs.(ReaderFileSystem); ok {
+		r, err := opener.OpenReader(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		var reader io.Reader = r
+		if gz {
+			gzr, err := gzip.NewReader(r)
+			if err != nil {
+				r.Close()
+				return nil, nil, err
+			}
+			reader = gzr
+		}
+		return newLineScanner(reader), r, nil
+	}
+
+	efs, ok := fs.(easyfiles.FileSystemInterface)
+	if !ok {
+		return nil, nil, fmt.Errorf("Can't open files on %T", fs)
+	}
+
+	fileType := easyfiles.GZ_FALSE
+	if gz {
+		fileType = easyfiles.GZ_TRUE
+	}
+	file, err := efs.Open(p, os.O_RDONLY, fileType)
+	if err != nil {
+		return nil, nil, err
+	}
+	closer := closerFunc(func() { file.Close() })
+
+	scanner, err := file.Reader(0)
+	if err != nil {
+		closer.Close()
+		return nil, nil, fmt.Errorf("Failed to get scanner: %v", err)
+	}
+	return scanner, closer, nil
+}
+
+// Paths can be URLs like s3://bucket/key, which filepath would mangle.
+func splitScheme(p string) (string, string) {
+	if idx := strings.Index(p, "://"); idx != -1 {
+		return p[:idx+3], p[idx+3:]
+	}
+	return "", p
+}
+
+// filepath.Join, for URLs too
+func joinSourcePath(base string, elem ...string) string {
+	scheme, rest := splitScheme(base)
+	if len(scheme) == 0 {
+		return filepath.Join(append([]string{base}, elem...)...)
+	}
+	return scheme + path.Join(append([]string{rest}, elem...)...)
+}
+
+// filepath.Dir, for URLs too
+func sourcePathDir(p string) string {
+	scheme, rest := splitScheme(p)
+	if len(scheme) == 0 {
+		return filepath.Dir(p)
+	}
+	return scheme + path.Dir(rest)
+}
+
+// The absolute directory of a file. URLs are already absolute.
+func sourcePathParent(p string) (string, error) {
+	if scheme, _ := splitScheme(p); len(scheme) > 0 {
+		return sourcePathDir(p), nil
+	}
+	return filepath.Abs(filepath.Dir(p))
+}
@@ -0,0 +1,235 @@
+package phonelab
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/shaseley/phonelab-go/serialize/s3test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Count the lines from each source, by context
+func countSourceLines(t *testing.T, gen PipelineSourceGenerator) map[string]int {
+	counts := make(map[string]int)
+	for source := range gen.Process() {
+		for line := range source.Processor.Process() {
+			require.True(t, len(line.(string)) > 0)
+			counts[source.Info.Context()] += 1
+		}
+	}
+	return counts
+}
+
+func TestS3Sources(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server, err := s3test.NewServer("bucket")
+	require.Nil(err)
+	defer server.Close()
+
+	require.Nil(server.PutFile("s3://bucket/logs/test.log.gz", "test/test.log.gz"))
+	require.Nil(server.PutFile("s3://bucket/logs/test.log", "test/test.log"))
+	require.Nil(server.PutDir("s3://bucket/phonelab_source", "test/phonelab_source"))
+
+	errHandler := func(err error) {
+		t.Error(err)
+	}
+
+	// files
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceFile,
+		Sources: []string{"s3://bucket/logs/*"},
+	}
+	files, err := conf.Expand()
+	require.Nil(err)
+	assert.Equal([]string{"s3://bucket/logs/test.log", "s3://bucket/logs/test.log.gz"}, files)
+
+	gen := NewTextFileSourceGenerator(files, errHandler)
+	counts := countSourceLines(t, gen)
+	localCounts := countSourceLines(t, NewTextFileSourceGenerator([]string{"test/test.log"}, errHandler))
+	assert.Equal(localCounts["test/test.log"], counts["s3://bucket/logs/test.log"])
+	assert.Equal(localCounts["test/test.log"], counts["s3://bucket/logs/test.log.gz"])
+
+	// phonelab
+	conf = &PipelineSourceConf{
+		Type:    PipelineSourcePhonelab,
+		Sources: []string{"s3://bucket/phonelab_source/*/info.json"},
+	}
+	sourceGen, err := conf.ToPipelineSourceGenerator()
+	require.Nil(err)
+	counts = countSourceLines(t, sourceGen)
+	assert.Equal(4, len(counts))
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	assert.Equal(2*10000+2*20000, total)
+
+	// phonelab-raw writes next to its sources
+	conf = &PipelineSourceConf{
+		Type:    PipelineSourcePhonelabRaw,
+		Sources: []string{"s3://bucket/phonelab_source/*/time"},
+	}
+	_, err = conf.Expand()
+	assert.NotNil(err)
+}
+
+func TestS3Collector(t *testing.T) {
+	require := require.New(t)
+
+	server, err := s3test.NewServer("bucket")
+	require.Nil(err)
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-s3")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	collector, err := NewDefaultCollector(map[string]interface{}{
+		"path":       "s3://bucket/out",
+		"stream":     true,
+		"aggregate":  true,
+		"compressed": true,
+		"parts_dir":  tmpDir,
+	})
+	require.Nil(err)
+	dc := collector.(*DefaultCollector)
+
+	a := &TextFileSourceInfo{"a"}
+	dc.OnData(&lineMapEntry{Logline: 1}, a)
+	dc.OnData(&lineMapEntry{Logline: 2}, a)
+	dc.SourceDone(a)
+	dc.Finish()
+
+	r, err := server.Client.OpenReader("s3://bucket/out/a.ndjson.gz")
+	require.Nil(err)
+	defer r.Close()
+	gzr, err := gzip.NewReader(r)
+	require.Nil(err)
+	require.Equal([]*lineMapEntry{{Logline: 1}, {Logline: 2}}, decodeNDJSON(t, gzr))
+}
+
+// An in-memory filesystem for mem:// paths
+type memFileSystem map[string]string
+
+func (m memFileSystem) Glob(pattern string) ([]string, error) {
+	matches := make([]string, 0)
+	for name := range m {
+		if ok, err := path.Match(pattern, name); err != nil {
+			return nil, err
+		} else if ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (m memFileSystem) ReadFile(p string) ([]byte, error) {
+	if data, ok := m[p]; ok {
+		return []byte(data), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m memFileSystem) Exists(p string) (bool, error) {
+	_, ok := m[p]
+	return ok, nil
+}
+
+func (m memFileSystem) OpenReader(p string) (io.ReadCloser, error) {
+	if data, ok := m[p]; ok {
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestFileSystemRegistry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	env := NewEnvironment()
+	mem := memFileSystem{
+		"mem://logs/a.log":  "1\n2\n3\n",
+		"mem://logs/b.log":  "4\n5\n",
+		"mem://other/c.log": "6\n",
+	}
+	env.RegisterFileSystem("mem", func(p string) (FileSystem, error) {
+		return mem, nil
+	})
+
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceFile,
+		Sources: []string{"mem://logs/*.log"},
+	}
+	gen, err := conf.ToPipelineSourceGeneratorEnv(env)
+	require.Nil(err)
+	assert.Equal(map[string]int{"mem://logs/a.log": 3, "mem://logs/b.log": 2}, countSourceLines(t, gen))
+
+	// Sources without a resolver find it through the Runner's Environment
+	files := []string{"mem://logs/a.log", "mem://other/c.log"}
+	collector := newTestDataCollector()
+	runner := NewRunner(NewTextFileSourceGenerator(files, nil), collector, collector)
+	runner.Env = env
+	require.Equal(0, len(runner.Run()))
+	assert.ElementsMatch([]int{3, 1}, collector.results)
+
+	collector = newTestDataCollector()
+	runner = NewRunner(NewTextFileSourceGenerator(files, nil), collector, collector)
+	errs := runner.Run()
+	require.Equal(len(files), len(errs))
+	for _, err := range errs {
+		assert.Contains(err.Error(), "Unknown filesystem 'mem'")
+	}
+
+	// Without the registration, it's unknown
+	_, err = conf.Expand()
+	require.NotNil(err)
+	assert.Contains(err.Error(), "Unknown filesystem 'mem'")
+
+	conf.Sources = []string{"s4://bucket/*.log"}
+	_, err = conf.ExpandEnv(env)
+	require.NotNil(err)
+	assert.Contains(err.Error(), "Did you mean 's3'?")
+
+	// Built-in URLs
+	conf.Sources = []string{"file://test/test.lo*"}
+	files, err = conf.ExpandEnv(env)
+	require.Nil(err)
+	assert.Equal([]string{"file://test/test.log", "file://test/test.log.gz"}, files)
+	gen, err = conf.ToPipelineSourceGeneratorEnv(env)
+	require.Nil(err)
+	counts := countSourceLines(t, gen)
+	assert.Equal(2, len(counts))
+	assert.Equal(counts["file://test/test.log"], counts["file://test/test.log.gz"])
+
+	// Plain paths are local unless there's an hdfs_addr
+	fs, err := env.ResolveFileSystem("test/test.log", "")
+	require.Nil(err)
+	assert.Equal(easyfiles.LocalFS, fs)
+	fs, err = env.ResolveFileSystem("hdfs://namenode:9000/logs", "")
+	require.Nil(err)
+	assert.Equal("hdfs://namenode:9000", fs.(*urlFileSystem).prefix)
+}
+
+func TestSourcePaths(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("s3://bucket/a/b/c", joinSourcePath("s3://bucket/a", "b", "c"))
+	assert.Equal("test/a/b", joinSourcePath("test", "a", "b"))
+	assert.Equal("s3://bucket/a", sourcePathDir("s3://bucket/a/b.gz"))
+	assert.Equal("test", sourcePathDir("test/b.gz"))
+
+	parent, err := sourcePathParent("s3://bucket/a/b.gz")
+	assert.Nil(err)
+	assert.Equal("s3://bucket/a", parent)
+}
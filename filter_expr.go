@@ -0,0 +1,773 @@
+package phonelab
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Expression filters
+//
+// An expr filter is a boolean expression over the fields of a parsed Logline.
+// The syntax is a small subset of Go's:
+//
+//	tag == "Kernel-Trace" && payload.Cpu == 2 && tracetime > 100.5
+//
+// Top-level names are Logline fields (see loglineExprFields). payload refers
+// to the parsed payload, and payload.X to its field X, which is matched by Go
+// name, case-insensitively, or by its logcat struct tag. Fields of embedded
+// structs (e.g. Trace) can be used directly. Map payloads are indexed by key.
+//
+// The usual comparison (== != < <= > >=), logical (&& || !) and arithmetic
+// (+ - * / %) operators are supported, along with the functions contains(s,
+// substr), hasPrefix(s, prefix), hasSuffix(s, suffix) and matches(s, regex).
+//
+// Expressions are parsed and checked when they are compiled. Anything that can
+// be checked then is: syntax, names of Logline fields, functions, regexes, and
+// the types of Logline fields. Payload fields can only be checked against the
+// logs themselves; a log that doesn't have a field the expression needs (e.g.
+// because it has a different payload type) doesn't match.
+
+// A compiled expression
+type LoglineExpr struct {
+	src  string
+	eval exprFunc
+}
+
+// The static type of an expression, when it is known at compile time.
+type exprType int
+
+const (
+	exprUnknown exprType = iota
+	exprBool
+	exprNumber
+	exprString
+	exprNil
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprNumber:
+		return "number"
+	case exprString:
+		return "string"
+	case exprNil:
+		return "nil"
+	}
+	return "unknown"
+}
+
+// Evaluate an expression. Values are bool, int64, float64, string, nil, or,
+// for payload fields that aren't one of those, whatever the field holds.
+type exprFunc func(ll *Logline) (interface{}, error)
+
+type loglineExprField struct {
+	typ exprType
+	get func(ll *Logline) interface{}
+}
+
+// The Logline fields that can be used in expressions, by lower case name.
+var loglineExprFields = map[string]*loglineExprField{
+	"line":          {exprString, func(ll *Logline) interface{} { return ll.Line }},
+	"boot_id":       {exprString, func(ll *Logline) interface{} { return ll.BootId }},
+	"bootid":        {exprString, func(ll *Logline) interface{} { return ll.BootId }},
+	"datetime":      {exprNumber, func(ll *Logline) interface{} { return float64(ll.Datetime.UnixNano()) / 1e9 }},
+	"datetimenanos": {exprNumber, func(ll *Logline) interface{} { return ll.DatetimeNanos }},
+	"logcattoken":   {exprNumber, func(ll *Logline) interface{} { return ll.LogcatToken }},
+	"tracetime":     {exprNumber, func(ll *Logline) interface{} { return ll.TraceTime }},
+	"pid":           {exprNumber, func(ll *Logline) interface{} { return int64(ll.Pid) }},
+	"tid":           {exprNumber, func(ll *Logline) interface{} { return int64(ll.Tid) }},
+	"level":         {exprString, func(ll *Logline) interface{} { return ll.Level }},
+	"tag":           {exprString, func(ll *Logline) interface{} { return ll.Tag }},
+	"format":        {exprString, func(ll *Logline) interface{} { return string(ll.Format) }},
+	"payload":       {exprUnknown, func(ll *Logline) interface{} { return exprValue(reflect.ValueOf(ll.Payload)) }},
+}
+
+// The functions that can be used in expressions. All take two strings.
+var loglineExprFuncs = map[string]func(string, string) bool{
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	// matches is special-cased so the regex is compiled once.
+	"matches": nil,
+}
+
+// Compile an expression.
+func CompileLoglineExpr(src string) (*LoglineExpr, error) {
+	if len(strings.TrimSpace(src)) == 0 {
+		return nil, errors.New("Empty expression")
+	}
+
+	node, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("Syntax error: %v", err)
+	}
+
+	c := &exprCompiler{src: src}
+	eval, typ, err := c.compile(node)
+	if err != nil {
+		return nil, err
+	}
+	if typ != exprBool && typ != exprUnknown {
+		return nil, fmt.Errorf("Expression must be a bool, got %v", typ)
+	}
+
+	return &LoglineExpr{
+		src:  src,
+		eval: eval,
+	}, nil
+}
+
+func (e *LoglineExpr) String() string {
+	return e.src
+}
+
+// Whether the logline matches the expression
+func (e *LoglineExpr) Match(ll *Logline) bool {
+	if ll == nil {
+		return false
+	}
+	res, err := e.eval(ll)
+	if err != nil {
+		return false
+	}
+	b, ok := res.(bool)
+	return ok && b
+}
+
+type exprCompiler struct {
+	src string
+}
+
+// Errors include the column the problem is at, since ParseExpr's positions
+// are offsets (+1) into src.
+func (c *exprCompiler) errorf(node ast.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("column %v: %v", int(node.Pos()), fmt.Sprintf(format, args...))
+}
+
+func (c *exprCompiler) compile(node ast.Expr) (exprFunc, exprType, error) {
+	switch n := node.(type) {
+	case *ast.ParenExpr:
+		return c.compile(n.X)
+	case *ast.BasicLit:
+		return c.compileLiteral(n)
+	case *ast.Ident:
+		return c.compileIdent(n)
+	case *ast.SelectorExpr:
+		return c.compileSelector(n)
+	case *ast.UnaryExpr:
+		return c.compileUnary(n)
+	case *ast.BinaryExpr:
+		return c.compileBinary(n)
+	case *ast.CallExpr:
+		return c.compileCall(n)
+	}
+	return nil, exprUnknown, c.errorf(node, "Unsupported expression: %v", c.src[node.Pos()-1:node.End()-1])
+}
+
+func constant(v interface{}) exprFunc {
+	return func(ll *Logline) (interface{}, error) {
+		return v, nil
+	}
+}
+
+func (c *exprCompiler) compileLiteral(n *ast.BasicLit) (exprFunc, exprType, error) {
+	switch n.Kind {
+	case token.INT:
+		if v, err := strconv.ParseInt(n.Value, 0, 64); err != nil {
+			return nil, exprUnknown, c.errorf(n, "Bad integer %v: %v", n.Value, err)
+		} else {
+			return constant(v), exprNumber, nil
+		}
+	case token.FLOAT:
+		if v, err := strconv.ParseFloat(n.Value, 64); err != nil {
+			return nil, exprUnknown, c.errorf(n, "Bad number %v: %v", n.Value, err)
+		} else {
+			return constant(v), exprNumber, nil
+		}
+	case token.STRING:
+		if v, err := strconv.Unquote(n.Value); err != nil {
+			return nil, exprUnknown, c.errorf(n, "Bad string %v: %v", n.Value, err)
+		} else {
+			return constant(v), exprString, nil
+		}
+	}
+	return nil, exprUnknown, c.errorf(n, "Unsupported literal: %v", n.Value)
+}
+
+func (c *exprCompiler) compileIdent(n *ast.Ident) (exprFunc, exprType, error) {
+	switch n.Name {
+	case "true":
+		return constant(true), exprBool, nil
+	case "false":
+		return constant(false), exprBool, nil
+	case "nil":
+		return constant(nil), exprNil, nil
+	}
+
+	field, ok := loglineExprFields[strings.ToLower(n.Name)]
+	if !ok {
+		names := make([]string, 0, len(loglineExprFields))
+		for name := range loglineExprFields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if suggestion := suggestName(n.Name, names); len(suggestion) > 0 {
+			return nil, exprUnknown, c.errorf(n, "Unknown field '%v'. Did you mean '%v'?",
+				n.Name, suggestion)
+		}
+		return nil, exprUnknown, c.errorf(n, "Unknown field '%v'. Expected one of: %v",
+			n.Name, strings.Join(names, ", "))
+	}
+
+	return func(ll *Logline) (interface{}, error) {
+		return field.get(ll), nil
+	}, field.typ, nil
+}
+
+func (c *exprCompiler) compileSelector(n *ast.SelectorExpr) (exprFunc, exprType, error) {
+	x, typ, err := c.compile(n.X)
+	if err != nil {
+		return nil, exprUnknown, err
+	}
+	if typ != exprUnknown {
+		return nil, exprUnknown, c.errorf(n, "Cannot get field '%v' of a %v", n.Sel.Name, typ)
+	}
+
+	name := n.Sel.Name
+	return func(ll *Logline) (interface{}, error) {
+		obj, err := x(ll)
+		if err != nil {
+			return nil, err
+		}
+		return selectExprField(obj, name)
+	}, exprUnknown, nil
+}
+
+func (c *exprCompiler) compileUnary(n *ast.UnaryExpr) (exprFunc, exprType, error) {
+	x, typ, err := c.compile(n.X)
+	if err != nil {
+		return nil, exprUnknown, err
+	}
+
+	switch n.Op {
+	case token.NOT:
+		if typ != exprBool && typ != exprUnknown {
+			return nil, exprUnknown, c.errorf(n, "Operator ! needs a bool, got %v", typ)
+		}
+		return func(ll *Logline) (interface{}, error) {
+			v, err := x(ll)
+			if err != nil {
+				return nil, err
+			}
+			if b, ok := v.(bool); ok {
+				return !b, nil
+			}
+			return nil, fmt.Errorf("Operator ! needs a bool, got %T", v)
+		}, exprBool, nil
+	case token.SUB, token.ADD:
+		if typ != exprNumber && typ != exprUnknown {
+			return nil, exprUnknown, c.errorf(n, "Operator %v needs a number, got %v", n.Op, typ)
+		}
+		negate := n.Op == token.SUB
+		return func(ll *Logline) (interface{}, error) {
+			v, err := x(ll)
+			if err != nil {
+				return nil, err
+			}
+			switch t := v.(type) {
+			case int64:
+				if negate {
+					return -t, nil
+				}
+				return t, nil
+			case float64:
+				if negate {
+					return -t, nil
+				}
+				return t, nil
+			}
+			return nil, fmt.Errorf("Operator %v needs a number, got %T", n.Op, v)
+		}, exprNumber, nil
+	}
+	return nil, exprUnknown, c.errorf(n, "Unsupported operator: %v", n.Op)
+}
+
+func (c *exprCompiler) compileBinary(n *ast.BinaryExpr) (exprFunc, exprType, error) {
+	lhs, ltyp, err := c.compile(n.X)
+	if err != nil {
+		return nil, exprUnknown, err
+	}
+	rhs, rtyp, err := c.compile(n.Y)
+	if err != nil {
+		return nil, exprUnknown, err
+	}
+
+	known := ltyp != exprUnknown && rtyp != exprUnknown
+	op := n.Op
+
+	switch op {
+	case token.LAND, token.LOR:
+		for _, typ := range []exprType{ltyp, rtyp} {
+			if typ != exprBool && typ != exprUnknown {
+				return nil, exprUnknown, c.errorf(n, "Operator %v needs bools, got %v", op, typ)
+			}
+		}
+		return func(ll *Logline) (interface{}, error) {
+			l, err := evalBool(lhs, ll, op)
+			if err != nil {
+				return nil, err
+			}
+			// Short-circuit
+			if (op == token.LAND && !l) || (op == token.LOR && l) {
+				return l, nil
+			}
+			return evalBool(rhs, ll, op)
+		}, exprBool, nil
+
+	case token.EQL, token.NEQ:
+		if known && ltyp != rtyp && ltyp != exprNil && rtyp != exprNil {
+			return nil, exprUnknown, c.errorf(n, "Cannot compare %v and %v", ltyp, rtyp)
+		}
+		return func(ll *Logline) (interface{}, error) {
+			l, r, err := evalBoth(lhs, rhs, ll)
+			if err != nil {
+				return nil, err
+			}
+			eq := exprEqual(l, r)
+			if op == token.NEQ {
+				return !eq, nil
+			}
+			return eq, nil
+		}, exprBool, nil
+
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		for _, typ := range []exprType{ltyp, rtyp} {
+			if typ != exprNumber && typ != exprString && typ != exprUnknown {
+				return nil, exprUnknown, c.errorf(n, "Cannot order a %v", typ)
+			}
+		}
+		if known && ltyp != rtyp {
+			return nil, exprUnknown, c.errorf(n, "Cannot compare %v and %v", ltyp, rtyp)
+		}
+		return func(ll *Logline) (interface{}, error) {
+			l, r, err := evalBoth(lhs, rhs, ll)
+			if err != nil {
+				return nil, err
+			}
+			cmp, err := exprCompare(l, r)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case token.LSS:
+				return cmp < 0, nil
+			case token.LEQ:
+				return cmp <= 0, nil
+			case token.GTR:
+				return cmp > 0, nil
+			}
+			return cmp >= 0, nil
+		}, exprBool, nil
+
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		resType := exprNumber
+		for _, typ := range []exprType{ltyp, rtyp} {
+			if typ == exprString && op == token.ADD {
+				resType = exprString
+			} else if typ != exprNumber && typ != exprUnknown {
+				return nil, exprUnknown, c.errorf(n, "Operator %v needs numbers, got %v", op, typ)
+			}
+		}
+		if known && ltyp != rtyp {
+			return nil, exprUnknown, c.errorf(n, "Operator %v on mismatched types %v and %v", op, ltyp, rtyp)
+		}
+		if !known {
+			resType = exprUnknown
+		}
+		return func(ll *Logline) (interface{}, error) {
+			l, r, err := evalBoth(lhs, rhs, ll)
+			if err != nil {
+				return nil, err
+			}
+			return exprArith(op, l, r)
+		}, resType, nil
+	}
+
+	return nil, exprUnknown, c.errorf(n, "Unsupported operator: %v", op)
+}
+
+func (c *exprCompiler) compileCall(n *ast.CallExpr) (exprFunc, exprType, error) {
+	ident, ok := n.Fun.(*ast.Ident)
+	if !ok {
+		return nil, exprUnknown, c.errorf(n, "Unsupported function call")
+	}
+	fn, ok := loglineExprFuncs[ident.Name]
+	if !ok {
+		names := make([]string, 0, len(loglineExprFuncs))
+		for name := range loglineExprFuncs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, exprUnknown, c.errorf(n, "Unknown function '%v'. Expected one of: %v",
+			ident.Name, strings.Join(names, ", "))
+	}
+	if len(n.Args) != 2 {
+		return nil, exprUnknown, c.errorf(n, "%v takes 2 arguments, got %v", ident.Name, len(n.Args))
+	}
+
+	args := make([]exprFunc, 2)
+	for i, arg := range n.Args {
+		eval, typ, err := c.compile(arg)
+		if err != nil {
+			return nil, exprUnknown, err
+		}
+		if typ != exprString && typ != exprUnknown {
+			return nil, exprUnknown, c.errorf(arg, "%v takes strings, got %v", ident.Name, typ)
+		}
+		args[i] = eval
+	}
+
+	if ident.Name == "matches" {
+		lit, ok := n.Args[1].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return nil, exprUnknown, c.errorf(n.Args[1], "The regex for matches must be a string literal")
+		}
+		pattern, _ := strconv.Unquote(lit.Value)
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, exprUnknown, c.errorf(lit, "Bad regex: %v", err)
+		}
+		fn = func(s, unused string) bool {
+			return regex.MatchString(s)
+		}
+	}
+
+	return func(ll *Logline) (interface{}, error) {
+		s, sub, err := evalBoth(args[0], args[1], ll)
+		if err != nil {
+			return nil, err
+		}
+		lhs, ok1 := s.(string)
+		rhs, ok2 := sub.(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%v takes strings, got %T and %T", ident.Name, s, sub)
+		}
+		return fn(lhs, rhs), nil
+	}, exprBool, nil
+}
+
+func evalBool(eval exprFunc, ll *Logline, op token.Token) (bool, error) {
+	v, err := eval(ll)
+	if err != nil {
+		return false, err
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("Operator %v needs bools, got %T", op, v)
+}
+
+func evalBoth(lhs, rhs exprFunc, ll *Logline) (interface{}, interface{}, error) {
+	l, err := lhs(ll)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := rhs(ll)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, r, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+func exprEqual(l, r interface{}) bool {
+	if li, ok := l.(int64); ok {
+		if ri, ok := r.(int64); ok {
+			return li == ri
+		}
+	}
+	if lf, ok := toFloat(l); ok {
+		rf, ok := toFloat(r)
+		return ok && lf == rf
+	}
+
+	switch lv := l.(type) {
+	case nil:
+		return r == nil
+	case string:
+		rv, ok := r.(string)
+		return ok && lv == rv
+	case bool:
+		rv, ok := r.(bool)
+		return ok && lv == rv
+	}
+	return false
+}
+
+func exprCompare(l, r interface{}) (int, error) {
+	if li, ok := l.(int64); ok {
+		if ri, ok := r.(int64); ok {
+			switch {
+			case li < ri:
+				return -1, nil
+			case li > ri:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if lf, ok := toFloat(l); ok {
+		if rf, ok := toFloat(r); ok {
+			switch {
+			case lf < rf:
+				return -1, nil
+			case lf > rf:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			return strings.Compare(ls, rs), nil
+		}
+	}
+	return 0, fmt.Errorf("Cannot compare %T and %T", l, r)
+}
+
+func exprArith(op token.Token, l, r interface{}) (interface{}, error) {
+	if op == token.ADD {
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return ls + rs, nil
+			}
+		}
+	}
+
+	li, lok := l.(int64)
+	ri, rok := r.(int64)
+	if lok && rok {
+		switch op {
+		case token.ADD:
+			return li + ri, nil
+		case token.SUB:
+			return li - ri, nil
+		case token.MUL:
+			return li * ri, nil
+		case token.QUO, token.REM:
+			if ri == 0 {
+				return nil, errors.New("Division by zero")
+			}
+			if op == token.QUO {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("Operator %v needs numbers, got %T and %T", op, l, r)
+	}
+	switch op {
+	case token.ADD:
+		return lf + rf, nil
+	case token.SUB:
+		return lf - rf, nil
+	case token.MUL:
+		return lf * rf, nil
+	case token.QUO:
+		return lf / rf, nil
+	}
+	return nil, fmt.Errorf("Operator %v needs integers", op)
+}
+
+// Convert a reflected value to one of the expression value types, if it is
+// one. Anything else is returned as is.
+func exprValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+	}
+	return v.Interface()
+}
+
+var errNoField = errors.New("No such field")
+
+// Get a field from a struct (or pointer to one), or a key from a map.
+func selectExprField(obj interface{}, name string) (interface{}, error) {
+	v := reflect.ValueOf(obj)
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil, errNoField
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, errNoField
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		index := exprFieldIndex(v.Type(), name)
+		if index == nil {
+			return nil, errNoField
+		}
+		// Walk down the index, which might go through embedded pointers.
+		for i, idx := range index {
+			if i > 0 {
+				for v.Kind() == reflect.Ptr {
+					if v.IsNil() {
+						return nil, errNoField
+					}
+					v = v.Elem()
+				}
+			}
+			v = v.Field(idx)
+		}
+		return exprValue(v), nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, errNoField
+		}
+		elem := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		if !elem.IsValid() {
+			return nil, errNoField
+		}
+		return exprValue(elem), nil
+	}
+	return nil, errNoField
+}
+
+type exprFieldKey struct {
+	t    reflect.Type
+	name string
+}
+
+// Field lookups by type and name. The values are []int (nil if there's no
+// such field).
+var exprFieldCache sync.Map
+
+// Find the field called name in struct type t. An exact match on the Go name
+// wins, then a case-insensitive match, then the logcat tag. Fields of
+// embedded structs are searched after the struct's own fields.
+func exprFieldIndex(t reflect.Type, name string) []int {
+	key := exprFieldKey{t, name}
+	if index, ok := exprFieldCache.Load(key); ok {
+		return index.([]int)
+	}
+
+	index := findExprField(t, name)
+	exprFieldCache.Store(key, index)
+	return index
+}
+
+func findExprField(t reflect.Type, name string) []int {
+	matches := []func(f reflect.StructField) bool{
+		func(f reflect.StructField) bool { return f.Name == name },
+		func(f reflect.StructField) bool { return strings.EqualFold(f.Name, name) },
+		func(f reflect.StructField) bool {
+			tag := strings.Split(f.Tag.Get("logcat"), ",")[0]
+			return tag != "-" && tag == name
+		},
+	}
+
+	for _, match := range matches {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if len(f.PkgPath) == 0 && match(f) {
+				return []int{i}
+			}
+		}
+	}
+
+	// Try embedded structs
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct {
+			continue
+		}
+		if index := findExprField(ft, name); index != nil {
+			return append([]int{i}, index...)
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Filtering parsed loglines
+
+type LoglineFilter func(*Logline) bool
+
+// LoglineFilterHandler passes on loglines that match at least one of its
+// filters, the same as StringFilterHandler does for strings. Anything that
+// isn't a *Logline (e.g. a line that failed to parse) is dropped.
+type LoglineFilterHandler struct {
+	Filters []LoglineFilter
+}
+
+func (p *LoglineFilterHandler) Handle(log interface{}) interface{} {
+	ll, ok := log.(*Logline)
+	if !ok || ll == nil {
+		return nil
+	}
+	for _, filter := range p.Filters {
+		if filter(ll) {
+			return log
+		}
+	}
+	return nil
+}
+
+func (p *LoglineFilterHandler) Finish() {}
+
+func NewLoglineFilterProcessor(source Processor, filters []LoglineFilter) Processor {
+	return NewSimpleProcessor(source, &LoglineFilterHandler{filters})
+}
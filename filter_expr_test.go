@@ -0,0 +1,172 @@
+package phonelab
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoglineExprMatch(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	ll := &Logline{
+		BootId:    "43424168-e44e-473a-bf12-dba8a4a4453a",
+		TraceTime: 56250.419488,
+		Pid:       388,
+		Tid:       390,
+		Level:     "D",
+		Tag:       "Kernel-Trace",
+		Payload: &CpuFrequency{
+			Trace: Trace{
+				Thread:    "kworker/2:2H-10277",
+				Cpu:       2,
+				Timestamp: 56250.330631,
+				Tag:       "cpu_frequency",
+			},
+			State: 1497600,
+			CpuId: 2,
+		},
+	}
+
+	tests := map[string]bool{
+		`tag == "Kernel-Trace"`: true,
+		`tag == "Kernel-Trace" && payload.Cpu == 2 && tracetime > 100.5`: true,
+		`tag != "Kernel-Trace" || pid == 388`:                            true,
+		`!(level == "E")`:                                                true,
+		`Pid == 388 && tid - pid == 2`:                                   true,
+		`pid % 2 == 0 && pid / 2 == 194`:                                 true,
+		`tracetime >= 56250.419488 && tracetime <= 56250.419488`:         true,
+		`payload.cpu_id == 2 && payload.CpuId == payload.cpu`:            true,
+		`payload.State > 1000000`:                                        true,
+		`payload.Tag == "cpu_frequency"`:                                 true,
+		`payload.Timestamp < tracetime`:                                  true,
+		`contains(payload.Thread, "kworker")`:                            true,
+		`hasPrefix(boot_id, "4342") && hasSuffix(tag, "Trace")`:          true,
+		`matches(payload.thread, "^kworker/[0-9]+:")`:                    true,
+		`payload.Cpu == 3`:                                               false,
+		`level < "A"`:                                                    false,
+		// Missing fields don't match
+		`payload.NoSuchField == 2`:                     false,
+		`payload.NoSuchField != 2`:                     false,
+		`payload.Cpu == 2 || payload.NoSuchField == 2`: true,
+		// Mismatched runtime types are unequal
+		`payload.Thread == 2`: false,
+		`payload.Thread != 2`: true,
+	}
+
+	for src, expected := range tests {
+		expr, err := CompileLoglineExpr(src)
+		if !assert.Nil(err, src) {
+			continue
+		}
+		assert.Equal(expected, expr.Match(ll), src)
+	}
+
+	// Unparsed payloads are strings
+	expr, err := CompileLoglineExpr(`payload == "foo" && payload.Cpu == nil`)
+	require.Nil(t, err)
+	assert.False(expr.Match(&Logline{Payload: "foo"}))
+	assert.False(expr.Match(nil))
+
+	expr, err = CompileLoglineExpr(`payload == "foo"`)
+	require.Nil(t, err)
+	assert.True(expr.Match(&Logline{Payload: "foo"}))
+
+	// Map payloads are indexed by key
+	expr, err = CompileLoglineExpr(`payload.count > 3`)
+	require.Nil(t, err)
+	assert.True(expr.Match(&Logline{Payload: map[string]interface{}{"count": 4}}))
+	assert.False(expr.Match(&Logline{Payload: map[string]interface{}{"other": 4}}))
+}
+
+func TestLoglineExprErrors(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	bad := []string{
+		"",
+		`tag == `,
+		`tga == "Kernel-Trace"`,
+		`tag == 2`,
+		`pid == "388"`,
+		`tag`,
+		`pid + 1`,
+		`tag.Foo == 2`,
+		`tag && pid == 1`,
+		`!pid`,
+		`-tag == 1`,
+		`tag < 1`,
+		`true < false`,
+		`contain(tag, "Kernel")`,
+		`contains(tag)`,
+		`contains(pid, "1")`,
+		`matches(tag, "[")`,
+		`matches(tag, level)`,
+		`payload[0] == 1`,
+		`'c' == payload`,
+	}
+
+	for _, src := range bad {
+		_, err := CompileLoglineExpr(src)
+		assert.NotNil(err, src)
+	}
+}
+
+func TestBuilderExprFilters(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	manager := &countingResultsManager{
+		counts: make(map[string]int),
+	}
+
+	env := NewEnvironment()
+	env.Processors["counter"] = &countingProcessorGen{manager}
+
+	confString := `
+processors:
+  - name: counter
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: simple
+        filter: "cpu_frequency"
+      - type: expr
+        filter: 'tag == "Kernel-Trace" && payload.cpu_id == 2 && tracetime > 100.5'
+source:
+  type: files
+  sources: ["./test/*.log"]
+sink:
+  name: "counter"
+`
+
+	conf, err := RunnerConfFromString(confString)
+	require.Nil(err)
+
+	runner, err := conf.ToRunner(env)
+	require.Nil(err)
+
+	errs := runner.Run()
+	assert.Equal(0, len(errs))
+
+	c1 := manager.counts["test/test.log"]
+	c2 := manager.counts["test/test.10000.log"]
+	assert.Equal(81, c1)
+	assert.Equal(286, c1+c2)
+
+	// Typos are caught up front
+	conf.Processors[0].Filters[1].Filter = `tga == "Kernel-Trace"`
+	_, err = conf.ToRunner(env)
+	assert.NotNil(err)
+
+	// expr filters need a parser
+	conf.Processors[0].Filters[1].Filter = `tag == "Kernel-Trace"`
+	conf.Processors[0].RawStrings = true
+	_, err = conf.ToRunner(env)
+	assert.NotNil(err)
+}
@@ -0,0 +1,238 @@
+package phonelab
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ftrace sources are raw ftrace output: text from trace_pipe (or the trace
+// file), or trace-cmd's trace.dat files. Files ending in .gz are gunzipped.
+// Rather than lines, they send on what the Kernel-Trace parser makes of each
+// event, e.g. a *CpuFrequency, or a *Trace for events without a subparser.
+// Both are MonotonicTimestampers on the same clock as the loglines of the
+// boot, so they can be timewoven with them.
+
+type FtraceSourceInfo struct {
+	Filename string
+}
+
+func (info *FtraceSourceInfo) Type() string {
+	return "ftrace"
+}
+
+func (info *FtraceSourceInfo) Context() string {
+	return info.Filename
+}
+
+// Reads the events of a trace_pipe dump or trace.dat file
+type FtraceProcessor struct {
+	Filename string
+	ErrHandler
+	// Makes the parser for the events. nil for a KernelTraceParser that
+	// passes on unknown events as a *Trace.
+	Parser ParserGen
+	// Finds the filesystem the file is on. nil for the Environment's
+	// defaults.
+	Resolve FileSystemResolver
+}
+
+func NewFtraceProcessor(file string, errHandler ErrHandler) *FtraceProcessor {
+	return &FtraceProcessor{
+		Filename:   file,
+		ErrHandler: errHandler,
+	}
+}
+
+// Sent on nothing, because the run is over
+var errFtraceStopped = errors.New("Stopped")
+
+func (p *FtraceProcessor) processFile(ctx context.Context, outChan chan interface{}) {
+	onError := func(err error, line int) {
+		reportSourceError(ctx, p.ErrHandler, &SourceError{
+			Info: &FtraceSourceInfo{p.Filename},
+			File: p.Filename,
+			Line: line,
+			Err:  err,
+		})
+	}
+
+	resolve := p.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(ctx, "")
+	}
+	fs, err := resolve(p.Filename)
+	if err != nil {
+		onError(fmt.Errorf("Error opening file: %v", err), 0)
+		return
+	}
+	r, err := openSourceReader(fs, p.Filename)
+	if err != nil {
+		onError(fmt.Errorf("Error opening file: %v", err), 0)
+		return
+	}
+	defer r.Close()
+
+	var reader io.Reader = r
+	gz := strings.HasSuffix(p.Filename, ".gz")
+	if gz {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			onError(fmt.Errorf("Error opening file: %v", err), 0)
+			return
+		}
+		reader = gzr
+	}
+	buffered := bufio.NewReader(reader)
+
+	var parser Parser
+	if p.Parser != nil {
+		parser = p.Parser()
+	} else {
+		tparser := NewKernelTraceParser()
+		tparser.ErrOnUnknownTag = false
+		parser = tparser
+	}
+
+	metrics := nodeMetrics(ctx, "FtraceProcessor")
+	// The line being handled. trace.dat files don't have lines.
+	lineNum := 0
+	handle := func(line string) error {
+		metrics.itemIn()
+		obj, err := parser.Parse(line)
+		if err != nil {
+			// Bad traces are skipped rather than reported, but say where
+			// they are.
+			metrics.AddParseErrors(1)
+			log.Debugf("Error parsing trace: %v", &SourceError{File: p.Filename, Line: lineNum, Err: err})
+			return nil
+		}
+		if !metrics.send(ctx, outChan, obj) {
+			return errFtraceStopped
+		}
+		return nil
+	}
+
+	if start, _ := buffered.Peek(len(traceDatMagic)); isTraceDat(start) {
+		// trace.dat files have to be read out of order
+		var rest io.Reader = buffered
+		if !gz {
+			if file, err := openSourceFile(fs, p.Filename); err != nil {
+				onError(fmt.Errorf("Error opening file: %v", err), 0)
+				return
+			} else {
+				defer file.Close()
+				rest = file
+			}
+		}
+		if err := p.processTraceDat(rest, handle); err != nil && err != errFtraceStopped {
+			onError(fmt.Errorf("Error reading trace.dat: %v", err), 0)
+		}
+		return
+	}
+
+	scanner := newLineScanner(buffered)
+	for scanner.Scan() {
+		lineNum += 1
+		line := scanner.Text()
+		// Headers, and lines like CPU:2 [LOST 118 EVENTS]
+		if trimmed := strings.TrimSpace(line); len(trimmed) == 0 ||
+			strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "CPU:") {
+			continue
+		}
+		if handle(line) != nil {
+			return
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		onError(fmt.Errorf("Error scanning file: %v", err), lineNum+1)
+	}
+}
+
+// Read a trace.dat from r, which is an *os.File unless it has to be copied to
+// one first.
+func (p *FtraceProcessor) processTraceDat(r io.Reader, handle func(string) error) error {
+	file, ok := r.(io.ReaderAt)
+	if !ok {
+		spooled, err := spoolTempFile(r)
+		if err != nil {
+			return err
+		}
+		defer spooled.Close()
+		file = spooled
+	}
+
+	t, err := openTraceDat(file)
+	if err != nil {
+		return err
+	}
+	return t.eachLine(handle)
+}
+
+func (p *FtraceProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *FtraceProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		p.processFile(ctx, outChan)
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+// A source generator that generates one FtraceProcessor for each file.
+type FtraceSourceGenerator struct {
+	Files      []string
+	ErrHandler ErrHandler
+	// Makes the parser for the events, e.g. the Environment's Kernel-Trace
+	// parser. nil for the default.
+	Parser ParserGen
+	// Finds the filesystem each file is on. nil for the Environment's
+	// defaults.
+	Resolve FileSystemResolver
+}
+
+func NewFtraceSourceGenerator(files []string, errHandler ErrHandler) *FtraceSourceGenerator {
+	return &FtraceSourceGenerator{
+		Files:      files,
+		ErrHandler: errHandler,
+	}
+}
+
+func (fg *FtraceSourceGenerator) Process() <-chan *PipelineSourceInstance {
+	return fg.ProcessContext(context.Background())
+}
+
+func (fg *FtraceSourceGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
+	sourceChan := make(chan *PipelineSourceInstance)
+
+	go func() {
+		for _, file := range fg.Files {
+			processor := NewFtraceProcessor(file, fg.ErrHandler)
+			processor.Parser = fg.Parser
+			processor.Resolve = fg.Resolve
+
+			source := &PipelineSourceInstance{
+				Processor: processor,
+				Info:      &FtraceSourceInfo{file},
+			}
+			if !sendSourceContext(ctx, sourceChan, source) {
+				break
+			}
+		}
+		close(sourceChan)
+	}()
+
+	return sourceChan
+}
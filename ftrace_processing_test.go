@@ -0,0 +1,194 @@
+package phonelab
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTracePipe = `# tracer: nop
+#
+#                              _-----=> irqs-off
+#           TASK-PID   CPU#  ||||    TIMESTAMP  FUNCTION
+#              | |       |   ||||       |         |
+     kworker/0:2-1911  [003] ...1 20455.979145: thermal_temp: sensor_id=5 temp=32
+CPU:2 [LOST 118 EVENTS]
+          <idle>-0     [000] d..2. 20456.000001: cpu_frequency: state=2265600 cpu_id=0
+     kworker/0:3-2658  [000] ...1 20456.100000: sched_cpu_hotplug: cpu 1 online error=0
+     kworker/0:3-2658  [000] ...1 20456.200000: sched_stat_runtime: comm=kworker/0:3 pid=2658 runtime=1000 [ns] vruntime=123456 [ns]
+not a trace line
+
+`
+
+// Read everything an ftrace source sends
+func readFtraceSource(t *testing.T, conf *PipelineSourceConf, errs *[]error) []interface{} {
+	gen, err := conf.ToPipelineSourceGenerator()
+	require.Nil(t, err)
+	gen.(*FtraceSourceGenerator).ErrHandler = func(err error) {
+		*errs = append(*errs, err)
+	}
+
+	objs := make([]interface{}, 0)
+	for source := range gen.Process() {
+		assert.Equal(t, "ftrace", source.Info.Type())
+		for obj := range source.Processor.Process() {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+func TestFtraceTracePipe(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-ftrace")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	require.Nil(ioutil.WriteFile(filepath.Join(tmpDir, "trace_pipe.txt"), []byte(testTracePipe), 0644))
+
+	errs := make([]error, 0)
+	objs := readFtraceSource(t, &PipelineSourceConf{
+		Type:    PipelineSourceFtrace,
+		Sources: []string{filepath.Join(tmpDir, "trace_pipe.*")},
+	}, &errs)
+	assert.Equal(0, len(errs))
+	require.Equal(4, len(objs))
+
+	thermal := objs[0].(*ThermalTemp)
+	assert.Equal(5, thermal.SensorId)
+	assert.Equal(32, thermal.Temp)
+	assert.Equal("kworker/0:2-1911", thermal.Thread)
+	assert.Equal(3, thermal.Cpu)
+
+	// Newer kernels have another flag
+	freq := objs[1].(*CpuFrequency)
+	assert.Equal(2265600, freq.State)
+	assert.Equal("d..2.", freq.Unknown)
+
+	assert.Equal("online", objs[2].(*SchedCpuHotplug).State)
+
+	// No subparser
+	assert.Equal("sched_stat_runtime", objs[3].(*Trace).Tag)
+
+	// They can be timewoven with loglines
+	timestamps := make([]float64, 0)
+	for _, obj := range objs {
+		timestamps = append(timestamps, obj.(MonotonicTimestamper).MonotonicTimestamp())
+	}
+	assert.Equal([]float64{20455.979145, 20456.000001, 20456.1, 20456.2}, timestamps)
+}
+
+func TestFtraceTraceDat(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-ftrace")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	data := buildTraceDat(2, testTraceDatEvents)
+	require.Nil(ioutil.WriteFile(filepath.Join(tmpDir, "trace.dat"), data, 0644))
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	require.Nil(w.Close())
+	require.Nil(ioutil.WriteFile(filepath.Join(tmpDir, "trace.dat.gz"), gz.Bytes(), 0644))
+
+	for _, file := range []string{"trace.dat", "trace.dat.gz"} {
+		errs := make([]error, 0)
+		objs := readFtraceSource(t, &PipelineSourceConf{
+			Type:    PipelineSourceFtrace,
+			Sources: []string{filepath.Join(tmpDir, file)},
+		}, &errs)
+		assert.Equal(0, len(errs), file)
+		require.Equal(4, len(objs), file)
+
+		freq := objs[0].(*CpuFrequency)
+		assert.Equal(2265600, freq.State)
+		assert.Equal(0, freq.CpuId)
+		assert.Equal("kworker/0:2-1911", freq.Thread)
+		assert.Equal(1000.000001, freq.MonotonicTimestamp())
+
+		hotplug := objs[1].(*SchedCpuHotplug)
+		assert.Equal(1, hotplug.Cpu)
+		assert.Equal("online", hotplug.State)
+		assert.Equal(1, hotplug.Trace.Cpu)
+
+		foreground := objs[2].(*PhonelabProcForeground)
+		assert.Equal(".android.dialer", foreground.Comm)
+		assert.Equal(13759, foreground.Pid)
+
+		assert.Equal("mystery", objs[3].(*Trace).Tag)
+		assert.Equal(1000.5, objs[3].(*Trace).MonotonicTimestamp())
+	}
+
+	// A broken file is an error for the source
+	require.Nil(ioutil.WriteFile(filepath.Join(tmpDir, "trace.dat"), data[:len(data)-100], 0644))
+	errs := make([]error, 0)
+	readFtraceSource(t, &PipelineSourceConf{
+		Type:    PipelineSourceFtrace,
+		Sources: []string{filepath.Join(tmpDir, "trace.dat")},
+	}, &errs)
+	require.Equal(1, len(errs))
+	assert.Contains(errs[0].Error(), "Error reading trace.dat")
+}
+
+func TestFtraceSourceConf(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// The Kernel-Trace parser comes from the environment
+	env := NewEnvironment()
+	parsed := make([]string, 0)
+	env.RegisterParserGenerator(TAG_TRACE, func() Parser {
+		return &recordingParser{&parsed}
+	})
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceFtrace,
+		Sources: []string{"test/test.log"},
+	}
+	gen, err := conf.ToPipelineSourceGeneratorEnv(env)
+	assert.Nil(err)
+	for source := range gen.Process() {
+		drain(source.Processor.Process())
+	}
+	assert.Equal(5000, len(parsed))
+
+	confString := `
+source:
+  type: ftrace
+  sources: ["./test/*.log"]
+processors:
+  - name: main
+    generator: passthrough
+    has_logstream: true
+    filters:
+      - type: simple
+        filter: cpu_frequency
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(confString, newValidateTestEnv(), nil)
+	require.Equal(t, 1, len(diags), "%v", diags)
+	assert.Equal(9, diags[0].Line)
+	assert.Contains(diags[0].Message, "ftrace")
+}
+
+type recordingParser struct {
+	lines *[]string
+}
+
+func (p *recordingParser) Parse(line string) (interface{}, error) {
+	*p.lines = append(*p.lines, line)
+	return line, nil
+}
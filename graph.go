@@ -0,0 +1,291 @@
+package phonelab
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pipeline graphs
+//
+// A PipelineGraph is the pipeline that a RunnerConf builds for each source,
+// with all of the processors that buildProcessor adds along the way: the Tee
+// in front of sources that can only be read once, the string filters, parser,
+// expr filters and preprocessors on each logstream, the MergeProcessors that
+// stitch inputs together, and the Muxers in front of processors with more
+// than one consumer. It is drawn by the builder itself, as it builds the
+// pipeline for a stand-in source.
+
+type PipelineGraphNodeKind string
+
+const (
+	GraphNodeSource       PipelineGraphNodeKind = "source"
+	GraphNodeTee          PipelineGraphNodeKind = "tee"
+	GraphNodeFilter       PipelineGraphNodeKind = "filter"
+	GraphNodeParser       PipelineGraphNodeKind = "parser"
+	GraphNodeExprFilter   PipelineGraphNodeKind = "expr_filter"
+	GraphNodePreprocessor PipelineGraphNodeKind = "preprocessor"
+	GraphNodeMerge        PipelineGraphNodeKind = "merge"
+	GraphNodeProcessor    PipelineGraphNodeKind = "processor"
+	GraphNodeMuxer        PipelineGraphNodeKind = "muxer"
+	GraphNodeCollector    PipelineGraphNodeKind = "collector"
+)
+
+type PipelineGraphNode struct {
+	// Unique within the graph, e.g. "main/parser"
+	Id   string
+	Kind PipelineGraphNodeKind
+	// Lines of text describing the node. The first is the title.
+	Label []string
+}
+
+type PipelineGraphEdge struct {
+	From string
+	To   string
+}
+
+type PipelineGraph struct {
+	Nodes []*PipelineGraphNode
+	Edges []*PipelineGraphEdge
+
+	// The node the logstreams read from
+	source string
+	// The last node of each processor that has been built, by key
+	built map[string]string
+}
+
+// The methods the builder draws with do nothing on a nil graph, which is
+// what it has when it isn't drawing.
+
+// Add a node with edges from each of from, and return its id.
+func (g *PipelineGraph) addNode(id string, kind PipelineGraphNodeKind, from []string, label ...string) string {
+	if g == nil {
+		return id
+	}
+	g.Nodes = append(g.Nodes, &PipelineGraphNode{
+		Id:    id,
+		Kind:  kind,
+		Label: label,
+	})
+	for _, f := range from {
+		g.Edges = append(g.Edges, &PipelineGraphEdge{f, id})
+	}
+	return id
+}
+
+func (g *PipelineGraph) sourceNode() string {
+	if g == nil {
+		return ""
+	}
+	return g.source
+}
+
+func (g *PipelineGraph) setSourceNode(id string) {
+	if g != nil {
+		g.source = id
+	}
+}
+
+func (g *PipelineGraph) builtNode(key string) string {
+	if g == nil {
+		return ""
+	}
+	return g.built[key]
+}
+
+func (g *PipelineGraph) setBuiltNode(key, id string) {
+	if g != nil {
+		g.built[key] = id
+	}
+}
+
+// The label of the string filters, or of the expr filters
+func (conf *ProcessorConf) filterLabel(expr bool) []string {
+	label := []string{"filter"}
+	if expr {
+		label[0] = "expr filter"
+	}
+	for _, filterSpec := range conf.Filters {
+		if (filterSpec.Type == FilterTypeExpr) != expr {
+			continue
+		} else if expr {
+			label = append(label, filterSpec.Filter)
+		} else {
+			label = append(label, fmt.Sprintf("%v: %v", filterSpec.Type, filterSpec.Filter))
+		}
+	}
+	return label
+}
+
+// A source like the ones the conf generates, for the builder to build a
+// pipeline for. Nothing is read from it.
+func (conf *PipelineSourceConf) graphSource() *PipelineSourceInstance {
+	var sourceType PipelineSourceType
+	if conf != nil {
+		sourceType = conf.Type
+	}
+
+	switch sourceType {
+	case PipelineSourceArchive:
+		info := &ArchiveSourceInfo{}
+		return &PipelineSourceInstance{Info: info, Processor: &ArchiveMemberProcessor{Info: info}}
+	case PipelineSourceStream:
+		info := &StreamSourceInfo{}
+		return &PipelineSourceInstance{Info: info, Processor: NewStreamProcessor(info, nil, nil)}
+	case PipelineSourceBinary:
+		return &PipelineSourceInstance{Info: &BinaryLogSourceInfo{}, Processor: &BinaryLogProcessor{}}
+	case PipelineSourceFtrace:
+		return &PipelineSourceInstance{Info: &FtraceSourceInfo{}, Processor: NewFtraceProcessor("", nil)}
+	}
+	return &PipelineSourceInstance{Info: &TextFileSourceInfo{}, Processor: &TextFileProcessor{}}
+}
+
+// Draw the pipeline the conf builds for each source, with the processors in
+// env.
+func (conf *RunnerConf) PipelineGraph(env *Environment) (*PipelineGraph, error) {
+	graph, err := conf.dependencyGraph(env)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = graph.TopSort(); err != nil {
+		return nil, errPipelineCycle
+	}
+	if err = validateProcessorConfs(graph, env); err != nil {
+		return nil, err
+	}
+
+	g := &PipelineGraph{
+		Nodes: make([]*PipelineGraphNode, 0),
+		Edges: make([]*PipelineGraphEdge, 0),
+		built: make(map[string]string),
+	}
+
+	// The source
+	sourceLabel := []string{"source"}
+	if conf.SourceConf != nil {
+		sourceLabel[0] = fmt.Sprintf("source: %v", conf.SourceConf.Type)
+		sourceLabel = append(sourceLabel, conf.SourceConf.Sources...)
+	}
+	g.setSourceNode(g.addNode("<source>", GraphNodeSource, nil, sourceLabel...))
+
+	// The processors
+	proc := NewRunnerConfProcssor(conf, env, graph)
+	if _, err = proc.buildPipeline(conf.SourceConf.graphSource(), g); err != nil {
+		return nil, err
+	}
+
+	// Where the results go
+	collectorLabel := "collector: none"
+	if conf.DataCollector != nil && len(conf.DataCollector.Name) > 0 {
+		collectorLabel = "collector: " + conf.DataCollector.Name
+	}
+	g.addNode("<collector>", GraphNodeCollector, []string{g.builtNode(conf.Sink.Name)}, collectorLabel)
+
+	return g, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Rendering
+
+var dotShapes = map[PipelineGraphNodeKind]string{
+	GraphNodeSource:       "cylinder",
+	GraphNodeTee:          "triangle",
+	GraphNodeFilter:       "invtrapezium",
+	GraphNodeParser:       "box",
+	GraphNodeExprFilter:   "invtrapezium",
+	GraphNodePreprocessor: "box",
+	GraphNodeMerge:        "invtriangle",
+	GraphNodeProcessor:    "box",
+	GraphNodeMuxer:        "triangle",
+	GraphNodeCollector:    "folder",
+}
+
+func dotEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
+
+// Render the graph in Graphviz DOT.
+func (g *PipelineGraph) DOT() string {
+	var b strings.Builder
+
+	b.WriteString("digraph pipeline {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [fontname=\"Helvetica\"];\n")
+
+	for _, node := range g.Nodes {
+		label := make([]string, 0, len(node.Label))
+		for _, line := range node.Label {
+			label = append(label, dotEscape(line))
+		}
+		style := ""
+		if node.Kind == GraphNodeProcessor {
+			style = ", style=bold"
+		}
+		fmt.Fprintf(&b, "\t%v [label=\"%v\", shape=%v%v];\n", dotQuote(node.Id),
+			strings.Join(label, `\n`), dotShapes[node.Kind], style)
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&b, "\t%v -> %v;\n", dotQuote(edge.From), dotQuote(edge.To))
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// The opening and closing brackets for each kind of node
+var mermaidShapes = map[PipelineGraphNodeKind][2]string{
+	GraphNodeSource:       {"[(", ")]"},
+	GraphNodeTee:          {"{{", "}}"},
+	GraphNodeFilter:       {"[/", "\\]"},
+	GraphNodeParser:       {"[", "]"},
+	GraphNodeExprFilter:   {"[/", "\\]"},
+	GraphNodePreprocessor: {"[", "]"},
+	GraphNodeMerge:        {"{{", "}}"},
+	GraphNodeProcessor:    {"[[", "]]"},
+	GraphNodeMuxer:        {"{{", "}}"},
+	GraphNodeCollector:    {"[(", ")]"},
+}
+
+func mermaidEscape(s string) string {
+	for _, r := range []struct{ from, to string }{
+		{"&", "#amp;"},
+		{`"`, "#quot;"},
+		{"<", "#lt;"},
+		{">", "#gt;"},
+	} {
+		s = strings.Replace(s, r.from, r.to, -1)
+	}
+	return s
+}
+
+// Render the graph as a Mermaid flowchart.
+func (g *PipelineGraph) Mermaid() string {
+	var b strings.Builder
+
+	b.WriteString("flowchart LR\n")
+
+	// Mermaid IDs can't have most punctuation in them
+	ids := make(map[string]string)
+	for i, node := range g.Nodes {
+		ids[node.Id] = fmt.Sprintf("n%v", i)
+
+		label := make([]string, 0, len(node.Label))
+		for _, line := range node.Label {
+			label = append(label, mermaidEscape(line))
+		}
+		shape := mermaidShapes[node.Kind]
+		fmt.Fprintf(&b, "    %v%v\"%v\"%v\n", ids[node.Id], shape[0],
+			strings.Join(label, "<br/>"), shape[1])
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&b, "    %v --> %v\n", ids[edge.From], ids[edge.To])
+	}
+
+	return b.String()
+}
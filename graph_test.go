@@ -0,0 +1,148 @@
+package phonelab
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineGraph(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conf, err := RunnerConfFromString(`
+source:
+  type: files
+  sources: ["./test/*.log"]
+processors:
+  - name: main
+    generator: passthrough
+    has_logstream: true
+    raw_strings: true
+    inputs:
+      - name: a
+      - name: b
+  - name: a
+    generator: passthrough
+    inputs:
+      - name: shared
+  - name: b
+    generator: passthrough
+    inputs:
+      - name: shared
+  - name: shared
+    generator: passthrough
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: simple
+        filter: "Kernel-Trace"
+      - type: expr
+        filter: 'payload.Cpu == 2'
+    preprocessors:
+      - name: passthrough
+data_collector:
+  name: default
+sink:
+  name: main
+`)
+	require.Nil(err)
+
+	env := newValidateTestEnv()
+	g, err := conf.PipelineGraph(env)
+	require.Nil(err)
+
+	kinds := make(map[string]PipelineGraphNodeKind)
+	for _, node := range g.Nodes {
+		_, dup := kinds[node.Id]
+		assert.False(dup, node.Id)
+		kinds[node.Id] = node.Kind
+	}
+
+	assert.Equal(map[string]PipelineGraphNodeKind{
+		"<source>":              GraphNodeSource,
+		"shared/filter":         GraphNodeFilter,
+		"shared/parser":         GraphNodeParser,
+		"shared/expr_filter":    GraphNodeExprFilter,
+		"shared/preprocessor/0": GraphNodePreprocessor,
+		"shared":                GraphNodeProcessor,
+		"shared/muxer":          GraphNodeMuxer,
+		"a":                     GraphNodeProcessor,
+		"b":                     GraphNodeProcessor,
+		"main/merge":            GraphNodeMerge,
+		"main":                  GraphNodeProcessor,
+		"<collector>":           GraphNodeCollector,
+	}, kinds)
+
+	edges := make([]string, 0)
+	for _, edge := range g.Edges {
+		edges = append(edges, edge.From+" -> "+edge.To)
+	}
+	assert.ElementsMatch([]string{
+		// main's logstream is raw, so it goes straight into the merge
+		"<source> -> main/merge",
+		"<source> -> shared/filter",
+		"shared/filter -> shared/parser",
+		"shared/parser -> shared/expr_filter",
+		"shared/expr_filter -> shared/preprocessor/0",
+		"shared/preprocessor/0 -> shared",
+		"shared -> shared/muxer",
+		"shared/muxer -> a",
+		"shared/muxer -> b",
+		"a -> main/merge",
+		"b -> main/merge",
+		"main/merge -> main",
+		"main -> <collector>",
+	}, edges)
+
+	dot := g.DOT()
+	assert.True(strings.HasPrefix(dot, "digraph pipeline {\n"))
+	assert.Contains(dot, `"shared/expr_filter" [label="expr filter\npayload.Cpu == 2", shape=invtrapezium];`)
+	assert.Contains(dot, `"a" [label="a\ngenerator: passthrough", shape=box, style=bold];`)
+	assert.Contains(dot, `"main/merge" -> "main";`)
+	assert.Equal(len(g.Nodes)+len(g.Edges)+4, strings.Count(dot, "\n"))
+
+	mermaid := g.Mermaid()
+	assert.True(strings.HasPrefix(mermaid, "flowchart LR\n"))
+	assert.Contains(mermaid, `[/"filter<br/>simple: Kernel-Trace"\]`)
+	assert.Contains(mermaid, `{{"merge<br/>3 inputs"}}`)
+	assert.Equal(len(g.Nodes)+len(g.Edges)+1, strings.Count(mermaid, "\n"))
+
+	// Cycles can't be drawn
+	inputs := conf.Processors[3].Inputs
+	conf.Processors[3].Inputs = []*ProcessorInputConf{{Name: "main"}}
+	_, err = conf.PipelineGraph(env)
+	assert.NotNil(err)
+	conf.Processors[3].Inputs = inputs
+
+	// Sources that can only be read once are shared through a Tee
+	conf.SourceConf = &PipelineSourceConf{
+		Type:    PipelineSourceStream,
+		Sources: []string{"-"},
+		Args:    map[string]interface{}{"tee_max_queue": 100},
+	}
+	g, err = conf.PipelineGraph(env)
+	require.Nil(err)
+	edges = make([]string, 0)
+	for _, edge := range g.Edges {
+		edges = append(edges, edge.From+" -> "+edge.To)
+	}
+	assert.Contains(edges, "<source> -> <tee>")
+	assert.Contains(edges, "<tee> -> main/merge")
+	assert.Contains(edges, "<tee> -> shared/filter")
+	assert.NotContains(edges, "<source> -> shared/filter")
+	assert.Contains(g.DOT(), `"<tee>" [label="tee\n2 logstreams\nmax queue: 100", shape=triangle];`)
+
+	// Ftrace sources can't be filtered
+	conf.SourceConf = &PipelineSourceConf{
+		Type:    PipelineSourceFtrace,
+		Sources: []string{"./test/*.trace"},
+	}
+	_, err = conf.PipelineGraph(env)
+	require.NotNil(err)
+	assert.Contains(err.Error(), "Processor 'shared' has filters, which can't be used with ftrace sources")
+}
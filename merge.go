@@ -0,0 +1,131 @@
+package phonelab
+
+import (
+	"container/heap"
+	"context"
+	"reflect"
+)
+
+// MergeProcessor merges any number of streams into one based on timestamp.
+// It does the same job as a chain of TimeweaverProcessors, but with a single
+// goroutine and a min-heap of the next log from each source, so each log costs
+// O(log N) comparisons instead of O(N) channel hops.
+//
+// As with the TimeweaverProcessor, the logs coming down the source channels
+// should implement the MonotonicTimestamper interface. Logs with the same
+// timestamp are emitted in the order of their sources. Anything without a
+// timestamp, e.g. a nil, is passed through with the timestamp of the log
+// before it from the same source, so it comes out right after that log.
+type MergeProcessor struct {
+	Sources []Processor
+}
+
+func NewMergeProcessor(sources []Processor) *MergeProcessor {
+	return &MergeProcessor{
+		Sources: sources,
+	}
+}
+
+// The next log from one of the sources
+type mergeItem struct {
+	obj       interface{}
+	timestamp float64
+	index     int
+	source    <-chan interface{}
+}
+
+// Read the next log from the item's source. Returns false if the source is
+// done.
+func (item *mergeItem) next() bool {
+	obj, ok := <-item.source
+	if ok {
+		item.obj = obj
+		if ts, ok := obj.(MonotonicTimestamper); ok && !isNilPointer(ts) {
+			item.timestamp = ts.MonotonicTimestamp()
+		}
+	}
+	return ok
+}
+
+// e.g. a nil *Logline, whose MonotonicTimestamp would panic
+func isNilPointer(obj interface{}) bool {
+	v := reflect.ValueOf(obj)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].timestamp == h[j].timestamp {
+		return h[i].index < h[j].index
+	}
+	return h[i].timestamp < h[j].timestamp
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*mergeItem))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+func (m *MergeProcessor) Process() <-chan interface{} {
+	return m.ProcessContext(context.Background())
+}
+
+func (m *MergeProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	sources := make([]<-chan interface{}, len(m.Sources))
+	for i, proc := range m.Sources {
+		sources[i] = ProcessContext(ctx, proc)
+	}
+
+	outChan := make(chan interface{})
+	metrics := nodeMetrics(ctx, "Merge")
+
+	go func() {
+		h := make(mergeHeap, 0, len(sources))
+		for i, source := range sources {
+			item := &mergeItem{
+				index:  i,
+				source: source,
+			}
+			if item.next() {
+				metrics.itemIn()
+				h = append(h, item)
+			}
+		}
+		heap.Init(&h)
+
+		for h.Len() > 0 {
+			item := h[0]
+			if !metrics.send(ctx, outChan, item.obj) {
+				break
+			}
+
+			if item.next() {
+				metrics.itemIn()
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+
+		// Only has work to do if we were canceled
+		for _, source := range sources {
+			drain(source)
+		}
+
+		close(outChan)
+	}()
+
+	return outChan
+}
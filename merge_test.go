@@ -0,0 +1,214 @@
+package phonelab
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeOddEven(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	odds := make([]sequenceNum, 0)
+	for i := 1; i <= 100; i += 2 {
+		odds = append(odds, sequenceNum(i))
+	}
+
+	evens := make([]sequenceNum, 0)
+	for i := 2; i <= 100; i += 2 {
+		evens = append(evens, sequenceNum(i))
+	}
+
+	results := make([]sequenceNum, 0)
+	merge := NewMergeProcessor([]Processor{&sequenceEmitter{odds}, &sequenceEmitter{evens}})
+
+	for sn := range merge.Process() {
+		results = append(results, sn.(sequenceNum))
+	}
+
+	require.Equal(100, len(results))
+	for i := 0; i < 100; i++ {
+		assert.Equal(i+1, int(results[i]))
+	}
+}
+
+func TestMergeMany(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Stripe 1-1000 across 10 sources, plus a few empty ones.
+	const numSources = 10
+	const total = 1000
+
+	sources := []Processor{&sequenceEmitter{}}
+	for i := 0; i < numSources; i++ {
+		emitter := &sequenceEmitter{make([]sequenceNum, 0)}
+		for j := i + 1; j <= total; j += numSources {
+			emitter.numbers = append(emitter.numbers, sequenceNum(j))
+		}
+		sources = append(sources, emitter, &sequenceEmitter{})
+	}
+
+	results := make([]sequenceNum, 0)
+	for sn := range NewMergeProcessor(sources).Process() {
+		results = append(results, sn.(sequenceNum))
+	}
+
+	require.Equal(total, len(results))
+	for i := 0; i < total; i++ {
+		assert.Equal(i+1, int(results[i]))
+	}
+}
+
+type taggedNum struct {
+	num    int
+	source int
+}
+
+func (tn *taggedNum) MonotonicTimestamp() float64 {
+	return float64(tn.num)
+}
+
+type taggedEmitter struct {
+	source int
+	count  int
+}
+
+func (e *taggedEmitter) Process() <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		for i := 1; i <= e.count; i++ {
+			outChan <- &taggedNum{i, e.source}
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+func TestMergeTies(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const numSources = 5
+	const count = 50
+
+	sources := make([]Processor, numSources)
+	for i := 0; i < numSources; i++ {
+		sources[i] = &taggedEmitter{i, count}
+	}
+
+	results := make([]*taggedNum, 0)
+	for obj := range NewMergeProcessor(sources).Process() {
+		results = append(results, obj.(*taggedNum))
+	}
+
+	// Equal timestamps are ordered by source
+	require.Equal(numSources*count, len(results))
+	for i, tn := range results {
+		assert.Equal(i/numSources+1, tn.num)
+		assert.Equal(i%numSources, tn.source)
+	}
+}
+
+type objectEmitter struct {
+	objs []interface{}
+}
+
+func (e *objectEmitter) Process() <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		for _, obj := range e.objs {
+			outChan <- obj
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+func TestMergeNoTimestamp(t *testing.T) {
+	t.Parallel()
+
+	var nilLogline *Logline
+	merge := NewMergeProcessor([]Processor{
+		&objectEmitter{[]interface{}{nil, sequenceNum(2), "after 2", sequenceNum(5), nilLogline}},
+		&sequenceEmitter{[]sequenceNum{1, 3, 4, 6}},
+	})
+
+	results := make([]interface{}, 0)
+	for obj := range merge.Process() {
+		results = append(results, obj)
+	}
+
+	// They come out right after whatever was before them from their source
+	assert.Equal(t, []interface{}{nil, sequenceNum(1), sequenceNum(2), "after 2", sequenceNum(3),
+		sequenceNum(4), sequenceNum(5), nilLogline, sequenceNum(6)}, results)
+}
+
+func TestMergeNoSources(t *testing.T) {
+	t.Parallel()
+
+	count := 0
+	for _ = range NewMergeProcessor([]Processor{}).Process() {
+		count += 1
+	}
+	assert.Equal(t, 0, count)
+}
+
+// The way stitchInputs used to combine inputs: (((0 1) 2) 3).
+func timeweaverChain(processors []Processor) Processor {
+	proc := processors[0]
+	for i := 1; i < len(processors); i++ {
+		proc = NewTimeweaverProcessor(proc, processors[i])
+	}
+	return proc
+}
+
+func benchmarkStitch(b *testing.B, numSources int, stitch func([]Processor) Processor) {
+	const perSource = 1000
+
+	numbers := make([][]sequenceNum, numSources)
+	for i := range numbers {
+		for j := 0; j < perSource; j++ {
+			numbers[i] = append(numbers[i], sequenceNum(j*numSources+i))
+		}
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		sources := make([]Processor, numSources)
+		for i := range sources {
+			sources[i] = &sequenceEmitter{numbers[i]}
+		}
+		for _ = range stitch(sources).Process() {
+		}
+	}
+}
+
+func BenchmarkStitchInputs(b *testing.B) {
+	merge := func(sources []Processor) Processor {
+		return NewMergeProcessor(sources)
+	}
+
+	for _, numSources := range []int{2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("Merge/%v", numSources), func(b *testing.B) {
+			benchmarkStitch(b, numSources, merge)
+		})
+		b.Run(fmt.Sprintf("TimeweaverChain/%v", numSources), func(b *testing.B) {
+			benchmarkStitch(b, numSources, timeweaverChain)
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package phonelab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics
+//
+// A Runner with Metrics set counts what goes through each node of each
+// pipeline: items in and out, time spent in LogHandler.Handle, time spent
+// blocked sending to the next node, and parse errors. Time spent in
+// DataCollector.OnData is counted as handle time for the DataCollector node.
+// Most channels between nodes are unbuffered, so there's no queue to measure
+// and a slow node shows up as send-blocked time in the node feeding it. The
+// exception is the Tee, which reports the depth of its queues.
+//
+// The processor primitives and sources find their counters through the context
+// they're started with, so only nodes started with ProcessContext are counted.
+// The builder names the nodes of each conf processor after it, e.g.
+// main/phonelab.LoglineProcessorHandler, so two processors with the same
+// generator get their own counters. Nodes with the same name in the same
+// pipeline share counters. Without Metrics, nothing is counted or timed.
+
+// The counters for a node in a pipeline. A nil *ProcessorMetrics is valid and
+// counts nothing.
+type ProcessorMetrics struct {
+	Name             string
+	itemsIn          int64
+	itemsOut         int64
+	handleNanos      int64
+	sendBlockedNanos int64
+	parseErrors      int64
+	queueDepth       int64
+	maxQueueDepth    int64
+}
+
+func (m *ProcessorMetrics) itemIn() {
+	if m != nil {
+		atomic.AddInt64(&m.itemsIn, 1)
+	}
+}
+
+// Count errors parsing items, e.g. from a LogHandler that implements
+// MetricsHandler.
+func (m *ProcessorMetrics) AddParseErrors(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.parseErrors, n)
+	}
+}
+
+// Items queued by the node went up or down by delta
+func (m *ProcessorMetrics) queueChanged(delta int64) {
+	if m == nil {
+		return
+	}
+	depth := atomic.AddInt64(&m.queueDepth, delta)
+	for {
+		max := atomic.LoadInt64(&m.maxQueueDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&m.maxQueueDepth, max, depth) {
+			return
+		}
+	}
+}
+
+func (m *ProcessorMetrics) addHandleTime(d time.Duration) {
+	if m != nil {
+		atomic.AddInt64(&m.handleNanos, int64(d))
+	}
+}
+
+// Call h.Handle(obj), timing it.
+func (m *ProcessorMetrics) handle(h LogHandler, obj interface{}) interface{} {
+	if m == nil {
+		return h.Handle(obj)
+	}
+	start := time.Now()
+	res := h.Handle(obj)
+	m.addHandleTime(time.Since(start))
+	return res
+}
+
+// sendContext, counting and timing the send.
+func (m *ProcessorMetrics) send(ctx context.Context, outChan chan<- interface{}, obj interface{}) bool {
+	if m == nil {
+		return sendContext(ctx, outChan, obj)
+	}
+	start := time.Now()
+	sent := sendContext(ctx, outChan, obj)
+	atomic.AddInt64(&m.sendBlockedNanos, int64(time.Since(start)))
+	if sent {
+		atomic.AddInt64(&m.itemsOut, 1)
+	}
+	return sent
+}
+
+func (m *ProcessorMetrics) Snapshot() *ProcessorMetricsSnapshot {
+	return &ProcessorMetricsSnapshot{
+		Name:               m.Name,
+		ItemsIn:            atomic.LoadInt64(&m.itemsIn),
+		ItemsOut:           atomic.LoadInt64(&m.itemsOut),
+		HandleSeconds:      time.Duration(atomic.LoadInt64(&m.handleNanos)).Seconds(),
+		SendBlockedSeconds: time.Duration(atomic.LoadInt64(&m.sendBlockedNanos)).Seconds(),
+		ParseErrors:        atomic.LoadInt64(&m.parseErrors),
+		QueueDepth:         atomic.LoadInt64(&m.queueDepth),
+		MaxQueueDepth:      atomic.LoadInt64(&m.maxQueueDepth),
+	}
+}
+
+// LogHandlers that implement MetricsHandler are given the counters for the
+// SimpleProcessor they run in, e.g. to count parse errors. m may be nil.
+type MetricsHandler interface {
+	LogHandler
+	SetMetrics(m *ProcessorMetrics)
+}
+
+type ProcessorMetricsSnapshot struct {
+	Name               string  `json:"name"`
+	ItemsIn            int64   `json:"items_in"`
+	ItemsOut           int64   `json:"items_out"`
+	HandleSeconds      float64 `json:"handle_seconds"`
+	SendBlockedSeconds float64 `json:"send_blocked_seconds"`
+	ParseErrors        int64   `json:"parse_errors"`
+	// Items waiting in the node's queues, now and at most
+	QueueDepth    int64 `json:"queue_depth,omitempty"`
+	MaxQueueDepth int64 `json:"max_queue_depth,omitempty"`
+}
+
+func (s *ProcessorMetricsSnapshot) add(other *ProcessorMetricsSnapshot) {
+	s.ItemsIn += other.ItemsIn
+	s.ItemsOut += other.ItemsOut
+	s.HandleSeconds += other.HandleSeconds
+	s.SendBlockedSeconds += other.SendBlockedSeconds
+	s.ParseErrors += other.ParseErrors
+	s.QueueDepth += other.QueueDepth
+	if other.MaxQueueDepth > s.MaxQueueDepth {
+		s.MaxQueueDepth = other.MaxQueueDepth
+	}
+}
+
+// The counters for the nodes of one pipeline
+type PipelineMetrics struct {
+	Info  PipelineSourceInfo
+	nodes map[string]*ProcessorMetrics
+	order []string
+	sync.Mutex
+}
+
+// The counters for the node called name
+func (pm *PipelineMetrics) Node(name string) *ProcessorMetrics {
+	pm.Lock()
+	defer pm.Unlock()
+
+	if m, ok := pm.nodes[name]; ok {
+		return m
+	}
+	m := &ProcessorMetrics{Name: name}
+	pm.nodes[name] = m
+	pm.order = append(pm.order, name)
+	return m
+}
+
+func (pm *PipelineMetrics) Snapshot() []*ProcessorMetricsSnapshot {
+	pm.Lock()
+	defer pm.Unlock()
+
+	res := make([]*ProcessorMetricsSnapshot, 0, len(pm.order))
+	for _, name := range pm.order {
+		res = append(res, pm.nodes[name].Snapshot())
+	}
+	return res
+}
+
+type pipelineMetricsKey struct{}
+
+func withPipelineMetrics(ctx context.Context, pm *PipelineMetrics) context.Context {
+	return context.WithValue(ctx, pipelineMetricsKey{}, pm)
+}
+
+type metricsScopeKey struct{}
+
+// The counters for the node called name in the pipeline ctx belongs to, or nil
+// if we aren't counting. The name is prefixed with the scope of ctx, if any.
+func nodeMetrics(ctx context.Context, name string) *ProcessorMetrics {
+	if pm, ok := ctx.Value(pipelineMetricsKey{}).(*PipelineMetrics); ok {
+		if scope, ok := ctx.Value(metricsScopeKey{}).(string); ok && len(scope) > 0 {
+			name = scope + "/" + name
+		}
+		return pm.Node(name)
+	}
+	return nil
+}
+
+// metricsScopeProcessor counts the nodes Source starts under Scope, e.g. the
+// name of the conf processor they were built for.
+type metricsScopeProcessor struct {
+	Scope  string
+	Source Processor
+}
+
+func (p *metricsScopeProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *metricsScopeProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	return ProcessContext(context.WithValue(ctx, metricsScopeKey{}, p.Scope), p.Source)
+}
+
+// The name to count a SimpleProcessor under, e.g.
+// phonelab.LoglineProcessorHandler
+func handlerMetricsName(h LogHandler) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", h), "*")
+}
+
+// The counters for every pipeline in a run
+type RunMetrics struct {
+	Started   time.Time
+	pipelines []*PipelineMetrics
+	sync.Mutex
+}
+
+func NewRunMetrics() *RunMetrics {
+	return &RunMetrics{
+		Started:   time.Now(),
+		pipelines: make([]*PipelineMetrics, 0),
+	}
+}
+
+// Start counting for a new pipeline
+func (rm *RunMetrics) newPipeline(info PipelineSourceInfo) *PipelineMetrics {
+	pm := &PipelineMetrics{
+		Info:  info,
+		nodes: make(map[string]*ProcessorMetrics),
+		order: make([]string, 0),
+	}
+
+	rm.Lock()
+	rm.pipelines = append(rm.pipelines, pm)
+	rm.Unlock()
+
+	return pm
+}
+
+type SourceMetrics struct {
+	Type       string                      `json:"type"`
+	Context    string                      `json:"context"`
+	Processors []*ProcessorMetricsSnapshot `json:"processors"`
+}
+
+type MetricsSummary struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// Per source
+	Sources []*SourceMetrics `json:"sources,omitempty"`
+	// Each node summed over all of the sources
+	Total []*ProcessorMetricsSnapshot `json:"total"`
+}
+
+// The counters so far. This can be called while the run is going.
+func (rm *RunMetrics) Summary() *MetricsSummary {
+	rm.Lock()
+	pipelines := append([]*PipelineMetrics{}, rm.pipelines...)
+	rm.Unlock()
+
+	summary := &MetricsSummary{
+		ElapsedSeconds: time.Since(rm.Started).Seconds(),
+		Sources:        make([]*SourceMetrics, 0, len(pipelines)),
+		Total:          make([]*ProcessorMetricsSnapshot, 0),
+	}
+
+	totals := make(map[string]*ProcessorMetricsSnapshot)
+
+	for _, pm := range pipelines {
+		source := &SourceMetrics{
+			Processors: pm.Snapshot(),
+		}
+		if pm.Info != nil {
+			source.Type = pm.Info.Type()
+			source.Context = pm.Info.Context()
+		}
+		summary.Sources = append(summary.Sources, source)
+
+		for _, s := range source.Processors {
+			if total, ok := totals[s.Name]; ok {
+				total.add(s)
+			} else {
+				total = &ProcessorMetricsSnapshot{Name: s.Name}
+				total.add(s)
+				totals[s.Name] = total
+				summary.Total = append(summary.Total, total)
+			}
+		}
+	}
+
+	return summary
+}
+
+func promEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+// Write the totals in the Prometheus text format. Per-source counters aren't
+// included, as there can be a lot of sources.
+func (rm *RunMetrics) WritePrometheus(w io.Writer) error {
+	summary := rm.Summary()
+
+	// Keep the output stable
+	sort.Slice(summary.Total, func(i, j int) bool {
+		return summary.Total[i].Name < summary.Total[j].Name
+	})
+
+	metrics := []struct {
+		name  string
+		help  string
+		gauge bool
+		get   func(s *ProcessorMetricsSnapshot) interface{}
+	}{
+		{"phonelab_processor_items_in_total", "Items read by a processor.", false,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.ItemsIn }},
+		{"phonelab_processor_items_out_total", "Items sent by a processor.", false,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.ItemsOut }},
+		{"phonelab_processor_handle_seconds_total", "Time spent in LogHandler.Handle.", false,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.HandleSeconds }},
+		{"phonelab_processor_send_blocked_seconds_total", "Time spent waiting for the next processor to take an item.", false,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.SendBlockedSeconds }},
+		{"phonelab_processor_parse_errors_total", "Items a processor failed to parse.", false,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.ParseErrors }},
+		{"phonelab_processor_queue_depth", "Items waiting in a processor's queues.", true,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.QueueDepth }},
+		{"phonelab_processor_max_queue_depth", "Most items waiting in a processor's queues at once.", true,
+			func(s *ProcessorMetricsSnapshot) interface{} { return s.MaxQueueDepth }},
+	}
+
+	for _, metric := range metrics {
+		kind := "counter"
+		if metric.gauge {
+			kind = "gauge"
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n",
+			metric.name, metric.help, metric.name, kind); err != nil {
+			return err
+		}
+		for _, s := range summary.Total {
+			if _, err := fmt.Fprintf(w, "%v{processor=\"%v\"} %v\n",
+				metric.name, promEscape(s.Name), metric.get(s)); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "# HELP phonelab_sources_total Sources started.\n"+
+		"# TYPE phonelab_sources_total counter\nphonelab_sources_total %v\n", len(summary.Sources))
+	return err
+}
+
+// Serve the totals in the Prometheus text format, e.g. on /metrics.
+func (rm *RunMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rm.WritePrometheus(w)
+}
@@ -0,0 +1,284 @@
+package phonelab
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Parses every line in the source.
+type parsingBuilder struct{}
+
+func (b *parsingBuilder) BuildPipeline(source *PipelineSourceInstance) (*Pipeline, error) {
+	return &Pipeline{
+		LastHop: NewLoglineProcessor(source.Processor, NewLoglineParser()),
+	}, nil
+}
+
+type countingCollector struct {
+	count int
+	sync.Mutex
+}
+
+func (c *countingCollector) OnData(data interface{}, info PipelineSourceInfo) {
+	c.Lock()
+	c.count += 1
+	c.Unlock()
+}
+
+func (c *countingCollector) Finish() {}
+
+// Write the first n lines of test/test.log followed by bad garbage lines.
+func writeMetricsTestFile(file string, n, bad int) error {
+	in, err := os.Open("./test/test.log")
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	lines := make([]string, 0, n+bad)
+	scanner := bufio.NewScanner(in)
+	for len(lines) < n && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	for i := 0; i < bad; i++ {
+		lines = append(lines, "not a logline")
+	}
+
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func TestRunnerMetrics(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-metrics")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	files := []string{filepath.Join(tmpDir, "a.log"), filepath.Join(tmpDir, "b.log")}
+	require.Nil(writeMetricsTestFile(files[0], 100, 3))
+	require.Nil(writeMetricsTestFile(files[1], 50, 7))
+
+	collector := &countingCollector{}
+	runner := NewRunner(NewTextFileSourceGenerator(files, nil), collector, &parsingBuilder{})
+	runner.Metrics = NewRunMetrics()
+
+	errs := runner.Run()
+	require.Equal(0, len(errs))
+	assert.Equal(160, collector.count)
+
+	summary := runner.Metrics.Summary()
+	require.Equal(2, len(summary.Sources))
+
+	expected := map[string][]int64{
+		files[0]: {103, 3},
+		files[1]: {57, 7},
+	}
+
+	for _, source := range summary.Sources {
+		assert.Equal("file", source.Type)
+		counts, ok := expected[source.Context]
+		require.True(ok, source.Context)
+
+		names := make([]string, 0)
+		for _, s := range source.Processors {
+			names = append(names, s.Name)
+			assert.Equal(counts[0], s.ItemsIn, s.Name)
+			if s.Name == "phonelab.LoglineProcessorHandler" {
+				assert.Equal(counts[1], s.ParseErrors)
+				assert.Equal(counts[0], s.ItemsOut)
+			} else {
+				assert.Equal(int64(0), s.ParseErrors, s.Name)
+			}
+		}
+		assert.ElementsMatch([]string{
+			"TextFileProcessor",
+			"phonelab.LoglineProcessorHandler",
+			"DataCollector",
+		}, names)
+	}
+
+	totals := make(map[string]*ProcessorMetricsSnapshot)
+	for _, s := range summary.Total {
+		totals[s.Name] = s
+	}
+	require.Equal(3, len(totals))
+	assert.Equal(int64(160), totals["TextFileProcessor"].ItemsIn)
+	assert.Equal(int64(160), totals["TextFileProcessor"].ItemsOut)
+	assert.Equal(int64(10), totals["phonelab.LoglineProcessorHandler"].ParseErrors)
+	assert.True(totals["phonelab.LoglineProcessorHandler"].HandleSeconds > 0)
+	assert.Equal(int64(160), totals["DataCollector"].ItemsIn)
+	assert.Equal(int64(0), totals["DataCollector"].ItemsOut)
+
+	// The summary is meant to be written out as JSON
+	b, err := json.Marshal(summary)
+	require.Nil(err)
+	assert.Contains(string(b), `"name":"TextFileProcessor","items_in":160,"items_out":160`)
+
+	// Prometheus
+	w := httptest.NewRecorder()
+	runner.Metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, "# TYPE phonelab_processor_items_in_total counter\n")
+	assert.Contains(body, `phonelab_processor_items_in_total{processor="TextFileProcessor"} 160`+"\n")
+	assert.Contains(body, `phonelab_processor_parse_errors_total{processor="phonelab.LoglineProcessorHandler"} 10`+"\n")
+	assert.Contains(body, "phonelab_sources_total 2\n")
+}
+
+func TestRunnerMetricsProcessorNames(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	env := NewEnvironment()
+	env.Processors["passthrough"] = &passThroughProcessorGen{}
+
+	// Two processors with the same generator, read from the same source
+	confString := `
+source:
+  type: files
+  sources: ["./test/test.log"]
+processors:
+  - name: main
+    generator: passthrough
+    inputs:
+      - name: pp1
+      - name: pp2
+  - name: pp1
+    generator: passthrough
+    has_logstream: true
+  - name: pp2
+    generator: passthrough
+    has_logstream: true
+sink:
+  name: main
+`
+	conf, err := RunnerConfFromString(confString)
+	require.Nil(err)
+	runner, err := conf.ToRunner(env)
+	require.Nil(err)
+	runner.Metrics = NewRunMetrics()
+	require.Equal(0, len(runner.Run()))
+
+	totals := make(map[string]*ProcessorMetricsSnapshot)
+	for _, s := range runner.Metrics.Summary().Total {
+		totals[s.Name] = s
+	}
+	for _, name := range []string{"pp1", "pp2"} {
+		require.Contains(totals, name+"/phonelab.passThroughHandler")
+		assert.Equal(int64(5000), totals[name+"/phonelab.passThroughHandler"].ItemsIn, name)
+	}
+	// Each logstream reads the source, which is counted once for the run
+	assert.Equal(int64(10000), totals["TextFileProcessor"].ItemsOut)
+	require.Contains(totals, "main/phonelab.passThroughHandler")
+	assert.Equal(int64(10000), totals["main/phonelab.passThroughHandler"].ItemsIn)
+	assert.Equal(int64(10000), totals["main/Merge"].ItemsOut)
+	assert.Equal(int64(10000), totals["DataCollector"].ItemsIn)
+}
+
+func TestTeeQueueMetrics(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	pm := NewRunMetrics().newPipeline(nil)
+	ctx := withPipelineMetrics(context.Background(), pm)
+
+	// Read one destination before the other, so everything is queued for
+	// the second one.
+	tee := NewTee(NewTextFileProcessor("./test/test.log", nil, nil), 2)
+	first := tee.ProcessContext(ctx)
+	second := tee.ProcessContext(ctx)
+	for _, c := range []<-chan interface{}{first, second} {
+		lines := 0
+		for range c {
+			lines += 1
+		}
+		assert.Equal(5000, lines)
+	}
+
+	metrics := pm.Node("Tee").Snapshot()
+	assert.Equal(int64(0), metrics.QueueDepth)
+	assert.True(metrics.MaxQueueDepth >= 5000, metrics.MaxQueueDepth)
+}
+
+func TestTeeMaxQueue(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	const ntee = 2
+	const iter = 1000
+
+	pm := NewRunMetrics().newPipeline(nil)
+	ctx := withPipelineMetrics(context.Background(), pm)
+
+	processor := NewTee(&emitter{iter}, ntee)
+	processor.MaxQueue = 10
+
+	resChans := make([]<-chan interface{}, ntee)
+	for i := 0; i < ntee; i++ {
+		resChans[i] = processor.ProcessContext(ctx)
+	}
+
+	// Read at the same time, as a full queue holds up every destination
+	counts := make(chan int)
+	for _, resChan := range resChans {
+		go func(resChan <-chan interface{}) {
+			count := 0
+			for range resChan {
+				count += 1
+			}
+			counts <- count
+		}(resChan)
+	}
+	for range resChans {
+		assert.Equal(iter, <-counts)
+	}
+
+	assert.True(pm.Node("Tee").Snapshot().MaxQueueDepth <= ntee*10)
+
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceStream,
+		Sources: []string{"-"},
+	}
+	for _, v := range []interface{}{-1, "10"} {
+		conf.Args = map[string]interface{}{"tee_max_queue": v}
+		errs := conf.check()
+		if assert.Equal(1, len(errs), "%v", v) {
+			assert.Equal("args.tee_max_queue", errs[0].Field)
+		}
+	}
+}
+
+func TestProcessorMetricsNil(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is counted without a RunMetrics, and nothing breaks.
+	var m *ProcessorMetrics
+	m.itemIn()
+	m.AddParseErrors(1)
+	m.addHandleTime(1)
+	assert.Nil(t, nodeMetrics(context.Background(), "TextFileProcessor"))
+
+	lines := 0
+	for _ = range NewLoglineProcessor(NewTextFileProcessor("./test/test.log", nil, nil), NewLoglineParser()).Process() {
+		lines += 1
+	}
+	assert.Equal(t, 5000, lines)
+}
@@ -0,0 +1,455 @@
+package phonelab
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/shaseley/phonelab-go/serialize"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DataCollectorParquetName = "parquet"
+
+	defaultParquetRowGroupSize = 65536
+	defaultParquetTemplate     = "{context}/{type}"
+)
+
+var parquetPathVars = []string{
+	PathVarDevice,
+	PathVarBootId,
+	PathVarContext,
+	PathVarSourceType,
+	PathVarFile,
+	PathVarDate,
+	PathVarType,
+}
+
+var parquetCodecs = map[string]compress.Codec{
+	"none":   &parquet.Uncompressed,
+	"snappy": &parquet.Snappy,
+	"gzip":   &parquet.Gzip,
+	"zstd":   &parquet.Zstd,
+}
+
+// ParquetCollector is a DataCollector that writes columnar Parquet files, with
+// a schema per record type. Records are flattened the same way as for the
+// CSVCollector, and the schema comes from the first record of each type.
+//
+// The files are laid out by the path template under the path, e.g. with
+//
+//	path: hdfs://namenode:9000/study
+//	path_template: device={device}/date={date}/{context}/{type}
+//
+// {date} comes from the record's Datetime, so a source can end up in several
+// files. The template needs {type}, since every file has one schema, and
+// {context}, since every source writes its own files. Row groups are written
+// out every row_group_size rows, so memory use doesn't grow with the data.
+type ParquetCollector struct {
+	// Base path or URL of the output destination
+	Path string
+	// Where in Path each file goes
+	Template *pathTemplate
+	// Number of rows per row group
+	RowGroupSize int
+	// Compression codec for the columns
+	Codec compress.Codec
+
+	// Open files, by source context and file URL
+	files map[string]map[string]*parquetFile
+	// The files that are done, by source context
+	outputs map[string][]string
+	sync.Mutex
+}
+
+type parquetFile struct {
+	url string
+	// Flattened column names by leaf column index
+	columns []string
+	kinds   []reflect.Kind
+	index   map[string]int
+	stream  io.WriteCloser
+	writer  *parquet.Writer
+	// Rows in the row group being written
+	groupRows    int
+	rowGroupSize int
+	// Columns we've already warned about dropping
+	dropped map[string]bool
+}
+
+// Create a ParquetCollector from generic args: path (required),
+// path_template, row_group_size and compression.
+func NewParquetCollector(args map[string]interface{}) (DataCollector, error) {
+	pathOrUrl := ""
+	if v, ok := args["path"]; ok {
+		if pathOrUrl, ok = v.(string); !ok {
+			return nil, fmt.Errorf("Unexpected type for 'path'. Expected string, got %T", v)
+		}
+	} else {
+		return nil, errors.New("Missing 'path' argument. A path is required for the parquet collector")
+	}
+
+	serializer, err := serialize.DetectSerializer(pathOrUrl)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := serializer.(serialize.StreamSerializer); !ok {
+		return nil, fmt.Errorf("Unsupported protocol in path '%v'", pathOrUrl)
+	}
+
+	templateString := defaultParquetTemplate
+	if v, ok := args["path_template"]; ok {
+		if templateString, ok = v.(string); !ok {
+			return nil, fmt.Errorf("Unexpected type for 'path_template'. Expected string, got %T", v)
+		}
+	}
+	template, err := parsePathTemplate(templateString, parquetPathVars)
+	if err != nil {
+		return nil, err
+	}
+	for _, required := range []string{PathVarType, PathVarContext} {
+		if !template.Has(required) {
+			return nil, fmt.Errorf("Path template '%v' needs '{%v}'", templateString, required)
+		}
+	}
+
+	rowGroupSize := defaultParquetRowGroupSize
+	if v, ok := args["row_group_size"]; ok {
+		if rowGroupSize, ok = v.(int); !ok || rowGroupSize <= 0 {
+			return nil, fmt.Errorf("Unexpected value for 'row_group_size'. Expected a positive int, got %v", v)
+		}
+	}
+
+	codec := parquetCodecs["snappy"]
+	if v, ok := args["compression"]; ok {
+		name, _ := v.(string)
+		if codec, ok = parquetCodecs[name]; !ok {
+			names := make([]string, 0, len(parquetCodecs))
+			for name := range parquetCodecs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unknown compression '%v'. Expected one of: %v", v, strings.Join(names, ", "))
+		}
+	}
+
+	return &ParquetCollector{
+		Path:         pathOrUrl,
+		Template:     template,
+		RowGroupSize: rowGroupSize,
+		Codec:        codec,
+		files:        make(map[string]map[string]*parquetFile),
+		outputs:      make(map[string][]string),
+	}, nil
+}
+
+func (c *ParquetCollector) makeOutUrl(vars map[string]string) string {
+	u, _ := url.Parse(c.Path)
+	u.Path = path.Join(u.Path, c.Template.Expand(vars)+".parquet")
+	return u.String()
+}
+
+// Sources run concurrently, so OnData may be called from multiple goroutines.
+func (c *ParquetCollector) OnData(data interface{}, info PipelineSourceInfo) {
+	typeName, f := flattenRecordKinds(data)
+
+	vars := sourcePathVars(info)
+	vars[PathVarType] = typeName
+	if c.Template.Has(PathVarDate) {
+		vars[PathVarDate] = recordDate(data)
+	}
+	outUrl := c.makeOutUrl(vars)
+
+	c.Lock()
+	defer c.Unlock()
+
+	context := info.Context()
+	files, ok := c.files[context]
+	if !ok {
+		files = make(map[string]*parquetFile)
+		c.files[context] = files
+	}
+
+	file, ok := files[outUrl]
+	if !ok {
+		// The first record makes the schema, and is written with it.
+		file, err := newParquetFile(outUrl, typeName, f, c.RowGroupSize, c.Codec)
+		if err != nil {
+			log.Errorf("Error writing %v: %v", typeName, err)
+		}
+		// Don't try again for every record if it failed.
+		files[outUrl] = file
+		return
+	} else if file == nil {
+		return
+	}
+
+	if err := file.write(f); err != nil {
+		log.Errorf("Error writing to %v: %v", file.url, err)
+	}
+}
+
+// Open a file with a schema for the flattened record.
+func newParquetFile(outUrl, typeName string, f *recordFlattener, rowGroupSize int,
+	codec compress.Codec) (*parquetFile, error) {
+
+	group := parquet.Group{}
+	kinds := make(map[string]reflect.Kind)
+	for i, col := range f.columns {
+		if _, ok := group[col]; ok {
+			continue
+		}
+		group[col] = parquet.Optional(parquetNode(f.kinds[i]))
+		kinds[col] = f.kinds[i]
+	}
+	schema := parquet.NewSchema(typeName, group)
+
+	file := &parquetFile{
+		url:          outUrl,
+		columns:      make([]string, 0, len(group)),
+		kinds:        make([]reflect.Kind, 0, len(group)),
+		index:        make(map[string]int),
+		rowGroupSize: rowGroupSize,
+		dropped:      make(map[string]bool),
+	}
+	// The schema has its own column order.
+	for i, colPath := range schema.Columns() {
+		col := colPath[0]
+		file.columns = append(file.columns, col)
+		file.kinds = append(file.kinds, kinds[col])
+		file.index[col] = i
+	}
+
+	stream, err := serialize.OpenStream(outUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %v: %v", outUrl, err)
+	}
+	file.stream = stream
+	file.writer = parquet.NewWriter(stream, schema, parquet.Compression(codec))
+	if err := file.write(f); err != nil {
+		file.close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func parquetNode(kind reflect.Kind) parquet.Node {
+	switch kind {
+	case reflect.Bool:
+		return parquet.Leaf(parquet.BooleanType)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return parquet.Int(64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return parquet.Uint(64)
+	case reflect.Float32, reflect.Float64:
+		return parquet.Leaf(parquet.DoubleType)
+	}
+	return parquet.String()
+}
+
+// The value for a column, or null if there isn't one or it doesn't fit the
+// column's type.
+func parquetValue(value string, kind reflect.Kind) parquet.Value {
+	if len(value) == 0 && kind != reflect.String {
+		return parquet.NullValue()
+	}
+
+	switch parquetNode(kind).Type() {
+	case parquet.BooleanType:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return parquet.BooleanValue(b)
+		}
+	case parquet.DoubleType:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return parquet.DoubleValue(f)
+		}
+	default:
+		switch kind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return parquet.Int64Value(i)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if u, err := strconv.ParseUint(value, 10, 64); err == nil {
+				return parquet.Int64Value(int64(u))
+			}
+		default:
+			return parquet.ByteArrayValue([]byte(value))
+		}
+	}
+	return parquet.NullValue()
+}
+
+func (p *parquetFile) write(f *recordFlattener) error {
+	values := make([]string, len(p.columns))
+	present := make([]bool, len(p.columns))
+	for i, col := range f.columns {
+		if j, ok := p.index[col]; ok {
+			values[j] = f.values[i]
+			present[j] = true
+		} else if !p.dropped[col] {
+			p.dropped[col] = true
+			log.Warnf("Dropping column '%v' from %v: it wasn't in the first record", col, p.url)
+		}
+	}
+
+	row := make(parquet.Row, len(p.columns))
+	for i := range p.columns {
+		value := parquet.NullValue()
+		if present[i] {
+			value = parquetValue(values[i], p.kinds[i])
+		}
+		if value.IsNull() {
+			row[i] = value.Level(0, 0, i)
+		} else {
+			row[i] = value.Level(0, 1, i)
+		}
+	}
+
+	if _, err := p.writer.WriteRows([]parquet.Row{row}); err != nil {
+		return err
+	}
+	if p.groupRows++; p.groupRows >= p.rowGroupSize {
+		p.groupRows = 0
+		return p.writer.Flush()
+	}
+	return nil
+}
+
+// Write the footer and close the stream.
+func (p *parquetFile) close() error {
+	err := p.writer.Close()
+	if cerr := p.stream.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close the files for the source.
+func (c *ParquetCollector) SourceDone(info PipelineSourceInfo) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closeFiles(info.Context())
+}
+
+// Must be called with the lock held.
+func (c *ParquetCollector) closeFiles(context string) {
+	files := c.files[context]
+	delete(c.files, context)
+
+	urls := make([]string, 0, len(files))
+	for outUrl, file := range files {
+		if file != nil {
+			urls = append(urls, outUrl)
+		}
+	}
+	sort.Strings(urls)
+
+	for _, outUrl := range urls {
+		if err := files[outUrl].close(); err != nil {
+			log.Errorf("Error closing %v: %v", outUrl, err)
+		} else {
+			c.outputs[context] = append(c.outputs[context], outUrl)
+		}
+	}
+}
+
+// Close anything still open, e.g. when used without a Runner.
+func (c *ParquetCollector) Finish() {
+	c.Lock()
+	defer c.Unlock()
+
+	for context := range c.files {
+		c.closeFiles(context)
+	}
+}
+
+// The files of the sources that didn't finish are closed with whatever made it
+// into them, so they're still readable.
+func (c *ParquetCollector) FinishPartial(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	for context := range c.files {
+		log.Warnf("Run did not finish (%v), files for '%v' are incomplete", err, context)
+		c.closeFiles(context)
+	}
+}
+
+// The output for a source is its files.
+func (c *ParquetCollector) Checkpoint(info PipelineSourceInfo) ([]string, interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	outputs := c.outputs[info.Context()]
+	delete(c.outputs, info.Context())
+	return outputs, nil, nil
+}
+
+// Finished sources' files are already where they belong.
+func (c *ParquetCollector) Restore(entries []*JournalEntry) error {
+	return nil
+}
+
+// ParquetSerializer is a serialize.Serializer that writes a record, or a slice
+// of records of the same type, as a Parquet file. It writes wherever
+// serialize.OpenStream can.
+type ParquetSerializer struct {
+	// Number of rows per row group
+	RowGroupSize int
+}
+
+func (s *ParquetSerializer) OutPath(path string) (string, error) {
+	serializer, err := serialize.DetectSerializer(path)
+	if err != nil {
+		return "", err
+	}
+	return serializer.OutPath(path)
+}
+
+func (s *ParquetSerializer) Serialize(obj interface{}, path string) error {
+	records := make([]interface{}, 0)
+	v := reflect.ValueOf(obj)
+	if v.IsValid() && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) {
+		for i := 0; i < v.Len(); i++ {
+			records = append(records, v.Index(i).Interface())
+		}
+	} else {
+		records = append(records, obj)
+	}
+	if len(records) == 0 {
+		return errors.New("Nothing to serialize: Parquet files need at least one record for the schema")
+	}
+
+	rowGroupSize := s.RowGroupSize
+	if rowGroupSize <= 0 {
+		rowGroupSize = defaultParquetRowGroupSize
+	}
+
+	typeName, f := flattenRecordKinds(records[0])
+	file, err := newParquetFile(path, typeName, f, rowGroupSize, parquetCodecs["snappy"])
+	if err != nil {
+		return err
+	}
+	for _, record := range records[1:] {
+		_, f = flattenRecordKinds(record)
+		if err = file.write(f); err != nil {
+			break
+		}
+	}
+	if cerr := file.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+package phonelab
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Read every row of a Parquet file, by column name.
+func readParquet(t *testing.T, file string) (*parquet.File, []map[string]parquet.Value) {
+	f, err := os.Open(file)
+	require.Nil(t, err)
+	defer f.Close()
+
+	stat, err := f.Stat()
+	require.Nil(t, err)
+	pf, err := parquet.OpenFile(f, stat.Size())
+	require.Nil(t, err)
+
+	columns := pf.Schema().Columns()
+	reader := parquet.NewReader(f)
+	defer reader.Close()
+
+	res := make([]map[string]parquet.Value, 0)
+	rows := make([]parquet.Row, 16)
+	for {
+		n, err := reader.ReadRows(rows)
+		for _, row := range rows[:n] {
+			m := make(map[string]parquet.Value)
+			for _, value := range row {
+				m[columns[value.Column()][0]] = value.Clone()
+			}
+			res = append(res, m)
+		}
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+	}
+	return pf, res
+}
+
+func TestParquetCollector(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-parquet")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	env := NewEnvironment()
+	env.Processors["payloads"] = &ProcessorGenWrapper{
+		Gen: func(source *PipelineSourceInstance, kwargs map[string]interface{}) Processor {
+			_, loglines := kwargs["loglines"]
+			return NewSimpleProcessor(source.Processor, &payloadHandler{loglines})
+		},
+	}
+
+	run := func(dir, sinkArgs, collectorArgs string) {
+		conf, err := RunnerConfFromString(`
+processors:
+  - name: payloads
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: simple
+        filter: "cpu_frequency"
+source:
+  type: files
+  sources: ["./test/test.log"]
+sink:
+  name: payloads
+  args: ` + sinkArgs + `
+data_collector:
+  name: parquet
+  args:
+    path: file://` + filepath.Join(tmpDir, dir) + `
+` + collectorArgs)
+		require.Nil(err)
+		runner, err := conf.ToRunner(env)
+		require.Nil(err)
+		require.Equal(0, len(runner.Run()))
+	}
+
+	run("payloads", "{}", "    row_group_size: 100\n")
+	pf, rows := readParquet(t, filepath.Join(tmpDir, "payloads/test/test.log/CpuFrequency.parquet"))
+	require.Equal(int64(427), pf.NumRows())
+	assert.Equal(5, len(pf.RowGroups()))
+	require.Equal(427, len(rows))
+	assert.Equal("kworker/2:2H-10277", rows[0]["trace_thread"].String())
+	assert.Equal(56250.330631, rows[0]["trace_timestamp"].Double())
+	assert.Equal(int64(1497600), rows[0]["state"].Int64())
+	assert.Equal(int64(2), rows[0]["cpu_id"].Int64())
+
+	// Partitioned by date
+	run("loglines", "{loglines: true}", "    path_template: date={date}/{context}/{type}\n    compression: zstd\n")
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "loglines/date=*/test/test.log/Logline_CpuFrequency.parquet"))
+	require.Nil(err)
+	require.Equal(1, len(matches))
+	_, rows = readParquet(t, matches[0])
+	require.Equal(427, len(rows))
+	assert.Equal("Kernel-Trace", rows[0]["tag"].String())
+	date := rows[0]["datetime"].String()[:10]
+	assert.Equal(filepath.Join(tmpDir, "loglines", "date="+date, "test/test.log/Logline_CpuFrequency.parquet"), matches[0])
+
+	for _, args := range []map[string]interface{}{
+		{},
+		{"path": "ftp://example.com/out"},
+		{"path": "file:///tmp/out", "path_template": "{device}/{type}"},
+		{"path": "file:///tmp/out", "path_template": "{context}/{tpye}"},
+		{"path": "file:///tmp/out", "compression": "lzma"},
+		{"path": "file:///tmp/out", "row_group_size": -1},
+	} {
+		_, err = NewParquetCollector(args)
+		assert.NotNil(err, args)
+	}
+}
+
+func TestParquetSerializer(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-parquet")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	type sample struct {
+		Name  string    `json:"name"`
+		Value *int      `json:"value"`
+		On    bool      `json:"on"`
+		When  time.Time `json:"when"`
+	}
+	one := 1
+	when := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	s := &ParquetSerializer{}
+	out := filepath.Join(tmpDir, "out/samples.parquet")
+	require.Nil(s.Serialize([]*sample{{"a", &one, true, when}, {"b", nil, false, when}}, "file://"+out))
+
+	_, rows := readParquet(t, out)
+	require.Equal(2, len(rows))
+	assert.Equal("a", rows[0]["name"].String())
+	assert.Equal(int64(1), rows[0]["value"].Int64())
+	assert.True(rows[0]["on"].Boolean())
+	assert.Equal("2017-03-01T12:00:00Z", rows[0]["when"].String())
+	assert.True(rows[1]["value"].IsNull())
+
+	assert.NotNil(s.Serialize([]*sample{}, "file://"+out))
+	_, err = s.OutPath("foo://bar")
+	assert.NotNil(err)
+}
+
+func TestPathTemplate(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	template, err := parsePathTemplate("device={device}/{date}/{context}/{type}", parquetPathVars)
+	require.Nil(err)
+	assert.True(template.Has(PathVarDevice))
+	assert.False(template.Has(PathVarBootId))
+	assert.Equal("device=dev/unknown/test/test.log/Healthd", template.Expand(map[string]string{
+		PathVarDevice:  "dev",
+		PathVarContext: "./test/test.log",
+		PathVarType:    "Healthd",
+	}))
+
+	// Nothing gets out of the base path
+	template, err = parsePathTemplate("../{context}", parquetPathVars)
+	require.Nil(err)
+	assert.Equal("a/b", template.Expand(map[string]string{PathVarContext: "/../a/b"}))
+
+	for template, expected := range map[string]string{
+		"{devise}":   "Did you mean '{device}'?",
+		"{foo}":      "Expected one of",
+		"{context":   "Unclosed",
+		"context}":   "Unmatched",
+		"{context}}": "Unmatched",
+	} {
+		_, err := parsePathTemplate(template, parquetPathVars)
+		if assert.NotNil(err, template) {
+			assert.Contains(err.Error(), expected, template)
+		}
+	}
+
+	assert.Equal("2017-03-01", recordDate(&Logline{Datetime: time.Date(2017, 3, 1, 23, 0, 0, 0, time.UTC)}))
+	assert.Equal("", recordDate(&Logline{}))
+	assert.Equal("", recordDate(42))
+}
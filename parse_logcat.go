@@ -24,6 +24,13 @@ type Logline struct {
 	Tid           int32     `logcat:"tid"`
 	Level         string    `logcat:"level"`
 	Tag           string    `logcat:"tag"`
+	// The stock logcat format the line was in, or empty for the PhoneLab
+	// formats, which have every field. The stock formats have no BootId,
+	// LogcatToken or TraceTime, so LogcatParser makes them up.
+	Format LogcatFormat `logcat:"format"`
+	// The line was in a stock format without the year and the parser wasn't
+	// given one, so the Datetime is in year 0.
+	NoYear bool `logcat:"-"`
 
 	// This will be a string or object, depending on if it has been parsed.
 	Payload interface{} `logcat:"-"`
@@ -70,12 +77,23 @@ type LogcatParser struct {
 
 	// Parameters
 	StoreLogline bool
+	// The format of the lines. The default, LogcatFormatAuto, works it out
+	// from each line.
+	Format LogcatFormat
+	// The year for the stock formats that leave it out. If 0, those
+	// loglines are marked NoYear.
+	Year int
 
 	// Private
 	curPattern   int
 	startPattern int
 	l            sync.Mutex
 
+	// For the stock formats
+	token      int64
+	lastFormat LogcatFormat
+	longHeader *Logline
+
 	fieldParser *logcatFieldParser
 }
 
@@ -87,6 +105,7 @@ func NewLogcatParser() *LogcatParser {
 		curPattern:   0,
 		startPattern: 0,
 		StoreLogline: true,
+		Format:       LogcatFormatAuto,
 		fieldParser:  newLogcatFieldParser(),
 	}
 	parser.RegexParser = NewMultRegexParser(parser)
@@ -104,10 +123,25 @@ func (p *LogcatParser) Regex() []*regexp.Regexp {
 var ConfigDoNewParse = true
 var ConfigDoNewNewParse = false
 
+// Parse a line. The Logline is nil, with no error, only for the lines of the
+// long format that hold no logline of their own: its headers and the blank
+// lines after their payloads.
 func (p *LogcatParser) Parse(line string) (*Logline, error) {
 
 	if ConfigDoNewParse {
-		return parseLoglineString(line)
+		switch p.Format {
+		case "", LogcatFormatAuto:
+			ll, err := parseLoglineString(line)
+			// Blank lines end the payload of the long format
+			if err == errUnsupportedLogcatFormat || err == errBlankLogline {
+				return p.parseStock(line)
+			}
+			return ll, err
+		case LogcatFormatPhonelab, LogcatFormatTraceTime:
+			return parseLoglineString(line)
+		default:
+			return p.parseStock(line)
+		}
 	} else if ConfigDoNewNewParse {
 		return p.fieldParser.Parse(line)
 	}
@@ -552,7 +586,7 @@ func parseLoglineString(line string) (*Logline, error) {
 
 	firstField, ok := parser.nextToken()
 	if !ok {
-		return nil, errors.New("LC Parser Error: Invalid line")
+		return nil, errBlankLogline
 	}
 
 	if len(firstField) == 40 {
@@ -560,10 +594,15 @@ func parseLoglineString(line string) (*Logline, error) {
 	} else if len(firstField) == 36 {
 		return parser.parseLoglineTraceTimeFmt()
 	} else {
-		return nil, errors.New("LC Parser Error: Unsupported logcat format")
+		return nil, errUnsupportedLogcatFormat
 	}
 }
 
+var (
+	errBlankLogline            = errors.New("LC Parser Error: Invalid line")
+	errUnsupportedLogcatFormat = errors.New("LC Parser Error: Unsupported logcat format")
+)
+
 ////////////////////////////////////////////////////////////////////////////////
 // New Format (Field Declaration)
 
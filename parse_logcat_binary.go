@@ -0,0 +1,492 @@
+package phonelab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Binary Android logs: the logger_entry records that logcat -B writes and
+// logd buffers are saved as, and the pmsg records in pstore. Each record is
+// decoded into a LoggerEntry, and LoggerEntryParser turns those into
+// Loglines, so that they can go through the same tag parsers as text logs.
+
+// The Format of Loglines from binary logs
+const LogcatFormatBinary LogcatFormat = "binary"
+
+// How the records are framed
+type LoggerFraming string
+
+const (
+	// struct logger_entry, as written by logcat -B. This is the default.
+	LoggerFramingLogger LoggerFraming = "logger"
+	// The pmsg records that end up in /sys/fs/pstore/pmsg-ramoops-*
+	LoggerFramingPmsg LoggerFraming = "pmsg"
+)
+
+var loggerFramings = []string{string(LoggerFramingLogger), string(LoggerFramingPmsg)}
+
+func ParseLoggerFraming(s string) (LoggerFraming, error) {
+	if len(s) == 0 {
+		return LoggerFramingLogger, nil
+	}
+	for _, framing := range loggerFramings {
+		if s == framing {
+			return LoggerFraming(s), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid framing '%v'. Expected one of: %v", s, strings.Join(loggerFramings, ", "))
+}
+
+// The log buffers (log_id_t). Their order is their ID.
+var logBuffers = []string{"main", "radio", "events", "system", "crash", "stats", "security", "kernel"}
+
+const (
+	LogIdMain     = 0
+	LogIdEvents   = 2
+	LogIdStats    = 5
+	LogIdSecurity = 6
+	// The record didn't say which buffer it's from
+	LogIdUnknown = -1
+)
+
+// The ID of a log buffer from its name. An empty name is LogIdUnknown.
+func ParseLogBuffer(s string) (int, error) {
+	if len(s) == 0 {
+		return LogIdUnknown, nil
+	}
+	for id, name := range logBuffers {
+		if s == name {
+			return id, nil
+		}
+	}
+	return LogIdUnknown, fmt.Errorf("Invalid log buffer '%v'. Expected one of: %v", s, strings.Join(logBuffers, ", "))
+}
+
+// Whether the entries of a buffer are binary events rather than text
+func isEventBuffer(id int) bool {
+	return id == LogIdEvents || id == LogIdStats || id == LogIdSecurity
+}
+
+// Header sizes of the logger_entry versions. Version 1 has no hdr_size and
+// leaves it 0. Versions 2 and 3 are the same size; 2 has the euid where 3
+// has the log ID, so it is read as 3.
+const (
+	loggerEntryV1HeaderSize = 20
+	loggerEntryV3HeaderSize = 24
+	loggerEntryV4HeaderSize = 28
+	// android_pmsg_log_header_t and android_log_header_t
+	pmsgHeaderSize = 18
+	pmsgMagic      = 'l'
+)
+
+// A record of a binary log
+type LoggerEntry struct {
+	// 1, 3 or 4 for logger_entry, and 0 for pmsg
+	Version int
+	Pid     int32
+	Tid     int32
+	Sec     uint32
+	Nsec    uint32
+	// The buffer the entry is from, or LogIdUnknown for version 1
+	LogId int
+	// Version 4 and pmsg only
+	Uid uint32
+	// The priority, tag and message of text buffers, or the event of event
+	// buffers
+	Payload []byte
+}
+
+// Reads LoggerEntries one after the other
+type LoggerEntryReader struct {
+	Framing LoggerFraming
+	r       *bufio.Reader
+	header  []byte
+}
+
+func NewLoggerEntryReader(r io.Reader, framing LoggerFraming) *LoggerEntryReader {
+	return &LoggerEntryReader{
+		Framing: framing,
+		r:       bufio.NewReader(r),
+		header:  make([]byte, loggerEntryV4HeaderSize),
+	}
+}
+
+// The next entry. The error is io.EOF at the end, and io.ErrUnexpectedEOF
+// if an entry is cut off.
+func (lr *LoggerEntryReader) Next() (*LoggerEntry, error) {
+	if lr.Framing == LoggerFramingPmsg {
+		return lr.nextPmsg()
+	}
+
+	header := lr.header[:4]
+	if _, err := io.ReadFull(lr.r, header); err != nil {
+		return nil, err
+	}
+	payloadLen := int(binary.LittleEndian.Uint16(header[0:]))
+	headerSize := int(binary.LittleEndian.Uint16(header[2:]))
+
+	entry := &LoggerEntry{
+		LogId: LogIdUnknown,
+	}
+	switch headerSize {
+	case 0:
+		entry.Version = 1
+		headerSize = loggerEntryV1HeaderSize
+	case loggerEntryV3HeaderSize:
+		entry.Version = 3
+	case loggerEntryV4HeaderSize:
+		entry.Version = 4
+	default:
+		return nil, fmt.Errorf("Invalid logger_entry header size: %v", headerSize)
+	}
+
+	header = lr.header[:headerSize]
+	if _, err := io.ReadFull(lr.r, header[4:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	entry.Pid = int32(binary.LittleEndian.Uint32(header[4:]))
+	entry.Tid = int32(binary.LittleEndian.Uint32(header[8:]))
+	entry.Sec = binary.LittleEndian.Uint32(header[12:])
+	entry.Nsec = binary.LittleEndian.Uint32(header[16:])
+	if entry.Version >= 3 {
+		entry.LogId = int(binary.LittleEndian.Uint32(header[20:]))
+	}
+	if entry.Version >= 4 {
+		entry.Uid = binary.LittleEndian.Uint32(header[24:])
+	}
+
+	entry.Payload = make([]byte, payloadLen)
+	if _, err := io.ReadFull(lr.r, entry.Payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return entry, nil
+}
+
+func (lr *LoggerEntryReader) nextPmsg() (*LoggerEntry, error) {
+	header := lr.header[:pmsgHeaderSize]
+	if _, err := io.ReadFull(lr.r, header[:1]); err != nil {
+		return nil, err
+	}
+	if header[0] != pmsgMagic {
+		return nil, fmt.Errorf("Invalid pmsg magic: %#x", header[0])
+	}
+	if _, err := io.ReadFull(lr.r, header[1:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	// The length includes the headers
+	totalLen := int(binary.LittleEndian.Uint16(header[1:]))
+	if totalLen < pmsgHeaderSize {
+		return nil, fmt.Errorf("Invalid pmsg length: %v", totalLen)
+	}
+	entry := &LoggerEntry{
+		Uid:   uint32(binary.LittleEndian.Uint16(header[3:])),
+		Pid:   int32(binary.LittleEndian.Uint16(header[5:])),
+		LogId: int(header[7]),
+		Tid:   int32(binary.LittleEndian.Uint16(header[8:])),
+		Sec:   binary.LittleEndian.Uint32(header[10:]),
+		Nsec:  binary.LittleEndian.Uint32(header[14:]),
+	}
+
+	entry.Payload = make([]byte, totalLen-pmsgHeaderSize)
+	if _, err := io.ReadFull(lr.r, entry.Payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return entry, nil
+}
+
+// Once part of an entry has been read, the end of the file is an error
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// The event log tags, from /system/etc/event-log-tags, by number
+type EventLogTags map[uint32]*EventLogTag
+
+type EventLogTag struct {
+	Name string
+	// The names of the values in the event's list, if the tag has them
+	Fields []string
+}
+
+var EVENT_LOG_FIELD_PATTERN = regexp.MustCompile(`\(\s*([^|)]*?)\s*\|`)
+
+// Read an event-log-tags file. Each line is a tag number, its name and,
+// optionally, its fields, e.g.
+//
+//	30010 am_proc_bound (User|1|5),(PID|1|5),(Process Name|3)
+//
+// Blank lines and comments starting with '#' are skipped.
+func ParseEventLogTags(r io.Reader) (EventLogTags, error) {
+	tags := make(EventLogTags)
+
+	scanner := newLineScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("Invalid event log tag on line %v: %v", lineNum, line)
+		}
+		number, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid event log tag number on line %v: %v", lineNum, parts[0])
+		}
+
+		tag := &EventLogTag{
+			Name:   parts[1],
+			Fields: make([]string, 0),
+		}
+		if len(parts) == 3 {
+			for _, m := range EVENT_LOG_FIELD_PATTERN.FindAllStringSubmatch(parts[2], -1) {
+				tag.Fields = append(tag.Fields, m[1])
+			}
+		}
+		tags[uint32(number)] = tag
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// The payload of an entry from an event buffer
+type EventLog struct {
+	TagNumber uint32
+	// The tag's name, or its number if it isn't in the EventLogTags
+	Tag string
+	// int32, int64, float32, string or a []interface{} of them
+	Value interface{}
+	// The names of the values of a list, if the tag has them
+	Fields []string
+}
+
+// The value of a field of the event, by its name. ok is false if the event
+// doesn't have it.
+func (e *EventLog) Field(name string) (value interface{}, ok bool) {
+	values, isList := e.Value.([]interface{})
+	if !isList {
+		return nil, false
+	}
+	for i, field := range e.Fields {
+		if field == name && i < len(values) {
+			return values[i], true
+		}
+	}
+	return nil, false
+}
+
+// The event as logcat prints it, e.g. [0,1234,com.android.phone]
+func (e *EventLog) String() string {
+	return formatEventValue(e.Value)
+}
+
+func formatEventValue(value interface{}) string {
+	if values, ok := value.([]interface{}); ok {
+		strs := make([]string, len(values))
+		for i, v := range values {
+			strs[i] = formatEventValue(v)
+		}
+		return "[" + strings.Join(strs, ",") + "]"
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// The types of event values
+const (
+	eventTypeInt    = 0
+	eventTypeLong   = 1
+	eventTypeString = 2
+	eventTypeList   = 3
+	eventTypeFloat  = 4
+)
+
+// Decode the payload of an event entry: the tag number, then a value.
+func decodeEvent(payload []byte, tags EventLogTags) (*EventLog, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("Event is too short: %v bytes", len(payload))
+	}
+	event := &EventLog{
+		TagNumber: binary.LittleEndian.Uint32(payload),
+	}
+	if tag, ok := tags[event.TagNumber]; ok {
+		event.Tag = tag.Name
+		event.Fields = tag.Fields
+	} else {
+		event.Tag = strconv.FormatUint(uint64(event.TagNumber), 10)
+	}
+
+	// Some events are just the tag
+	if len(payload) == 4 {
+		return event, nil
+	}
+	value, _, err := decodeEventValue(payload[4:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid event %v: %v", event.Tag, err)
+	}
+	event.Value = value
+	return event, nil
+}
+
+// Decode a typed value, and return what is left after it
+func decodeEventValue(b []byte) (interface{}, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	valueType, b := b[0], b[1:]
+
+	switch valueType {
+	case eventTypeInt:
+		if len(b) < 4 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return int32(binary.LittleEndian.Uint32(b)), b[4:], nil
+	case eventTypeLong:
+		if len(b) < 8 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return int64(binary.LittleEndian.Uint64(b)), b[8:], nil
+	case eventTypeFloat:
+		if len(b) < 4 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), b[4:], nil
+	case eventTypeString:
+		if len(b) < 4 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		b = b[4:]
+		if n < 0 || len(b) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return string(b[:n]), b[n:], nil
+	case eventTypeList:
+		if len(b) < 1 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		count := int(b[0])
+		b = b[1:]
+		values := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			var value interface{}
+			var err error
+			if value, b, err = decodeEventValue(b); err != nil {
+				return nil, nil, err
+			}
+			values = append(values, value)
+		}
+		return values, b, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown event value type %v", valueType)
+}
+
+// The letters of the priorities (android_LogPriority)
+const logPriorityLevels = "??VDIWEFS"
+
+func logPriorityLevel(priority byte) string {
+	if int(priority) < len(logPriorityLevels) {
+		return logPriorityLevels[priority : priority+1]
+	}
+	return "?"
+}
+
+// Turns LoggerEntries into Loglines. Like the stock logcat formats, binary
+// logs have no boot ID, so BootId is left empty, LogcatToken counts the
+// entries from 1 and TraceTime is the Datetime in seconds since the epoch.
+//
+// Entries from text buffers have a string Payload, which the LoglineParser
+// can parse further by tag. Entries from event buffers have an *EventLog
+// Payload, and the event's tag as their Tag.
+type LoggerEntryParser struct {
+	// The buffer of every entry, for logs whose entries don't say, e.g. a
+	// version 1 logcat -B of the events buffer. LogIdUnknown to go by the
+	// entries, which are text if they don't say.
+	Buffer int
+	// The names of the event tags. Events without one are named by their
+	// number.
+	EventTags EventLogTags
+
+	token int64
+	l     sync.Mutex
+}
+
+func NewLoggerEntryParser() *LoggerEntryParser {
+	return &LoggerEntryParser{
+		Buffer:    LogIdUnknown,
+		EventTags: make(EventLogTags),
+	}
+}
+
+func (p *LoggerEntryParser) Parse(entry *LoggerEntry) (*Logline, error) {
+	datetime := time.Unix(int64(entry.Sec), int64(entry.Nsec)).In(est)
+	ll := &Logline{
+		Datetime:      datetime,
+		DatetimeNanos: int64(entry.Nsec),
+		TraceTime:     float64(entry.Sec) + float64(entry.Nsec)/1e9,
+		Pid:           entry.Pid,
+		Tid:           entry.Tid,
+		Format:        LogcatFormatBinary,
+	}
+
+	buffer := p.Buffer
+	if buffer == LogIdUnknown {
+		buffer = entry.LogId
+	}
+
+	if isEventBuffer(buffer) {
+		event, err := decodeEvent(entry.Payload, p.EventTags)
+		if err != nil {
+			return nil, err
+		}
+		ll.Level = "I"
+		ll.Tag = event.Tag
+		ll.Payload = event
+	} else {
+		// The priority, then the tag and message, each ending in a NUL.
+		// Messages that were cut short may be missing theirs.
+		if len(entry.Payload) < 2 {
+			return nil, fmt.Errorf("Log entry is too short: %v bytes", len(entry.Payload))
+		}
+		ll.Level = logPriorityLevel(entry.Payload[0])
+		rest := entry.Payload[1:]
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return nil, fmt.Errorf("Log entry has no end to its tag")
+		}
+		ll.Tag = string(rest[:end])
+		message := rest[end+1:]
+		if end := bytes.IndexByte(message, 0); end >= 0 {
+			message = message[:end]
+		}
+		ll.Payload = strings.TrimRight(string(message), "\n")
+	}
+
+	// The line is what logcat -v threadtime would print
+	ll.Line = fmt.Sprintf("%v %5d %5d %v %v: %v", datetime.Format("01-02 15:04:05.000"),
+		ll.Pid, ll.Tid, ll.Level, ll.Tag, ll.Payload)
+
+	p.l.Lock()
+	p.token += 1
+	ll.LogcatToken = p.token
+	p.l.Unlock()
+	return ll, nil
+}
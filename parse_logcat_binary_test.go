@@ -0,0 +1,329 @@
+package phonelab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A logger_entry of the given version
+func loggerEntryBytes(version int, logId uint32, pid, tid int32, sec, nsec uint32, payload []byte) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, uint16(len(payload)))
+	switch version {
+	case 1:
+		binary.Write(&b, le, uint16(0))
+	case 3:
+		binary.Write(&b, le, uint16(loggerEntryV3HeaderSize))
+	case 4:
+		binary.Write(&b, le, uint16(loggerEntryV4HeaderSize))
+	}
+	binary.Write(&b, le, pid)
+	binary.Write(&b, le, tid)
+	binary.Write(&b, le, sec)
+	binary.Write(&b, le, nsec)
+	if version >= 3 {
+		binary.Write(&b, le, logId)
+	}
+	if version >= 4 {
+		binary.Write(&b, le, uint32(10001))
+	}
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func textPayload(priority byte, tag string, message string) []byte {
+	return []byte(string([]byte{priority}) + tag + "\x00" + message + "\x00")
+}
+
+// The tag, then a list of an int, a long, a string and a float
+func eventPayload(tag uint32) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, tag)
+	b.Write([]byte{eventTypeList, 4})
+	b.WriteByte(eventTypeInt)
+	binary.Write(&b, le, int32(-5))
+	b.WriteByte(eventTypeLong)
+	binary.Write(&b, le, int64(1)<<40)
+	b.WriteByte(eventTypeString)
+	binary.Write(&b, le, uint32(len("com.android.phone")))
+	b.WriteString("com.android.phone")
+	b.WriteByte(eventTypeFloat)
+	binary.Write(&b, le, math.Float32bits(0.5))
+	return b.Bytes()
+}
+
+func TestLoggerEntryReader(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var data bytes.Buffer
+	data.Write(loggerEntryBytes(1, 0, 100, 101, 1577934245, 678000000, textPayload(4, "ActivityManager", "v1")))
+	data.Write(loggerEntryBytes(3, LogIdEvents, 200, 201, 1577934246, 0, eventPayload(30010)))
+	data.Write(loggerEntryBytes(4, 3, 300, 301, 1577934247, 5, textPayload(6, "SystemServer", "v4\n")))
+
+	reader := NewLoggerEntryReader(&data, LoggerFramingLogger)
+	entries := make([]*LoggerEntry, 0)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(err)
+		entries = append(entries, entry)
+	}
+	require.Equal(3, len(entries))
+
+	assert.Equal(1, entries[0].Version)
+	assert.Equal(LogIdUnknown, entries[0].LogId)
+	assert.Equal(int32(100), entries[0].Pid)
+	assert.Equal(int32(101), entries[0].Tid)
+	assert.Equal(uint32(678000000), entries[0].Nsec)
+	assert.Equal(3, entries[1].Version)
+	assert.Equal(LogIdEvents, entries[1].LogId)
+	assert.Equal(4, entries[2].Version)
+	assert.Equal(3, entries[2].LogId)
+	assert.Equal(uint32(10001), entries[2].Uid)
+
+	parser := NewLoggerEntryParser()
+	parser.EventTags = EventLogTags{30010: {"am_proc_bound", []string{"User", "PID", "Process Name", "Load"}}}
+
+	ll, err := parser.Parse(entries[0])
+	require.Nil(err)
+	assert.Equal(LogcatFormatBinary, ll.Format)
+	assert.Equal("I", ll.Level)
+	assert.Equal("ActivityManager", ll.Tag)
+	assert.Equal("v1", ll.Payload)
+	assert.Equal(int64(1), ll.LogcatToken)
+	assert.InDelta(1577934245.678, ll.MonotonicTimestamp(), 1e-6)
+	assert.Equal("2020-01-01 22:04:05.678", ll.Datetime.Format("2006-01-02 15:04:05.000"))
+	assert.Equal("01-01 22:04:05.678   100   101 I ActivityManager: v1", ll.Line)
+
+	ll, err = parser.Parse(entries[1])
+	require.Nil(err)
+	assert.Equal("am_proc_bound", ll.Tag)
+	event := ll.Payload.(*EventLog)
+	assert.Equal(uint32(30010), event.TagNumber)
+	assert.Equal([]interface{}{int32(-5), int64(1) << 40, "com.android.phone", float32(0.5)}, event.Value)
+	name, ok := event.Field("Process Name")
+	assert.True(ok)
+	assert.Equal("com.android.phone", name)
+	_, ok = event.Field("UID")
+	assert.False(ok)
+	assert.Equal("[-5,1099511627776,com.android.phone,0.5]", event.String())
+
+	// The trailing newline goes
+	ll, err = parser.Parse(entries[2])
+	require.Nil(err)
+	assert.Equal("E", ll.Level)
+	assert.Equal("v4", ll.Payload)
+	assert.Equal(int64(3), ll.LogcatToken)
+
+	// Unknown tags are named by their number
+	ll, err = NewLoggerEntryParser().Parse(entries[1])
+	require.Nil(err)
+	assert.Equal("30010", ll.Tag)
+
+	// Version 1 entries can be from the events buffer too
+	parser.Buffer = LogIdEvents
+	entry := *entries[1]
+	entry.LogId = LogIdUnknown
+	ll, err = parser.Parse(&entry)
+	require.Nil(err)
+	assert.Equal("am_proc_bound", ll.Tag)
+
+	// Cut off
+	b := loggerEntryBytes(4, 0, 1, 1, 1, 1, textPayload(4, "Tag", "message"))
+	_, err = NewLoggerEntryReader(bytes.NewReader(b[:len(b)-2]), LoggerFramingLogger).Next()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	b[2] = 17
+	_, err = NewLoggerEntryReader(bytes.NewReader(b), LoggerFramingLogger).Next()
+	assert.NotNil(err)
+}
+
+func TestPmsgEntryReader(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	payload := textPayload(3, "pmsg", "from pstore")
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.WriteByte(pmsgMagic)
+	binary.Write(&b, le, uint16(pmsgHeaderSize+len(payload)))
+	binary.Write(&b, le, uint16(1000))
+	binary.Write(&b, le, uint16(123))
+	b.WriteByte(LogIdMain)
+	binary.Write(&b, le, uint16(124))
+	binary.Write(&b, le, uint32(1577934245))
+	binary.Write(&b, le, uint32(0))
+	b.Write(payload)
+
+	reader := NewLoggerEntryReader(&b, LoggerFramingPmsg)
+	entry, err := reader.Next()
+	require.Nil(err)
+	assert.Equal(int32(123), entry.Pid)
+	assert.Equal(int32(124), entry.Tid)
+	assert.Equal(uint32(1000), entry.Uid)
+	ll, err := NewLoggerEntryParser().Parse(entry)
+	require.Nil(err)
+	assert.Equal("D", ll.Level)
+	assert.Equal("pmsg", ll.Tag)
+	assert.Equal("from pstore", ll.Payload)
+
+	_, err = reader.Next()
+	assert.Equal(io.EOF, err)
+
+	_, err = NewLoggerEntryReader(strings.NewReader("x"), LoggerFramingPmsg).Next()
+	assert.NotNil(err)
+}
+
+func TestParseEventLogTags(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tags, err := ParseEventLogTags(strings.NewReader(`
+# The tags
+42 answer (to life the universe etc|3)
+2722 battery_level (level|1|6),(voltage|1|1),(temperature|1|1)
+30010 am_proc_bound
+`))
+	assert.Nil(err)
+	assert.Equal(3, len(tags))
+	assert.Equal("battery_level", tags[2722].Name)
+	assert.Equal([]string{"level", "voltage", "temperature"}, tags[2722].Fields)
+	assert.Equal([]string{"to life the universe etc"}, tags[42].Fields)
+	assert.Equal(0, len(tags[30010].Fields))
+
+	_, err = ParseEventLogTags(strings.NewReader("am_proc_bound 30010"))
+	assert.NotNil(err)
+}
+
+func TestBinaryLogSource(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-binary")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	var data bytes.Buffer
+	data.Write(loggerEntryBytes(4, LogIdMain, 200, 200, 1466875491, 291000001,
+		textPayload(3, TAG_PRINTK, "<6>[   21.512807] msm_thermal: Allow Online CPU3 Temp: 66")))
+	data.Write(loggerEntryBytes(4, LogIdEvents, 300, 301, 1466875492, 0, eventPayload(30010)))
+	// Not enough payload for the tag
+	data.Write(loggerEntryBytes(4, LogIdEvents, 300, 301, 1466875492, 0, []byte{1}))
+	data.Write(loggerEntryBytes(4, LogIdMain, 400, 401, 1466875493, 0, textPayload(4, "Other", "done")))
+	logFile := filepath.Join(tmpDir, "logcat.bin")
+	require.Nil(ioutil.WriteFile(logFile, data.Bytes(), 0644))
+	tagsFile := filepath.Join(tmpDir, "event-log-tags")
+	require.Nil(ioutil.WriteFile(tagsFile, []byte("30010 am_proc_bound (User|1|5),(PID|1|5)\n"), 0644))
+
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceBinary,
+		Sources: []string{filepath.Join(tmpDir, "*.bin")},
+		Args:    map[string]interface{}{"event_tags": tagsFile},
+	}
+	gen, err := conf.ToPipelineSourceGenerator()
+	require.Nil(err)
+
+	// The tag parsers work as they do for text logs
+	parser := NewLoglineParser()
+	parser.SetParser(TAG_PRINTK, NewPrintkParser())
+
+	errs := make([]error, 0)
+	gen.(*BinaryLogSourceGenerator).ErrHandler = func(err error) { errs = append(errs, err) }
+
+	results := make([]interface{}, 0)
+	for source := range gen.Process() {
+		assert.Equal("binary", source.Info.Type())
+		filter := NewStringFilterProcessor(source.Processor, []StringFilter{makeRegexFilter("msm_thermal|am_proc_bound")})
+		for obj := range NewLoglineProcessor(filter, parser).Process() {
+			results = append(results, obj)
+		}
+	}
+	assert.Equal(0, len(errs))
+	require.Equal(2, len(results))
+
+	ll := results[0].(*Logline)
+	thermal, ok := ll.Payload.(*MsmThermalPrintk)
+	require.True(ok, "%T", ll.Payload)
+	assert.Equal(3, thermal.Cpu)
+	assert.Equal(66, thermal.Temp)
+	assert.Equal(int64(1), ll.LogcatToken)
+
+	ll = results[1].(*Logline)
+	assert.Equal("am_proc_bound", ll.Tag)
+	assert.Equal([]string{"User", "PID"}, ll.Payload.(*EventLog).Fields)
+
+	// A cut off file is an error for the source
+	require.Nil(ioutil.WriteFile(logFile, data.Bytes()[:data.Len()-3], 0644))
+	count := 0
+	for source := range gen.Process() {
+		for _ = range source.Processor.Process() {
+			count += 1
+		}
+	}
+	assert.Equal(2, count)
+	require.Equal(1, len(errs))
+	assert.Contains(errs[0].Error(), "Error reading entry 4")
+}
+
+func TestBinaryLogSourceConf(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceBinary,
+		Sources: []string{"test/test.log"},
+		Args:    map[string]interface{}{"framing": "pmsg", "buffer": "events"},
+	}
+	gen, err := conf.ToPipelineSourceGenerator()
+	assert.Nil(err)
+	assert.Equal(LoggerFramingPmsg, gen.(*BinaryLogSourceGenerator).Framing)
+	assert.Equal(LogIdEvents, gen.(*BinaryLogSourceGenerator).Buffer)
+
+	for _, args := range []map[string]interface{}{
+		{"framing": "logd"},
+		{"buffer": 2},
+		{"event_tags": "test/missing-event-log-tags"},
+	} {
+		conf.Args = args
+		_, err = conf.ToPipelineSourceGenerator()
+		assert.NotNil(err, "%v", args)
+	}
+
+	confString := `
+source:
+  type: binary
+  sources: ["./test/*.log"]
+  args:
+    framing: pmgs
+    buffer: 2
+processors:
+  - name: main
+    generator: passthrough
+    has_logstream: true
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(confString, newValidateTestEnv(), nil)
+	require.Equal(t, 2, len(diags), "%v", diags)
+	assert.Equal(6, diags[0].Line)
+	assert.Equal("pmsg", diags[0].Suggestion)
+	assert.Equal(7, diags[1].Line)
+	assert.Contains(diags[1].Message, "Unexpected type for 'buffer'")
+}
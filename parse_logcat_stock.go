@@ -0,0 +1,268 @@
+package phonelab
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The output formats of stock logcat (adb logcat -v <format>), as well as the
+// PhoneLab ones. The stock formats don't have the boot ID, logcat token or
+// trace time, so LogcatParser fills them in:
+//
+//	BootId      is left empty
+//	LogcatToken counts the lines from the parser, from 1, so they sort in
+//	            the order they were read
+//	TraceTime   is the monotonic timestamp for monotonic, and the Datetime in
+//	            seconds since the epoch for the rest
+//
+// The monotonic format has no Datetime either. The Logline's Format says
+// which format it was in. Only threadtime, time and long with -v year have
+// the year; without it, LogcatParser uses its Year or, if that's 0, marks the
+// Logline NoYear.
+type LogcatFormat string
+
+const (
+	// Work out the format from each line. This is the default.
+	LogcatFormatAuto LogcatFormat = "auto"
+	// The PhoneLab conductor format, starting with the device ID
+	LogcatFormatPhonelab LogcatFormat = "phonelab"
+	// boot_id datetime token [tracetime] pid tid level tag: payload
+	LogcatFormatTraceTime LogcatFormat = "tracetime"
+	// 01-02 03:04:05.678  1234  5678 I Tag: payload
+	LogcatFormatThreadtime LogcatFormat = "threadtime"
+	// 01-02 03:04:05.678 I/Tag( 1234): payload
+	LogcatFormatTime LogcatFormat = "time"
+	// [ 01-02 03:04:05.678  1234: 5678 I/Tag ], then a line for each line of
+	// the payload and a blank line. Each payload line is a Logline.
+	LogcatFormatLong LogcatFormat = "long"
+	// 1577934245.678  1234  5678 I Tag: payload
+	LogcatFormatEpoch LogcatFormat = "epoch"
+	// 12345.678  1234  5678 I Tag: payload, in seconds since boot
+	LogcatFormatMonotonic LogcatFormat = "monotonic"
+)
+
+var logcatFormats = []string{string(LogcatFormatAuto), string(LogcatFormatPhonelab),
+	string(LogcatFormatTraceTime), string(LogcatFormatThreadtime), string(LogcatFormatTime),
+	string(LogcatFormatLong), string(LogcatFormatEpoch), string(LogcatFormatMonotonic)}
+
+func ParseLogcatFormat(s string) (LogcatFormat, error) {
+	if len(s) == 0 {
+		return LogcatFormatAuto, nil
+	}
+	for _, format := range logcatFormats {
+		if s == format {
+			return LogcatFormat(s), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid logcat format '%v'. Expected one of: %v", s, strings.Join(logcatFormats, ", "))
+}
+
+// The date and time of the threadtime, time and long formats. The year is
+// only there with -v year.
+const stockDatetimePattern = `(?:(\d{4})-)?(\d{2})-(\d{2})\s+(\d{2}):(\d{2}):(\d{2})\.(\d{1,9})`
+
+var (
+	THREADTIME_PATTERN = regexp.MustCompile(`^\s*` + stockDatetimePattern +
+		`\s+(\d+)\s+(\d+)\s+([A-Z])\s+(.*?)\s*: ?(.*)$`)
+	TIME_PATTERN = regexp.MustCompile(`^\s*` + stockDatetimePattern +
+		`\s+([A-Z])/(.*?)\(\s*(\d+)\): ?(.*)$`)
+	LONG_HEADER_PATTERN = regexp.MustCompile(`^\[\s+` + stockDatetimePattern +
+		`\s+(\d+):\s*(\d+)\s+([A-Z])/(.*?)\s+\]$`)
+	// Epoch and monotonic look the same. Epoch times are much bigger.
+	EPOCH_PATTERN = regexp.MustCompile(`^\s*(\d+)\.(\d{1,9})\s+(\d+)\s+(\d+)\s+([A-Z])\s+(.*?)\s*: ?(.*)$`)
+)
+
+// Anything since 2001 is an epoch time rather than a monotonic one.
+const minEpochSeconds = 1e9
+
+// Parse a line in one of the stock formats. Blank lines and the
+// "--------- beginning of main" lines between buffers are errors, as they are
+// for the PhoneLab formats. The long format's header and the blank line after
+// its payload are the only lines that give a nil Logline and no error.
+func (p *LogcatParser) parseStock(line string) (*Logline, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	format := p.Format
+	if len(format) == 0 {
+		format = LogcatFormatAuto
+	}
+	blank := len(strings.TrimSpace(line)) == 0
+
+	// The lines after a long header are its payload, up to a blank line.
+	if p.longHeader != nil && (format == LogcatFormatAuto || format == LogcatFormatLong) {
+		if blank {
+			p.longHeader = nil
+			return nil, nil
+		}
+		ll := *p.longHeader
+		ll.Line = line
+		ll.Payload = strings.TrimSpace(line)
+		p.token += 1
+		ll.LogcatToken = p.token
+		return &ll, nil
+	}
+
+	if blank {
+		return nil, errBlankLogline
+	} else if strings.HasPrefix(line, "--------- ") {
+		return nil, errUnsupportedLogcatFormat
+	}
+
+	if format != LogcatFormatAuto {
+		return p.parseStockFormat(line, format)
+	}
+
+	// Lines tend to be in the same format as the last one.
+	if len(p.lastFormat) > 0 {
+		if ll, err := p.parseStockFormat(line, p.lastFormat); err == nil {
+			return ll, nil
+		}
+	}
+	for _, format := range []LogcatFormat{LogcatFormatThreadtime, LogcatFormatTime, LogcatFormatEpoch, LogcatFormatLong} {
+		if format == p.lastFormat {
+			continue
+		}
+		if ll, err := p.parseStockFormat(line, format); err == nil {
+			p.lastFormat = format
+			return ll, nil
+		}
+	}
+	return nil, errUnsupportedLogcatFormat
+}
+
+// Parse a line in format. In auto mode, the epoch format covers monotonic too.
+// Must be called with the lock held.
+func (p *LogcatParser) parseStockFormat(line string, format LogcatFormat) (*Logline, error) {
+	ll := &Logline{
+		Line:   line,
+		Format: format,
+	}
+
+	var err error
+	switch format {
+	case LogcatFormatThreadtime:
+		m := THREADTIME_PATTERN.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		if err = p.parseStockDatetime(ll, m[1:8]); err != nil {
+			return nil, err
+		}
+		ll.Pid, ll.Tid = parseInt32(m[8]), parseInt32(m[9])
+		ll.Level, ll.Tag, ll.Payload = m[10], m[11], strings.TrimSpace(m[12])
+	case LogcatFormatTime:
+		m := TIME_PATTERN.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		if err = p.parseStockDatetime(ll, m[1:8]); err != nil {
+			return nil, err
+		}
+		// No thread ID
+		ll.Level, ll.Tag, ll.Pid = m[8], strings.TrimSpace(m[9]), parseInt32(m[10])
+		ll.Payload = strings.TrimSpace(m[11])
+	case LogcatFormatLong:
+		m := LONG_HEADER_PATTERN.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		if err = p.parseStockDatetime(ll, m[1:8]); err != nil {
+			return nil, err
+		}
+		ll.Pid, ll.Tid = parseInt32(m[8]), parseInt32(m[9])
+		ll.Level, ll.Tag = m[10], m[11]
+		ll.TraceTime = stockTraceTime(ll)
+		// The payload comes next
+		p.longHeader = ll
+		return nil, nil
+	case LogcatFormatEpoch, LogcatFormatMonotonic:
+		m := EPOCH_PATTERN.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		secs, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nanos := parseStockNanos(m[2])
+		if p.Format == LogcatFormatAuto || len(p.Format) == 0 {
+			if secs >= minEpochSeconds {
+				ll.Format = LogcatFormatEpoch
+			} else {
+				ll.Format = LogcatFormatMonotonic
+			}
+		}
+		if ll.Format == LogcatFormatEpoch {
+			ll.Datetime = time.Unix(secs, int64(nanos)).In(est)
+			ll.DatetimeNanos = int64(nanos)
+		}
+		ll.TraceTime = float64(secs) + float64(nanos)/1e9
+		ll.Pid, ll.Tid = parseInt32(m[3]), parseInt32(m[4])
+		ll.Level, ll.Tag, ll.Payload = m[5], m[6], strings.TrimSpace(m[7])
+	}
+
+	if len(ll.Level) == 0 {
+		return nil, fmt.Errorf("LC Parser Error: Line is not in logcat %v format", format)
+	}
+
+	if ll.Format != LogcatFormatEpoch && ll.Format != LogcatFormatMonotonic {
+		ll.TraceTime = stockTraceTime(ll)
+	}
+	p.token += 1
+	ll.LogcatToken = p.token
+	return ll, nil
+}
+
+// Fill in the Datetime from the year, month, day, hours, minutes, seconds
+// and fraction of a second.
+func (p *LogcatParser) parseStockDatetime(ll *Logline, fields []string) error {
+	ints := make([]int, 6)
+	for i, field := range fields[:6] {
+		if i == 0 && len(field) == 0 {
+			// No year. Guessing one would make the Datetime depend on when
+			// the line was parsed.
+			ints[i] = p.Year
+			ll.NoYear = p.Year == 0
+			continue
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return err
+		}
+		ints[i] = v
+	}
+
+	nanos := parseStockNanos(fields[6])
+	ll.Datetime = time.Date(ints[0], time.Month(ints[1]), ints[2], ints[3], ints[4], ints[5], nanos, est)
+	ll.DatetimeNanos = int64(nanos)
+	return nil
+}
+
+// The Datetime in seconds since the epoch. UnixNano overflows for NoYear
+// loglines, which are in year 0.
+func stockTraceTime(ll *Logline) float64 {
+	if ll.NoYear {
+		return float64(ll.Datetime.Unix()) + float64(ll.DatetimeNanos)/1e9
+	}
+	return float64(ll.Datetime.UnixNano()) / 1e9
+}
+
+// Fractions of a second, e.g. 678 for .678, in nanoseconds. The patterns only
+// allow up to 9 digits.
+func parseStockNanos(s string) int {
+	nanos, _ := strconv.Atoi(s)
+	for i := len(s); i < 9; i++ {
+		nanos *= 10
+	}
+	return nanos
+}
+
+// For digits the patterns have already matched
+func parseInt32(s string) int32 {
+	v, _ := strconv.ParseInt(s, 10, 32)
+	return int32(v)
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jehiah/go-strftime"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCheckLogcatPattern(t *testing.T) {
@@ -49,3 +50,206 @@ func BenchmarkLogcatParse(b *testing.B) {
 		ParseLogline(line)
 	}
 }
+
+func TestStockLogcatFormats(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	type expected struct {
+		format    LogcatFormat
+		datetime  string
+		tracetime float64
+		pid       int32
+		tid       int32
+		tag       string
+		payload   string
+	}
+
+	tests := map[string]expected{
+		"01-02 03:04:05.678  1234  5678 I ActivityManager: Start proc com.android.phone": {
+			LogcatFormatThreadtime, "2020-01-02 03:04:05.678", 0, 1234, 5678, "ActivityManager", "Start proc com.android.phone"},
+		"2019-01-02 03:04:05.678  1234  5678 D Kernel-Trace:   cpu=1": {
+			LogcatFormatThreadtime, "2019-01-02 03:04:05.678", 0, 1234, 5678, "Kernel-Trace", "cpu=1"},
+		"01-02 03:04:05.678 W/ActivityManager( 1234): Slow operation: 52ms": {
+			LogcatFormatTime, "2020-01-02 03:04:05.678", 0, 1234, 0, "ActivityManager", "Slow operation: 52ms"},
+		"1577934245.678  1234  5678 I ActivityManager: Start proc": {
+			LogcatFormatEpoch, "2020-01-01 22:04:05.678", 1577934245.678, 1234, 5678, "ActivityManager", "Start proc"},
+		"   12345.678  1234  5678 E ActivityManager: ANR": {
+			LogcatFormatMonotonic, "", 12345.678, 1234, 5678, "ActivityManager", "ANR"},
+	}
+
+	for line, e := range tests {
+		parser := NewLogcatParser()
+		parser.Year = 2020
+		ll, err := parser.Parse(line)
+		require.Nil(err, line)
+		require.NotNil(ll, line)
+
+		assert.Equal(e.format, ll.Format, line)
+		if len(e.datetime) > 0 {
+			assert.Equal(e.datetime, ll.Datetime.Format("2006-01-02 15:04:05.000"), line)
+		} else {
+			assert.True(ll.Datetime.IsZero(), line)
+		}
+		if e.tracetime > 0 {
+			assert.InDelta(e.tracetime, ll.MonotonicTimestamp(), 1e-6, line)
+		} else {
+			assert.InDelta(float64(ll.Datetime.UnixNano())/1e9, ll.MonotonicTimestamp(), 1e-6, line)
+		}
+		assert.Equal("", ll.BootId, line)
+		assert.Equal(int64(1), ll.LogcatToken, line)
+		assert.Equal(e.pid, ll.Pid, line)
+		assert.Equal(e.tid, ll.Tid, line)
+		assert.Equal(e.tag, ll.Tag, line)
+		assert.Equal(e.payload, ll.Payload, line)
+		assert.Equal(line, ll.Line, line)
+		assert.False(ll.NoYear, line)
+
+		// The format can be given instead of worked out
+		parser = NewLogcatParser()
+		parser.Format = e.format
+		ll, err = parser.Parse(line)
+		assert.Nil(err, line)
+		assert.Equal(e.format, ll.Format, line)
+	}
+
+	// The wrong format is an error
+	parser := NewLogcatParser()
+	parser.Format = LogcatFormatTime
+	_, err := parser.Parse("01-02 03:04:05.678  1234  5678 I ActivityManager: Start proc")
+	assert.NotNil(err)
+
+	// Blank lines and banners are errors outside the long format
+	for _, line := range []string{"", "   ", "--------- beginning of main"} {
+		for _, format := range []LogcatFormat{LogcatFormatAuto, LogcatFormatThreadtime} {
+			parser = NewLogcatParser()
+			parser.Format = format
+			ll, err := parser.Parse(line)
+			assert.NotNil(err, "%q", line)
+			assert.Nil(ll, "%q", line)
+		}
+	}
+
+	// Without a year, the logline says so rather than guessing one
+	parser = NewLogcatParser()
+	ll, err := parser.Parse("01-02 03:04:05.678  1234  5678 I ActivityManager: Start proc")
+	require.Nil(err)
+	assert.True(ll.NoYear)
+	assert.Equal("0000-01-02 03:04:05.678", ll.Datetime.Format("2006-01-02 15:04:05.000"))
+	assert.InDelta(float64(ll.Datetime.Unix())+0.678, ll.MonotonicTimestamp(), 1e-6)
+	ll, err = parser.Parse("2019-01-02 03:04:05.678  1234  5678 I ActivityManager: Start proc")
+	require.Nil(err)
+	assert.False(ll.NoYear)
+}
+
+func TestLongLogcatFormat(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	lines := []string{
+		"--------- beginning of main",
+		"[ 01-02 03:04:05.678  1234: 5678 I/ActivityManager ]",
+		"Start proc com.android.phone",
+		"  for service",
+		"",
+		"[ 01-02 03:04:06.000  1234: 5679 W/Binder ]",
+		"Slow transaction",
+		"",
+		"01-02 03:04:07.000  1234  5678 I ActivityManager: threadtime after long",
+	}
+
+	for _, format := range []LogcatFormat{LogcatFormatAuto, LogcatFormatLong} {
+		parser := NewLogcatParser()
+		parser.Format = format
+		parser.Year = 2020
+		loglines := make([]*Logline, 0)
+		for _, line := range lines {
+			ll, err := parser.Parse(line)
+			if line == lines[0] || (format == LogcatFormatLong && line == lines[len(lines)-1]) {
+				assert.NotNil(err)
+				continue
+			}
+			require.Nil(err, line)
+			if ll != nil {
+				loglines = append(loglines, ll)
+			}
+		}
+
+		if format == LogcatFormatAuto {
+			require.Equal(4, len(loglines))
+			assert.Equal(LogcatFormatThreadtime, loglines[3].Format)
+		} else {
+			require.Equal(3, len(loglines))
+		}
+
+		assert.Equal("Start proc com.android.phone", loglines[0].Payload)
+		assert.Equal("for service", loglines[1].Payload)
+		assert.Equal("Slow transaction", loglines[2].Payload)
+		for i, ll := range loglines[:3] {
+			assert.Equal(LogcatFormatLong, ll.Format)
+			assert.Equal(float64(ll.Datetime.UnixNano())/1e9, ll.MonotonicTimestamp())
+			assert.Equal(int64(i+1), ll.LogcatToken)
+		}
+		assert.Equal("ActivityManager", loglines[1].Tag)
+		assert.Equal(int32(5678), loglines[1].Tid)
+		assert.Equal("Binder", loglines[2].Tag)
+		assert.Equal("W", loglines[2].Level)
+	}
+}
+
+func TestLogcatFormatConf(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	format, err := ParseLogcatFormat("")
+	assert.Nil(err)
+	assert.Equal(LogcatFormatAuto, format)
+	format, err = ParseLogcatFormat("threadtime")
+	assert.Nil(err)
+	assert.Equal(LogcatFormatThreadtime, format)
+
+	conf := &ProcessorConf{
+		Name:         "main",
+		LogcatFormat: "threadtim",
+	}
+	env := NewEnvironment()
+	env.Processors["main"] = &passThroughProcessorGen{}
+	assert.NotNil(conf.validate(env))
+
+	confString := `
+source:
+  type: files
+  sources: ["./test/*.log"]
+processors:
+  - name: main
+    generator: passthrough
+    has_logstream: true
+    logcat_format: threadtim
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(confString, newValidateTestEnv(), nil)
+	require.Equal(t, 1, len(diags), "%v", diags)
+	assert.Equal(9, diags[0].Line)
+	assert.Equal("threadtime", diags[0].Suggestion)
+
+	// Building it is an error too
+	_, err = conf.buildParserProc(env, &emitter{0})
+	assert.NotNil(err)
+
+	conf.LogcatFormat = "threadtime"
+	conf.LogcatYear = -1
+	assert.NotNil(conf.validate(env))
+
+	// The parser gets it
+	conf.LogcatFormat = "epoch"
+	conf.LogcatYear = 2020
+	assert.Nil(conf.validate(env))
+	proc, err := conf.buildParserProc(env, &emitter{0})
+	require.Nil(t, err)
+	parser := proc.(*SimpleProcessor).Handler.(*LoglineProcessorHandler).Parser
+	assert.Equal(LogcatFormatEpoch, parser.LogcatParser.Format)
+	assert.Equal(2020, parser.LogcatParser.Year)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -17,7 +19,7 @@ type TraceInterface interface {
 var TRACE_PATTERN = regexp.MustCompile(`` +
 	`\s*(?P<thread>.*?)` +
 	`\s+\[(?P<cpu>\d+)\]` +
-	`\s+(?P<unknown>.{4})` +
+	`\s+(?P<unknown>\S{5}|.{4})` +
 	`\s+(?P<timestamp>\d+\.\d+)` +
 	`: ` +
 	`(?P<message>(?P<tag>.*?):` +
@@ -39,6 +41,12 @@ func (t *Trace) TraceTag() string {
 	return t.Tag
 }
 
+// The ftrace timestamp, which is on the same clock as a Logline's TraceTime,
+// so traces can be timewoven with the loglines from the same boot.
+func (t *Trace) MonotonicTimestamp() float64 {
+	return t.Timestamp
+}
+
 type KernelTraceParser struct {
 	RegexParser *RegexParser
 	Subparsers  map[string]Parser
@@ -51,7 +59,6 @@ func NewKernelTraceParser() *KernelTraceParser {
 	parser := &KernelTraceParser{ErrOnUnknownTag: true}
 	parser.RegexParser = NewRegexParser(parser)
 
-	// TODO: This should be ad hoc
 	parser.Subparsers = map[string]Parser{
 		"sched_cpu_hotplug":                   NewRegexParser(&SchedCPUHotplugParser{}),
 		"phonelab_num_online_cpus":            NewRegexParser(&NumOnlineCpusParser{}),
@@ -60,11 +67,39 @@ func NewKernelTraceParser() *KernelTraceParser {
 		"phonelab_proc_foreground":            NewRegexParser(&ProcForegroundParser{}),
 		"phonelab_periodic_ctx_switch_info":   NewRegexParser(&PeriodicCtxSwitchInfoParser{}),
 		"phonelab_periodic_ctx_switch_marker": NewRegexParser(&PeriodicCtxSwitchMarkerParser{}),
+		"sched_switch":                        NewRegexParser(&SchedSwitchParser{}),
+		"sched_wakeup":                        NewRegexParser(&SchedWakeupParser{}),
+		"sched_wakeup_new":                    NewRegexParser(&SchedWakeupParser{}),
+		"sched_waking":                        NewRegexParser(&SchedWakeupParser{}),
+		"sched_migrate_task":                  NewRegexParser(&SchedMigrateTaskParser{}),
+		"cpu_idle":                            NewRegexParser(&CpuIdleParser{}),
+		"cpu_frequency_limits":                NewRegexParser(&CpuFrequencyLimitsParser{}),
+		"clock_set_rate":                      NewRegexParser(&ClockSetRateParser{}),
+		"irq_handler_entry":                   NewRegexParser(&IrqHandlerEntryParser{}),
+		"irq_handler_exit":                    NewRegexParser(&IrqHandlerExitParser{}),
+		"block_rq_issue":                      NewRegexParser(&BlockRqIssueParser{}),
+		"block_rq_complete":                   NewRegexParser(&BlockRqCompleteParser{}),
+		"writeback_pages_written":             NewRegexParser(&WritebackPagesWrittenParser{}),
+		"mm_filemap_add_to_page_cache":        &MmFilemapParser{},
+		"mm_filemap_delete_from_page_cache":   &MmFilemapParser{},
+	}
+	for _, tag := range WritebackTags {
+		parser.Subparsers[tag] = &WritebackParser{}
 	}
 
 	return parser
 }
 
+// Add a parser for the payload of the traces with the given tag, replacing
+// any parser the tag already has. The objects it returns must embed a Trace,
+// which is filled in from the trace line.
+// Parsers can keep state between lines, so each KernelTraceParser needs its
+// own. See Environment.RegisterTraceSubparser to add one to all of the
+// parsers an Environment makes.
+func (p *KernelTraceParser) RegisterSubparser(tag string, parser Parser) {
+	p.Subparsers[tag] = parser
+}
+
 func (p *KernelTraceParser) New() interface{} {
 	return &Trace{}
 }
@@ -349,3 +384,472 @@ func (s *PeriodicCtxSwitchMarkerParser) New() interface{} {
 func (s *PeriodicCtxSwitchMarkerParser) Regex() *regexp.Regexp {
 	return PHONELAB_PERIODIC_CTX_SWITCH_MARKER_PATTERN
 }
+
+///////////////////////////////////////////////////////////////////////////////
+// Sched switch
+
+/* Format: sched_switch: prev_comm=kworker/0:3 prev_pid=2658 prev_prio=120 prev_state=S ==> next_comm=swapper/0 next_pid=0 next_prio=120 */
+var SCHED_SWITCH_PATTERN = regexp.MustCompile(`` +
+	`\s*prev_comm=(?P<prev_comm>.*?)` +
+	`\s+prev_pid=(?P<prev_pid>\d+)` +
+	`\s+prev_prio=(?P<prev_prio>-?\d+)` +
+	`\s+prev_state=(?P<prev_state>\S+)` +
+	`\s+==>` +
+	`\s+next_comm=(?P<next_comm>.*?)` +
+	`\s+next_pid=(?P<next_pid>\d+)` +
+	`\s+next_prio=(?P<next_prio>-?\d+)`)
+
+type SchedSwitch struct {
+	Trace `logcat:"-"`
+	// e.g. R, S, D or R+ when the task was preempted
+	PrevState string `logcat:"prev_state"`
+	PrevComm  string `logcat:"prev_comm"`
+	PrevPid   int    `logcat:"prev_pid"`
+	PrevPrio  int    `logcat:"prev_prio"`
+	NextComm  string `logcat:"next_comm"`
+	NextPid   int    `logcat:"next_pid"`
+	NextPrio  int    `logcat:"next_prio"`
+}
+
+type SchedSwitchParser struct {
+}
+
+func (s *SchedSwitchParser) New() interface{} {
+	return &SchedSwitch{}
+}
+
+func (s *SchedSwitchParser) Regex() *regexp.Regexp {
+	return SCHED_SWITCH_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Sched wakeup
+
+/* Format: sched_wakeup: comm=kworker/0:3 pid=2658 prio=120 success=1 target_cpu=000
+ * Newer kernels don't have success, and it's the same for sched_wakeup_new
+ * and sched_waking.
+ */
+var SCHED_WAKEUP_PATTERN = regexp.MustCompile(`` +
+	`\s*comm=(?P<comm>.*?)` +
+	`\s+pid=(?P<pid>\d+)` +
+	`\s+prio=(?P<prio>-?\d+)` +
+	`(\s+success=(?P<success>\d+))?` +
+	`\s+target_cpu=(?P<target_cpu>\d+)`)
+
+type SchedWakeup struct {
+	Trace     `logcat:"-"`
+	Comm      string `logcat:"comm"`
+	Pid       int    `logcat:"pid"`
+	Prio      int    `logcat:"prio"`
+	Success   int    `logcat:"success"`
+	TargetCpu int    `logcat:"target_cpu"`
+}
+
+type SchedWakeupParser struct {
+}
+
+func (s *SchedWakeupParser) New() interface{} {
+	return &SchedWakeup{}
+}
+
+func (s *SchedWakeupParser) Regex() *regexp.Regexp {
+	return SCHED_WAKEUP_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Sched migrate task
+
+/* Format: sched_migrate_task: comm=kworker/0:3 pid=2658 prio=120 orig_cpu=0 dest_cpu=1 */
+var SCHED_MIGRATE_TASK_PATTERN = regexp.MustCompile(`` +
+	`\s*comm=(?P<comm>.*?)` +
+	`\s+pid=(?P<pid>\d+)` +
+	`\s+prio=(?P<prio>-?\d+)` +
+	`\s+orig_cpu=(?P<orig_cpu>\d+)` +
+	`\s+dest_cpu=(?P<dest_cpu>\d+)`)
+
+type SchedMigrateTask struct {
+	Trace   `logcat:"-"`
+	Comm    string `logcat:"comm"`
+	Pid     int    `logcat:"pid"`
+	Prio    int    `logcat:"prio"`
+	OrigCpu int    `logcat:"orig_cpu"`
+	DestCpu int    `logcat:"dest_cpu"`
+}
+
+type SchedMigrateTaskParser struct {
+}
+
+func (s *SchedMigrateTaskParser) New() interface{} {
+	return &SchedMigrateTask{}
+}
+
+func (s *SchedMigrateTaskParser) Regex() *regexp.Regexp {
+	return SCHED_MIGRATE_TASK_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// CPU Idle
+
+/* Format: cpu_idle: state=1 cpu_id=0 */
+var CPU_IDLE_PATTERN = regexp.MustCompile(`` +
+	`\s*state=(?P<state>\d+)` +
+	`\s+cpu_id=(?P<cpu_id>\d+)`)
+
+// The state of a cpu_idle when the CPU leaves idle, which is (u32)-1
+const CpuIdleExit int64 = 4294967295
+
+type CpuIdle struct {
+	Trace `logcat:"-"`
+	State int64 `logcat:"state"`
+	CpuId int   `logcat:"cpu_id"`
+}
+
+// Whether the CPU is leaving idle, rather than entering State
+func (c *CpuIdle) Exit() bool {
+	return c.State == CpuIdleExit
+}
+
+type CpuIdleParser struct {
+}
+
+func (s *CpuIdleParser) New() interface{} {
+	return &CpuIdle{}
+}
+
+func (s *CpuIdleParser) Regex() *regexp.Regexp {
+	return CPU_IDLE_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// CPU Frequency Limits
+
+/* Format: cpu_frequency_limits: min=300000 max=2265600 cpu_id=0 */
+var CPU_FREQUENCY_LIMITS_PATTERN = regexp.MustCompile(`` +
+	`\s*min=(?P<min>\d+)` +
+	`\s+max=(?P<max>\d+)` +
+	`\s+cpu_id=(?P<cpu_id>\d+)`)
+
+type CpuFrequencyLimits struct {
+	Trace `logcat:"-"`
+	Min   int `logcat:"min"`
+	Max   int `logcat:"max"`
+	CpuId int `logcat:"cpu_id"`
+}
+
+type CpuFrequencyLimitsParser struct {
+}
+
+func (s *CpuFrequencyLimitsParser) New() interface{} {
+	return &CpuFrequencyLimits{}
+}
+
+func (s *CpuFrequencyLimitsParser) Regex() *regexp.Regexp {
+	return CPU_FREQUENCY_LIMITS_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Clock Set Rate
+
+/* Format: clock_set_rate: gcc_sdcc1_apps_clk state=200000000 cpu_id=0 */
+var CLOCK_SET_RATE_PATTERN = regexp.MustCompile(`` +
+	`\s*(?P<name>\S+)` +
+	`\s+state=(?P<state>\d+)` +
+	`\s+cpu_id=(?P<cpu_id>\d+)`)
+
+type ClockSetRate struct {
+	Trace `logcat:"-"`
+	Name  string `logcat:"name"`
+	// The rate, in Hz
+	State int64 `logcat:"state"`
+	CpuId int   `logcat:"cpu_id"`
+}
+
+type ClockSetRateParser struct {
+}
+
+func (s *ClockSetRateParser) New() interface{} {
+	return &ClockSetRate{}
+}
+
+func (s *ClockSetRateParser) Regex() *regexp.Regexp {
+	return CLOCK_SET_RATE_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// IRQ Handler Entry
+
+/* Format: irq_handler_entry: irq=35 name=arch_timer */
+var IRQ_HANDLER_ENTRY_PATTERN = regexp.MustCompile(`` +
+	`\s*irq=(?P<irq>\d+)` +
+	`\s+name=(?P<name>.*)`)
+
+type IrqHandlerEntry struct {
+	Trace `logcat:"-"`
+	Irq   int    `logcat:"irq"`
+	Name  string `logcat:"name"`
+}
+
+type IrqHandlerEntryParser struct {
+}
+
+func (s *IrqHandlerEntryParser) New() interface{} {
+	return &IrqHandlerEntry{}
+}
+
+func (s *IrqHandlerEntryParser) Regex() *regexp.Regexp {
+	return IRQ_HANDLER_ENTRY_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// IRQ Handler Exit
+
+/* Format: irq_handler_exit: irq=35 ret=handled */
+var IRQ_HANDLER_EXIT_PATTERN = regexp.MustCompile(`` +
+	`\s*irq=(?P<irq>\d+)` +
+	`\s+ret=(?P<ret>handled|unhandled)`)
+
+type IrqHandlerExit struct {
+	Trace `logcat:"-"`
+	Irq   int    `logcat:"irq"`
+	Ret   string `logcat:"ret"`
+}
+
+func (i *IrqHandlerExit) Handled() bool {
+	return i.Ret == "handled"
+}
+
+type IrqHandlerExitParser struct {
+}
+
+func (s *IrqHandlerExitParser) New() interface{} {
+	return &IrqHandlerExit{}
+}
+
+func (s *IrqHandlerExitParser) Regex() *regexp.Regexp {
+	return IRQ_HANDLER_EXIT_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Block Request Issue
+
+/* Format: block_rq_issue: 179,0 W 4096 () 4530176 + 8 [mmcqd/0]
+ * Newer kernels have the I/O priority before the comm.
+ */
+var BLOCK_RQ_ISSUE_PATTERN = regexp.MustCompile(`` +
+	`\s*(?P<major>\d+),(?P<minor>\d+)` +
+	`\s+(?P<rwbs>\S+)` +
+	`\s+(?P<bytes>\d+)` +
+	`\s+\((?P<cmd>.*?)\)` +
+	`\s+(?P<sector>\d+)` +
+	`\s+\+\s+(?P<nr_sector>\d+)` +
+	`(\s+\S+)?` +
+	`\s+\[(?P<comm>.*)\]`)
+
+type BlockRqIssue struct {
+	Trace `logcat:"-"`
+	Major int `logcat:"major"`
+	Minor int `logcat:"minor"`
+	// The kind of request, e.g. W, RA or WS. See blk_fill_rwbs.
+	Rwbs     string `logcat:"rwbs"`
+	Bytes    int64  `logcat:"bytes"`
+	Cmd      string `logcat:"cmd"`
+	Sector   uint64 `logcat:"sector"`
+	NrSector int    `logcat:"nr_sector"`
+	Comm     string `logcat:"comm"`
+}
+
+type BlockRqIssueParser struct {
+}
+
+func (s *BlockRqIssueParser) New() interface{} {
+	return &BlockRqIssue{}
+}
+
+func (s *BlockRqIssueParser) Regex() *regexp.Regexp {
+	return BLOCK_RQ_ISSUE_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Block Request Complete
+
+/* Format: block_rq_complete: 179,0 W () 4530176 + 8 [0] */
+var BLOCK_RQ_COMPLETE_PATTERN = regexp.MustCompile(`` +
+	`\s*(?P<major>\d+),(?P<minor>\d+)` +
+	`\s+(?P<rwbs>\S+)` +
+	`\s+\((?P<cmd>.*?)\)` +
+	`\s+(?P<sector>\d+)` +
+	`\s+\+\s+(?P<nr_sector>\d+)` +
+	`(\s+\S+)?` +
+	`\s+\[(?P<error>-?\d+)\]`)
+
+type BlockRqComplete struct {
+	Trace    `logcat:"-"`
+	Major    int    `logcat:"major"`
+	Minor    int    `logcat:"minor"`
+	Rwbs     string `logcat:"rwbs"`
+	Cmd      string `logcat:"cmd"`
+	Sector   uint64 `logcat:"sector"`
+	NrSector int    `logcat:"nr_sector"`
+	Error    int    `logcat:"error"`
+}
+
+type BlockRqCompleteParser struct {
+}
+
+func (s *BlockRqCompleteParser) New() interface{} {
+	return &BlockRqComplete{}
+}
+
+func (s *BlockRqCompleteParser) Regex() *regexp.Regexp {
+	return BLOCK_RQ_COMPLETE_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Writeback
+
+// The writeback_* events with a WritebackParser. Their payloads differ from
+// event to event and from kernel to kernel, so they are parsed into fields
+// rather than a struct for each one.
+var WritebackTags = []string{
+	"writeback_dirty_page",
+	"writeback_mark_inode_dirty",
+	"writeback_dirty_inode_start",
+	"writeback_dirty_inode",
+	"writeback_dirty_inode_enqueue",
+	"writeback_write_inode_start",
+	"writeback_write_inode",
+	"writeback_queue",
+	"writeback_exec",
+	"writeback_start",
+	"writeback_written",
+	"writeback_wait",
+	"writeback_nowork",
+	"writeback_wake_background",
+	"writeback_wake_thread",
+	"writeback_wake_forker_thread",
+	"writeback_bdi_register",
+	"writeback_bdi_unregister",
+	"writeback_thread_start",
+	"writeback_thread_stop",
+	"writeback_queue_io",
+	"writeback_sb_inodes_requeue",
+	"writeback_congestion_wait",
+	"writeback_wait_iff_congested",
+	"writeback_single_inode_start",
+	"writeback_single_inode",
+	"writeback_lazytime",
+	"writeback_lazytime_iput",
+}
+
+/* Format: writeback_dirty_page: bdi 179:0: ino=1605 index=3
+ *         writeback_start: bdi 179:0: sb_dev 0:0 nr_pages=1024 sync_mode=0 kupdate=0 range_cyclic=1 background=1 reason=background
+ */
+var WRITEBACK_BDI_PATTERN = regexp.MustCompile(`^\s*bdi\s+(\S+?):?(\s+|$)`)
+
+type WritebackEvent struct {
+	Trace `logcat:"-"`
+	// The backing device, e.g. 179:0. Empty for events that aren't about one.
+	Bdi string
+	// The name=value fields, and ones like sb_dev 0:0 that are a name and a
+	// value
+	Fields map[string]string
+}
+
+// The value of a field as a number
+func (w *WritebackEvent) IntField(name string) (int64, error) {
+	value, ok := w.Fields[name]
+	if !ok {
+		return 0, fmt.Errorf("No field '%v' in %v", name, w.Tag)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+type WritebackParser struct {
+}
+
+func (p *WritebackParser) Parse(line string) (interface{}, error) {
+	event := &WritebackEvent{
+		Fields: make(map[string]string),
+	}
+
+	if m := WRITEBACK_BDI_PATTERN.FindStringSubmatch(line); m != nil {
+		event.Bdi = m[1]
+		line = line[len(m[0]):]
+	}
+
+	tokens := strings.Fields(line)
+	for i := 0; i < len(tokens); i++ {
+		if idx := strings.Index(tokens[i], "="); idx > 0 {
+			event.Fields[tokens[i][:idx]] = tokens[i][idx+1:]
+		} else if i+1 < len(tokens) && !strings.Contains(tokens[i+1], "=") {
+			event.Fields[tokens[i]] = tokens[i+1]
+			i += 1
+		} else {
+			return nil, fmt.Errorf("Unexpected writeback field '%v'", tokens[i])
+		}
+	}
+
+	return event, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Writeback Pages Written
+
+/* Format: writeback_pages_written: 1024 */
+var WRITEBACK_PAGES_WRITTEN_PATTERN = regexp.MustCompile(`` +
+	`^\s*(?P<pages>\d+)\s*$`)
+
+type WritebackPagesWritten struct {
+	Trace `logcat:"-"`
+	Pages int64 `logcat:"pages"`
+}
+
+type WritebackPagesWrittenParser struct {
+}
+
+func (s *WritebackPagesWrittenParser) New() interface{} {
+	return &WritebackPagesWritten{}
+}
+
+func (s *WritebackPagesWrittenParser) Regex() *regexp.Regexp {
+	return WRITEBACK_PAGES_WRITTEN_PATTERN
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Page cache
+
+/* Format: mm_filemap_add_to_page_cache: dev 179:32 ino 1a2b page=ffffffbdc1234560 pfn=301234 ofs=8192
+ * The same for mm_filemap_delete_from_page_cache. The inode is in hex.
+ */
+var MM_FILEMAP_PATTERN = regexp.MustCompile(`` +
+	`\s*dev\s+(?P<major>\d+):(?P<minor>\d+)` +
+	`\s+ino\s+(?P<ino>[0-9a-fA-F]+)` +
+	`\s+page=(?P<page>\S+)` +
+	`\s+pfn=(?P<pfn>\d+)` +
+	`\s+ofs=(?P<ofs>\d+)`)
+
+type MmFilemap struct {
+	Trace `logcat:"-"`
+	Major int    `logcat:"major"`
+	Minor int    `logcat:"minor"`
+	Ino   uint64 `logcat:"-"`
+	Page  string `logcat:"page"`
+	Pfn   uint64 `logcat:"pfn"`
+	// The offset in the file, in bytes
+	Ofs uint64 `logcat:"ofs"`
+}
+
+type MmFilemapParser struct {
+}
+
+func (p *MmFilemapParser) Parse(line string) (interface{}, error) {
+	obj := &MmFilemap{}
+	m, err := unpackFromRegex(line, MM_FILEMAP_PATTERN, obj)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Ino, err = strconv.ParseUint(m["ino"], 16, 64); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
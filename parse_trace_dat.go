@@ -0,0 +1,960 @@
+package phonelab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// trace-cmd's trace.dat files (version 6). Rather than parse every event
+// into its own type, each event is printed the way trace_pipe would print
+// it, using the event's print fmt, and the line is parsed by the
+// KernelTraceParser like any other.
+
+var traceDatMagic = []byte("\x17\x08\x44tracing")
+
+// The types of ring buffer events (type_len). 1 to 28 are data events of
+// that many 4 byte words.
+const (
+	ringBufTypeData       = 0
+	ringBufTypePadding    = 29
+	ringBufTypeTimeExtend = 30
+	ringBufTypeTimeStamp  = 31
+	ringBufTimeShift      = 27
+	ringBufCommitMask     = 1<<27 - 1
+)
+
+// ftrace's trace_flag_type
+const (
+	traceFlagIrqsOff       = 0x01
+	traceFlagIrqsNoSupport = 0x02
+	traceFlagNeedResched   = 0x04
+	traceFlagHardIrq       = 0x08
+	traceFlagSoftIrq       = 0x10
+)
+
+// A field of an event format
+type traceField struct {
+	Name   string
+	Type   string
+	Offset int
+	Size   int
+	Signed bool
+	Array  bool
+	// char name[16] is a fixed size string, and char name[] runs to the end
+	// of the event
+	String bool
+	// __data_loc char[] name is a string elsewhere in the event
+	DataLoc bool
+}
+
+// The format of an event, from its events/<system>/<name>/format
+type traceEventFormat struct {
+	Id     int
+	Name   string
+	Fields []*traceField
+	// The format string and arguments of the print fmt
+	PrintFmt  string
+	PrintArgs []string
+}
+
+var (
+	TRACE_FORMAT_FIELD_PATTERN = regexp.MustCompile(`field:\s*(.*?)\s*;\s*offset:\s*(\d+);\s*size:\s*(\d+);(?:\s*signed:\s*(\d+);)?`)
+	TRACE_FORMAT_ARRAY_PATTERN = regexp.MustCompile(`^(.*?)\s*(\w+)\s*\[(\w*)\]$`)
+)
+
+// Parse an event format file
+func parseTraceEventFormat(data string) (*traceEventFormat, error) {
+	format := &traceEventFormat{
+		Id: -1,
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "name:"):
+			format.Name = strings.TrimSpace(strings.TrimPrefix(line, "name:"))
+		case strings.HasPrefix(line, "ID:"):
+			id, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "ID:")))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid event ID: %v", line)
+			}
+			format.Id = id
+		case strings.HasPrefix(line, "field:"):
+			m := TRACE_FORMAT_FIELD_PATTERN.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("Invalid event field: %v", line)
+			}
+			field := &traceField{}
+			field.Offset, _ = strconv.Atoi(m[2])
+			field.Size, _ = strconv.Atoi(m[3])
+			field.Signed = m[4] == "1"
+
+			decl := m[1]
+			if am := TRACE_FORMAT_ARRAY_PATTERN.FindStringSubmatch(decl); am != nil {
+				field.Type, field.Name = am[1], am[2]
+				field.Array = true
+				field.String = field.Type == "char" || strings.HasSuffix(field.Type, " char")
+			} else if i := strings.LastIndexAny(decl, " *"); i >= 0 {
+				field.Type, field.Name = strings.TrimSpace(decl[:i+1]), decl[i+1:]
+			} else {
+				field.Name = decl
+			}
+			field.DataLoc = strings.HasPrefix(field.Type, "__data_loc")
+			format.Fields = append(format.Fields, field)
+		case strings.HasPrefix(line, "print fmt:"):
+			if err := format.parsePrintFmt(strings.TrimSpace(strings.TrimPrefix(line, "print fmt:"))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if format.Id < 0 || len(format.Name) == 0 {
+		return nil, fmt.Errorf("Event format is missing its name or ID")
+	}
+	return format, nil
+}
+
+// Split the print fmt into its format string and arguments, e.g.
+// "state=%lu cpu_id=%lu", (unsigned long)REC->state, (unsigned long)REC->cpu_id
+func (f *traceEventFormat) parsePrintFmt(s string) error {
+	if !strings.HasPrefix(s, `"`) {
+		return fmt.Errorf("Invalid print fmt for %v: %v", f.Name, s)
+	}
+	end := closingQuote(s, 0)
+	if end < 0 {
+		return fmt.Errorf("Invalid print fmt for %v: %v", f.Name, s)
+	}
+	unquoted, err := strconv.Unquote(s[:end+1])
+	if err != nil {
+		// Not every C escape is a Go one, so make do.
+		unquoted = s[1:end]
+	}
+	f.PrintFmt = unquoted
+
+	rest := strings.TrimSpace(s[end+1:])
+	if strings.HasPrefix(rest, ",") {
+		f.PrintArgs = splitTraceArgs(rest[1:])
+	}
+	return nil
+}
+
+// The index of the quote that closes the string starting at s[start]
+func closingQuote(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// Split on the commas between arguments, but not the ones in brackets or
+// strings.
+func splitTraceArgs(s string) []string {
+	args := make([]string, 0)
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			if end := closingQuote(s, i); end >= 0 {
+				i = end
+			}
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); len(last) > 0 {
+		args = append(args, last)
+	}
+	return args
+}
+
+// The value of a field in an event's data: an int64, a uint64 or a string.
+// ok is false if there is no making sense of it, e.g. an array of ints.
+func (f *traceField) value(data []byte, order binary.ByteOrder) (interface{}, bool) {
+	if f.Offset+f.Size > len(data) {
+		return nil, false
+	}
+	raw := data[f.Offset : f.Offset+f.Size]
+
+	switch {
+	case f.DataLoc:
+		if f.Size != 4 {
+			return nil, false
+		}
+		loc := order.Uint32(raw)
+		offset, length := int(loc&0xffff), int(loc>>16)
+		if offset+length > len(data) {
+			return nil, false
+		}
+		return cString(data[offset : offset+length]), true
+	case f.String:
+		if f.Size == 0 {
+			return cString(data[f.Offset:]), true
+		}
+		return cString(raw), true
+	case f.Array:
+		return nil, false
+	}
+
+	var v uint64
+	switch f.Size {
+	case 1:
+		v = uint64(raw[0])
+	case 2:
+		v = uint64(order.Uint16(raw))
+	case 4:
+		v = uint64(order.Uint32(raw))
+	case 8:
+		v = order.Uint64(raw)
+	default:
+		return nil, false
+	}
+	if f.Signed {
+		// Sign extend
+		shift := uint(64 - 8*f.Size)
+		return int64(v<<shift) >> shift, true
+	}
+	return v, true
+}
+
+// A string up to its NUL, if it has one
+func cString(b []byte) string {
+	if end := bytes.IndexByte(b, 0); end >= 0 {
+		b = b[:end]
+	}
+	return string(b)
+}
+
+var (
+	TRACE_CAST_PATTERN    = regexp.MustCompile(`^\(\s*(?:(?:unsigned|signed|const|struct|long|int|short|char)\s+)*[A-Za-z_]\w*\s*\**\s*\)`)
+	TRACE_VERB_PATTERN    = regexp.MustCompile(`%([-+ #0]*)(\d*)(\.\d+)?(hh|h|ll|l|z|L)?([diouxXcsp%])`)
+	TRACE_PRINTK_NUMBER   = regexp.MustCompile(`^-?(0x[0-9a-fA-F]+|\d+)[uUlL]*$`)
+	TRACE_REC_FIELD       = regexp.MustCompile(`^REC->(\w+)$`)
+	TRACE_GET_STR_PATTERN = regexp.MustCompile(`^__get_str\(\s*(\w+)\s*\)$`)
+)
+
+// Evaluate an argument of a print fmt. Only the simple ones are understood:
+// fields, strings from __get_str, literals and ternaries of those.
+func (f *traceEventFormat) evalArg(arg string, data []byte, order binary.ByteOrder) (interface{}, bool) {
+	arg = strings.TrimSpace(arg)
+	for {
+		if loc := TRACE_CAST_PATTERN.FindStringIndex(arg); loc != nil {
+			arg = strings.TrimSpace(arg[loc[1]:])
+		} else if strings.HasPrefix(arg, "(") && strings.HasSuffix(arg, ")") && closingParen(arg) == len(arg)-1 {
+			arg = strings.TrimSpace(arg[1 : len(arg)-1])
+		} else {
+			break
+		}
+	}
+
+	// cond ? a : b
+	if q := topLevelIndex(arg, '?'); q >= 0 {
+		if c := topLevelIndex(arg[q+1:], ':'); c >= 0 {
+			cond, ok := f.evalArg(arg[:q], data, order)
+			if !ok {
+				return nil, false
+			}
+			if traceValueTrue(cond) {
+				return f.evalArg(arg[q+1:q+1+c], data, order)
+			}
+			return f.evalArg(arg[q+1+c+1:], data, order)
+		}
+	}
+
+	if m := TRACE_REC_FIELD.FindStringSubmatch(arg); m != nil {
+		if field := f.field(m[1]); field != nil {
+			return field.value(data, order)
+		}
+		return nil, false
+	}
+	if m := TRACE_GET_STR_PATTERN.FindStringSubmatch(arg); m != nil {
+		if field := f.field(m[1]); field != nil {
+			return field.value(data, order)
+		}
+		return nil, false
+	}
+	if strings.HasPrefix(arg, `"`) && closingQuote(arg, 0) == len(arg)-1 {
+		if s, err := strconv.Unquote(arg); err == nil {
+			return s, true
+		}
+		return arg[1 : len(arg)-1], true
+	}
+	if TRACE_PRINTK_NUMBER.MatchString(arg) {
+		if v, err := strconv.ParseInt(strings.TrimRight(arg, "uUlL"), 0, 64); err == nil {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (f *traceEventFormat) field(name string) *traceField {
+	for _, field := range f.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// The index of the paren that closes the one at s[0]
+func closingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			if end := closingQuote(s, i); end >= 0 {
+				i = end
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// The index of c in s, outside of any brackets or strings
+func topLevelIndex(s string, c byte) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			if end := closingQuote(s, i); end >= 0 {
+				i = end
+			}
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case c:
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func traceValueTrue(v interface{}) bool {
+	switch t := v.(type) {
+	case int64:
+		return t != 0
+	case uint64:
+		return t != 0
+	case string:
+		return len(t) > 0
+	}
+	return false
+}
+
+// Print an event the way the kernel would, from its print fmt. ok is false
+// if the print fmt is more than evalArg understands.
+func (f *traceEventFormat) sprint(data []byte, order binary.ByteOrder) (string, bool) {
+	var b strings.Builder
+	argIdx := 0
+	rest := f.PrintFmt
+	for {
+		loc := TRACE_VERB_PATTERN.FindStringSubmatchIndex(rest)
+		if loc == nil {
+			b.WriteString(rest)
+			break
+		}
+		b.WriteString(rest[:loc[0]])
+		verb := rest[loc[10]:loc[11]]
+		if verb == "%" {
+			b.WriteString("%")
+			rest = rest[loc[1]:]
+			continue
+		}
+
+		if argIdx >= len(f.PrintArgs) {
+			return "", false
+		}
+		value, ok := f.evalArg(f.PrintArgs[argIdx], data, order)
+		if !ok {
+			return "", false
+		}
+		argIdx++
+
+		flags := rest[loc[2]:loc[3]] + rest[loc[4]:loc[5]]
+		if loc[6] >= 0 {
+			flags += rest[loc[6]:loc[7]]
+		}
+		switch verb {
+		case "d", "i":
+			if u, ok := value.(uint64); ok {
+				value = int64(u)
+			}
+			verb = "d"
+		case "u":
+			if i, ok := value.(int64); ok {
+				value = uint64(i)
+			}
+			verb = "d"
+		case "p":
+			// Symbols, e.g. %pS, would need kallsyms
+			verb = "x"
+			flags = "#" + flags
+			rest = strings.TrimLeft(rest[loc[1]:], "sSfFbB")
+			fmt.Fprintf(&b, "%"+flags+verb, value)
+			continue
+		}
+		fmt.Fprintf(&b, "%"+flags+verb, value)
+		rest = rest[loc[1]:]
+	}
+	if argIdx != len(f.PrintArgs) {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// Print an event's fields as name=value, for events whose print fmt can't be
+// followed.
+func (f *traceEventFormat) sprintFields(data []byte, order binary.ByteOrder) string {
+	parts := make([]string, 0, len(f.Fields))
+	for _, field := range f.Fields {
+		if strings.HasPrefix(field.Name, "common_") {
+			continue
+		}
+		if value, ok := field.value(data, order); ok {
+			parts = append(parts, fmt.Sprintf("%v=%v", field.Name, value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// A trace.dat file, read into trace_pipe lines
+type traceDatFile struct {
+	r        io.ReaderAt
+	order    binary.ByteOrder
+	longSize int
+	pageSize int
+	// The offset of commit and the data in each page
+	commitOffset int
+	dataOffset   int
+	formats      map[int]*traceEventFormat
+	comms        map[int64]string
+	cpus         []traceDatCPU
+}
+
+type traceDatCPU struct {
+	Offset int64
+	Size   int64
+}
+
+// A reader for the header of the file, which is read in order
+type traceDatHeaderReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+}
+
+func (h *traceDatHeaderReader) bytes(n int64) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(h.r, b)
+	return b, unexpectedEOF(err)
+}
+
+func (h *traceDatHeaderReader) uint16() (uint16, error) {
+	b, err := h.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return h.order.Uint16(b), nil
+}
+
+func (h *traceDatHeaderReader) uint32() (uint32, error) {
+	b, err := h.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return h.order.Uint32(b), nil
+}
+
+func (h *traceDatHeaderReader) uint64() (uint64, error) {
+	b, err := h.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return h.order.Uint64(b), nil
+}
+
+func (h *traceDatHeaderReader) cString() (string, error) {
+	s, err := h.r.ReadString(0)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return s[:len(s)-1], nil
+}
+
+// Sections with a 4 or 8 byte size
+func (h *traceDatHeaderReader) section(sizeLen int) ([]byte, error) {
+	var size uint64
+	var err error
+	if sizeLen == 4 {
+		var size32 uint32
+		size32, err = h.uint32()
+		size = uint64(size32)
+	} else {
+		size, err = h.uint64()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > 1<<30 {
+		return nil, fmt.Errorf("Invalid trace.dat section size: %v", size)
+	}
+	return h.bytes(int64(size))
+}
+
+// Whether the start of a file is a trace.dat one
+func isTraceDat(start []byte) bool {
+	return bytes.HasPrefix(start, traceDatMagic)
+}
+
+var TRACE_HEADER_PAGE_FIELD = regexp.MustCompile(`field:\s*[^;]*?(\w+);\s*offset:(\d+);`)
+
+func openTraceDat(r io.ReaderAt) (*traceDatFile, error) {
+	// The header is read in order, and then the data of each CPU from where
+	// it says.
+	h := &traceDatHeaderReader{r: bufio.NewReader(io.NewSectionReader(r, 0, 1<<62))}
+
+	magic, err := h.bytes(int64(len(traceDatMagic)))
+	if err != nil || !isTraceDat(magic) {
+		return nil, fmt.Errorf("Not a trace.dat file")
+	}
+	version, err := h.cString()
+	if err != nil {
+		return nil, err
+	}
+	if version != "6" {
+		return nil, fmt.Errorf("Unsupported trace.dat version %v. Only version 6 is supported", version)
+	}
+
+	b, err := h.bytes(2)
+	if err != nil {
+		return nil, err
+	}
+	t := &traceDatFile{
+		r:        r,
+		order:    binary.LittleEndian,
+		longSize: int(b[1]),
+		formats:  make(map[int]*traceEventFormat),
+		comms:    make(map[int64]string),
+	}
+	if b[0] != 0 {
+		t.order = binary.BigEndian
+	}
+	h.order = t.order
+	if t.longSize != 4 && t.longSize != 8 {
+		return nil, fmt.Errorf("Invalid trace.dat long size: %v", t.longSize)
+	}
+	pageSize, err := h.uint32()
+	if err != nil {
+		return nil, err
+	}
+	t.pageSize = int(pageSize)
+
+	// The page header, which says where the commit and data are
+	if name, err := h.cString(); err != nil {
+		return nil, err
+	} else if name != "header_page" {
+		return nil, fmt.Errorf("Invalid trace.dat: expected header_page, got '%v'", name)
+	}
+	headerPage, err := h.section(8)
+	if err != nil {
+		return nil, err
+	}
+	t.commitOffset, t.dataOffset = 8, 8+t.longSize
+	for _, m := range TRACE_HEADER_PAGE_FIELD.FindAllStringSubmatch(string(headerPage), -1) {
+		offset, _ := strconv.Atoi(m[2])
+		switch m[1] {
+		case "commit":
+			t.commitOffset = offset
+		case "data":
+			t.dataOffset = offset
+		}
+	}
+	// Every page starts with its timestamp, then the commit, then the data
+	if t.pageSize < 8 || t.pageSize < t.dataOffset {
+		return nil, fmt.Errorf("Invalid trace.dat page size %v for data at %v", t.pageSize, t.dataOffset)
+	}
+	if t.commitOffset+t.longSize > t.pageSize {
+		return nil, fmt.Errorf("Invalid trace.dat page size %v for commit at %v", t.pageSize, t.commitOffset)
+	}
+	if name, err := h.cString(); err != nil {
+		return nil, err
+	} else if name != "header_event" {
+		return nil, fmt.Errorf("Invalid trace.dat: expected header_event, got '%v'", name)
+	}
+	if _, err := h.section(8); err != nil {
+		return nil, err
+	}
+
+	// The ftrace events, then the events of each system
+	addFormats := func() error {
+		count, err := h.uint32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < count; i++ {
+			data, err := h.section(8)
+			if err != nil {
+				return err
+			}
+			format, err := parseTraceEventFormat(string(data))
+			if err != nil {
+				return err
+			}
+			t.formats[format.Id] = format
+		}
+		return nil
+	}
+	if err := addFormats(); err != nil {
+		return nil, err
+	}
+	systems, err := h.uint32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < systems; i++ {
+		if _, err := h.cString(); err != nil {
+			return nil, err
+		}
+		if err := addFormats(); err != nil {
+			return nil, err
+		}
+	}
+
+	// kallsyms and printk formats, which we don't need
+	for i := 0; i < 2; i++ {
+		if _, err := h.section(4); err != nil {
+			return nil, err
+		}
+	}
+
+	// The command of each pid, as "pid comm" lines
+	cmdlines, err := h.section(8)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(cmdlines), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if pid, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+			t.comms[pid] = parts[1]
+		}
+	}
+
+	cpus, err := h.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	// Options, then the data
+	for {
+		label, err := h.bytes(10)
+		if err != nil {
+			return nil, err
+		}
+		switch string(label) {
+		case "options  \x00":
+			for {
+				id, err := h.uint16()
+				if err != nil {
+					return nil, err
+				}
+				if id == 0 {
+					break
+				}
+				if _, err := h.section(4); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case "latency  \x00":
+			return nil, fmt.Errorf("Unsupported trace.dat: latency traces have no per-CPU data")
+		case "flyrecord\x00":
+		default:
+			return nil, fmt.Errorf("Invalid trace.dat: unexpected section '%v'", strings.TrimRight(string(label), " \x00"))
+		}
+		break
+	}
+
+	for i := uint32(0); i < cpus; i++ {
+		offset, err := h.uint64()
+		if err != nil {
+			return nil, err
+		}
+		size, err := h.uint64()
+		if err != nil {
+			return nil, err
+		}
+		t.cpus = append(t.cpus, traceDatCPU{int64(offset), int64(size)})
+	}
+	return t, nil
+}
+
+// A trace event from the ring buffer of a CPU
+type traceDatEvent struct {
+	Cpu       int
+	Timestamp uint64
+	Data      []byte
+}
+
+// Reads the events of a CPU, page by page
+type traceDatCPUReader struct {
+	t         *traceDatFile
+	cpu       int
+	section   *io.SectionReader
+	page      []byte
+	pos       int
+	end       int
+	timestamp uint64
+}
+
+func (t *traceDatFile) cpuReader(cpu int) *traceDatCPUReader {
+	c := t.cpus[cpu]
+	return &traceDatCPUReader{
+		t:       t,
+		cpu:     cpu,
+		section: io.NewSectionReader(t.r, c.Offset, c.Size),
+		page:    make([]byte, t.pageSize),
+	}
+}
+
+func (c *traceDatCPUReader) readLong(b []byte) uint64 {
+	if c.t.longSize == 4 {
+		return uint64(c.t.order.Uint32(b))
+	}
+	return c.t.order.Uint64(b)
+}
+
+func (c *traceDatCPUReader) nextPage() error {
+	if _, err := io.ReadFull(c.section, c.page); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("CPU %v: partial page", c.cpu)
+		}
+		return err
+	}
+	order := c.t.order
+	c.timestamp = order.Uint64(c.page)
+	commit := c.readLong(c.page[c.t.commitOffset:]) & ringBufCommitMask
+	c.pos = c.t.dataOffset
+	c.end = c.t.dataOffset + int(commit)
+	if c.end > len(c.page) {
+		return fmt.Errorf("CPU %v: invalid page commit %v", c.cpu, commit)
+	}
+	return nil
+}
+
+// The next event. io.EOF at the end of the CPU's data.
+func (c *traceDatCPUReader) next() (*traceDatEvent, error) {
+	order := c.t.order
+	for {
+		if c.pos+4 > c.end {
+			if err := c.nextPage(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		header := order.Uint32(c.page[c.pos:])
+		var typeLen int
+		var delta uint64
+		if order == binary.LittleEndian {
+			typeLen, delta = int(header&0x1f), uint64(header>>5)
+		} else {
+			typeLen, delta = int(header>>27), uint64(header&(1<<27-1))
+		}
+		c.pos += 4
+
+		// The word after the header, for the types that have one
+		array0 := func() (uint32, error) {
+			if c.pos+4 > c.end {
+				return 0, fmt.Errorf("CPU %v: event runs off the page", c.cpu)
+			}
+			v := order.Uint32(c.page[c.pos:])
+			c.pos += 4
+			return v, nil
+		}
+
+		switch {
+		case typeLen == ringBufTypePadding:
+			if delta == 0 {
+				// The rest of the page is empty
+				c.pos = c.end
+				continue
+			}
+			length, err := array0()
+			if err != nil {
+				return nil, err
+			}
+			// The length includes the word it's in
+			if length < 4 {
+				return nil, fmt.Errorf("CPU %v: invalid padding length %v", c.cpu, length)
+			}
+			c.pos += int(length) - 4
+			c.timestamp += delta
+		case typeLen == ringBufTypeTimeExtend:
+			ext, err := array0()
+			if err != nil {
+				return nil, err
+			}
+			c.timestamp += uint64(ext)<<ringBufTimeShift + delta
+		case typeLen == ringBufTypeTimeStamp:
+			abs, err := array0()
+			if err != nil {
+				return nil, err
+			}
+			c.timestamp = uint64(abs)<<ringBufTimeShift | delta
+		default:
+			var length int
+			if typeLen == ringBufTypeData {
+				l, err := array0()
+				if err != nil {
+					return nil, err
+				}
+				length = int(l) - 4
+			} else {
+				length = typeLen * 4
+			}
+			if length < 0 || c.pos+length > c.end {
+				return nil, fmt.Errorf("CPU %v: event runs off the page", c.cpu)
+			}
+			c.timestamp += delta
+			event := &traceDatEvent{
+				Cpu:       c.cpu,
+				Timestamp: c.timestamp,
+				Data:      c.page[c.pos : c.pos+length],
+			}
+			c.pos += length
+			return event, nil
+		}
+	}
+}
+
+// Print an event as trace_pipe would, e.g.
+//
+//	kworker/0:2-1911  [003] ...1 20455.979145: thermal_temp: sensor_id=5 temp=32
+func (t *traceDatFile) sprintEvent(event *traceDatEvent) (string, error) {
+	if len(event.Data) < 8 {
+		return "", fmt.Errorf("Event is too short: %v bytes", len(event.Data))
+	}
+	order := t.order
+	id := int(order.Uint16(event.Data))
+	format, ok := t.formats[id]
+	if !ok {
+		return "", fmt.Errorf("No format for event %v", id)
+	}
+
+	flags, preempt := event.Data[2], event.Data[3]
+	pid := int64(int32(order.Uint32(event.Data[4:])))
+	comm, ok := t.comms[pid]
+	if !ok {
+		comm = "<...>"
+		if pid == 0 {
+			comm = "<idle>"
+		}
+	}
+
+	text, ok := format.sprint(event.Data, order)
+	if !ok {
+		text = format.sprintFields(event.Data, order)
+	}
+
+	secs, usecs := event.Timestamp/1e9, (event.Timestamp%1e9)/1e3
+	return fmt.Sprintf("%16s-%-5d [%03d] %v %5d.%06d: %v: %v", comm, pid, event.Cpu,
+		traceFlagsString(flags, preempt), secs, usecs, format.Name, text), nil
+}
+
+// The latency format flags, e.g. d..2
+func traceFlagsString(flags byte, preempt byte) string {
+	b := []byte("....")
+	if flags&traceFlagIrqsOff != 0 {
+		b[0] = 'd'
+	} else if flags&traceFlagIrqsNoSupport != 0 {
+		b[0] = 'X'
+	}
+	if flags&traceFlagNeedResched != 0 {
+		b[1] = 'N'
+	}
+	switch {
+	case flags&traceFlagHardIrq != 0 && flags&traceFlagSoftIrq != 0:
+		b[2] = 'H'
+	case flags&traceFlagHardIrq != 0:
+		b[2] = 'h'
+	case flags&traceFlagSoftIrq != 0:
+		b[2] = 's'
+	}
+	if preempt&0xf != 0 {
+		b[3] = "0123456789abcdef"[preempt&0xf]
+	}
+	return string(b)
+}
+
+// Read the events of every CPU in timestamp order, calling fn with each one
+// as a trace_pipe line. Reading stops at the first error, from the file or
+// fn.
+func (t *traceDatFile) eachLine(fn func(line string) error) error {
+	readers := make([]*traceDatCPUReader, len(t.cpus))
+	heads := make([]*traceDatEvent, len(t.cpus))
+	for cpu := range t.cpus {
+		readers[cpu] = t.cpuReader(cpu)
+		event, err := readers[cpu].next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		heads[cpu] = event
+	}
+
+	for {
+		// The CPU with the earliest event
+		next := -1
+		for cpu, event := range heads {
+			if event != nil && (next < 0 || event.Timestamp < heads[next].Timestamp) {
+				next = cpu
+			}
+		}
+		if next < 0 {
+			return nil
+		}
+
+		line, err := t.sprintEvent(heads[next])
+		if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+
+		event, err := readers[next].next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		heads[next] = event
+	}
+}
@@ -0,0 +1,288 @@
+package phonelab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const traceDatCommonFields = `
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+`
+
+var testTraceDatFormats = map[string]string{
+	"power": `name: cpu_frequency
+ID: 10
+format:` + traceDatCommonFields + `
+	field:u32 state;	offset:8;	size:4;	signed:0;
+	field:u32 cpu_id;	offset:12;	size:4;	signed:0;
+
+print fmt: "state=%lu cpu_id=%lu", (unsigned long)REC->state, (unsigned long)REC->cpu_id
+`,
+	"sched": `name: sched_cpu_hotplug
+ID: 11
+format:` + traceDatCommonFields + `
+	field:int affected_cpu;	offset:8;	size:4;	signed:1;
+	field:int error;	offset:12;	size:4;	signed:1;
+	field:int status;	offset:16;	size:4;	signed:1;
+
+print fmt: "cpu %d %s error=%d", REC->affected_cpu, REC->status ? "online" : "offline", REC->error
+`,
+	"phonelab": `name: phonelab_proc_foreground
+ID: 12
+format:` + traceDatCommonFields + `
+	field:int pid;	offset:8;	size:4;	signed:1;
+	field:int tgid;	offset:12;	size:4;	signed:1;
+	field:__data_loc char[] comm;	offset:16;	size:4;	signed:0;
+
+print fmt: "pid=%d tgid=%d comm=%s", REC->pid, REC->tgid, __get_str(comm)
+`,
+	"mystery": `name: mystery
+ID: 13
+format:` + traceDatCommonFields + `
+	field:unsigned long flags;	offset:8;	size:8;	signed:0;
+	field:char name[8];	offset:16;	size:8;	signed:0;
+
+print fmt: "flags=%s", __print_flags(REC->flags, "|", { 1, "A" }, { 2, "B" })
+`,
+}
+
+// An event in a test trace.dat
+type testTraceDatEvent struct {
+	cpu int
+	// Nanoseconds
+	ts   uint64
+	data []byte
+}
+
+func traceDatEventData(id uint16, flags byte, preempt byte, pid int32, fields ...interface{}) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, id)
+	b.WriteByte(flags)
+	b.WriteByte(preempt)
+	binary.Write(&b, le, pid)
+	for _, field := range fields {
+		if s, ok := field.(string); ok {
+			b.WriteString(s)
+		} else {
+			binary.Write(&b, le, field)
+		}
+	}
+	// Events are in 4 byte words
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// Build a trace.dat with a page of events for each CPU
+func buildTraceDat(cpus int, events []testTraceDatEvent) []byte {
+	const pageSize = 4096
+	le := binary.LittleEndian
+
+	var h bytes.Buffer
+	h.Write(traceDatMagic)
+	h.WriteString("6\x00")
+	h.Write([]byte{0, 8})
+	binary.Write(&h, le, uint32(pageSize))
+
+	section := func(sizeLen int, data string) {
+		if sizeLen == 4 {
+			binary.Write(&h, le, uint32(len(data)))
+		} else {
+			binary.Write(&h, le, uint64(len(data)))
+		}
+		h.WriteString(data)
+	}
+
+	h.WriteString("header_page\x00")
+	section(8, "\tfield: u64 timestamp;\toffset:0;\tsize:8;\tsigned:0;\n"+
+		"\tfield: local_t commit;\toffset:8;\tsize:8;\tsigned:1;\n"+
+		"\tfield: int overwrite;\toffset:8;\tsize:1;\tsigned:1;\n"+
+		"\tfield: char data;\toffset:16;\tsize:4080;\tsigned:1;\n")
+	h.WriteString("header_event\x00")
+	section(8, "# compressed entry header\n\ttype_len    :    5 bits\n")
+
+	// No ftrace events, then a system for each format
+	binary.Write(&h, le, uint32(0))
+	binary.Write(&h, le, uint32(len(testTraceDatFormats)))
+	for system, format := range testTraceDatFormats {
+		h.WriteString(system + "\x00")
+		binary.Write(&h, le, uint32(1))
+		section(8, format)
+	}
+
+	section(4, "")
+	section(4, "")
+	section(8, "1911 kworker/0:2\n13759 .android.dialer\n")
+	binary.Write(&h, le, uint32(cpus))
+
+	h.WriteString("options  \x00")
+	binary.Write(&h, le, uint16(3))
+	section(4, "local\x00")
+	binary.Write(&h, le, uint16(0))
+	h.WriteString("flyrecord\x00")
+
+	// The pages of each CPU come after the header
+	pages := make([][]byte, cpus)
+	for cpu := range pages {
+		var page bytes.Buffer
+		var base, last uint64
+		for _, event := range events {
+			if event.cpu != cpu {
+				continue
+			}
+			if page.Len() == 0 {
+				base, last = event.ts, event.ts
+			}
+			delta := event.ts - last
+			last = event.ts
+			if delta >= 1<<ringBufTimeShift {
+				binary.Write(&page, le, uint32(ringBufTypeTimeExtend)|uint32(delta&(1<<ringBufTimeShift-1))<<5)
+				binary.Write(&page, le, uint32(delta>>ringBufTimeShift))
+				delta = 0
+			}
+			binary.Write(&page, le, uint32(len(event.data)/4)|uint32(delta)<<5)
+			page.Write(event.data)
+		}
+
+		var b bytes.Buffer
+		binary.Write(&b, le, base)
+		binary.Write(&b, le, uint64(page.Len()))
+		b.Write(page.Bytes())
+		b.Write(make([]byte, pageSize-b.Len()))
+		pages[cpu] = b.Bytes()
+	}
+
+	offset := uint64(h.Len() + cpus*16)
+	for _, page := range pages {
+		binary.Write(&h, le, offset)
+		binary.Write(&h, le, uint64(len(page)))
+		offset += uint64(len(page))
+	}
+	for _, page := range pages {
+		h.Write(page)
+	}
+	return h.Bytes()
+}
+
+var testTraceDatEvents = []testTraceDatEvent{
+	{0, 1000000001000, traceDatEventData(10, 0, 1, 1911, uint32(2265600), uint32(0))},
+	// More than a time delta holds
+	{0, 1000500000000, traceDatEventData(13, traceFlagIrqsOff, 2, 0, uint64(3), "abc\x00\x00\x00\x00\x00")},
+	{1, 1000200000000, traceDatEventData(11, traceFlagIrqsOff|traceFlagHardIrq, 0, 1911, int32(1), int32(0), int32(1))},
+	{1, 1000300000000, traceDatEventData(12, 0, 0, 13759, int32(13759), int32(13759),
+		uint32(20)|uint32(len(".android.dialer")+1)<<16, ".android.dialer\x00")},
+}
+
+func TestTraceDatLines(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	file, err := openTraceDat(bytes.NewReader(buildTraceDat(2, testTraceDatEvents)))
+	require.Nil(err)
+	assert.Equal(4, len(file.formats))
+	assert.Equal(16, file.dataOffset)
+
+	lines := make([]string, 0)
+	require.Nil(file.eachLine(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}))
+
+	// In time order, across the CPUs
+	assert.Equal([]string{
+		"     kworker/0:2-1911  [000] ...1  1000.000001: cpu_frequency: state=2265600 cpu_id=0",
+		"     kworker/0:2-1911  [001] d.h.  1000.200000: sched_cpu_hotplug: cpu 1 online error=0",
+		" .android.dialer-13759 [001] ....  1000.300000: phonelab_proc_foreground: pid=13759 tgid=13759 comm=.android.dialer",
+		"          <idle>-0     [000] d..2  1000.500000: mystery: flags=3 name=abc",
+	}, lines)
+}
+
+func TestTraceEventFormat(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	require := require.New(t)
+
+	format, err := parseTraceEventFormat(testTraceDatFormats["sched"])
+	require.Nil(err)
+	assert.Equal(11, format.Id)
+	assert.Equal("sched_cpu_hotplug", format.Name)
+	assert.Equal(7, len(format.Fields))
+	assert.Equal("cpu %d %s error=%d", format.PrintFmt)
+	assert.Equal([]string{"REC->affected_cpu", `REC->status ? "online" : "offline"`, "REC->error"}, format.PrintArgs)
+
+	data := traceDatEventData(11, 0, 0, 1, int32(-2), int32(-22), int32(0))
+	text, ok := format.sprint(data, binary.LittleEndian)
+	assert.True(ok)
+	assert.Equal("cpu -2 offline error=-22", text)
+
+	assert.Equal([]string{"a", `"b, c"`, "f(d, e)"}, splitTraceArgs(`a, "b, c", f(d, e)`))
+
+	_, err = parseTraceEventFormat("format:\n" + traceDatCommonFields)
+	assert.NotNil(err)
+}
+
+func TestTraceDatErrors(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	data := buildTraceDat(2, testTraceDatEvents)
+
+	// Not a trace.dat
+	_, err := openTraceDat(bytes.NewReader([]byte("tracing")))
+	assert.NotNil(err)
+
+	// Another version
+	other := append([]byte{}, data...)
+	other[len(traceDatMagic)] = '7'
+	_, err = openTraceDat(bytes.NewReader(other))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Only version 6")
+
+	// Cut off in the header
+	_, err = openTraceDat(bytes.NewReader(data[:100]))
+	assert.NotNil(err)
+
+	// Cut off in the data
+	file, err := openTraceDat(bytes.NewReader(data[:len(data)-100]))
+	assert.Nil(err)
+	assert.NotNil(file.eachLine(func(string) error { return nil }))
+}
+
+func TestTraceDatBadPageSize(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	data := buildTraceDat(2, testTraceDatEvents)
+	// After the magic, version, endianness and long size
+	pageSizeAt := len(traceDatMagic) + 4
+
+	withPageSize := func(data []byte, pageSize uint32) []byte {
+		other := append([]byte{}, data...)
+		binary.LittleEndian.PutUint32(other[pageSizeAt:], pageSize)
+		return other
+	}
+
+	// Smaller than the page header
+	for _, pageSize := range []uint32{0, 4, 12} {
+		_, err := openTraceDat(bytes.NewReader(withPageSize(data, pageSize)))
+		assert.NotNil(err, "%v", pageSize)
+	}
+
+	// The data fits, but the commit doesn't
+	moved := bytes.Replace(data, []byte("char data;\toffset:16;"), []byte("char data;\toffset:10;"), 1)
+	_, err := openTraceDat(bytes.NewReader(withPageSize(moved, 12)))
+	assert.NotNil(err)
+	if err != nil {
+		assert.Contains(err.Error(), "commit")
+	}
+}
@@ -348,3 +348,236 @@ func TestSetTrace(t *testing.T) {
 	assert.True(reflect.DeepEqual(expected, &log.Trace))
 	t.Log(log)
 }
+
+// A Kernel-Trace logline with the given trace event and payload
+func traceLogline(event string) string {
+	return "1b0676e5fb2d7ab82a2b76887c53e94cf0410826        1461715200524   1461715200524.17        346fb177-c54f-4f8a-9385-124c461fd5cc    1268385 20456.226252    2016-04-27 00:00:00.524332      203     203     D   Kernel-Trace     kworker/0:2-1911  [003] d..3 20455.979145: " + event
+}
+
+func TestParseSchedEvents(t *testing.T) {
+	t.Parallel()
+
+	parser := NewKernelTraceParser()
+
+	testConf := []*parseComparison{
+		&parseComparison{
+			line:     traceLogline("sched_switch: prev_comm=kworker/0:2 prev_pid=1911 prev_prio=120 prev_state=R+ ==> next_comm=Binder_2 Thread next_pid=882 next_prio=-2"),
+			parser:   parser,
+			expected: &SchedSwitch{PrevComm: "kworker/0:2", PrevPid: 1911, PrevPrio: 120, PrevState: "R+", NextComm: "Binder_2 Thread", NextPid: 882, NextPrio: -2},
+		},
+		// No next task
+		&parseComparison{
+			line:          traceLogline("sched_switch: prev_comm=kworker/0:2 prev_pid=1911 prev_prio=120 prev_state=S"),
+			parser:        parser,
+			subParseFails: true,
+		},
+		&parseComparison{
+			line:     traceLogline("sched_wakeup: comm=surfaceflinger pid=230 prio=112 success=1 target_cpu=002"),
+			parser:   parser,
+			expected: &SchedWakeup{Comm: "surfaceflinger", Pid: 230, Prio: 112, Success: 1, TargetCpu: 2},
+		},
+		// Newer kernels
+		&parseComparison{
+			line:     traceLogline("sched_waking: comm=surfaceflinger pid=230 prio=112 target_cpu=002"),
+			parser:   parser,
+			expected: &SchedWakeup{Comm: "surfaceflinger", Pid: 230, Prio: 112, TargetCpu: 2},
+		},
+		&parseComparison{
+			line:     traceLogline("sched_migrate_task: comm=kworker/0:2 pid=1911 prio=120 orig_cpu=3 dest_cpu=0"),
+			parser:   parser,
+			expected: &SchedMigrateTask{Comm: "kworker/0:2", Pid: 1911, Prio: 120, OrigCpu: 3, DestCpu: 0},
+		},
+		&parseComparison{
+			line:          traceLogline("sched_migrate_task: comm=kworker/0:2 pid=1911 prio=120 orig_cpu=-3 dest_cpu=0"),
+			parser:        parser,
+			subParseFails: true,
+		},
+	}
+
+	commonTestParse(testConf, t)
+}
+
+func TestParsePowerEvents(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	parser := NewKernelTraceParser()
+
+	testConf := []*parseComparison{
+		&parseComparison{
+			line:     traceLogline("cpu_idle: state=1 cpu_id=3"),
+			parser:   parser,
+			expected: &CpuIdle{State: 1, CpuId: 3},
+		},
+		&parseComparison{
+			line:     traceLogline("cpu_frequency_limits: min=300000 max=2265600 cpu_id=0"),
+			parser:   parser,
+			expected: &CpuFrequencyLimits{Min: 300000, Max: 2265600, CpuId: 0},
+		},
+		&parseComparison{
+			line:     traceLogline("clock_set_rate: gcc_sdcc1_apps_clk state=200000000 cpu_id=0"),
+			parser:   parser,
+			expected: &ClockSetRate{Name: "gcc_sdcc1_apps_clk", State: 200000000, CpuId: 0},
+		},
+		&parseComparison{
+			line:          traceLogline("clock_set_rate: state=200000000 cpu_id=0"),
+			parser:        parser,
+			subParseFails: true,
+		},
+		&parseComparison{
+			line:     traceLogline("irq_handler_entry: irq=35 name=arch_timer"),
+			parser:   parser,
+			expected: &IrqHandlerEntry{Irq: 35, Name: "arch_timer"},
+		},
+		&parseComparison{
+			line:     traceLogline("irq_handler_exit: irq=35 ret=unhandled"),
+			parser:   parser,
+			expected: &IrqHandlerExit{Irq: 35, Ret: "unhandled"},
+		},
+		&parseComparison{
+			line:          traceLogline("irq_handler_exit: irq=35 ret=maybe"),
+			parser:        parser,
+			subParseFails: true,
+		},
+	}
+
+	commonTestParse(testConf, t)
+
+	obj, err := parser.Parse("          <idle>-0     [000] d..2 20455.979145: cpu_idle: state=4294967295 cpu_id=0")
+	assert.Nil(err)
+	idle := obj.(*CpuIdle)
+	assert.True(idle.Exit())
+	assert.Equal(20455.979145, idle.Timestamp)
+}
+
+func TestParseBlockEvents(t *testing.T) {
+	t.Parallel()
+
+	parser := NewKernelTraceParser()
+
+	testConf := []*parseComparison{
+		&parseComparison{
+			line:     traceLogline("block_rq_issue: 179,0 WS 4096 () 4530176 + 8 [mmcqd/0]"),
+			parser:   parser,
+			expected: &BlockRqIssue{Major: 179, Minor: 0, Rwbs: "WS", Bytes: 4096, Sector: 4530176, NrSector: 8, Comm: "mmcqd/0"},
+		},
+		// Newer kernels have the priority
+		&parseComparison{
+			line:     traceLogline("block_rq_issue: 8,0 RA 16384 () 123456 + 32 none,0,0 [Binder:882_2]"),
+			parser:   parser,
+			expected: &BlockRqIssue{Major: 8, Minor: 0, Rwbs: "RA", Bytes: 16384, Sector: 123456, NrSector: 32, Comm: "Binder:882_2"},
+		},
+		&parseComparison{
+			line:     traceLogline("block_rq_complete: 179,0 W () 4530176 + 8 [-5]"),
+			parser:   parser,
+			expected: &BlockRqComplete{Major: 179, Minor: 0, Rwbs: "W", Sector: 4530176, NrSector: 8, Error: -5},
+		},
+		&parseComparison{
+			line:          traceLogline("block_rq_complete: 179,0 W () 4530176 + 8 [mmcqd/0]"),
+			parser:        parser,
+			subParseFails: true,
+		},
+	}
+
+	commonTestParse(testConf, t)
+}
+
+func TestParseWritebackEvents(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	parser := NewKernelTraceParser()
+
+	obj, err := parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: writeback_start: bdi 179:0: sb_dev 0:0 nr_pages=1024 sync_mode=0 kupdate=0 range_cyclic=1 background=1 reason=background")
+	assert.Nil(err)
+	event := obj.(*WritebackEvent)
+	assert.Equal("writeback_start", event.Tag)
+	assert.Equal("179:0", event.Bdi)
+	assert.Equal("0:0", event.Fields["sb_dev"])
+	assert.Equal("background", event.Fields["reason"])
+	pages, err := event.IntField("nr_pages")
+	assert.Nil(err)
+	assert.Equal(int64(1024), pages)
+	_, err = event.IntField("reason")
+	assert.NotNil(err)
+	_, err = event.IntField("foo")
+	assert.NotNil(err)
+
+	obj, err = parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: writeback_bdi_register: bdi 8:0")
+	assert.Nil(err)
+	assert.Equal("8:0", obj.(*WritebackEvent).Bdi)
+	assert.Equal(0, len(obj.(*WritebackEvent).Fields))
+
+	obj, err = parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: writeback_congestion_wait: usec_timeout=100000 usec_delayed=100000")
+	assert.Nil(err)
+	assert.Equal("", obj.(*WritebackEvent).Bdi)
+	assert.Equal("100000", obj.(*WritebackEvent).Fields["usec_delayed"])
+
+	obj, err = parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: writeback_pages_written: 1024")
+	assert.Nil(err)
+	assert.Equal(int64(1024), obj.(*WritebackPagesWritten).Pages)
+
+	_, err = parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: writeback_dirty_page: bdi 179:0: ino=1605 index")
+	assert.NotNil(err)
+
+	obj, err = parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: mm_filemap_add_to_page_cache: dev 179:32 ino 1a2b page=ffffffbdc1234560 pfn=301234 ofs=8192")
+	assert.Nil(err)
+	assert.Equal(&MmFilemap{
+		Trace: Trace{Thread: "kworker/u8:1-52", Cpu: 1, Unknown: "...1", Timestamp: 1932.849097, Tag: "mm_filemap_add_to_page_cache"},
+		Major: 179, Minor: 32, Ino: 0x1a2b, Page: "ffffffbdc1234560", Pfn: 301234, Ofs: 8192,
+	}, obj)
+
+	_, err = parser.Parse("     kworker/u8:1-52    [001] ...1  1932.849097: mm_filemap_delete_from_page_cache: dev 179:32 ino xyz page=ffffffbdc1234560 pfn=301234 ofs=8192")
+	assert.NotNil(err)
+}
+
+type testTraceFoo struct {
+	Trace
+	Text string
+}
+
+type testTraceFooParser struct{}
+
+func (p *testTraceFooParser) Parse(line string) (interface{}, error) {
+	return &testTraceFoo{Text: line}, nil
+}
+
+func TestRegisterTraceSubparser(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	line := "     kworker/0:2-1911  [003] ...1 20455.979145: foo: some text"
+
+	parser := NewKernelTraceParser()
+	_, err := parser.Parse(line)
+	assert.NotNil(err)
+
+	parser.RegisterSubparser("foo", &testTraceFooParser{})
+	obj, err := parser.Parse(line)
+	assert.Nil(err)
+	assert.Equal("some text", obj.(*testTraceFoo).Text)
+	assert.Equal(3, obj.(*testTraceFoo).Cpu)
+
+	// Plugins register them with the environment
+	env := NewEnvironment()
+	env.RegisterTraceSubparser("foo", func() Parser {
+		return &testTraceFooParser{}
+	})
+	env.RegisterTraceSubparser("thermal_temp", func() Parser {
+		return &testTraceFooParser{}
+	})
+	tparser := env.Parsers[TAG_TRACE]()
+	obj, err = tparser.Parse(line)
+	assert.Nil(err)
+	assert.Equal("some text", obj.(*testTraceFoo).Text)
+
+	// Built-in ones can be replaced
+	obj, err = tparser.Parse("     kworker/0:2-1911  [003] ...1 20455.979145: thermal_temp: sensor_id=5 temp=32")
+	assert.Nil(err)
+	assert.Equal("sensor_id=5 temp=32", obj.(*testTraceFoo).Text)
+
+	// And the rest are still there
+	obj, err = tparser.Parse("     kworker/0:2-1911  [003] ...1 20455.979145: cpu_idle: state=0 cpu_id=1")
+	assert.Nil(err)
+	assert.Equal(1, obj.(*CpuIdle).CpuId)
+}
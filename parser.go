@@ -87,10 +87,25 @@ func (pc *LoglineParser) Parse(line string) (interface{}, error) {
 		ll = obj
 	}
 
+	// Nothing to parse, e.g. a blank line
+	if ll == nil {
+		return nil, nil
+	}
+
+	return pc.ParsePayload(ll)
+}
+
+// Parse the payload of a Logline that has already been read, e.g. from a
+// binary log, with the parser for its tag. Payloads that aren't strings,
+// like events, have nothing left to parse.
+func (pc *LoglineParser) ParsePayload(ll *Logline) (interface{}, error) {
 	// Do we have a payload parser?
 	if parser, ok := pc.TagParsers[ll.Tag]; ok {
 		// Yes
-		payload := ll.Payload.(string)
+		payload, ok := ll.Payload.(string)
+		if !ok {
+			return ll, nil
+		}
 		if obj, err := parser.Parse(payload); err != nil {
 			return ll, err
 		} else {
@@ -0,0 +1,157 @@
+package phonelab
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Path templates lay out output files by values from the source and the
+// record, e.g. "device={device}/date={date}/{context}/{type}". Each collector
+// decides which variables it has.
+const (
+	PathVarDevice     = "device"
+	PathVarBootId     = "boot_id"
+	PathVarContext    = "context"
+	PathVarSourceType = "source_type"
+	PathVarFile       = "file"
+	PathVarDate       = "date"
+	PathVarType       = "type"
+	PathVarProcessor  = "processor"
+	PathVarSeq        = "seq"
+)
+
+// What a variable expands to when there's no value for it
+const pathTemplateUnknown = "unknown"
+
+type pathTemplate struct {
+	Template string
+	vars     map[string]bool
+}
+
+// Parse the template, allowing only the given variables.
+func parsePathTemplate(template string, allowed []string) (*pathTemplate, error) {
+	t := &pathTemplate{
+		Template: template,
+		vars:     make(map[string]bool),
+	}
+
+	rest := template
+	for {
+		start := strings.Index(rest, "{")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("Unclosed '{' in path template '%v'", template)
+		}
+		name := rest[start+1 : start+end]
+		rest = rest[start+end+1:]
+
+		known := false
+		for _, a := range allowed {
+			if a == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			if suggestion := suggestName(name, allowed); len(suggestion) > 0 {
+				return nil, fmt.Errorf("Unknown variable '{%v}' in path template. Did you mean '{%v}'?", name, suggestion)
+			}
+			return nil, fmt.Errorf("Unknown variable '{%v}' in path template. Expected one of: %v",
+				name, strings.Join(allowed, ", "))
+		}
+		t.vars[name] = true
+	}
+
+	if strings.Contains(rest, "}") {
+		return nil, fmt.Errorf("Unmatched '}' in path template '%v'", template)
+	}
+	return t, nil
+}
+
+// Whether the template uses the variable
+func (t *pathTemplate) Has(name string) bool {
+	return t.vars[name]
+}
+
+// Fill in the variables. Missing or empty ones are 'unknown'. The result is a
+// clean relative path.
+func (t *pathTemplate) Expand(vars map[string]string) string {
+	var b strings.Builder
+	rest := t.Template
+	for {
+		start := strings.Index(rest, "{")
+		if start == -1 {
+			b.WriteString(rest)
+			break
+		}
+		end := start + strings.Index(rest[start:], "}")
+		b.WriteString(rest[:start])
+		if v := vars[rest[start+1:end]]; len(v) > 0 {
+			b.WriteString(v)
+		} else {
+			b.WriteString(pathTemplateUnknown)
+		}
+		rest = rest[end+1:]
+	}
+	return strings.TrimPrefix(path.Clean("/"+b.String()), "/")
+}
+
+// The template variables that come from the source
+func sourcePathVars(info PipelineSourceInfo) map[string]string {
+	device, bootId := sourceDeviceBoot(info)
+	vars := map[string]string{
+		PathVarDevice:     device,
+		PathVarBootId:     bootId,
+		PathVarContext:    info.Context(),
+		PathVarSourceType: info.Type(),
+	}
+	switch t := info.(type) {
+	case *TextFileSourceInfo:
+		vars[PathVarFile] = path.Base(t.Filename)
+	case *ArchiveSourceInfo:
+		vars[PathVarFile] = path.Base(t.Member)
+	case *BinaryLogSourceInfo:
+		vars[PathVarFile] = path.Base(t.Filename)
+	case *FtraceSourceInfo:
+		vars[PathVarFile] = path.Base(t.Filename)
+	}
+	return vars
+}
+
+// The device and boot ID of the source, where there is one.
+func sourceDeviceBoot(info PipelineSourceInfo) (device string, bootId string) {
+	switch t := info.(type) {
+	case *PhonelabSourceInfo:
+		return t.DeviceId, t.BootId
+	case *PhonelabRawInfo:
+		return t.DeviceId, ""
+	}
+	return "", ""
+}
+
+// The date of a record, as YYYY-MM-DD, from its Datetime, e.g. a Logline's.
+// Empty if it doesn't have one.
+func recordDate(obj interface{}) string {
+	v := reflect.ValueOf(obj)
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	field := v.FieldByName("Datetime")
+	if !field.IsValid() || !field.CanInterface() {
+		return ""
+	}
+	if dt, ok := field.Interface().(time.Time); ok && !dt.IsZero() {
+		return dt.Format("2006-01-02")
+	}
+	return ""
+}
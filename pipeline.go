@@ -1,5 +1,13 @@
 package phonelab
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
 const (
 	DEFAULT_MAX_CONCURRENCY = 0
 )
@@ -52,6 +60,32 @@ type DataCollector interface {
 	Finish()
 }
 
+// DataCollectors that implement SourceDoneCollector are told when the Runner
+// is done with a source, whether or not it ran all the way through. There are
+// no more OnData calls for the source after that, so it's the time to close
+// anything kept open for it. Checkpoint, if the collector implements it, is
+// called afterwards.
+type SourceDoneCollector interface {
+	DataCollector
+	SourceDone(info PipelineSourceInfo)
+}
+
+// DataCollectors that implement FailedSourceCollector are told when a source
+// fails under ErrorPolicySkipSource, after SourceDone. The Runner stops passing
+// on the source's results once it fails, but some may already have been given
+// to OnData; this is the time to throw them away, or mark them as partial.
+type FailedSourceCollector interface {
+	DataCollector
+	SourceFailed(info PipelineSourceInfo)
+}
+
+// DataCollectors built from a RunnerConf that implement SinkNameCollector are
+// told the name of the sink processor whose results they get.
+type SinkNameCollector interface {
+	DataCollector
+	SetSinkName(name string)
+}
+
 // A Runner manages running the processors. Its job is to facilitate building
 // pipelines once for each source, kicking off the processing, and passing
 // results to the DataCollector.
@@ -60,6 +94,15 @@ type Runner struct {
 	Collector      DataCollector
 	Builder        PipelineBuilder
 	MaxConcurrency int
+	ErrorPolicy    ErrorPolicy
+	// If set, sources that finish are recorded here and sources that are
+	// already in it are skipped.
+	Journal *Journal
+	// If set, every pipeline's processors are counted here.
+	Metrics *RunMetrics
+	// The filesystems of sources that weren't given a FileSystemResolver
+	// come from here. nil for the built-in ones.
+	Env *Environment
 }
 
 func NewRunner(gen PipelineSourceGenerator, dc DataCollector, plb PipelineBuilder) *Runner {
@@ -68,36 +111,133 @@ func NewRunner(gen PipelineSourceGenerator, dc DataCollector, plb PipelineBuilde
 		Collector:      dc,
 		Builder:        plb,
 		MaxConcurrency: DEFAULT_MAX_CONCURRENCY,
+		ErrorPolicy:    DEFAULT_ERROR_POLICY,
 	}
 }
 
-func (r *Runner) runOne(source *PipelineSourceInstance, done chan error) {
+func (r *Runner) runOne(ctx context.Context, source *PipelineSourceInstance,
+	reporter *errorReporter, done chan bool) {
+
+	if r.Metrics != nil {
+		ctx = withPipelineMetrics(ctx, r.Metrics.newPipeline(source.Info))
+	}
+
+	// Make sure the source sees ctx, however the pipeline is put together.
+	source = &PipelineSourceInstance{
+		Processor: &contextSource{ctx, source.Processor},
+		Info:      source.Info,
+	}
+
 	// Build it
 	pipeline, err := r.Builder.BuildPipeline(source)
 	if err != nil {
-		done <- err
+		reporter.report(&SourceError{Info: source.Info, Err: err})
+		done <- true
 		return
 	}
 
 	// Start the processing
-	resChan := pipeline.LastHop.Process()
+	resChan := ProcessContext(ctx, pipeline.LastHop)
 
 	// Drain the results and forward them to the DataCollector.
+	skipSource := reporter.policy == ErrorPolicySkipSource && source.Info != nil
+	metrics := nodeMetrics(ctx, "DataCollector")
 	for res := range resChan {
+		if ctx.Err() != nil {
+			break
+		}
+		// Anything still coming from a failed source is dropped
+		if skipSource && reporter.sourceFailed(source.Info) {
+			break
+		}
+		metrics.itemIn()
+		start := time.Now()
 		r.Collector.OnData(res, source.Info)
+		metrics.addHandleTime(time.Since(start))
+	}
+	drain(resChan)
+
+	if sd, ok := r.Collector.(SourceDoneCollector); ok {
+		sd.SourceDone(source.Info)
+	}
+	if skipSource && reporter.sourceFailed(source.Info) {
+		if fc, ok := r.Collector.(FailedSourceCollector); ok {
+			fc.SourceFailed(source.Info)
+		}
+	}
+
+	// Only sources that ran all the way through without errors are done.
+	if r.Journal != nil && source.Info != nil && journaled(source.Info) && ctx.Err() == nil && !reporter.sourceFailed(source.Info) {
+		if err := r.checkpoint(source.Info); err != nil {
+			reporter.report(&SourceError{Info: source.Info, Err: err})
+		}
 	}
 
-	done <- nil
+	done <- true
 }
 
 // Synchronsously run the processor for all data sources.
 func (runner *Runner) Run() []error {
+	return runner.RunContext(context.Background())
+}
+
+// Synchronously run the processor for all data sources, stopping early if ctx
+// is canceled or its deadline passes. RunContext doesn't return until every
+// pipeline has shut down.
+//
+// Errors from the sources are returned as *SourceErrors. What happens to the
+// rest of the run after an error depends on the ErrorPolicy. If the run was cut
+// short, either by ctx or by ErrorPolicyFailFast, the DataCollector is told
+// that the run was partial (see PartialDataCollector), and ctx.Err() is
+// included in the returned errors if ctx was the reason.
+func (runner *Runner) RunContext(ctx context.Context) []error {
+	policy := runner.ErrorPolicy
+	if len(policy) == 0 {
+		policy = DEFAULT_ERROR_POLICY
+	}
+
+	// Sources find the reporter through the context.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reporter := &errorReporter{
+		policy: policy,
+		cancel: cancel,
+		errs:   make([]error, 0),
+		failed: make(map[string]bool),
+	}
+	runCtx = withErrorReporter(runCtx, reporter)
+	if runner.Env != nil {
+		runCtx = withEnvironment(runCtx, runner.Env)
+	}
+	if runner.Journal != nil {
+		runCtx = withJournal(runCtx, runner.Journal)
+	}
+
+	// Pick up where we left off
+	if runner.Journal != nil {
+		if cp, ok := runner.Collector.(Checkpointer); ok {
+			if err := cp.Restore(runner.Journal.Entries()); err != nil {
+				return []error{fmt.Errorf("Failed to restore from journal: %v", err)}
+			}
+		}
+	}
+
 	running := 0
-	sourceChan := runner.Source.Process()
-	done := make(chan error)
-	allErrors := make([]error, 0)
+	sourceChan := processSourcesContext(runCtx, runner.Source)
+	done := make(chan bool)
 
 	for source := range sourceChan {
+		// Don't start anything new once we're canceled, but keep reading so
+		// the generator isn't left blocked.
+		if runCtx.Err() != nil {
+			continue
+		}
+
+		if sourceSkipped(runCtx, source.Info) {
+			log.Infof("Skipping %v %v: already done", source.Info.Type(), source.Info.Context())
+			continue
+		}
+
 		// Do we have a spot?
 		if runner.MaxConcurrency > 0 && running == runner.MaxConcurrency {
 			// No. Wait for something to finish.
@@ -105,17 +245,32 @@ func (runner *Runner) Run() []error {
 			running -= 1
 		}
 		running += 1
-		go runner.runOne(source, done)
+		go runner.runOne(runCtx, source, reporter, done)
 	}
 
 	for running > 0 {
-		err := <-done
-		if err != nil {
-			allErrors = append(allErrors, err)
-		}
+		<-done
 		running -= 1
 	}
 
-	runner.Collector.Finish()
+	allErrors := reporter.errors()
+
+	if runCtx.Err() != nil {
+		reason := ctx.Err()
+		if reason != nil {
+			allErrors = append(allErrors, reason)
+		} else {
+			// We failed fast
+			reason = allErrors[0]
+		}
+
+		if pdc, ok := runner.Collector.(PartialDataCollector); ok {
+			pdc.FinishPartial(reason)
+		} else {
+			runner.Collector.Finish()
+		}
+	} else {
+		runner.Collector.Finish()
+	}
 	return allErrors
 }
@@ -7,6 +7,7 @@ package phonelab
 // log sources.
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"regexp"
@@ -46,6 +47,10 @@ func NewSimpleProcessor(source Processor, handler LogHandler) *SimpleProcessor {
 }
 
 func (proc *SimpleProcessor) Process() <-chan interface{} {
+	return proc.ProcessContext(context.Background())
+}
+
+func (proc *SimpleProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
 	outChan := make(chan interface{})
 
 	if proc.Handler == nil {
@@ -55,13 +60,25 @@ func (proc *SimpleProcessor) Process() <-chan interface{} {
 		panic("SimpleProcessor source cannot be nil!")
 	}
 
+	metrics := nodeMetrics(ctx, handlerMetricsName(proc.Handler))
+	if mh, ok := proc.Handler.(MetricsHandler); ok {
+		mh.SetMetrics(metrics)
+	}
+
 	go func() {
-		inChan := proc.Source.Process()
+		inChan := ProcessContext(ctx, proc.Source)
 		for log := range inChan {
-			if res := proc.Handler.Handle(log); res != nil {
-				outChan <- res
+			if ctx.Err() != nil {
+				break
+			}
+			metrics.itemIn()
+			if res := metrics.handle(proc.Handler, log); res != nil {
+				if !metrics.send(ctx, outChan, res) {
+					break
+				}
 			}
 		}
+		drain(inChan)
 		proc.Handler.Finish()
 		close(outChan)
 	}()
@@ -69,58 +86,218 @@ func (proc *SimpleProcessor) Process() <-chan interface{} {
 	return outChan
 }
 
-// Muxer multiplexes log lines/objects onto multiple output channels from a
-// single source.
-type Muxer struct {
+// fanOut hands everything from a single source to multiple destinations, each
+// of which calls ProcessContext once. Nothing is read until they all have.
+type fanOut struct {
 	Source  Processor
+	name    string
 	dest    []chan interface{}
 	numDest int
+	ctx     context.Context
 	l       sync.Mutex
 }
 
-func NewMuxer(source Processor, numDest int) *Muxer {
-	return &Muxer{
-		Source:  source,
-		dest:    make([]chan interface{}, 0),
-		numDest: numDest,
-	}
-}
+// Add a destination, and start run with all of them once this is the last.
+// run closes the destinations when it's done with them.
+func (f *fanOut) processContext(ctx context.Context,
+	run func(ctx context.Context, dest []chan interface{})) <-chan interface{} {
 
-func (m *Muxer) Process() <-chan interface{} {
 	// This is going to be invoked multiple times, once for each output
 	// processor, but we need to give each one their own channel. And, we want
 	// to wait until all the channels have been created to start processing.
-	m.l.Lock()
-	defer m.l.Unlock()
+	f.l.Lock()
+	defer f.l.Unlock()
 
 	outChan := make(chan interface{})
-	m.dest = append(m.dest, outChan)
+	f.dest = append(f.dest, outChan)
+
+	// Every destination is part of the same run, so the first context we're
+	// given is as good as any.
+	if f.ctx == nil {
+		f.ctx = ctx
+	}
 
-	if len(m.dest) > m.numDest {
-		panic("Muxer: More invocations than destinations")
-	} else if len(m.dest) < m.numDest {
+	if len(f.dest) > f.numDest {
+		panic(f.name + ": More invocations than destinations")
+	} else if len(f.dest) < f.numDest {
 		// Not there yet
 		return outChan
 	}
 
 	// Good to go.
-	go func() {
-		inChan := m.Source.Process()
+	go run(f.ctx, f.dest)
 
-		for log := range inChan {
+	return outChan
+}
 
+// Read the source, passing each item to send until it returns false.
+func (f *fanOut) forEach(ctx context.Context, metrics *ProcessorMetrics, send func(interface{}) bool) {
+	inChan := ProcessContext(ctx, f.Source)
+	for log := range inChan {
+		metrics.itemIn()
+		if !send(log) {
+			break
+		}
+	}
+	drain(inChan)
+}
+
+// Muxer multiplexes log lines/objects onto multiple output channels from a
+// single source.
+type Muxer struct {
+	fanOut
+}
+
+func NewMuxer(source Processor, numDest int) *Muxer {
+	return &Muxer{fanOut{
+		Source:  source,
+		name:    "Muxer",
+		dest:    make([]chan interface{}, 0),
+		numDest: numDest,
+	}}
+}
+
+func (m *Muxer) Process() <-chan interface{} {
+	return m.ProcessContext(context.Background())
+}
+
+func (m *Muxer) ProcessContext(ctx context.Context) <-chan interface{} {
+	return m.processContext(ctx, func(ctx context.Context, dest []chan interface{}) {
+		metrics := nodeMetrics(ctx, "Muxer")
+		m.forEach(ctx, metrics, func(log interface{}) bool {
 			// Multiplex current message. For now, blocking non-concurrent sends.
-			for _, c := range m.dest {
-				c <- log
+			for _, c := range dest {
+				if !metrics.send(ctx, c, log) {
+					return false
+				}
 			}
-		}
+			return true
+		})
 
-		for _, c := range m.dest {
+		for _, c := range dest {
 			close(c)
 		}
-	}()
+	})
+}
 
-	return outChan
+// SinglePassProcessor is a source Processor that can only be read once, e.g.
+// a live stream. The builder reads these through a Tee when they feed more
+// than one logstream.
+type SinglePassProcessor interface {
+	Processor
+	SinglePass()
+}
+
+// Whether proc is a SinglePassProcessor, including as the source of a run.
+func isSinglePass(proc Processor) bool {
+	if cs, ok := proc.(*contextSource); ok {
+		return isSinglePass(cs.Processor)
+	}
+	_, ok := proc.(SinglePassProcessor)
+	return ok
+}
+
+// Tee is a Muxer for sources that can only be read once. Each destination
+// gets its own queue, so one that falls behind doesn't hold up the others,
+// e.g. when they are merged back together.
+//
+// By default the queues are unbounded, so a destination that falls far behind
+// costs memory rather than stalling the run. With MaxQueue set, a full queue
+// holds up the Tee, and so every destination. That bounds the memory, but if
+// the destinations wait on each other, e.g. because they're merged back
+// together, one that falls more than MaxQueue items behind deadlocks the run.
+type Tee struct {
+	fanOut
+	// Most items to queue for a destination. 0 for no limit.
+	MaxQueue int
+}
+
+func NewTee(source Processor, numDest int) *Tee {
+	return &Tee{fanOut: fanOut{
+		Source:  source,
+		name:    "Tee",
+		dest:    make([]chan interface{}, 0),
+		numDest: numDest,
+	}}
+}
+
+func (t *Tee) Process() <-chan interface{} {
+	return t.ProcessContext(context.Background())
+}
+
+func (t *Tee) ProcessContext(ctx context.Context) <-chan interface{} {
+	// The source is shared by every destination, so it isn't counted under
+	// any one processor's name.
+	ctx = context.WithValue(ctx, metricsScopeKey{}, "")
+
+	return t.processContext(ctx, func(ctx context.Context, dest []chan interface{}) {
+		metrics := nodeMetrics(ctx, "Tee")
+
+		queues := make([]chan interface{}, len(dest))
+		for i, c := range dest {
+			queues[i] = make(chan interface{})
+			go queueItems(ctx, queues[i], c, t.MaxQueue, metrics)
+		}
+
+		t.forEach(ctx, metrics, func(log interface{}) bool {
+			for _, q := range queues {
+				select {
+				case q <- log:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		})
+
+		for _, q := range queues {
+			close(q)
+		}
+	})
+}
+
+// Pass everything from inChan to outChan, queueing up to maxQueue items (0 for
+// no limit) for as long as it takes outChan to take them. Once the queue is
+// full, nothing more is taken from inChan until there's room. outChan is
+// closed once inChan is and the queue is empty, or when ctx is canceled. The
+// queue's depth is counted in metrics.
+func queueItems(ctx context.Context, inChan <-chan interface{}, outChan chan<- interface{},
+	maxQueue int, metrics *ProcessorMetrics) {
+
+	defer close(outChan)
+
+	queue := make([]interface{}, 0)
+	for inChan != nil || len(queue) > 0 {
+		// Nothing to send is a nil channel, which is never ready.
+		var sendChan chan<- interface{}
+		var next interface{}
+		if len(queue) > 0 {
+			sendChan = outChan
+			next = queue[0]
+		}
+		// Same for nothing to take
+		recvChan := inChan
+		if maxQueue > 0 && len(queue) >= maxQueue {
+			recvChan = nil
+		}
+
+		select {
+		case item, ok := <-recvChan:
+			if !ok {
+				inChan = nil
+			} else {
+				queue = append(queue, item)
+				metrics.queueChanged(1)
+			}
+		case sendChan <- next:
+			queue[0] = nil
+			queue = queue[1:]
+			metrics.queueChanged(-1)
+		case <-ctx.Done():
+			metrics.queueChanged(-int64(len(queue)))
+			return
+		}
+	}
 }
 
 // Demuxer takes input from multiple sources and funnels it down a single
@@ -136,14 +313,23 @@ func NewDemuxer(sources []Processor) *Demuxer {
 }
 
 func (dm *Demuxer) Process() <-chan interface{} {
+	return dm.ProcessContext(context.Background())
+}
+
+func (dm *Demuxer) ProcessContext(ctx context.Context) <-chan interface{} {
 	outChan := make(chan interface{})
 	done := make(chan int)
+	metrics := nodeMetrics(ctx, "Demuxer")
 
 	var runOne = func(p Processor) {
-		res := p.Process()
+		res := ProcessContext(ctx, p)
 		for log := range res {
-			outChan <- log
+			metrics.itemIn()
+			if !metrics.send(ctx, outChan, log) {
+				break
+			}
 		}
+		drain(res)
 		done <- 1
 	}
 
@@ -175,6 +361,14 @@ func (p *StringFilterHandler) Handle(log interface{}) interface{} {
 				return log
 			}
 		}
+	case *Logline:
+		// Sources that read Loglines, e.g. binary logs, are filtered by
+		// their line.
+		for _, filter := range p.Filters {
+			if filter(t.Line) {
+				return log
+			}
+		}
 	default:
 		panic(fmt.Sprintf("String filter got non-string object: %T", log))
 	}
@@ -198,13 +392,25 @@ func makeRegexFilter(regexStr string) StringFilter {
 
 // Log
 type LoglineProcessorHandler struct {
-	Parser *LoglineParser
+	Parser  *LoglineParser
+	metrics *ProcessorMetrics
 }
 
 func (p *LoglineProcessorHandler) Handle(logline interface{}) interface{} {
-	line := logline.(string)
-	ll, err := p.Parser.Parse(line)
+	var ll interface{}
+	var err error
+	switch t := logline.(type) {
+	case string:
+		ll, err = p.Parser.Parse(t)
+	case *Logline:
+		// Already read, e.g. from a binary log
+		ll, err = p.Parser.ParsePayload(t)
+	default:
+		// Already parsed by the source, e.g. ftrace events
+		return logline
+	}
 	if err != nil {
+		p.metrics.AddParseErrors(1)
 		log.Printf("Error parsing line: %v\n", err)
 	}
 	return ll
@@ -212,6 +418,10 @@ func (p *LoglineProcessorHandler) Handle(logline interface{}) interface{} {
 
 func (p *LoglineProcessorHandler) Finish() {}
 
+func (p *LoglineProcessorHandler) SetMetrics(m *ProcessorMetrics) {
+	p.metrics = m
+}
+
 func NewLoglineProcessor(source Processor, parser *LoglineParser) Processor {
-	return NewSimpleProcessor(source, &LoglineProcessorHandler{parser})
+	return NewSimpleProcessor(source, &LoglineProcessorHandler{Parser: parser})
 }
@@ -72,6 +72,31 @@ func TestMuxer(t *testing.T) {
 
 }
 
+func TestTee(t *testing.T) {
+	assert := assert.New(t)
+
+	const ntee = 3
+	const iter = 100
+
+	processor := NewTee(&emitter{iter}, ntee)
+
+	resChans := make([]<-chan interface{}, ntee)
+	for i := 0; i < ntee; i++ {
+		resChans[i] = processor.Process()
+	}
+
+	// Unlike a Muxer, each destination can be read all the way through
+	// before the next one.
+	for _, resChan := range resChans {
+		expected := 0
+		for val := range resChan {
+			assert.Equal(expected, val.(int))
+			expected += 1
+		}
+		assert.Equal(iter, expected)
+	}
+}
+
 func TestDemuxer(t *testing.T) {
 	assert := assert.New(t)
 
@@ -0,0 +1,264 @@
+// Package s3 reaches S3-compatible object stores, such as a local MinIO, for
+// the s3://bucket/key paths that sources are read from and results are
+// written to. The serialize package writes with the same clients.
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Config says how to reach an S3-compatible object store.
+type Config struct {
+	// URL of the service, e.g. http://localhost:9000 for a local MinIO
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Size of the parts of multipart uploads, which is also how much of an
+	// upload is held in memory
+	PartSize uint64
+}
+
+const (
+	DefaultEndpoint = "https://s3.amazonaws.com"
+	DefaultRegion   = "us-east-1"
+	DefaultPartSize = 16 * 1024 * 1024
+)
+
+// The config used for s3:// paths. If nil, it comes from the environment
+// (see ConfigFromEnv).
+var DefaultConfig *Config
+
+// Read the config from S3_ENDPOINT and the usual AWS_REGION,
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func ConfigFromEnv() *Config {
+	return &Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+}
+
+// Client reads s3://bucket/key URLs. It is a filesystem for sources: it can
+// Glob, ReadFile, check if paths Exist and OpenReader.
+type Client struct {
+	client   *minio.Client
+	partSize uint64
+}
+
+func NewClient(conf *Config) (*Client, error) {
+	endpoint := conf.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = DefaultEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%v'. Expected a URL like http://host:port", endpoint)
+	}
+
+	// Without a region, every request would first ask for the bucket's.
+	region := conf.Region
+	if len(region) == 0 {
+		region = DefaultRegion
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, ""),
+		Secure: u.Scheme == "https",
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := conf.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	return &Client{client, partSize}, nil
+}
+
+// The underlying MinIO client, for everything else
+func (c *Client) Minio() *minio.Client {
+	return c.client
+}
+
+// The size of the parts of multipart uploads
+func (c *Client) PartSize() uint64 {
+	return c.partSize
+}
+
+var (
+	defaultClient    *Client
+	defaultClientErr error
+	defaultClientMu  sync.Mutex
+)
+
+// The client for DefaultConfig. It is created on first use.
+func DefaultClient() (*Client, error) {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+
+	if defaultClient == nil && defaultClientErr == nil {
+		conf := DefaultConfig
+		if conf == nil {
+			conf = ConfigFromEnv()
+		}
+		defaultClient, defaultClientErr = NewClient(conf)
+	}
+	return defaultClient, defaultClientErr
+}
+
+// Forget the default client, so the next one uses the current
+// DefaultConfig.
+func ResetDefaultClient() {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	defaultClient = nil
+	defaultClientErr = nil
+}
+
+// Split s3://bucket/key
+func ParseURL(s3url string) (string, string, error) {
+	if !strings.HasPrefix(s3url, "s3://") {
+		return "", "", fmt.Errorf("Path '%v' does not contain 's3://'", s3url)
+	}
+	rest := s3url[5:]
+	idx := strings.Index(rest, "/")
+	if idx == -1 {
+		idx = len(rest)
+	}
+	bucket := rest[:idx]
+	if len(bucket) == 0 {
+		return "", "", fmt.Errorf("Path '%v' has no bucket", s3url)
+	}
+	return bucket, strings.TrimPrefix(rest[idx:], "/"), nil
+}
+
+func IsNoSuchKey(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// Find the objects matching a pattern like s3://bucket/prefix/*/*.gz. As with
+// easyfiles, ** matches any number of directories. Only the part of the
+// pattern before the first wildcard is listed.
+func (c *Client) Glob(pattern string) ([]string, error) {
+	bucket, keyPattern, err := ParseURL(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := keyPattern
+	if idx := strings.IndexAny(keyPattern, "*?[\\"); idx != -1 {
+		prefix = keyPattern[:idx]
+	}
+
+	matches := make([]string, 0)
+	opts := minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}
+	for obj := range c.client.ListObjects(context.Background(), bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		ok, err := matchKey(strings.Split(keyPattern, "/"), strings.Split(obj.Key, "/"))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, "s3://"+bucket+"/"+obj.Key)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Match a key against a pattern one path element at a time
+func matchKey(pattern, key []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(key) == 0, nil
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(key); i++ {
+			if ok, err := matchKey(pattern[1:], key[i:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	if len(key) == 0 {
+		return false, nil
+	}
+	if ok, err := path.Match(pattern[0], key[0]); !ok || err != nil {
+		return false, err
+	}
+	return matchKey(pattern[1:], key[1:])
+}
+
+// Open an object for reading. Nothing is decompressed.
+func (c *Client) OpenReader(s3url string) (io.ReadCloser, error) {
+	bucket, key, err := ParseURL(s3url)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := c.client.GetObject(context.Background(), bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, so this is where a missing object shows up
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (c *Client) ReadFile(s3url string) ([]byte, error) {
+	r, err := c.OpenReader(s3url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// An object exists, or a "directory" does if there are objects under it.
+func (c *Client) Exists(s3url string) (bool, error) {
+	bucket, key, err := ParseURL(s3url)
+	if err != nil {
+		return false, err
+	}
+	if len(key) > 0 {
+		_, err := c.client.StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
+		if err == nil {
+			return true, nil
+		} else if !IsNoSuchKey(err) {
+			return false, err
+		}
+	}
+
+	prefix := key
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range c.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1}) {
+		return obj.Err == nil, obj.Err
+	}
+	return false, nil
+}
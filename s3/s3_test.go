@@ -0,0 +1,160 @@
+package s3_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/shaseley/phonelab-go/s3"
+	"github.com/shaseley/phonelab-go/serialize/s3test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Start a server with a bucket holding the keys, each containing its name
+func newTestServer(t *testing.T, keys ...string) *s3test.Server {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-s3")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	server, err := s3test.NewServer("bucket")
+	require.Nil(err)
+	for i, key := range keys {
+		local := filepath.Join(tmpDir, strconv.Itoa(i))
+		require.Nil(ioutil.WriteFile(local, []byte(key), 0644))
+		require.Nil(server.PutFile("s3://bucket/"+key, local))
+	}
+	return server
+}
+
+func TestParseURL(t *testing.T) {
+	assert := assert.New(t)
+
+	bucket, key, err := s3.ParseURL("s3://bucket/a/b.gz")
+	assert.Nil(err)
+	assert.Equal("bucket", bucket)
+	assert.Equal("a/b.gz", key)
+
+	bucket, key, err = s3.ParseURL("s3://bucket")
+	assert.Nil(err)
+	assert.Equal("bucket", bucket)
+	assert.Equal("", key)
+
+	for _, bad := range []string{"bucket/a", "s3:///a", "hdfs://bucket/a"} {
+		_, _, err = s3.ParseURL(bad)
+		assert.NotNil(err, bad)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := newTestServer(t,
+		"logs/a.log",
+		"logs/b.log.gz",
+		"logs/sub/c.log",
+		"logsx/d.log",
+		"other/e.log",
+	)
+	defer server.Close()
+
+	for pattern, expected := range map[string][]string{
+		// Wildcards stay within one path element
+		"s3://bucket/logs/*":      {"s3://bucket/logs/a.log", "s3://bucket/logs/b.log.gz"},
+		"s3://bucket/logs/*.log":  {"s3://bucket/logs/a.log"},
+		"s3://bucket/*/*.log":     {"s3://bucket/logs/a.log", "s3://bucket/logsx/d.log", "s3://bucket/other/e.log"},
+		"s3://bucket/logs*/?.log": {"s3://bucket/logs/a.log", "s3://bucket/logsx/d.log"},
+		// Listing by prefix doesn't make a prefix match
+		"s3://bucket/logs":     {},
+		"s3://bucket/log*":     {},
+		"s3://bucket/logs/sub": {},
+		// Exact keys
+		"s3://bucket/logs/sub/c.log": {"s3://bucket/logs/sub/c.log"},
+		// ** matches any number of directories
+		"s3://bucket/logs/**": {"s3://bucket/logs/a.log", "s3://bucket/logs/b.log.gz", "s3://bucket/logs/sub/c.log"},
+		"s3://bucket/**/*.log": {"s3://bucket/logs/a.log", "s3://bucket/logs/sub/c.log",
+			"s3://bucket/logsx/d.log", "s3://bucket/other/e.log"},
+		"s3://bucket/**/sub/*":  {"s3://bucket/logs/sub/c.log"},
+		"s3://bucket/nothing/*": {},
+	} {
+		matches, err := server.Client.Glob(pattern)
+		require.Nil(err, pattern)
+		assert.Equal(expected, matches, pattern)
+	}
+
+	for _, bad := range []string{"s3://bucket/logs/[", "logs/*", "s3:///logs/*"} {
+		_, err := server.Client.Glob(bad)
+		assert.NotNil(err, bad)
+	}
+
+	_, err := server.Client.Glob("s3://missing/*")
+	assert.NotNil(err)
+}
+
+func TestExists(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, "logs/a.log", "logs/sub/c.log")
+	defer server.Close()
+
+	for p, expected := range map[string]bool{
+		"s3://bucket/logs/a.log":     true,
+		"s3://bucket/logs/sub/c.log": true,
+		// Directories exist if there's anything under them
+		"s3://bucket/logs":       true,
+		"s3://bucket/logs/":      true,
+		"s3://bucket/logs/sub":   true,
+		"s3://bucket":            true,
+		"s3://bucket/logs/b.log": false,
+		"s3://bucket/log":        false,
+		"s3://bucket/logs/a":     false,
+		"s3://bucket/other/":     false,
+	} {
+		exists, err := server.Client.Exists(p)
+		assert.Nil(err, p)
+		assert.Equal(expected, exists, p)
+	}
+
+	_, err := server.Client.Exists("bucket/logs/a.log")
+	assert.NotNil(err)
+}
+
+func TestOpenReader(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := newTestServer(t, "logs/a.log")
+	defer server.Close()
+
+	r, err := server.Client.OpenReader("s3://bucket/logs/a.log")
+	require.Nil(err)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Nil(r.Close())
+	assert.Equal("logs/a.log", string(data))
+
+	// A missing object is an error up front, not on the first read
+	r, err = server.Client.OpenReader("s3://bucket/logs/b.log")
+	assert.Nil(r)
+	require.NotNil(err)
+	assert.True(s3.IsNoSuchKey(err), "%v", err)
+
+	_, err = server.Client.ReadFile("s3://bucket/logs/b.log")
+	require.NotNil(err)
+	assert.True(s3.IsNoSuchKey(err), "%v", err)
+
+	// A directory isn't an object
+	_, err = server.Client.OpenReader("s3://bucket/logs")
+	assert.NotNil(err)
+
+	_, err = server.Client.OpenReader("s3://missing/logs/a.log")
+	assert.NotNil(err)
+
+	_, err = server.Client.OpenReader("logs/a.log")
+	assert.NotNil(err)
+}
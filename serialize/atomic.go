@@ -0,0 +1,291 @@
+package serialize
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gurupras/go-easyfiles"
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteMode says what to do when the destination of a write already exists.
+type WriteMode string
+
+const (
+	// Replace it. This is the default.
+	WriteOverwrite WriteMode = "overwrite"
+	// Fail with an *ExistsError.
+	WriteNoOverwrite WriteMode = "no_overwrite"
+	// Leave it alone if it has the same content, and replace it otherwise.
+	// The content is compared uncompressed.
+	WriteSkipIdentical WriteMode = "skip_identical"
+)
+
+var writeModes = []WriteMode{WriteOverwrite, WriteNoOverwrite, WriteSkipIdentical}
+
+func ParseWriteMode(s string) (WriteMode, error) {
+	if len(s) == 0 {
+		return WriteOverwrite, nil
+	}
+	for _, mode := range writeModes {
+		if string(mode) == s {
+			return mode, nil
+		}
+	}
+	names := make([]string, len(writeModes))
+	for i, mode := range writeModes {
+		names[i] = string(mode)
+	}
+	return "", fmt.Errorf("Unknown write mode '%v'. Expected one of: %v", s, strings.Join(names, ", "))
+}
+
+// ModeSerializer is a Serializer with a configurable WriteMode.
+type ModeSerializer interface {
+	Serializer
+	SetWriteMode(mode WriteMode)
+}
+
+// ExistsError is returned for writes with WriteNoOverwrite whose destination
+// already exists.
+type ExistsError struct {
+	Path string
+}
+
+func (e *ExistsError) Error() string {
+	return fmt.Sprintf("Refusing to overwrite existing file: %v", e.Path)
+}
+
+func IsExists(err error) bool {
+	_, ok := err.(*ExistsError)
+	return ok
+}
+
+// Filesystems that can move a file, e.g. HDFS
+type renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+var tempCounter int64
+
+// atomicWriter writes to a temporary sibling of the destination and moves it
+// into place on Close, after it is synced, so that nobody ever sees a partial
+// file under the real name. If the file is gzipped is decided by the
+// destination's name.
+//
+// Local files are fsynced and renamed. Other filesystems are renamed if they
+// can be, which is the case for HDFS; otherwise the file is written in place.
+type atomicWriter struct {
+	fs      easyfiles.FileSystemInterface
+	local   bool
+	path    string
+	tmpPath string
+	mode    WriteMode
+	file    *easyfiles.File
+	writer  *easyfiles.Writer
+	// Of the uncompressed content, for WriteSkipIdentical
+	hash hash.Hash
+	err  error
+}
+
+func newAtomicWriter(fs easyfiles.FileSystemInterface, local bool, outPath string, mode WriteMode) (*atomicWriter, error) {
+	dir := path.Dir(outPath)
+	if exists, _ := fs.Exists(dir); !exists {
+		if err := fs.Makedirs(dir); err != nil {
+			return nil, fmt.Errorf("Failed to create directory: %v: %v", dir, err)
+		}
+	}
+
+	if mode == WriteNoOverwrite {
+		if exists, _ := fs.Exists(outPath); exists {
+			return nil, &ExistsError{outPath}
+		}
+	}
+
+	w := &atomicWriter{
+		fs:    fs,
+		local: local,
+		path:  outPath,
+		mode:  mode,
+		hash:  sha256.New(),
+	}
+
+	if _, ok := fs.(renamer); local || ok {
+		w.tmpPath = path.Join(dir, fmt.Sprintf(".%v.tmp-%d-%d", path.Base(outPath), os.Getpid(),
+			atomic.AddInt64(&tempCounter, 1)))
+	} else {
+		log.Warnf("Can't rename files on %T, writing %v in place", fs, outPath)
+		w.tmpPath = outPath
+	}
+
+	fileType := easyfiles.GZ_FALSE
+	if strings.HasSuffix(outPath, ".gz") {
+		fileType = easyfiles.GZ_TRUE
+	}
+
+	var err error
+	if w.file, err = fs.Open(w.tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileType); err != nil {
+		return nil, fmt.Errorf("Failed to open file: %v: %v", w.tmpPath, err)
+	}
+	if w.writer, err = w.file.Writer(0); err != nil {
+		w.file.Close()
+		fs.Remove(w.tmpPath)
+		return nil, fmt.Errorf("Failed to get writer to file: %v: %v", w.tmpPath, err)
+	}
+	return w, nil
+}
+
+func (w *atomicWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.hash.Write(p[:n])
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Finish the file and move it into place. Returns the first error writing,
+// flushing or closing the file, if there was one, in which case the
+// destination is left alone.
+func (w *atomicWriter) Close() error {
+	err := w.err
+	for _, closeErr := range []error{w.writer.Flush(), w.writer.Close(), w.file.Close()} {
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("Failed to finish file: %v: %v", w.tmpPath, closeErr)
+		}
+	}
+
+	if err == nil && w.local {
+		err = syncPath(w.tmpPath)
+	}
+	if err == nil && w.tmpPath != w.path {
+		err = w.commit()
+	}
+	if err != nil && w.tmpPath != w.path {
+		w.fs.Remove(w.tmpPath)
+	}
+	return err
+}
+
+func (w *atomicWriter) commit() error {
+	switch w.mode {
+	case WriteSkipIdentical:
+		if exists, _ := w.fs.Exists(w.path); exists {
+			if sum, err := contentHash(w.fs, w.path); err == nil && bytes.Equal(sum, w.hash.Sum(nil)) {
+				log.Debugf("Skipping identical %v", w.path)
+				return w.fs.Remove(w.tmpPath)
+			}
+		}
+	case WriteNoOverwrite:
+		if w.local {
+			// A link fails if the destination exists, so nothing can sneak
+			// in between the check and the move.
+			if err := os.Link(w.tmpPath, w.path); err != nil {
+				if os.IsExist(err) {
+					return &ExistsError{w.path}
+				}
+				return err
+			}
+			os.Remove(w.tmpPath)
+			return syncPath(path.Dir(w.path))
+		}
+		if exists, _ := w.fs.Exists(w.path); exists {
+			return &ExistsError{w.path}
+		}
+	}
+	return w.rename()
+}
+
+func (w *atomicWriter) rename() error {
+	if w.local {
+		if err := os.Rename(w.tmpPath, w.path); err != nil {
+			return err
+		}
+		return syncPath(path.Dir(w.path))
+	}
+
+	r := w.fs.(renamer)
+	err := r.Rename(w.tmpPath, w.path)
+	if err != nil && w.mode != WriteNoOverwrite {
+		// Some filesystems won't rename over an existing file.
+		if exists, _ := w.fs.Exists(w.path); exists {
+			if rerr := w.fs.Remove(w.path); rerr == nil {
+				err = r.Rename(w.tmpPath, w.path)
+			}
+		}
+	}
+	return err
+}
+
+// fsync a local file or directory
+func syncPath(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		// Not every filesystem can sync a directory.
+		if stat, serr := f.Stat(); serr == nil && stat.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// The hash of the uncompressed content of a file. The file is opened as is
+// and gunzipped here, so two gzips of the same content match.
+func contentHash(fs easyfiles.FileSystemInterface, p string) ([]byte, error) {
+	f, err := fs.Open(p, os.O_RDONLY, easyfiles.GZ_FALSE)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader, err := f.RawReader()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(p, ".gz") {
+		gzr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		reader = gzr
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Write a whole file atomically.
+func writeAtomic(fs easyfiles.FileSystemInterface, local bool, outPath string, mode WriteMode, b []byte) error {
+	w, err := newAtomicWriter(fs, local, outPath, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return fmt.Errorf("Failed to write to file: %v: %v", outPath, err)
+	}
+	return w.Close()
+}
+
+// The mode to use, with the default for unset ones
+func writeMode(mode WriteMode) WriteMode {
+	if len(mode) == 0 {
+		return WriteOverwrite
+	}
+	return mode
+}
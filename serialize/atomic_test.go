@@ -0,0 +1,210 @@
+package serialize
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Nothing but the outputs should be left in dir
+func requireNoTempFiles(t *testing.T, dir string, outputs ...string) {
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	names := make([]string, 0)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, outputs, names)
+}
+
+func TestLocalSerializeShorter(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-atomic-shorter")
+	defer os.RemoveAll(outdir)
+	outPath := filepath.Join(outdir, "out.json")
+
+	s := &LocalSerializer{}
+	require.Nil(s.Serialize(streamRecords, "file://"+outPath))
+	require.Nil(s.Serialize(streamRecords[:1], "file://"+outPath))
+
+	// No leftovers from the longer file
+	b, err := ioutil.ReadFile(outPath)
+	require.Nil(err)
+	var got []*streamRecord
+	require.Nil(json.Unmarshal(b, &got))
+	require.Equal(streamRecords[:1], got)
+
+	requireNoTempFiles(t, outdir, "out.json")
+}
+
+func TestLocalSerializeNoOverwrite(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-atomic-no-overwrite")
+	defer os.RemoveAll(outdir)
+	outPath := filepath.Join(outdir, "out.json")
+
+	s := &LocalSerializer{Mode: WriteNoOverwrite}
+	require.Nil(s.Serialize(streamRecords, "file://"+outPath))
+
+	err := s.Serialize(streamRecords[:1], "file://"+outPath)
+	require.NotNil(err)
+	require.True(IsExists(err))
+
+	_, err = s.OpenStream("file://" + outPath)
+	require.True(IsExists(err))
+
+	b, err := ioutil.ReadFile(outPath)
+	require.Nil(err)
+	var got []*streamRecord
+	require.Nil(json.Unmarshal(b, &got))
+	require.Equal(streamRecords, got)
+
+	requireNoTempFiles(t, outdir, "out.json")
+}
+
+func TestLocalSerializeSkipIdentical(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-atomic-skip-identical")
+	defer os.RemoveAll(outdir)
+
+	for _, name := range []string{"out.json", "out.json.gz"} {
+		outPath := filepath.Join(outdir, name)
+		s := &LocalSerializer{Mode: WriteSkipIdentical}
+		require.Nil(s.Serialize(streamRecords, "file://"+outPath))
+
+		old := time.Now().Add(-time.Hour).Truncate(time.Second)
+		require.Nil(os.Chtimes(outPath, old, old))
+
+		// Same content, so it's left alone
+		require.Nil(s.Serialize(streamRecords, "file://"+outPath))
+		stat, err := os.Stat(outPath)
+		require.Nil(err)
+		require.True(stat.ModTime().Equal(old), name)
+
+		// Different content replaces it
+		require.Nil(s.Serialize(streamRecords[:1], "file://"+outPath))
+		stat, err = os.Stat(outPath)
+		require.Nil(err)
+		require.False(stat.ModTime().Equal(old), name)
+	}
+
+	requireNoTempFiles(t, outdir, "out.json", "out.json.gz")
+}
+
+func TestLocalSerializeSkipIdenticalGz(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-atomic-skip-identical-gz")
+	defer os.RemoveAll(outdir)
+	plainPath := filepath.Join(outdir, "plain.json")
+	outPath := filepath.Join(outdir, "out.json.gz")
+
+	s := &LocalSerializer{Mode: WriteSkipIdentical}
+	require.Nil(s.Serialize(streamRecords, "file://"+plainPath))
+	content, err := ioutil.ReadFile(plainPath)
+	require.Nil(err)
+
+	// The same content, gzipped differently than the serializer would
+	f, err := os.Create(outPath)
+	require.Nil(err)
+	gzw, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	require.Nil(err)
+	gzw.Name = "elsewhere.json"
+	_, err = gzw.Write(content)
+	require.Nil(err)
+	require.Nil(gzw.Close())
+	require.Nil(f.Close())
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.Nil(os.Chtimes(outPath, old, old))
+	before, err := os.Stat(outPath)
+	require.Nil(err)
+
+	require.Nil(s.Serialize(streamRecords, "file://"+outPath))
+	after, err := os.Stat(outPath)
+	require.Nil(err)
+	require.True(os.SameFile(before, after))
+	require.True(after.ModTime().Equal(old))
+
+	requireNoTempFiles(t, outdir, "plain.json", "out.json.gz")
+}
+
+func TestLocalStreamIncomplete(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-atomic-incomplete")
+	defer os.RemoveAll(outdir)
+	outPath := filepath.Join(outdir, "out.ndjson")
+	writeStream(t, "file://"+outPath)
+
+	s := &LocalSerializer{}
+	stream, err := s.OpenStream("file://" + outPath)
+	require.Nil(err)
+	require.Nil(NewRecordEncoder(stream).Encode(streamRecords[0]))
+
+	// Nothing shows up until the stream is closed
+	requireNoTempFiles(t, outdir, "out.ndjson", filepath.Base(stream.(*atomicWriter).tmpPath))
+
+	// A failed stream doesn't replace what was there
+	stream.(*atomicWriter).err = errors.New("failed")
+	require.NotNil(stream.Close())
+
+	f, err := os.Open(outPath)
+	require.Nil(err)
+	defer f.Close()
+	require.Equal(streamRecords, decodeStream(t, f))
+
+	requireNoTempFiles(t, outdir, "out.ndjson")
+}
+
+func TestLocalStreamCloseError(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-atomic-close-error")
+	defer os.RemoveAll(outdir)
+	outPath := filepath.Join(outdir, "out.ndjson")
+	writeStream(t, "file://"+outPath)
+
+	s := &LocalSerializer{}
+	stream, err := s.OpenStream("file://" + outPath)
+	require.Nil(err)
+	require.Nil(NewRecordEncoder(stream).Encode(streamRecords[0]))
+
+	// The record is still buffered, so it can't be flushed
+	stream.(*atomicWriter).file.File.Close()
+	err = stream.Close()
+	require.NotNil(err)
+	require.Contains(err.Error(), "Failed to finish file")
+
+	f, err := os.Open(outPath)
+	require.Nil(err)
+	defer f.Close()
+	require.Equal(streamRecords, decodeStream(t, f))
+
+	requireNoTempFiles(t, outdir, "out.ndjson")
+}
+
+func TestParseWriteMode(t *testing.T) {
+	require := require.New(t)
+
+	mode, err := ParseWriteMode("")
+	require.Nil(err)
+	require.Equal(WriteOverwrite, mode)
+
+	mode, err = ParseWriteMode("skip_identical")
+	require.Nil(err)
+	require.Equal(WriteSkipIdentical, mode)
+
+	_, err = ParseWriteMode("sometimes")
+	require.NotNil(err)
+}
@@ -10,6 +10,8 @@ func DetectSerializer(path string) (serializer Serializer, err error) {
 		serializer = NewHDFSSerializer(path)
 	} else if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
 		serializer = &HTTPSerializer{}
+	} else if strings.HasPrefix(path, "s3://") {
+		serializer = &S3Serializer{}
 	} else if strings.HasPrefix(path, "file://") {
 		// Local
 		serializer = &LocalSerializer{}
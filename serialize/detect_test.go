@@ -78,3 +78,11 @@ func TestDetectLocal(t *testing.T) {
 	str = "file:///test/"
 	test(t, str, &LocalSerializer{})
 }
+
+func TestDetectS3(t *testing.T) {
+	str := "s3://bucket"
+	test(t, str, &S3Serializer{})
+
+	str = "s3://bucket/prefix/out.json"
+	test(t, str, &S3Serializer{})
+}
@@ -3,21 +3,20 @@ package serialize
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path"
+	"io"
 	"strings"
 
-	"github.com/gurupras/go-easyfiles"
 	"github.com/gurupras/go-easyfiles/easyhdfs"
 	log "github.com/sirupsen/logrus"
 )
 
 type HDFSSerializer struct {
 	Addr string
+	Mode WriteMode
 }
 
 func NewHDFSSerializer(addr string) *HDFSSerializer {
-	return &HDFSSerializer{parseHDFSAddr(addr)}
+	return &HDFSSerializer{Addr: parseHDFSAddr(addr)}
 }
 
 func parseHDFSAddr(path string) string {
@@ -47,6 +46,10 @@ func (h *HDFSSerializer) OutPath(path string) (string, error) {
 	return path[hostnameIdx:], nil
 }
 
+func (h *HDFSSerializer) SetWriteMode(mode WriteMode) {
+	h.Mode = mode
+}
+
 func (h *HDFSSerializer) Serialize(obj interface{}, filename string) error {
 	// FIXME: We should use a pool of connections
 	// This will blow up the number of connections if there are a large
@@ -57,41 +60,22 @@ func (h *HDFSSerializer) Serialize(obj interface{}, filename string) error {
 	}
 	log.Debugf("OutPath=%v\n", outPath)
 
-	fileType := easyfiles.GZ_FALSE
-	if strings.HasSuffix(outPath, ".gz") {
-		fileType = easyfiles.GZ_TRUE
-	}
-
-	fs := easyhdfs.NewHDFSFileSystem(h.Addr)
-	//Mkdirs
-	outdir := path.Dir(outPath)
-	if exists, _ := fs.Exists(outdir); !exists {
-		err := fs.Makedirs(outdir)
-		if err != nil {
-			return fmt.Errorf("Failed to create directory: %v: %v", outdir, err)
-		}
-	}
-
-	file, err := fs.Open(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileType)
+	b, err := json.MarshalIndent(obj, "", "    ")
 	if err != nil {
-		return fmt.Errorf("Failed to open file: %v: %v", outPath, err)
+		return fmt.Errorf("Failed to marshal object to json: %v", err)
 	}
-	defer file.Close()
 
-	writer, err := file.Writer(0)
-	if err != nil {
-		return fmt.Errorf("Failed to get writer to file: %v: %v", outPath, err)
-	}
-	defer writer.Close()
-	defer writer.Flush()
+	fs := easyhdfs.NewHDFSFileSystem(h.Addr)
+	return writeAtomic(fs, false, outPath, writeMode(h.Mode), b)
+}
 
-	b, err := json.MarshalIndent(obj, "", "    ")
+func (h *HDFSSerializer) OpenStream(filename string) (io.WriteCloser, error) {
+	outPath, err := h.OutPath(filename)
 	if err != nil {
-		return fmt.Errorf("Failed to marshal object to json: %v", err)
+		return nil, err
 	}
+	log.Debugf("OutPath=%v\n", outPath)
 
-	if _, err := writer.Write(b); err != nil {
-		return fmt.Errorf("Failed to write json bytes to file: %v: %v", outPath, err)
-	}
-	return nil
+	fs := easyhdfs.NewHDFSFileSystem(h.Addr)
+	return newAtomicWriter(fs, false, outPath, writeMode(h.Mode))
 }
@@ -2,12 +2,14 @@ package serialize
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fatih/set"
@@ -19,15 +21,23 @@ import (
 )
 
 type HTTPSerializer struct {
+	Mode WriteMode
 }
 
+// The receiver writes uploads with the mode sent in this header.
+const WriteModeHeader = "X-Write-Mode"
+
 func (h *HTTPSerializer) OutPath(path string) (string, error) {
 	return path, nil
 }
 
+func (h *HTTPSerializer) SetWriteMode(mode WriteMode) {
+	h.Mode = mode
+}
+
 func (h *HTTPSerializer) Serialize(obj interface{}, url string) error {
 	request := gorequest.New()
-	resp, _, errors := request.Post(url).Send(obj).End()
+	resp, _, errors := request.Post(url).Set(WriteModeHeader, string(writeMode(h.Mode))).Send(obj).End()
 	if len(errors) > 0 {
 		return fmt.Errorf("%v", errors)
 	}
@@ -37,6 +47,69 @@ func (h *HTTPSerializer) Serialize(obj interface{}, url string) error {
 	return nil
 }
 
+// A streaming POST. Close waits for the response.
+type httpStream struct {
+	pipe *io.PipeWriter
+	gz   *gzip.Writer
+	done chan error
+}
+
+func (s *httpStream) Write(p []byte) (int, error) {
+	if s.gz != nil {
+		return s.gz.Write(p)
+	}
+	return s.pipe.Write(p)
+}
+
+func (s *httpStream) Close() error {
+	var err error
+	if s.gz != nil {
+		err = s.gz.Close()
+	}
+	s.pipe.CloseWithError(err)
+	if rerr := <-s.done; err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// The body is sent chunked as it is written, as newline-delimited JSON. If
+// the URL ends in .gz, it is sent with Content-Encoding: gzip.
+func (h *HTTPSerializer) OpenStream(url string) (io.WriteCloser, error) {
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest("POST", url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set(WriteModeHeader, string(writeMode(h.Mode)))
+
+	stream := &httpStream{
+		pipe: writer,
+		done: make(chan error, 1),
+	}
+	if strings.HasSuffix(url, ".gz") {
+		req.Header.Set("Content-Encoding", "gzip")
+		stream.gz = gzip.NewWriter(writer)
+	}
+
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			reader.CloseWithError(err)
+			stream.done <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			err = errors.New(resp.Status)
+			reader.CloseWithError(err)
+		}
+		stream.done <- err
+	}()
+	return stream, nil
+}
+
 type HTTPReceiver struct {
 	BasePath  string
 	callbacks set.Interface
@@ -87,30 +160,10 @@ func httpSerialize(basePath string, data []byte, r *http.Request) {
 	filePath := filepath.Join(outdir, filename)
 	log.Debugf("Writing '%v' > '%v'", relpath, filePath)
 
-	if !easyfiles.Exists(outdir) {
-		if err := easyfiles.Makedirs(outdir); err != nil {
-			log.Errorf("Failed to create directory: %v: %v", outdir, err)
-			return
-		}
-	}
-
-	f, err := easyfiles.Open(filePath, os.O_CREATE|os.O_WRONLY, easyfiles.GZ_UNKNOWN)
-	if err != nil {
-		log.Errorf("Failed to open file: %v: %v", filePath, err)
-		return
-	}
-	defer f.Close()
-
-	writer, err := f.Writer(0)
-	if err != nil {
-		log.Errorf("Failed to get writer to file: %v: %v", filePath, err)
-		return
-	}
-	defer writer.Close()
-	defer writer.Flush()
-
-	if _, err = writer.Write(data); err != nil {
-		log.Errorf("Failed to write data to file: %v: %v", filePath, err)
+	// Handle has already checked it
+	mode, _ := ParseWriteMode(r.Header.Get(WriteModeHeader))
+	if err := writeAtomic(easyfiles.LocalFS, true, filePath, mode, data); err != nil {
+		log.Errorf("Failed to write '%v': %v", filePath, err)
 	}
 }
 
@@ -125,9 +178,26 @@ func (h *HTTPReceiver) AddHTTPSerializeCallback() {
 }
 
 func (h *HTTPReceiver) Handle(w http.ResponseWriter, r *http.Request) {
+	if _, err := ParseWriteMode(r.Header.Get(WriteModeHeader)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Failed to read gzip body: %v", err)))
+			return
+		}
+		defer gzr.Close()
+		body = gzr
+	}
 
 	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, r.Body); err != nil {
+	if _, err := io.Copy(buf, body); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf("Failed to copy body: %v", err)))
 		return
@@ -3,14 +3,14 @@ package serialize
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path"
+	"io"
 	"strings"
 
 	"github.com/gurupras/go-easyfiles"
 )
 
 type LocalSerializer struct {
+	Mode WriteMode
 }
 
 func (h *LocalSerializer) OutPath(path string) (string, error) {
@@ -22,35 +22,27 @@ func (h *LocalSerializer) OutPath(path string) (string, error) {
 	}
 }
 
+func (h *LocalSerializer) SetWriteMode(mode WriteMode) {
+	h.Mode = mode
+}
+
 func (h *LocalSerializer) Serialize(obj interface{}, filename string) error {
 	outPath, err := h.OutPath(filename)
 	if err != nil {
 		return err
 	}
-	dir := path.Dir(outPath)
-	if !easyfiles.Exists(dir) {
-		if err := easyfiles.Makedirs(dir); err != nil {
-			return err
-		}
-	}
 
 	if b, err := json.MarshalIndent(obj, "", "    "); err != nil {
 		return err
 	} else {
-		f, err := easyfiles.Open(outPath, os.O_CREATE|os.O_WRONLY, easyfiles.GZ_UNKNOWN)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		writer, err := f.Writer(0)
-		if err != nil {
-			return err
-		}
-		defer writer.Close()
-		defer writer.Flush()
-
-		writer.Write(b)
+		return writeAtomic(easyfiles.LocalFS, true, outPath, writeMode(h.Mode), b)
+	}
+}
+
+func (h *LocalSerializer) OpenStream(filename string) (io.WriteCloser, error) {
+	outPath, err := h.OutPath(filename)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return newAtomicWriter(easyfiles.LocalFS, true, outPath, writeMode(h.Mode))
 }
@@ -0,0 +1,295 @@
+package serialize
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/shaseley/phonelab-go/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// The clients and config for s3:// paths live in the s3 package, which
+// sources read with too.
+type (
+	S3Config = s3.Config
+	S3Client = s3.Client
+)
+
+const (
+	DefaultS3Endpoint = s3.DefaultEndpoint
+	DefaultS3Region   = s3.DefaultRegion
+	DefaultS3PartSize = s3.DefaultPartSize
+)
+
+func NewS3Client(conf *S3Config) (*S3Client, error) {
+	return s3.NewClient(conf)
+}
+
+// The client for s3.DefaultConfig. It is created on first use.
+func DefaultS3Client() (*S3Client, error) {
+	return s3.DefaultClient()
+}
+
+// Split s3://bucket/key
+func ParseS3URL(s3url string) (string, string, error) {
+	return s3.ParseURL(s3url)
+}
+
+// Objects we write carry the hash of their uncompressed content, so that
+// WriteSkipIdentical doesn't have to download them.
+const s3HashMeta = "Content-Sha256"
+
+// The hash of the uncompressed content of an object
+func s3ContentHash(c *S3Client, s3url string) ([]byte, error) {
+	bucket, key, err := ParseS3URL(s3url)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Minio().StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if sum, ok := info.UserMetadata[s3HashMeta]; ok {
+		return hex.DecodeString(sum)
+	}
+
+	r, err := c.OpenReader(s3url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var reader io.Reader = r
+	if strings.HasSuffix(key, ".gz") {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		reader = gzr
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// s3Writer uploads an object as it is written, in parts. S3 only shows an
+// object once its upload is complete, so a failed upload leaves whatever was
+// there alone.
+//
+// For WriteSkipIdentical, the content has to be known before deciding to
+// upload it, so it is spooled to a local temp file first.
+type s3Writer struct {
+	client *S3Client
+	url    string
+	bucket string
+	key    string
+	mode   WriteMode
+	// Hash of the uncompressed content, if known up front
+	sum []byte
+
+	gz   *gzip.Writer
+	out  io.Writer
+	hash hash.Hash
+	err  error
+
+	// Streaming
+	pipe *io.PipeWriter
+	done chan error
+
+	// Spooling
+	spool *os.File
+}
+
+func newS3Writer(c *S3Client, s3url string, mode WriteMode, sum []byte) (*s3Writer, error) {
+	bucket, key, err := ParseS3URL(s3url)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 || strings.HasSuffix(key, "/") {
+		return nil, fmt.Errorf("Path '%v' has no object name", s3url)
+	}
+
+	if mode == WriteNoOverwrite {
+		// S3 can't create an object only if it's missing, so there's a
+		// window between this and the upload.
+		if exists, err := c.Exists(s3url); err != nil {
+			return nil, err
+		} else if exists {
+			return nil, &ExistsError{s3url}
+		}
+	}
+
+	w := &s3Writer{
+		client: c,
+		url:    s3url,
+		bucket: bucket,
+		key:    key,
+		mode:   mode,
+		sum:    sum,
+		hash:   sha256.New(),
+	}
+
+	if mode == WriteSkipIdentical {
+		if w.spool, err = ioutil.TempFile("", "phonelab-s3-"); err != nil {
+			return nil, err
+		}
+		w.out = w.spool
+	} else {
+		reader, writer := io.Pipe()
+		w.pipe = writer
+		w.out = writer
+		w.done = make(chan error, 1)
+		go func() {
+			err := w.put(reader, -1)
+			reader.CloseWithError(err)
+			w.done <- err
+		}()
+	}
+
+	if strings.HasSuffix(key, ".gz") {
+		w.gz = gzip.NewWriter(w.out)
+	}
+	return w, nil
+}
+
+func (w *s3Writer) put(r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{
+		PartSize: w.client.PartSize(),
+		// Don't sign the content, which needs the whole part up front,
+		// or chunked signing, which not every S3-compatible store
+		// understands.
+		DisableContentSha256: true,
+	}
+	if w.sum != nil {
+		opts.UserMetadata = map[string]string{s3HashMeta: hex.EncodeToString(w.sum)}
+	}
+	_, err := w.client.Minio().PutObject(context.Background(), w.bucket, w.key, r, size, opts)
+	return err
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	if w.gz != nil {
+		n, w.err = w.gz.Write(p)
+	} else {
+		n, w.err = w.out.Write(p)
+	}
+	w.hash.Write(p[:n])
+	return n, w.err
+}
+
+// Finish the upload. Returns the first write error, if there was one, in
+// which case nothing is uploaded.
+func (w *s3Writer) Close() error {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+
+	if w.pipe != nil {
+		w.pipe.CloseWithError(w.err)
+		err := <-w.done
+		if w.err != nil {
+			return w.err
+		}
+		return err
+	}
+
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+	if w.err != nil {
+		return w.err
+	}
+
+	w.sum = w.hash.Sum(nil)
+	if sum, err := s3ContentHash(w.client, w.url); err == nil && bytes.Equal(sum, w.sum) {
+		log.Debugf("Skipping identical %v", w.url)
+		return nil
+	} else if err != nil && !s3.IsNoSuchKey(err) {
+		return err
+	}
+
+	size, err := w.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.put(w.spool, size)
+}
+
+// S3Serializer writes to s3://bucket/key URLs. Objects are uploaded in parts
+// as they are written, and gzipped if the key ends in .gz.
+type S3Serializer struct {
+	Mode WriteMode
+	// nil for DefaultS3Client()
+	Client *S3Client
+}
+
+func (s *S3Serializer) OutPath(path string) (string, error) {
+	if _, _, err := ParseS3URL(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *S3Serializer) SetWriteMode(mode WriteMode) {
+	s.Mode = mode
+}
+
+func (s *S3Serializer) client() (*S3Client, error) {
+	if s.Client != nil {
+		return s.Client, nil
+	}
+	return DefaultS3Client()
+}
+
+func (s *S3Serializer) Serialize(obj interface{}, filename string) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(obj, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal object to json: %v", err)
+	}
+	sum := sha256.Sum256(b)
+
+	w, err := newS3Writer(client, filename, writeMode(s.Mode), sum[:])
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return fmt.Errorf("Failed to write to %v: %v", filename, err)
+	}
+	return w.Close()
+}
+
+func (s *S3Serializer) OpenStream(filename string) (io.WriteCloser, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	return newS3Writer(client, filename, writeMode(s.Mode), nil)
+}
@@ -0,0 +1,213 @@
+package serialize
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/require"
+)
+
+// An in-memory S3 that counts uploads
+type testS3 struct {
+	*httptest.Server
+	client  *S3Client
+	uploads int64
+}
+
+func newTestS3(t *testing.T) *testS3 {
+	require := require.New(t)
+
+	backend := s3mem.New()
+	require.Nil(backend.CreateBucket("bucket"))
+
+	ts := &testS3{}
+	handler := gofakes3.New(backend).Server()
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" || r.Method == "POST" {
+			atomic.AddInt64(&ts.uploads, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+
+	var err error
+	ts.client, err = NewS3Client(&S3Config{
+		Endpoint:  ts.URL,
+		AccessKey: "test",
+		SecretKey: "test",
+		PartSize:  5 * 1024 * 1024,
+	})
+	require.Nil(err)
+	return ts
+}
+
+func TestS3Serialize(t *testing.T) {
+	require := require.New(t)
+
+	ts := newTestS3(t)
+	defer ts.Close()
+
+	s := &S3Serializer{Client: ts.client}
+	for _, name := range []string{"out.json", "out.json.gz"} {
+		url := "s3://bucket/results/" + name
+		require.Nil(s.Serialize(streamRecords, url))
+
+		r, err := ts.client.OpenReader(url)
+		require.Nil(err)
+		var reader io.Reader = r
+		if name == "out.json.gz" {
+			gzr, err := gzip.NewReader(r)
+			require.Nil(err)
+			reader = gzr
+		}
+		b, err := ioutil.ReadAll(reader)
+		require.Nil(err)
+		r.Close()
+
+		var got []*streamRecord
+		require.Nil(json.Unmarshal(b, &got))
+		require.Equal(streamRecords, got)
+	}
+
+	_, err := ts.client.OpenReader("s3://bucket/results/missing.json")
+	require.NotNil(err)
+}
+
+func TestS3StreamMultipart(t *testing.T) {
+	require := require.New(t)
+
+	ts := newTestS3(t)
+	defer ts.Close()
+
+	// More than two parts
+	records := make([]*streamRecord, 0)
+	for i := 0; i < 400000; i++ {
+		records = append(records, &streamRecord{fmt.Sprintf("record-%v", i), i})
+	}
+
+	s := &S3Serializer{Client: ts.client}
+	stream, err := s.OpenStream("s3://bucket/stream.ndjson")
+	require.Nil(err)
+	encoder := NewRecordEncoder(stream)
+	for _, rec := range records {
+		require.Nil(encoder.Encode(rec))
+	}
+	require.Nil(stream.Close())
+	require.True(atomic.LoadInt64(&ts.uploads) > 2)
+
+	r, err := ts.client.OpenReader("s3://bucket/stream.ndjson")
+	require.Nil(err)
+	defer r.Close()
+	require.Equal(records, decodeStream(t, r))
+}
+
+func TestS3StreamIncomplete(t *testing.T) {
+	require := require.New(t)
+
+	ts := newTestS3(t)
+	defer ts.Close()
+
+	s := &S3Serializer{Client: ts.client}
+	stream, err := s.OpenStream("s3://bucket/stream.ndjson")
+	require.Nil(err)
+	require.Nil(NewRecordEncoder(stream).Encode(streamRecords[0]))
+	stream.(*s3Writer).err = errors.New("failed")
+	require.NotNil(stream.Close())
+
+	exists, err := ts.client.Exists("s3://bucket/stream.ndjson")
+	require.Nil(err)
+	require.False(exists)
+}
+
+func TestS3WriteModes(t *testing.T) {
+	require := require.New(t)
+
+	ts := newTestS3(t)
+	defer ts.Close()
+
+	url := "s3://bucket/out.json.gz"
+	s := &S3Serializer{Client: ts.client}
+	require.Nil(s.Serialize(streamRecords, url))
+
+	s.Mode = WriteNoOverwrite
+	err := s.Serialize(streamRecords, url)
+	require.True(IsExists(err))
+
+	// Same content, so nothing is uploaded
+	s.Mode = WriteSkipIdentical
+	uploads := atomic.LoadInt64(&ts.uploads)
+	require.Nil(s.Serialize(streamRecords, url))
+	require.Equal(uploads, atomic.LoadInt64(&ts.uploads))
+
+	// Streams don't record a hash, so the content is compared
+	stream, err := (&S3Serializer{Client: ts.client}).OpenStream("s3://bucket/stream.ndjson")
+	require.Nil(err)
+	require.Nil(NewRecordEncoder(stream).Encode(streamRecords[0]))
+	require.Nil(stream.Close())
+
+	uploads = atomic.LoadInt64(&ts.uploads)
+	stream, err = s.OpenStream("s3://bucket/stream.ndjson")
+	require.Nil(err)
+	require.Nil(NewRecordEncoder(stream).Encode(streamRecords[0]))
+	require.Nil(stream.Close())
+	require.Equal(uploads, atomic.LoadInt64(&ts.uploads))
+
+	// Different content is uploaded
+	require.Nil(s.Serialize(streamRecords[:1], url))
+	require.True(atomic.LoadInt64(&ts.uploads) > uploads)
+}
+
+func TestS3Glob(t *testing.T) {
+	require := require.New(t)
+
+	ts := newTestS3(t)
+	defer ts.Close()
+
+	s := &S3Serializer{Client: ts.client}
+	for _, key := range []string{
+		"logs/dev1/1.gz",
+		"logs/dev1/2.gz",
+		"logs/dev1/info.json",
+		"logs/dev2/time/2017/1.out.gz",
+		"other/1.gz",
+	} {
+		require.Nil(s.Serialize(key, "s3://bucket/"+key))
+	}
+
+	files, err := ts.client.Glob("s3://bucket/logs/*/*.gz")
+	require.Nil(err)
+	require.Equal([]string{"s3://bucket/logs/dev1/1.gz", "s3://bucket/logs/dev1/2.gz"}, files)
+
+	files, err = ts.client.Glob("s3://bucket/logs/**/*.gz")
+	require.Nil(err)
+	require.Equal([]string{
+		"s3://bucket/logs/dev1/1.gz",
+		"s3://bucket/logs/dev1/2.gz",
+		"s3://bucket/logs/dev2/time/2017/1.out.gz",
+	}, files)
+
+	files, err = ts.client.Glob("s3://bucket/logs/dev1/info.json")
+	require.Nil(err)
+	require.Equal([]string{"s3://bucket/logs/dev1/info.json"}, files)
+
+	for url, expected := range map[string]bool{
+		"s3://bucket/logs/dev1/1.gz": true,
+		"s3://bucket/logs/dev2":      true,
+		"s3://bucket/logs/dev2/":     true,
+		"s3://bucket/logs/dev3":      false,
+		"s3://bucket/logs/dev1/1":    false,
+	} {
+		exists, err := ts.client.Exists(url)
+		require.Nil(err)
+		require.Equal(expected, exists, url)
+	}
+}
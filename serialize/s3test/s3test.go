@@ -0,0 +1,106 @@
+// Package s3test runs an in-memory S3-compatible server, like a local MinIO,
+// for tests of code that reads or writes s3:// paths.
+package s3test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/shaseley/phonelab-go/s3"
+)
+
+type Server struct {
+	*httptest.Server
+	Client   *s3.Client
+	prevConf *s3.Config
+}
+
+// Start a server with the given buckets and point s3.DefaultConfig
+// at it. Close puts the previous config back.
+func NewServer(buckets ...string) (*Server, error) {
+	backend := s3mem.New()
+	for _, bucket := range buckets {
+		if err := backend.CreateBucket(bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		Server:   httptest.NewServer(gofakes3.New(backend).Server()),
+		prevConf: s3.DefaultConfig,
+	}
+
+	conf := &s3.Config{
+		Endpoint:  s.URL,
+		AccessKey: "test",
+		SecretKey: "test",
+	}
+	var err error
+	if s.Client, err = s3.NewClient(conf); err != nil {
+		s.Server.Close()
+		return nil, err
+	}
+
+	s3.DefaultConfig = conf
+	s3.ResetDefaultClient()
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.Server.Close()
+	s3.DefaultConfig = s.prevConf
+	s3.ResetDefaultClient()
+}
+
+// Upload a local file as is.
+func (s *Server) PutFile(s3url, localPath string) error {
+	bucket, key, err := s3.ParseURL(s3url)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The server doesn't check signatures
+	req, err := http.NewRequest("PUT", s.URL+"/"+bucket+"/"+key, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = stat.Size()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to upload %v: %v", localPath, resp.Status)
+	}
+	return nil
+}
+
+// Upload everything under a local directory to the prefix.
+func (s *Server) PutDir(s3url, localDir string) error {
+	return filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		return s.PutFile(s3url+"/"+path.Clean(filepath.ToSlash(rel)), p)
+	})
+}
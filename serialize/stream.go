@@ -0,0 +1,30 @@
+package serialize
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// StreamSerializer is a Serializer that can also write a stream of objects to
+// a path, e.g. as newline-delimited JSON (see NewRecordEncoder), without
+// holding them all in memory. If the path ends in .gz, the stream is gzipped.
+// Like Serialize, the file only shows up under its name once the stream is
+// closed.
+type StreamSerializer interface {
+	Serializer
+	OpenStream(path string) (io.WriteCloser, error)
+}
+
+// Open a stream to path with whatever serializer handles it.
+func OpenStream(path string) (io.WriteCloser, error) {
+	serializer, err := DetectSerializer(path)
+	if err != nil {
+		return nil, err
+	}
+	return serializer.(StreamSerializer).OpenStream(path)
+}
+
+// Write each object as a line of JSON.
+func NewRecordEncoder(w io.Writer) *json.Encoder {
+	return json.NewEncoder(w)
+}
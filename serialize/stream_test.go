@@ -0,0 +1,114 @@
+package serialize
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gurupras/go-easyfiles"
+	"github.com/stretchr/testify/require"
+)
+
+type streamRecord struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+var streamRecords = []*streamRecord{
+	{"a", 1},
+	{"b", 2},
+	{"c", 3},
+}
+
+func writeStream(t *testing.T, url string) {
+	require := require.New(t)
+
+	stream, err := OpenStream(url)
+	require.Nil(err)
+
+	encoder := NewRecordEncoder(stream)
+	for _, rec := range streamRecords {
+		require.Nil(encoder.Encode(rec))
+	}
+	require.Nil(stream.Close())
+}
+
+func decodeStream(t *testing.T, r io.Reader) []*streamRecord {
+	got := make([]*streamRecord, 0)
+	decoder := json.NewDecoder(r)
+	for {
+		var rec streamRecord
+		if err := decoder.Decode(&rec); err == io.EOF {
+			break
+		} else {
+			require.Nil(t, err)
+		}
+		got = append(got, &rec)
+	}
+	return got
+}
+
+func TestLocalStream(t *testing.T) {
+	require := require.New(t)
+
+	outdir := filepath.Join("test", "test-local-stream")
+	defer os.RemoveAll(outdir)
+
+	for _, filename := range []string{"stream.ndjson", "stream.ndjson.gz"} {
+		filePath := filepath.Join(outdir, filename)
+		writeStream(t, "file://"+filePath)
+
+		// Overwrites rather than appends
+		writeStream(t, "file://"+filePath)
+
+		f, err := easyfiles.Open(filePath, os.O_RDONLY, easyfiles.GZ_UNKNOWN)
+		require.Nil(err)
+
+		reader, err := f.RawReader()
+		require.Nil(err)
+		require.Equal(streamRecords, decodeStream(t, reader), filename)
+		f.Close()
+	}
+
+	_, err := OpenStream("foo://bar")
+	require.NotNil(err)
+}
+
+func TestHTTPStream(t *testing.T) {
+	require := require.New(t)
+
+	httpReceiver := NewHTTPReceiver("test")
+	callback := make(chan HTTPCallback, 1)
+	httpReceiver.AddCallback(callback)
+
+	server := httptest.NewServer(http.HandlerFunc(httpReceiver.Handle))
+	defer server.Close()
+
+	for _, filename := range []string{"stream.ndjson", "stream.ndjson.gz"} {
+		writeStream(t, server.URL+"/upload/"+filename)
+
+		cbData := <-callback
+		request := cbData.Request()
+		require.Equal("application/x-ndjson", request.Header.Get("Content-Type"))
+		if strings.HasSuffix(filename, ".gz") {
+			require.Equal("gzip", request.Header.Get("Content-Encoding"))
+		}
+		require.Equal(streamRecords, decodeStream(t, strings.NewReader(string(cbData.Data()))), filename)
+	}
+
+	// Errors from the server are returned on Close
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	stream, err := OpenStream(failing.URL + "/upload/stream.ndjson")
+	require.Nil(err)
+	NewRecordEncoder(stream).Encode(streamRecords[0])
+	require.NotNil(stream.Close())
+}
@@ -0,0 +1,573 @@
+package phonelab
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DataCollectorSQLiteName = "sqlite"
+
+	defaultSQLiteBatchSize = 1000
+)
+
+// Every table starts with these, taken from the PipelineSourceInfo. A record
+// column with one of these names gets a record_ prefix.
+var sqliteSourceColumns = []string{"device", "boot_id", "context"}
+
+// SQLiteCollector is a DataCollector that writes everything into one local
+// SQLite database for querying. There's a table per record type, named and
+// flattened the same way as the CSVCollector's files, e.g. Healthd or
+// Logline_CpuFrequency. Columns that show up in later records are added as
+// they come.
+//
+// Rows are inserted in batches, one transaction per batch, and indexes on the
+// source columns (plus any listed in 'index') are built in Finish().
+//
+// A fresh run replaces the database. On resume, the rows of the sources that
+// finished are kept, and those of every other source are deleted before the
+// run starts.
+type SQLiteCollector struct {
+	// Path of the database file
+	Path string
+	// Number of rows to insert per transaction
+	BatchSize int
+	// Extra columns to index, in the tables that have them
+	Index []string
+
+	db     *sql.DB
+	tables map[string]*sqliteTable
+	// Contexts of the sources that finished in an earlier run
+	done    map[string]bool
+	resumed bool
+	pending int
+	openErr error
+	sync.Mutex
+}
+
+type sqliteTable struct {
+	name    string
+	columns []string
+	index   map[string]int
+	// Rows waiting to be inserted. Rows from before a column was added are
+	// short.
+	rows [][]interface{}
+}
+
+// Create a SQLiteCollector from generic args: path (required), batch_size and
+// index.
+func NewSQLiteCollector(args map[string]interface{}) (DataCollector, error) {
+	pathOrUrl := ""
+	if v, ok := args["path"]; ok {
+		if pathOrUrl, ok = v.(string); !ok {
+			return nil, fmt.Errorf("Unexpected type for 'path'. Expected string, got %T", v)
+		}
+	} else {
+		return nil, errors.New("Missing 'path' argument. A path is required for the sqlite collector")
+	}
+
+	// The database has to be local, but file:// is fine too.
+	dbPath := pathOrUrl
+	if strings.Contains(pathOrUrl, "://") {
+		u, err := url.Parse(pathOrUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid path '%v': %v", pathOrUrl, err)
+		}
+		if u.Scheme != "file" {
+			return nil, fmt.Errorf("Unsupported protocol in path '%v'. The sqlite collector only writes local files", pathOrUrl)
+		}
+		dbPath = strings.TrimPrefix(pathOrUrl, "file://")
+	}
+	if len(dbPath) == 0 {
+		return nil, errors.New("Empty 'path' argument")
+	}
+
+	batchSize := defaultSQLiteBatchSize
+	if v, ok := args["batch_size"]; ok {
+		if batchSize, ok = v.(int); !ok || batchSize <= 0 {
+			return nil, fmt.Errorf("Unexpected value for 'batch_size'. Expected a positive int, got %v", v)
+		}
+	}
+
+	index := make([]string, 0)
+	if v, ok := args["index"]; ok {
+		switch t := v.(type) {
+		case string:
+			index = append(index, t)
+		case []interface{}:
+			for _, col := range t {
+				if s, ok := col.(string); ok {
+					index = append(index, s)
+				} else {
+					return nil, fmt.Errorf("Unexpected type for 'index' column. Expected string, got %T", col)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected type for 'index'. Expected a list of columns, got %T", v)
+		}
+	}
+
+	return &SQLiteCollector{
+		Path:      dbPath,
+		BatchSize: batchSize,
+		Index:     index,
+		tables:    make(map[string]*sqliteTable),
+		done:      make(map[string]bool),
+	}, nil
+}
+
+// Open the database the first time it's needed. Must be called with the lock
+// held.
+func (c *SQLiteCollector) open() error {
+	if c.db != nil || c.openErr != nil {
+		return c.openErr
+	}
+
+	c.openErr = func() error {
+		if !c.resumed {
+			if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if dir := filepath.Dir(c.Path); dir != "." {
+			if err := os.MkdirAll(dir, 0775); err != nil {
+				return err
+			}
+		}
+
+		db, err := sql.Open("sqlite3", c.Path)
+		if err != nil {
+			return err
+		}
+		// Everything goes through one connection anyway.
+		db.SetMaxOpenConns(1)
+		c.db = db
+
+		if err := c.loadTables(); err != nil {
+			return err
+		}
+		if c.resumed {
+			return c.clearUnfinished()
+		}
+		return nil
+	}()
+
+	if c.openErr != nil {
+		log.Errorf("Error opening %v: %v", c.Path, c.openErr)
+	}
+	return c.openErr
+}
+
+// Pick up the tables from an earlier run.
+func (c *SQLiteCollector) loadTables() error {
+	rows, err := c.db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		table := &sqliteTable{
+			name:    name,
+			columns: make([]string, 0),
+			index:   make(map[string]int),
+		}
+		info, err := c.db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info(%v)", quoteSQLString(name)))
+		if err != nil {
+			return err
+		}
+		for info.Next() {
+			var col string
+			if err := info.Scan(&col); err != nil {
+				info.Close()
+				return err
+			}
+			table.index[col] = len(table.columns)
+			table.columns = append(table.columns, col)
+		}
+		info.Close()
+		if err := info.Err(); err != nil {
+			return err
+		}
+		c.tables[name] = table
+	}
+	return nil
+}
+
+// Sources run concurrently, so OnData may be called from multiple goroutines.
+func (c *SQLiteCollector) OnData(data interface{}, info PipelineSourceInfo) {
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.open(); err != nil {
+		return
+	}
+
+	typeName, f := flattenRecordKinds(data)
+	for i, col := range f.columns {
+		for _, sourceCol := range sqliteSourceColumns {
+			if col == sourceCol {
+				f.columns[i] = "record_" + col
+			}
+		}
+	}
+
+	table, err := c.table(typeName, f)
+	if err != nil {
+		log.Errorf("Error writing %v: %v", typeName, err)
+		return
+	}
+
+	device, bootId := sourceDeviceBoot(info)
+	row := make([]interface{}, len(table.columns))
+	row[0] = sqliteValue(device, reflect.Invalid)
+	row[1] = sqliteValue(bootId, reflect.Invalid)
+	row[2] = info.Context()
+	for i, col := range f.columns {
+		row[table.index[col]] = sqliteValue(f.values[i], f.kinds[i])
+	}
+	table.rows = append(table.rows, row)
+
+	c.pending++
+	if c.pending >= c.BatchSize {
+		if err := c.flush(); err != nil {
+			log.Errorf("Error inserting into %v: %v", c.Path, err)
+		}
+	}
+}
+
+// The table for the record type, created or widened to fit the columns. Must
+// be called with the lock held.
+func (c *SQLiteCollector) table(typeName string, f *recordFlattener) (*sqliteTable, error) {
+	table, ok := c.tables[typeName]
+	if !ok {
+		table = &sqliteTable{
+			name:    typeName,
+			columns: make([]string, 0),
+			index:   make(map[string]int),
+		}
+
+		defs := make([]string, 0)
+		for _, col := range sqliteSourceColumns {
+			table.index[col] = len(table.columns)
+			table.columns = append(table.columns, col)
+			defs = append(defs, quoteSQLIdent(col)+" TEXT")
+		}
+		for i, col := range f.columns {
+			if _, ok := table.index[col]; ok {
+				continue
+			}
+			table.index[col] = len(table.columns)
+			table.columns = append(table.columns, col)
+			defs = append(defs, strings.TrimSpace(quoteSQLIdent(col)+" "+sqliteType(f.kinds[i])))
+		}
+
+		stmt := fmt.Sprintf("CREATE TABLE %v (%v)", quoteSQLIdent(typeName), strings.Join(defs, ", "))
+		if _, err := c.db.Exec(stmt); err != nil {
+			return nil, err
+		}
+		c.tables[typeName] = table
+		return table, nil
+	}
+
+	for i, col := range f.columns {
+		if _, ok := table.index[col]; ok {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v", quoteSQLIdent(typeName),
+			strings.TrimSpace(quoteSQLIdent(col)+" "+sqliteType(f.kinds[i])))
+		if _, err := c.db.Exec(stmt); err != nil {
+			return nil, err
+		}
+		table.index[col] = len(table.columns)
+		table.columns = append(table.columns, col)
+	}
+	return table, nil
+}
+
+// Delete the rows an earlier run left for sources that didn't finish, whether
+// or not they send anything this time. Must be called with the lock held.
+func (c *SQLiteCollector) clearUnfinished() error {
+	for _, table := range c.tables {
+		if _, ok := table.index["context"]; !ok {
+			continue
+		}
+
+		rows, err := c.db.Query(fmt.Sprintf("SELECT DISTINCT context FROM %v", quoteSQLIdent(table.name)))
+		if err != nil {
+			return err
+		}
+		stale := make([]string, 0)
+		for rows.Next() {
+			var context sql.NullString
+			if err := rows.Scan(&context); err != nil {
+				rows.Close()
+				return err
+			}
+			if context.Valid && !c.done[context.String] {
+				stale = append(stale, context.String)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		stmt := fmt.Sprintf("DELETE FROM %v WHERE context = ?", quoteSQLIdent(table.name))
+		for _, context := range stale {
+			if _, err := c.db.Exec(stmt, context); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Insert the pending rows in one transaction. Must be called with the lock
+// held.
+func (c *SQLiteCollector) flush() error {
+	if c.pending == 0 {
+		return nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(c.tables))
+	for name, table := range c.tables {
+		if len(table.rows) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err = insertRows(tx, c.tables[name]); err != nil {
+			break
+		}
+	}
+
+	// The rows are dropped either way, so that one bad batch doesn't fail
+	// every one after it.
+	for _, table := range c.tables {
+		table.rows = nil
+	}
+	c.pending = 0
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRows(tx *sql.Tx, table *sqliteTable) error {
+	cols := make([]string, len(table.columns))
+	params := make([]string, len(table.columns))
+	for i, col := range table.columns {
+		cols[i] = quoteSQLIdent(col)
+		params[i] = "?"
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", quoteSQLIdent(table.name),
+		strings.Join(cols, ", "), strings.Join(params, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range table.rows {
+		// Fill in columns added after the row was made
+		for len(row) < len(table.columns) {
+			row = append(row, nil)
+		}
+		if _, err := stmt.Exec(row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build the indexes. Must be called with the lock held.
+func (c *SQLiteCollector) buildIndexes() error {
+	names := make([]string, 0, len(c.tables))
+	for name := range c.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	indexes := [][]string{{"context"}, {"device", "boot_id"}}
+	for _, col := range c.Index {
+		indexes = append(indexes, []string{col})
+	}
+
+	for _, name := range names {
+		table := c.tables[name]
+		for _, cols := range indexes {
+			quoted := make([]string, 0, len(cols))
+			for _, col := range cols {
+				if _, ok := table.index[col]; ok {
+					quoted = append(quoted, quoteSQLIdent(col))
+				}
+			}
+			if len(quoted) < len(cols) {
+				continue
+			}
+			stmt := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %v ON %v (%v)",
+				quoteSQLIdent(name+"_"+strings.Join(cols, "_")), quoteSQLIdent(name), strings.Join(quoted, ", "))
+			if _, err := c.db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Must be called with the lock held.
+func (c *SQLiteCollector) close() error {
+	err := c.db.Close()
+	c.db = nil
+	c.openErr = errors.New("Database is closed")
+	return err
+}
+
+// Make sure the source's rows are in before it's checkpointed.
+func (c *SQLiteCollector) SourceDone(info PipelineSourceInfo) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.db != nil {
+		if err := c.flush(); err != nil {
+			log.Errorf("Error inserting into %v: %v", c.Path, err)
+		}
+	}
+}
+
+func (c *SQLiteCollector) Finish() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.db == nil {
+		return
+	}
+	if err := c.flush(); err != nil {
+		log.Errorf("Error inserting into %v: %v", c.Path, err)
+	}
+	if err := c.buildIndexes(); err != nil {
+		log.Errorf("Error building indexes in %v: %v", c.Path, err)
+	}
+	if err := c.close(); err != nil {
+		log.Errorf("Error closing %v: %v", c.Path, err)
+	}
+}
+
+// Whatever made it in stays, and the indexes are left for the resumed run.
+func (c *SQLiteCollector) FinishPartial(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.db == nil {
+		return
+	}
+	log.Warnf("Run did not finish (%v), %v is incomplete", err, c.Path)
+	if err := c.flush(); err != nil {
+		log.Errorf("Error inserting into %v: %v", c.Path, err)
+	}
+	if err := c.close(); err != nil {
+		log.Errorf("Error closing %v: %v", c.Path, err)
+	}
+}
+
+// The source's rows are in the database, which isn't an output of its own.
+func (c *SQLiteCollector) Checkpoint(info PipelineSourceInfo) ([]string, interface{}, error) {
+	return nil, nil, nil
+}
+
+// Keep the database from the earlier run rather than starting over, minus the
+// rows of the sources that aren't done.
+func (c *SQLiteCollector) Restore(entries []*JournalEntry) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.resumed = true
+	for _, entry := range entries {
+		c.done[entry.Context] = true
+	}
+	return c.open()
+}
+
+// The column type for a kind of value. Values without a kind get no type, so
+// SQLite keeps whatever they are.
+func sqliteType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Invalid:
+		return ""
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "INTEGER"
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	}
+	return "TEXT"
+}
+
+// Turn a flattened value back into something typed. Empty values of anything
+// but strings are NULL.
+func sqliteValue(value string, kind reflect.Kind) interface{} {
+	if len(value) == 0 && kind != reflect.String {
+		return nil
+	}
+
+	switch sqliteType(kind) {
+	case "INTEGER":
+		if kind == reflect.Bool {
+			if value == "true" {
+				return int64(1)
+			}
+			return int64(0)
+		}
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	case "REAL":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	// Including uint64s too big for SQLite
+	return value
+}
+
+func quoteSQLIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func quoteSQLString(s string) string {
+	return `'` + strings.Replace(s, `'`, `''`, -1) + `'`
+}
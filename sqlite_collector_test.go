@@ -0,0 +1,159 @@
+package phonelab
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queryInt(t *testing.T, db *sql.DB, query string, args ...interface{}) int64 {
+	var n int64
+	require.Nil(t, db.QueryRow(query, args...).Scan(&n))
+	return n
+}
+
+func TestSQLiteCollector(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-sqlite")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	env := NewEnvironment()
+	env.Processors["payloads"] = &ProcessorGenWrapper{
+		Gen: func(source *PipelineSourceInstance, kwargs map[string]interface{}) Processor {
+			return NewSimpleProcessor(source.Processor, &payloadHandler{})
+		},
+	}
+
+	dbPath := filepath.Join(tmpDir, "out/results.db")
+	conf, err := RunnerConfFromString(`
+processors:
+  - name: payloads
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: simple
+        filter: "cpu_frequency"
+source:
+  type: files
+  sources: ["./test/test.log"]
+sink:
+  name: payloads
+data_collector:
+  name: sqlite
+  args:
+    path: file://` + dbPath + `
+    batch_size: 100
+    index: [cpu_id]
+`)
+	require.Nil(err)
+	runner, err := conf.ToRunner(env)
+	require.Nil(err)
+	require.Equal(0, len(runner.Run()))
+
+	db, err := sql.Open("sqlite3", dbPath)
+	require.Nil(err)
+	defer db.Close()
+
+	assert.Equal(int64(427), queryInt(t, db, `SELECT COUNT(*) FROM CpuFrequency WHERE context = ?`, "./test/test.log"))
+	assert.Equal(int64(0), queryInt(t, db, `SELECT COUNT(*) FROM CpuFrequency WHERE device IS NOT NULL`))
+
+	var thread string
+	var state, cpu int64
+	var timestamp float64
+	require.Nil(db.QueryRow(`SELECT trace_thread, trace_timestamp, state, cpu_id FROM CpuFrequency
+		ORDER BY trace_timestamp LIMIT 1`).Scan(&thread, &timestamp, &state, &cpu))
+	assert.Equal("kworker/2:2H-10277", thread)
+	assert.Equal(56250.330631, timestamp)
+	assert.Equal(int64(1497600), state)
+	assert.Equal(int64(2), cpu)
+
+	// Numbers are stored as numbers
+	assert.Equal(int64(427), queryInt(t, db, `SELECT COUNT(*) FROM CpuFrequency WHERE typeof(state) = 'integer'`))
+
+	for _, index := range []string{"CpuFrequency_context", "CpuFrequency_device_boot_id", "CpuFrequency_cpu_id"} {
+		assert.Equal(int64(1), queryInt(t, db, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?`, index), index)
+	}
+
+	for _, args := range []map[string]interface{}{
+		{},
+		{"path": "hdfs://host/out.db"},
+		{"path": "out.db", "batch_size": 0},
+		{"path": "out.db", "index": 1},
+	} {
+		_, err = NewSQLiteCollector(args)
+		assert.NotNil(err, args)
+	}
+}
+
+func TestSQLiteCollectorResume(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-sqlite")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	args := map[string]interface{}{"path": filepath.Join(tmpDir, "results.db")}
+
+	a := &PhonelabSourceInfo{DeviceId: "dev", BootId: "a"}
+	b := &PhonelabSourceInfo{DeviceId: "dev", BootId: "b"}
+	d := &PhonelabSourceInfo{DeviceId: "dev", BootId: "d"}
+
+	// The first run finishes a, but not b or d
+	collector, err := NewSQLiteCollector(args)
+	require.Nil(err)
+	c := collector.(*SQLiteCollector)
+	c.OnData(map[string]interface{}{"x": 1}, a)
+	c.OnData(map[string]interface{}{"x": 2}, a)
+	c.SourceDone(a)
+	c.OnData(map[string]interface{}{"x": 3}, b)
+	c.OnData(map[string]interface{}{"x": 100}, d)
+	c.FinishPartial(errors.New("interrupted"))
+
+	// The second redoes b, with a new column. d has nothing this time, but
+	// its old rows still go.
+	collector, err = NewSQLiteCollector(args)
+	require.Nil(err)
+	c = collector.(*SQLiteCollector)
+	require.Nil(c.Restore([]*JournalEntry{{Type: a.Type(), Context: a.Context()}}))
+	c.OnData(map[string]interface{}{"x": 3}, b)
+	c.OnData(map[string]interface{}{"x": 4, "y": "new", "boot_id": "mine"}, b)
+	c.Finish()
+
+	db, err := sql.Open("sqlite3", args["path"].(string))
+	require.Nil(err)
+	defer db.Close()
+
+	assert.Equal(int64(2), queryInt(t, db, `SELECT COUNT(*) FROM map WHERE boot_id = 'a'`))
+	assert.Equal(int64(2), queryInt(t, db, `SELECT COUNT(*) FROM map WHERE boot_id = 'b'`))
+	assert.Equal(int64(0), queryInt(t, db, `SELECT COUNT(*) FROM map WHERE boot_id = 'd'`))
+	assert.Equal(int64(10), queryInt(t, db, `SELECT SUM(x) FROM map WHERE device = 'dev'`))
+	assert.Equal(int64(1), queryInt(t, db, `SELECT COUNT(*) FROM map WHERE y = 'new' AND record_boot_id = 'mine'`))
+	assert.Equal(int64(3), queryInt(t, db, `SELECT COUNT(*) FROM map WHERE y IS NULL`))
+
+	// A fresh run starts over
+	collector, err = NewSQLiteCollector(args)
+	require.Nil(err)
+	c = collector.(*SQLiteCollector)
+	c.OnData(map[string]interface{}{"z": 1.5}, a)
+	c.Finish()
+
+	db2, err := sql.Open("sqlite3", args["path"].(string))
+	require.Nil(err)
+	defer db2.Close()
+	assert.Equal(int64(1), queryInt(t, db2, `SELECT COUNT(*) FROM map`))
+	assert.Equal(int64(1), queryInt(t, db2, `SELECT COUNT(*) FROM map WHERE z = 1.5`))
+}
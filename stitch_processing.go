@@ -1,9 +1,12 @@
 package phonelab
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -11,7 +14,6 @@ import (
 	"github.com/fatih/set"
 	"github.com/gurupras/go-daterange"
 	"github.com/gurupras/go-easyfiles"
-	"github.com/gurupras/go-easyfiles/easyhdfs"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -44,59 +46,115 @@ func NewPhonelabRawProcessor(sourceInfo *PhonelabRawInfo, files []string, errHan
 }
 
 func (prp *PhonelabRawProcessor) Process() <-chan interface{} {
+	return prp.ProcessContext(context.Background())
+}
+
+func (prp *PhonelabRawProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
 	outChan := make(chan interface{})
 
-	var filteredFiles []string
-	if prp.PhonelabRawInfo.DateRange != nil {
-		dateRange := prp.PhonelabRawInfo.DateRange
-		// Files are in the format time/YYYY/mm/dd.out.gz
-		filteredFiles = make([]string, 0)
-		for _, file := range prp.Files {
-			tmp := path.Base(file)[:2]
-			day, err := strconv.Atoi(tmp)
-			if err != nil {
-				panic(fmt.Sprintf("Failed to convert '%v' to int", tmp))
-			}
-			tmp = path.Base(path.Dir(file))
-			month, err := strconv.Atoi(tmp)
-			if err != nil {
-				panic(fmt.Sprintf("Failed to convert '%v' to int", tmp))
-			}
-			tmp = path.Base(path.Dir(path.Dir(file)))
-			year, err := strconv.Atoi(tmp)
-			if err != nil {
-				panic(fmt.Sprintf("Failed to convert '%v' to int", tmp))
-			}
-			date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
-			if dateRange.ContainsDate(date) {
-				filteredFiles = append(filteredFiles, file)
+	go func() {
+		defer close(outChan)
+
+		var filteredFiles []string
+		if prp.PhonelabRawInfo.DateRange != nil {
+			dateRange := prp.PhonelabRawInfo.DateRange
+			// Files are in the format time/YYYY/mm/dd.out.gz
+			filteredFiles = make([]string, 0)
+			for _, file := range prp.Files {
+				date, err := rawFileDate(file)
+				if err != nil {
+					policy := reportSourceError(ctx, prp.ErrHandler, &SourceError{
+						Info: prp.PhonelabRawInfo,
+						File: file,
+						Err:  err,
+					})
+					if policy == ErrorPolicySkipFile {
+						continue
+					}
+					return
+				}
+				if dateRange.ContainsDate(date) {
+					filteredFiles = append(filteredFiles, file)
+				}
 			}
+		} else {
+			filteredFiles = append([]string{}, prp.Files...)
 		}
-	} else {
-		filteredFiles = prp.Files
-	}
-	log.Infof("Files: %v", filteredFiles)
+		// The stitcher only keeps a window of lines, so the days have to
+		// come in order.
+		sortRawFiles(filteredFiles)
+		log.Infof("Files: %v", filteredFiles)
 
-	go func() {
+		metrics := nodeMetrics(ctx, "PhonelabRawProcessor")
 		for _, f := range filteredFiles {
-			outChan <- f
+			metrics.itemIn()
+			if !metrics.send(ctx, outChan, f) {
+				break
+			}
 		}
-		close(outChan)
 	}()
 	return outChan
 }
 
+// Get the date of a raw file from its time/YYYY/mm/dd.out.gz path.
+func rawFileDate(file string) (time.Time, error) {
+	parts := []string{
+		path.Base(path.Dir(path.Dir(file))),
+		path.Base(path.Dir(file)),
+		strings.TrimSuffix(path.Base(file), ".out.gz"),
+	}
+
+	values := make([]int, len(parts))
+	for i, part := range parts {
+		var err error
+		if values[i], err = strconv.Atoi(part); err != nil {
+			return time.Time{}, fmt.Errorf("Failed to convert '%v' to int", part)
+		}
+	}
+
+	return time.Date(values[0], time.Month(values[1]), values[2], 0, 0, 0, 0, time.UTC), nil
+}
+
+// Sort raw files by the date in their time/YYYY/mm/dd.out.gz paths, then by
+// path. Files without a date go first.
+func sortRawFiles(files []string) {
+	dates := make(map[string]time.Time)
+	for _, file := range files {
+		date, _ := rawFileDate(file)
+		dates[file] = date
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if di, dj := dates[files[i]], dates[files[j]]; !di.Equal(dj) {
+			return di.Before(dj)
+		}
+		return files[i] < files[j]
+	})
+}
+
 type PhonelabRawGenerator struct {
 	devicePaths map[string]string
 	Args        map[string]interface{}
 	ErrHandler
+	// Finds the filesystem each device path is on. nil for the
+	// Environment's defaults, with the hdfs_addr arg. The processed files
+	// are written to the same filesystem, so it must be an
+	// easyfiles.FileSystemInterface.
+	Resolve FileSystemResolver
 }
 
 func NewPhonelabRawGenerator(devicePaths map[string]string, args map[string]interface{}, errHandler ErrHandler) *PhonelabRawGenerator {
-	return &PhonelabRawGenerator{devicePaths, args, errHandler}
+	return &PhonelabRawGenerator{
+		devicePaths: devicePaths,
+		Args:        args,
+		ErrHandler:  errHandler,
+	}
 }
 
 func (prg *PhonelabRawGenerator) Process() <-chan *PipelineSourceInstance {
+	return prg.ProcessContext(context.Background())
+}
+
+func (prg *PhonelabRawGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
 	sourceChan := make(chan *PipelineSourceInstance)
 
 	// Parse hdfs address
@@ -104,183 +162,211 @@ func (prg *PhonelabRawGenerator) Process() <-chan *PipelineSourceInstance {
 	if v, ok := prg.Args["hdfs_addr"]; ok {
 		hdfsAddr = v.(string)
 	}
-
-	var fs easyfiles.FileSystemInterface
-
-	if strings.Compare(hdfsAddr, "") == 0 {
-		fs = easyfiles.LocalFS
-	} else {
-		fs = easyhdfs.NewHDFSFileSystem(hdfsAddr)
-	}
-
-	// Parse date range
-	var dateRange *daterange.DateRange
-	if v, ok := prg.Args["daterange"]; ok {
-		var err error
-		if dateRange, err = ParseDateRange(v.(string)); err != nil {
-			panic(fmt.Sprintf("Unable to parse daterange: %v", err))
-		}
-	}
-
-	// Get processed path
-	var processedPath string
-	if v, ok := prg.Args["processed_path"]; !ok {
-		panic(fmt.Sprintf("No processed path defined."))
-	} else {
-		processedPath = v.(string)
+	resolve := prg.Resolve
+	if resolve == nil {
+		resolve = defaultFileSystemResolver(ctx, hdfsAddr)
 	}
-	log.Infof("Processed path: %v", processedPath)
 
 	go func() {
-		for device, basePath := range prg.devicePaths {
-			currentFiles := set.NewNonTS()
-			log.Infof("device=%v basePath=%v", device, basePath)
-			filePattern := filepath.Join(basePath, device, "time", "**/*.out.gz")
-			var files []string
-			var diffSet set.Interface
-			curFiles, err := fs.Glob(filePattern)
-			for _, obj := range curFiles {
-				currentFiles.Add(obj)
-			}
-
-			var info *StitchInfo
-			// Try to pull and read info.json if it exists
-			infoJsonPath := filepath.Join(processedPath, device, "info.json")
-			log.Infof("infoJsonPath=%v", infoJsonPath)
-			if data, err := fs.ReadFile(infoJsonPath); err == nil {
-				log.Infof("Found info.json")
-				// We've processed a portion of the currentFiles.
-				// Don't re-process these
-				if info, err = GetInfoFromBytes(data); err != nil {
-					if prg.ErrHandler != nil {
-						prg.ErrHandler(err)
-					} else {
-						panic(fmt.Sprintf("Error unmarshaling '%v': %v", infoJsonPath, err))
-					}
-				}
-
-				// Make sure we clear out any files and directories that are not found in info.json
-				// This ensures that any previous run that failed mid-way while adding new files
-				// don't persist since info.json is only updated after everything else has succeeded.
-				// First, remote any extraneous bootIDs
-				log.Infof("Checking for extraneous bootIDs and files...")
-				validBootIds := set.NewNonTS()
-				for _, bootId := range info.BootIds() {
-					validBootIds.Add(bootId)
-				}
-				log.Infof("Valid bootIDs: %v", validBootIds)
-
-				bootIdsFound, err := fs.Glob(filepath.Join(processedPath, device, "*-*-*"))
-				if err != nil {
-					if prg.ErrHandler != nil {
-						prg.ErrHandler(err)
-					} else {
-						panic(fmt.Sprintf("Error globbing bootIds for device '%v': %v", device, err))
-					}
-				}
-				existingBootIds := set.NewNonTS()
-				for _, bootIdPath := range bootIdsFound {
-					bootId := path.Base(bootIdPath)
-					existingBootIds.Add(bootId)
-				}
-				log.Infof("Existing bootIDs: %v", existingBootIds)
-
-				// Get the difference
-				extraneousBootIds := set.Difference(existingBootIds, validBootIds)
-				if extraneousBootIds.Size() > 0 {
-					log.Warnf("Extraneous bootIDs: %v", extraneousBootIds)
-				}
-				// Any remaining bootID is extraneous
-				for _, obj := range extraneousBootIds.List() {
-					b := obj.(string)
-					bootIdPath := filepath.Join(processedPath, device, b)
-					log.Warnf("Deleting: %v", bootIdPath)
-					if err := fs.RemoveAll(bootIdPath); err != nil {
-						if prg.ErrHandler != nil {
-							prg.ErrHandler(err)
-						} else {
-							panic(fmt.Sprintf("Failed to remove extraneous bootID '%v': %v", bootIdPath, err))
-						}
-					}
-				}
+		defer close(sourceChan)
 
-				// Now, remove any extraneous files within valid bootIDs
-				for bootId, data := range info.BootInfo {
-					bootIdPath := filepath.Join(processedPath, device, bootId)
-					validFiles := set.NewNonTS()
-					existingFiles := set.NewNonTS()
-					for file := range data {
-						validFiles.Add(file)
-					}
-					filesFound, err := fs.Glob(filepath.Join(bootIdPath, "*.gz"))
-					if err != nil {
-						if prg.ErrHandler != nil {
-							prg.ErrHandler(err)
-						} else {
-							panic(fmt.Sprintf("Error globbing bootId files '%v': %v", bootIdPath, err))
-						}
-					}
-					for _, file := range filesFound {
-						// Extract name alone
-						name := path.Base(file)
-						existingFiles.Add(name)
-					}
-					if validFiles.Size() != existingFiles.Size() {
-						log.Warnf("Found extraneous files")
-					}
-					// Now, find the set difference and remove any extraneous files
-					extraneousFiles := set.Difference(existingFiles, validFiles)
-					for _, obj := range extraneousFiles.List() {
-						f := obj.(string)
-						f = filepath.Join(bootIdPath, f)
-						log.Warnf("Deleting: %v", f)
-						if err := fs.Remove(f); err != nil {
-							if prg.ErrHandler != nil {
-								prg.ErrHandler(err)
-							} else {
-								panic(fmt.Sprintf("Failed to remove extraneous bootID file '%v': %v", f, err))
-							}
-						}
-					}
-				}
+		// Without these, there's nothing we can do
+		var dateRange *daterange.DateRange
+		if v, ok := prg.Args["daterange"]; ok {
+			var err error
+			if dateRange, err = ParseDateRange(v.(string)); err != nil {
+				reportSourceError(ctx, prg.ErrHandler, &SourceError{
+					Err: fmt.Errorf("Unable to parse daterange: %v", err),
+				})
+				return
+			}
+		}
 
-				processedFiles := set.NewNonTS()
-				for _, obj := range info.Files {
-					processedFiles.Add(obj)
-				}
+		var processedPath string
+		if v, ok := prg.Args["processed_path"]; !ok {
+			reportSourceError(ctx, prg.ErrHandler, &SourceError{
+				Err: errors.New("No processed path defined."),
+			})
+			return
+		} else {
+			processedPath = v.(string)
+		}
+		log.Infof("Processed path: %v", processedPath)
 
-				diffSet = set.Difference(currentFiles, processedFiles)
-			} else {
-				diffSet = currentFiles
-			}
-			files = make([]string, diffSet.Size())
-			for idx, obj := range diffSet.List() {
-				files[idx] = obj.(string)
+		for device, basePath := range prg.devicePaths {
+			// Don't start cleaning up another device if we're done.
+			if ctx.Err() != nil {
+				break
 			}
 
 			sourceInfo := &PhonelabRawInfo{
 				DeviceId:      device,
 				Path:          basePath,
 				ProcessedPath: processedPath,
-				FSInterface:   fs,
-				StitchInfo:    info,
+				HdfsAddr:      hdfsAddr,
 				DateRange:     dateRange,
 			}
 
-			prp, err := NewPhonelabRawProcessor(sourceInfo, files, prg.ErrHandler)
+			files, err := prg.prepareDevice(sourceInfo, resolve)
 			if err != nil {
-				if prg.ErrHandler != nil {
-					prg.ErrHandler(err)
-				} else {
-					panic(fmt.Sprintf("Error creating new PhonelabRawProcessor: %v", err))
+				// Skip the device unless we're failing fast
+				policy := reportSourceError(ctx, prg.ErrHandler, err)
+				if policy == ErrorPolicyFailFast {
+					return
 				}
+				continue
 			}
-			sourceChan <- &PipelineSourceInstance{
+
+			prp, _ := NewPhonelabRawProcessor(sourceInfo, files, prg.ErrHandler)
+			source := &PipelineSourceInstance{
 				Processor: prp,
 				Info:      sourceInfo,
 			}
+			if !sendSourceContext(ctx, sourceChan, source) {
+				break
+			}
 		}
-		close(sourceChan)
 	}()
 	return sourceChan
 }
+
+// Read info.json for the device, if there is one, and clean up anything a
+// previous failed run left in the processed path. Returns the raw files that
+// still need to be processed.
+func (prg *PhonelabRawGenerator) prepareDevice(sourceInfo *PhonelabRawInfo, resolve FileSystemResolver) ([]string, *SourceError) {
+	device := sourceInfo.DeviceId
+	basePath := sourceInfo.Path
+	processedPath := sourceInfo.ProcessedPath
+
+	makeError := func(file string, err error) *SourceError {
+		return &SourceError{
+			Info: sourceInfo,
+			File: file,
+			Err:  err,
+		}
+	}
+
+	resolved, err := resolve(basePath)
+	if err != nil {
+		return nil, makeError(basePath, err)
+	}
+	fs, ok := resolved.(easyfiles.FileSystemInterface)
+	if !ok {
+		return nil, makeError(basePath, fmt.Errorf("Can't write processed files to %T", resolved))
+	}
+	sourceInfo.FSInterface = fs
+
+	currentFiles := set.NewNonTS()
+	log.Infof("device=%v basePath=%v", device, basePath)
+	filePattern := filepath.Join(basePath, device, "time", "**/*.out.gz")
+	curFiles, err := fs.Glob(filePattern)
+	if err != nil {
+		return nil, makeError(filePattern, fmt.Errorf("Error globbing raw files: %v", err))
+	}
+	for _, obj := range curFiles {
+		currentFiles.Add(obj)
+	}
+
+	// Try to pull and read info.json if it exists. Without it, nothing has
+	// been stitched yet, so anything under the device is left from a first
+	// run that failed and is cleaned up the same way.
+	infoJsonPath := filepath.Join(processedPath, device, "info.json")
+	log.Infof("infoJsonPath=%v", infoJsonPath)
+	info := NewStitchInfo()
+	if exists, err := fs.Exists(infoJsonPath); err != nil {
+		return nil, makeError(infoJsonPath, fmt.Errorf("Error checking for info.json: %v", err))
+	} else if exists {
+		log.Infof("Found info.json")
+		data, err := fs.ReadFile(infoJsonPath)
+		if err != nil {
+			return nil, makeError(infoJsonPath, fmt.Errorf("Error reading: %v", err))
+		}
+		// We've processed a portion of the currentFiles.
+		// Don't re-process these
+		if info, err = GetInfoFromBytes(data); err != nil {
+			return nil, makeError(infoJsonPath, fmt.Errorf("Error unmarshaling: %v", err))
+		}
+		sourceInfo.StitchInfo = info
+	}
+
+	// Make sure we clear out any files and directories that are not found in info.json
+	// This ensures that any previous run that failed mid-way while adding new files
+	// don't persist since info.json is only updated after everything else has succeeded.
+	// First, remote any extraneous bootIDs
+	log.Infof("Checking for extraneous bootIDs and files...")
+	validBootIds := set.NewNonTS()
+	for _, bootId := range info.BootIds() {
+		validBootIds.Add(bootId)
+	}
+	log.Infof("Valid bootIDs: %v", validBootIds)
+
+	bootIdsFound, err := fs.Glob(filepath.Join(processedPath, device, "*-*-*"))
+	if err != nil {
+		return nil, makeError("", fmt.Errorf("Error globbing bootIds: %v", err))
+	}
+	existingBootIds := set.NewNonTS()
+	for _, bootIdPath := range bootIdsFound {
+		bootId := path.Base(bootIdPath)
+		existingBootIds.Add(bootId)
+	}
+	log.Infof("Existing bootIDs: %v", existingBootIds)
+
+	// Get the difference
+	extraneousBootIds := set.Difference(existingBootIds, validBootIds)
+	if extraneousBootIds.Size() > 0 {
+		log.Warnf("Extraneous bootIDs: %v", extraneousBootIds)
+	}
+	// Any remaining bootID is extraneous
+	for _, obj := range extraneousBootIds.List() {
+		b := obj.(string)
+		bootIdPath := filepath.Join(processedPath, device, b)
+		log.Warnf("Deleting: %v", bootIdPath)
+		if err := fs.RemoveAll(bootIdPath); err != nil {
+			return nil, makeError(bootIdPath, fmt.Errorf("Failed to remove extraneous bootID: %v", err))
+		}
+	}
+
+	// Now, remove any extraneous files within valid bootIDs
+	for bootId, data := range info.BootInfo {
+		bootIdPath := filepath.Join(processedPath, device, bootId)
+		validFiles := set.NewNonTS()
+		existingFiles := set.NewNonTS()
+		for file := range data {
+			validFiles.Add(file)
+		}
+		filesFound, err := fs.Glob(filepath.Join(bootIdPath, "*.gz"))
+		if err != nil {
+			return nil, makeError(bootIdPath, fmt.Errorf("Error globbing bootId files: %v", err))
+		}
+		for _, file := range filesFound {
+			// Extract name alone
+			name := path.Base(file)
+			existingFiles.Add(name)
+		}
+		if validFiles.Size() != existingFiles.Size() {
+			log.Warnf("Found extraneous files")
+		}
+		// Now, find the set difference and remove any extraneous files
+		extraneousFiles := set.Difference(existingFiles, validFiles)
+		for _, obj := range extraneousFiles.List() {
+			f := obj.(string)
+			f = filepath.Join(bootIdPath, f)
+			log.Warnf("Deleting: %v", f)
+			if err := fs.Remove(f); err != nil {
+				return nil, makeError(f, fmt.Errorf("Failed to remove extraneous bootID file: %v", err))
+			}
+		}
+	}
+
+	processedFiles := set.NewNonTS()
+	for _, obj := range info.Files {
+		processedFiles.Add(obj)
+	}
+	diffSet := set.Difference(currentFiles, processedFiles)
+
+	files := make([]string, diffSet.Size())
+	for idx, obj := range diffSet.List() {
+		files[idx] = obj.(string)
+	}
+	return files, nil
+}
@@ -0,0 +1,394 @@
+package phonelab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gurupras/go-easyfiles"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The generator name the stitcher is registered under in the Environment.
+	PhonelabRawStitcherName = "phonelab-raw-stitch"
+
+	// Number of loglines written to each N.gz chunk.
+	DEFAULT_STITCH_CHUNK_SIZE = 100000
+)
+
+// PhonelabRawStitcher turns the raw time/YYYY/mm/dd.out.gz files emitted by a
+// PhonelabRawProcessor into the processed layout read by
+// PhonelabSourceGenerator:
+//
+//	<processed_path>/<device>/<bootid>/N.gz
+//	<processed_path>/<device>/info.json
+//
+// Lines are split by boot ID and sorted using Logline.Less. Each boot ID keeps
+// a window of pending lines across raw files so that lines uploaded out of
+// order can still be sorted; once the window holds two chunks worth of lines,
+// the oldest chunk is written out. info.json is written last, so a run that
+// dies partway through leaves only files that PhonelabRawGenerator removes on
+// the next run.
+//
+// The stitcher emits the updated *StitchInfo once everything has been written.
+type PhonelabRawStitcher struct {
+	*PhonelabRawInfo
+	Source    Processor
+	ChunkSize int
+	ErrHandler
+}
+
+func NewPhonelabRawStitcher(source Processor, info *PhonelabRawInfo, errHandler ErrHandler) *PhonelabRawStitcher {
+	return &PhonelabRawStitcher{
+		PhonelabRawInfo: info,
+		Source:          source,
+		ChunkSize:       DEFAULT_STITCH_CHUNK_SIZE,
+		ErrHandler:      errHandler,
+	}
+}
+
+func (s *PhonelabRawStitcher) Process() <-chan interface{} {
+	return s.ProcessContext(context.Background())
+}
+
+// If ctx is canceled, the stitcher stops after the current raw file without
+// updating info.json. The chunks it already wrote are cleaned up by
+// PhonelabRawGenerator on the next run.
+func (s *PhonelabRawStitcher) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		inChan := ProcessContext(ctx, s.Source)
+		if err := s.stitch(ctx, inChan); err != nil {
+			// Don't leave the source blocked on a send.
+			drain(inChan)
+			if ctx.Err() != nil {
+				log.Warnf("Stopped stitching device '%v': %v", s.DeviceId, err)
+			} else if s.ErrHandler == nil && !hasErrorReporter(ctx) {
+				log.Errorf("Failed to stitch device '%v': %v", s.DeviceId, err)
+			} else {
+				// Whatever the policy, the device is done. It gets another try
+				// on the next run.
+				srcErr := &SourceError{Info: s.PhonelabRawInfo}
+				if fileErr, ok := err.(*SourceError); ok {
+					// Keep the file and line it happened at
+					srcErr.File, srcErr.Line, err = fileErr.File, fileErr.Line, fileErr.Err
+				}
+				srcErr.Err = fmt.Errorf("Failed to stitch: %v", err)
+				reportSourceError(ctx, s.ErrHandler, srcErr)
+			}
+		} else {
+			sendContext(ctx, outChan, s.StitchInfo)
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+func (s *PhonelabRawStitcher) stitch(ctx context.Context, inChan <-chan interface{}) error {
+	if s.ChunkSize <= 0 {
+		return fmt.Errorf("Invalid chunk size: %v", s.ChunkSize)
+	}
+
+	// No info.json yet, so this is the first time we've seen the device.
+	if s.StitchInfo == nil {
+		s.StitchInfo = NewStitchInfo()
+	}
+
+	pending := make(map[string]Loglines)
+	processed := make([]string, 0)
+
+	for obj := range inChan {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		file, ok := obj.(string)
+		if !ok {
+			return fmt.Errorf("Expected raw file name, got %T", obj)
+		}
+		log.Infof("Stitching %v", file)
+
+		if err := s.readRawFile(file, pending); err != nil {
+			return err
+		}
+
+		for bootId, lines := range pending {
+			sort.Sort(lines)
+			for len(lines) >= 2*s.ChunkSize {
+				if err := s.writeChunk(bootId, lines[:s.ChunkSize]); err != nil {
+					return err
+				}
+				lines = lines[s.ChunkSize:]
+			}
+			pending[bootId] = lines
+		}
+		processed = append(processed, file)
+	}
+
+	// The source stops early if we're canceled, so we can't tell whether we
+	// got everything.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Flush whatever is left
+	for bootId, lines := range pending {
+		sort.Sort(lines)
+		for len(lines) > 0 {
+			n := s.ChunkSize
+			if n > len(lines) {
+				n = len(lines)
+			}
+			if err := s.writeChunk(bootId, lines[:n]); err != nil {
+				return err
+			}
+			lines = lines[n:]
+		}
+	}
+
+	s.Files = append(s.Files, processed...)
+
+	return s.writeInfo()
+}
+
+// Read and parse every line in a raw file, adding it to the pending lines for
+// its boot ID.
+func (s *PhonelabRawStitcher) readRawFile(file string, pending map[string]Loglines) error {
+	f, err := s.FSInterface.Open(file, os.O_RDONLY, easyfiles.GZ_TRUE)
+	if err != nil {
+		return &SourceError{File: file, Err: fmt.Errorf("Failed to open: %v", err)}
+	}
+	defer f.Close()
+
+	scanner, err := f.Reader(0)
+	if err != nil {
+		return &SourceError{File: file, Err: fmt.Errorf("Failed to get scanner: %v", err)}
+	}
+
+	parser := NewLogcatParser()
+	skipped := 0
+	var firstSkipped error
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum += 1
+		ll, err := parser.Parse(scanner.Text())
+		if err == nil && ll == nil {
+			// A long format header, which holds no logline of its own
+			continue
+		} else if err == nil && len(ll.BootId) == 0 {
+			// Stock formats have no boot ID to stitch the line under
+			err = errors.New("Logline has no boot ID")
+		}
+		if err != nil {
+			if skipped == 0 {
+				firstSkipped = &SourceError{File: file, Line: lineNum, Err: err}
+			}
+			skipped += 1
+			continue
+		}
+		pending[ll.BootId] = append(pending[ll.BootId], ll)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return &SourceError{File: file, Line: lineNum + 1, Err: fmt.Errorf("Error scanning: %v", err)}
+	}
+
+	if skipped > 0 {
+		log.Warnf("Skipped %v unparseable lines in %v, the first was %v", skipped, file, firstSkipped)
+	}
+	return nil
+}
+
+// Write lines as the next N.gz chunk for the boot ID and record it in the
+// StitchInfo.
+func (s *PhonelabRawStitcher) writeChunk(bootId string, lines Loglines) error {
+	bootInfo, ok := s.BootInfo[bootId]
+	if !ok {
+		bootInfo = make(map[string]*StitchFileInfo)
+		s.BootInfo[bootId] = bootInfo
+	}
+
+	bootPath := filepath.Join(s.ProcessedPath, s.DeviceId, bootId)
+	if exists, _ := s.FSInterface.Exists(bootPath); !exists {
+		if err := s.FSInterface.Makedirs(bootPath); err != nil {
+			return fmt.Errorf("Failed to create directory: %v: %v", bootPath, err)
+		}
+	}
+
+	name := fmt.Sprintf("%v.gz", nextChunkIndex(bootInfo))
+	chunkPath := filepath.Join(bootPath, name)
+
+	if err := writeChunkFile(s.FSInterface, chunkPath, lines); err != nil {
+		return err
+	}
+
+	bootInfo[name] = &StitchFileInfo{
+		Start: lines[0].Datetime.UnixNano(),
+		End:   lines[len(lines)-1].Datetime.UnixNano(),
+	}
+	return nil
+}
+
+// Some filesystems know how to rename a file. We'll use that when we can so
+// that info.json is replaced atomically.
+type fsRenamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// Write info.json for the device. The new info is written to a temporary file
+// first and renamed over the old one.
+func (s *PhonelabRawStitcher) writeInfo() error {
+	b, err := json.MarshalIndent(s.StitchInfo, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal info.json: %v", err)
+	}
+
+	devicePath := filepath.Join(s.ProcessedPath, s.DeviceId)
+	if exists, _ := s.FSInterface.Exists(devicePath); !exists {
+		if err := s.FSInterface.Makedirs(devicePath); err != nil {
+			return fmt.Errorf("Failed to create directory: %v: %v", devicePath, err)
+		}
+	}
+
+	infoJsonPath := filepath.Join(devicePath, "info.json")
+	tmpPath := infoJsonPath + ".tmp"
+
+	if r, ok := s.FSInterface.(fsRenamer); ok {
+		if err := writeFileBytes(s.FSInterface, tmpPath, b); err != nil {
+			return err
+		}
+		return r.Rename(tmpPath, infoJsonPath)
+	} else if len(s.HdfsAddr) == 0 {
+		if err := writeFileBytes(s.FSInterface, tmpPath, b); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, infoJsonPath)
+	} else {
+		// Not atomic, but it's still the last thing we write.
+		log.Warnf("Filesystem for %v cannot rename, writing info.json in place", s.HdfsAddr)
+		return writeFileBytes(s.FSInterface, infoJsonPath, b)
+	}
+}
+
+func writeChunkFile(fs easyfiles.FileSystemInterface, chunkPath string, lines Loglines) error {
+	f, err := fs.Open(chunkPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, easyfiles.GZ_TRUE)
+	if err != nil {
+		return fmt.Errorf("Failed to open file: %v: %v", chunkPath, err)
+	}
+	defer f.Close()
+
+	writer, err := f.Writer(0)
+	if err != nil {
+		return fmt.Errorf("Failed to get writer to file: %v: %v", chunkPath, err)
+	}
+	defer writer.Close()
+	defer writer.Flush()
+
+	for _, ll := range lines {
+		if _, err := writer.Write([]byte(ll.Line + "\n")); err != nil {
+			return fmt.Errorf("Failed to write to file: %v: %v", chunkPath, err)
+		}
+	}
+	return nil
+}
+
+func writeFileBytes(fs easyfiles.FileSystemInterface, filePath string, b []byte) error {
+	f, err := fs.Open(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, easyfiles.GZ_FALSE)
+	if err != nil {
+		return fmt.Errorf("Failed to open file: %v: %v", filePath, err)
+	}
+	defer f.Close()
+
+	writer, err := f.Writer(0)
+	if err != nil {
+		return fmt.Errorf("Failed to get writer to file: %v: %v", filePath, err)
+	}
+	defer writer.Close()
+	defer writer.Flush()
+
+	if _, err := writer.Write(b); err != nil {
+		return fmt.Errorf("Failed to write to file: %v: %v", filePath, err)
+	}
+	return nil
+}
+
+// Find the next unused chunk number for a boot ID. Chunks are named N.gz,
+// starting at 1.
+func nextChunkIndex(bootInfo map[string]*StitchFileInfo) int {
+	max := 0
+	for name := range bootInfo {
+		if idx, err := strconv.Atoi(strings.TrimSuffix(path.Base(name), ".gz")); err == nil && idx > max {
+			max = idx
+		}
+	}
+	return max + 1
+}
+
+func (l Loglines) Len() int      { return len(l) }
+func (l Loglines) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l Loglines) Less(i, j int) bool {
+	less, _ := l[i].Less(l[j])
+	return less
+}
+
+// Generates a PhonelabRawStitcher for phonelab-raw sources. The optional
+// chunk_size arg sets the number of lines per N.gz chunk.
+type PhonelabRawStitcherGen struct{}
+
+func (g *PhonelabRawStitcherGen) GenerateProcessor(source *PipelineSourceInstance,
+	kwargs map[string]interface{}) Processor {
+
+	chunkSize, err := parseStitchChunkSize(kwargs)
+	info, ok := source.Info.(*PhonelabRawInfo)
+	if err == nil && !ok {
+		err = fmt.Errorf("%v requires a phonelab-raw source, got %T", PhonelabRawStitcherName, source.Info)
+	}
+	if err != nil {
+		return &argsErrorProcessor{
+			Source: source.Processor,
+			Info:   source.Info,
+			Err:    err,
+		}
+	}
+
+	// Errors go wherever the raw files' errors go
+	var errHandler ErrHandler
+	if raw, ok := source.Processor.(*PhonelabRawProcessor); ok {
+		errHandler = raw.ErrHandler
+	}
+
+	stitcher := NewPhonelabRawStitcher(source.Processor, info, errHandler)
+	stitcher.ChunkSize = chunkSize
+	return stitcher
+}
+
+func (g *PhonelabRawStitcherGen) CheckArgs(kwargs map[string]interface{}) error {
+	_, err := parseStitchChunkSize(kwargs)
+	return err
+}
+
+func parseStitchChunkSize(kwargs map[string]interface{}) (int, error) {
+	v, ok := kwargs["chunk_size"]
+	if !ok {
+		return DEFAULT_STITCH_CHUNK_SIZE, nil
+	}
+	chunkSize, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected type for 'chunk_size'. Expected int, got %T", v)
+	}
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("Invalid chunk size: %v", chunkSize)
+	}
+	return chunkSize, nil
+}
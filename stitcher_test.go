@@ -0,0 +1,360 @@
+package phonelab
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	stitchTestBootId0 = "43424168-e44e-473a-bf12-dba8a4a4453a"
+	stitchTestBootId1 = "5c5ae4a1-8d3e-4f7a-9a55-0b1f3c2d4e6f"
+)
+
+// Write the lines to a gzipped raw file, creating directories as needed.
+func writeRawTestFile(file string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+
+	for _, line := range lines {
+		if _, err := gz.Write([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build a raw device directory with two days of uploads. The lines are split
+// across two boot IDs and written in reverse order so that the stitcher has to
+// sort them.
+func makeRawTestDevice(rawPath, device string) (int, error) {
+	data, err := ioutil.ReadFile("./test/test.log")
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i := range lines {
+		if i%2 == 1 {
+			lines[i] = strings.Replace(lines[i], stitchTestBootId0, stitchTestBootId1, 1)
+		}
+	}
+
+	reversed := make([]string, len(lines))
+	for i, line := range lines {
+		reversed[len(lines)-1-i] = line
+	}
+
+	half := len(reversed) / 2
+	timePath := filepath.Join(rawPath, device, "time", "2016", "12")
+	if err = writeRawTestFile(filepath.Join(timePath, "13.out.gz"), reversed[half:]); err != nil {
+		return 0, err
+	}
+	if err = writeRawTestFile(filepath.Join(timePath, "14.out.gz"), reversed[:half]); err != nil {
+		return 0, err
+	}
+	return len(lines), nil
+}
+
+func runRawStitcher(t *testing.T, rawPath, processedPath, device string, chunkSize int) *StitchInfo {
+	require := require.New(t)
+
+	errHandler := func(err error) {
+		t.Fatal("Error: ", err)
+	}
+
+	gen := NewPhonelabRawGenerator(map[string]string{device: rawPath},
+		map[string]interface{}{"processed_path": processedPath}, errHandler)
+
+	var result *StitchInfo
+	for source := range gen.Process() {
+		info, ok := source.Info.(*PhonelabRawInfo)
+		require.True(ok)
+
+		stitcher := NewPhonelabRawStitcher(source.Processor, info, errHandler)
+		stitcher.ChunkSize = chunkSize
+		for obj := range stitcher.Process() {
+			result = obj.(*StitchInfo)
+		}
+	}
+	return result
+}
+
+func TestPhonelabRawStitcher(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stitch")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	const device = "test-device-1"
+	const chunkSize = 1000
+
+	rawPath := filepath.Join(tmpDir, "raw")
+	processedPath := filepath.Join(tmpDir, "processed")
+
+	total, err := makeRawTestDevice(rawPath, device)
+	require.Nil(err)
+
+	result := runRawStitcher(t, rawPath, processedPath, device, chunkSize)
+	require.NotNil(result)
+	assert.Equal(2, len(result.Files))
+	assert.Equal(2, len(result.BootInfo))
+
+	// info.json should match what the stitcher emitted
+	info, err := GetInfoFromFile(filepath.Join(processedPath, device))
+	require.Nil(err)
+	assert.Equal(result.BootInfo, info.BootInfo)
+	assert.Equal(result.Files, info.Files)
+	_, err = os.Stat(filepath.Join(processedPath, device, "info.json.tmp"))
+	assert.True(os.IsNotExist(err))
+
+	// Read it back like any other processed device. Every line should be
+	// there, and each boot ID should be sorted.
+	gen := NewPhonelabSourceGenerator(map[string][]string{device: []string{processedPath}}, nil,
+		func(err error) {
+			t.Fatal("Error: ", err)
+		})
+
+	lines := 0
+	for source := range gen.Process() {
+		sourceInfo := source.Info.(*PhonelabSourceInfo)
+		assert.Equal((total/2+chunkSize-1)/chunkSize, len(sourceInfo.BootInfo[sourceInfo.BootId]))
+
+		var last *Logline
+		for obj := range source.Processor.Process() {
+			ll, err := ParseLogline(obj.(string))
+			require.Nil(err)
+			assert.Equal(sourceInfo.BootId, ll.BootId)
+			if last != nil {
+				less, err := ll.Less(last)
+				require.Nil(err)
+				assert.False(less)
+			}
+			last = ll
+			lines += 1
+		}
+	}
+	assert.Equal(total, lines)
+
+	// A second run has nothing new to do
+	result = runRawStitcher(t, rawPath, processedPath, device, chunkSize)
+	require.NotNil(result)
+	assert.Equal(2, len(result.Files))
+	assert.Equal(info.BootInfo, result.BootInfo)
+}
+
+func TestPhonelabRawStitcherNewFiles(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stitch")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	const device = "test-device-1"
+
+	rawPath := filepath.Join(tmpDir, "raw")
+	processedPath := filepath.Join(tmpDir, "processed")
+
+	_, err = makeRawTestDevice(rawPath, device)
+	require.Nil(err)
+
+	result := runRawStitcher(t, rawPath, processedPath, device, 1000)
+	require.NotNil(result)
+	before := len(result.BootInfo[stitchTestBootId0])
+
+	// A new day shows up. It should be appended as new chunks.
+	newLine := "43424168-e44e-473a-bf12-dba8a4a4453a 2016-12-15 11:24:01.796390655 9999999 [99999.000000]   963  1896 D Test: new day"
+	err = writeRawTestFile(filepath.Join(rawPath, device, "time", "2016", "12", "15.out.gz"), []string{newLine})
+	require.Nil(err)
+
+	// Leftovers from a failed run should be cleaned up.
+	stale := filepath.Join(processedPath, device, stitchTestBootId0, "100.gz")
+	require.Nil(writeRawTestFile(stale, []string{newLine}))
+
+	result = runRawStitcher(t, rawPath, processedPath, device, 1000)
+	require.NotNil(result)
+	assert.Equal(3, len(result.Files))
+	assert.Equal(before+1, len(result.BootInfo[stitchTestBootId0]))
+
+	_, err = os.Stat(stale)
+	assert.True(os.IsNotExist(err))
+
+	f, err := os.Open(filepath.Join(processedPath, device, stitchTestBootId0,
+		fmt.Sprintf("%v.gz", before+1)))
+	require.Nil(err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.Nil(err)
+	scanner := bufio.NewScanner(gz)
+	require.True(scanner.Scan())
+	assert.Equal(newLine, scanner.Text())
+}
+
+func TestPhonelabRawStitcherFirstRunLeftovers(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stitch")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	const device = "test-device-1"
+
+	rawPath := filepath.Join(tmpDir, "raw")
+	processedPath := filepath.Join(tmpDir, "processed")
+
+	_, err = makeRawTestDevice(rawPath, device)
+	require.Nil(err)
+
+	// A first run that died before writing info.json
+	staleLine := "43424168-e44e-473a-bf12-dba8a4a4453a 2016-12-15 11:24:01.796390655 9999999 [99999.000000]   963  1896 D Test: stale"
+	staleChunk := filepath.Join(processedPath, device, stitchTestBootId0, "100.gz")
+	staleBootId := filepath.Join(processedPath, device, "00000000-0000-0000-0000-000000000000")
+	require.Nil(writeRawTestFile(staleChunk, []string{staleLine}))
+	require.Nil(writeRawTestFile(filepath.Join(staleBootId, "1.gz"), []string{staleLine}))
+
+	result := runRawStitcher(t, rawPath, processedPath, device, 1000)
+	require.NotNil(result)
+	assert.Equal(2, len(result.BootInfo))
+
+	_, err = os.Stat(staleChunk)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(staleBootId)
+	assert.True(os.IsNotExist(err))
+
+	files, err := filepath.Glob(filepath.Join(processedPath, device, stitchTestBootId0, "*.gz"))
+	require.Nil(err)
+	assert.Equal(len(result.BootInfo[stitchTestBootId0]), len(files))
+}
+
+func TestPhonelabRawStitcherSkippedLines(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stitch")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	const device = "test-device-1"
+
+	rawPath := filepath.Join(tmpDir, "raw")
+	processedPath := filepath.Join(tmpDir, "processed")
+
+	// Lines that aren't loglines are skipped rather than stitched
+	lines := []string{
+		"43424168-e44e-473a-bf12-dba8a4a4453a 2016-12-15 11:24:01.796390655 1 [99999.000000]   963  1896 D Test: first",
+		"",
+		"--------- beginning of main",
+		// No boot ID
+		"12-15 11:24:01.900  963  1896 D Test: stock",
+		"[ 12-15 11:24:01.950  963: 1896 D/Test ]",
+		"43424168-e44e-473a-bf12-dba8a4a4453a 2016-12-15 11:24:02.796390655 2 [100000.000000]   963  1896 D Test: second",
+	}
+	require.Nil(writeRawTestFile(filepath.Join(rawPath, device, "time", "2016", "12", "15.out.gz"), lines))
+
+	result := runRawStitcher(t, rawPath, processedPath, device, 1000)
+	require.NotNil(result)
+	assert.Equal(1, len(result.Files))
+	require.Equal(1, len(result.BootInfo))
+	assert.Equal(1, len(result.BootInfo[stitchTestBootId0]))
+
+	f, err := os.Open(filepath.Join(processedPath, device, stitchTestBootId0, "1.gz"))
+	require.Nil(err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.Nil(err)
+	data, err := ioutil.ReadAll(gz)
+	require.Nil(err)
+	assert.Equal(lines[0]+"\n"+lines[len(lines)-1]+"\n", string(data))
+}
+
+func TestSortRawFiles(t *testing.T) {
+	t.Parallel()
+
+	files := []string{
+		"raw/dev/time/2017/1/2.out.gz",
+		"raw/dev/time/2016/12/31.out.gz",
+		"raw/dev/time/2016/12/9.out.gz",
+		"raw/dev/time/bad.out.gz",
+		"raw/dev/time/2016/12/10.out.gz",
+	}
+	sortRawFiles(files)
+	assert.Equal(t, []string{
+		"raw/dev/time/bad.out.gz",
+		"raw/dev/time/2016/12/9.out.gz",
+		"raw/dev/time/2016/12/10.out.gz",
+		"raw/dev/time/2016/12/31.out.gz",
+		"raw/dev/time/2017/1/2.out.gz",
+	}, files)
+}
+
+func TestPhonelabRawStitcherGen(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	gen := &PhonelabRawStitcherGen{}
+	info := &PhonelabRawInfo{DeviceId: "test-device-1"}
+	raw, _ := NewPhonelabRawProcessor(info, nil, nil)
+
+	stitcher, ok := gen.GenerateProcessor(&PipelineSourceInstance{Processor: raw, Info: info},
+		map[string]interface{}{"chunk_size": 10}).(*PhonelabRawStitcher)
+	assert.True(ok)
+	assert.Equal(10, stitcher.ChunkSize)
+
+	assert.Nil(gen.CheckArgs(map[string]interface{}{}))
+	assert.NotNil(gen.CheckArgs(map[string]interface{}{"chunk_size": "10"}))
+	assert.NotNil(gen.CheckArgs(map[string]interface{}{"chunk_size": 0}))
+
+	// Bad args and other sources are errors for the source, not panics
+	reporter := &errorReporter{
+		policy: ErrorPolicySkipSource,
+		failed: make(map[string]bool),
+	}
+	ctx := withErrorReporter(context.Background(), reporter)
+	for _, source := range []*PipelineSourceInstance{
+		&PipelineSourceInstance{Processor: raw, Info: info},
+		&PipelineSourceInstance{
+			Processor: NewTextFileProcessor("./test/test.log", nil, nil),
+			Info:      &TextFileSourceInfo{"./test/test.log"},
+		},
+	} {
+		kwargs := map[string]interface{}{}
+		if source.Info == info {
+			kwargs["chunk_size"] = "10"
+		}
+		proc := gen.GenerateProcessor(source, kwargs)
+		drain(ProcessContext(ctx, proc))
+	}
+	assert.Equal(2, len(reporter.errors()))
+}
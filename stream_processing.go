@@ -0,0 +1,329 @@
+package phonelab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Streams are live logs, e.g. from adb logcat, that are read until they
+// close. A stream source is one of:
+//
+//	-                    stdin
+//	tcp://host:port      a TCP socket to listen on, e.g. tcp://:5555
+//	unix:///path/to/sock a Unix socket to listen on
+//	/path/to/fifo        a named pipe, or any other file
+//
+// Each connection to a socket is a source of its own.
+
+const (
+	StreamSourceStdin = "-"
+	streamSchemeTCP   = "tcp://"
+	streamSchemeUnix  = "unix://"
+)
+
+type StreamSourceInfo struct {
+	// The stream, as it is written in the conf
+	Source string
+	// The connection number, from 1, for sockets
+	Connection int
+	// The address of the other end of the connection, if there is one
+	Remote string
+}
+
+func (info *StreamSourceInfo) Type() string {
+	return "stream"
+}
+
+func (info *StreamSourceInfo) Context() string {
+	if info.Connection == 0 {
+		return info.Source
+	}
+	return fmt.Sprintf("%v/%v", info.Source, info.Connection)
+}
+
+// Streams are different every time, so there's no picking up where a run left
+// off.
+func journaled(info PipelineSourceInfo) bool {
+	_, ok := info.(*StreamSourceInfo)
+	return !ok
+}
+
+// The network and address to listen on for a socket stream. ok is false if
+// the source isn't a socket.
+func parseStreamSocket(source string) (network string, addr string, ok bool) {
+	switch {
+	case strings.HasPrefix(source, streamSchemeTCP):
+		return "tcp", strings.TrimPrefix(source, streamSchemeTCP), true
+	case strings.HasPrefix(source, streamSchemeUnix):
+		return "unix", strings.TrimPrefix(source, streamSchemeUnix), true
+	}
+	return "", "", false
+}
+
+// Check a stream source, without opening it
+func checkStreamSource(source string) error {
+	if len(source) == 0 {
+		return fmt.Errorf("Invalid stream: empty name")
+	}
+	if network, addr, ok := parseStreamSocket(source); ok {
+		if len(addr) == 0 {
+			return fmt.Errorf("Invalid stream '%v': missing address", source)
+		}
+		if network == "tcp" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("Invalid stream '%v': %v", source, err)
+			}
+		}
+		return nil
+	}
+	if scheme, _ := splitScheme(source); len(scheme) > 0 {
+		return fmt.Errorf("Invalid stream '%v'. Expected -, tcp://host:port, unix:///path or the path of a named pipe", source)
+	}
+	return nil
+}
+
+// Reads the lines of a stream until it closes or the run is canceled.
+type StreamProcessor struct {
+	Info   *StreamSourceInfo
+	Reader io.ReadCloser
+	ErrHandler
+	once sync.Once
+}
+
+func NewStreamProcessor(info *StreamSourceInfo, reader io.ReadCloser, errHandler ErrHandler) *StreamProcessor {
+	return &StreamProcessor{
+		Info:       info,
+		Reader:     reader,
+		ErrHandler: errHandler,
+	}
+}
+
+// There's no going back for another look at a stream.
+func (p *StreamProcessor) SinglePass() {}
+
+func (p *StreamProcessor) processStream(ctx context.Context, outChan chan interface{}) {
+	defer p.Reader.Close()
+
+	// Reads from stdin and pipes can't be interrupted, so they're done on
+	// the side, and abandoned if the run is canceled.
+	lines := make(chan string)
+	errChan := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(lines)
+		scanner := newLineScanner(p.Reader)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-stop:
+				return
+			}
+		}
+		errChan <- scanner.Err()
+	}()
+
+	metrics := nodeMetrics(ctx, "StreamProcessor")
+	lineNum := 0
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if err := <-errChan; err != nil {
+					reportSourceError(ctx, p.ErrHandler, &SourceError{
+						Info: p.Info,
+						Line: lineNum + 1,
+						Err:  fmt.Errorf("Error reading stream: %v", err),
+					})
+				}
+				return
+			}
+			lineNum += 1
+			metrics.itemIn()
+			if !metrics.send(ctx, outChan, line) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *StreamProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *StreamProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		read := false
+		p.once.Do(func() {
+			read = true
+			p.processStream(ctx, outChan)
+		})
+		if !read {
+			reportSourceError(ctx, p.ErrHandler, &SourceError{
+				Info: p.Info,
+				Err:  fmt.Errorf("Stream can only be read once"),
+			})
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+// A source generator for streams. Stdin and pipes are one source each. Sockets
+// are listened on until the run is canceled or MaxConnections is reached,
+// with a source for each connection.
+type StreamSourceGenerator struct {
+	Sources []string
+	// The number of connections to take on each socket. 0 for no limit.
+	MaxConnections int
+	ErrHandler     ErrHandler
+	// Where - reads from. nil for os.Stdin.
+	Stdin io.ReadCloser
+}
+
+func NewStreamSourceGenerator(sources []string, errHandler ErrHandler) *StreamSourceGenerator {
+	return &StreamSourceGenerator{
+		Sources:    sources,
+		ErrHandler: errHandler,
+	}
+}
+
+func (sg *StreamSourceGenerator) Process() <-chan *PipelineSourceInstance {
+	return sg.ProcessContext(context.Background())
+}
+
+func (sg *StreamSourceGenerator) ProcessContext(ctx context.Context) <-chan *PipelineSourceInstance {
+	sourceChan := make(chan *PipelineSourceInstance)
+
+	// The streams are live, so they're all read at once.
+	var wg sync.WaitGroup
+	for _, source := range sg.Sources {
+		wg.Add(1)
+		go func(source string) {
+			defer wg.Done()
+			if err := sg.processSource(ctx, source, sourceChan); err != nil {
+				reportSourceError(ctx, sg.ErrHandler, &SourceError{
+					Info: &StreamSourceInfo{Source: source},
+					Err:  err,
+				})
+			}
+		}(source)
+	}
+
+	go func() {
+		wg.Wait()
+		close(sourceChan)
+	}()
+
+	return sourceChan
+}
+
+func (sg *StreamSourceGenerator) send(ctx context.Context, sourceChan chan<- *PipelineSourceInstance,
+	info *StreamSourceInfo, reader io.ReadCloser) bool {
+
+	source := &PipelineSourceInstance{
+		Processor: NewStreamProcessor(info, reader, sg.ErrHandler),
+		Info:      info,
+	}
+	if !sendSourceContext(ctx, sourceChan, source) {
+		reader.Close()
+		return false
+	}
+	return true
+}
+
+func (sg *StreamSourceGenerator) processSource(ctx context.Context, source string,
+	sourceChan chan<- *PipelineSourceInstance) error {
+
+	if source == StreamSourceStdin {
+		stdin := sg.Stdin
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+		sg.send(ctx, sourceChan, &StreamSourceInfo{Source: source}, stdin)
+		return nil
+	}
+
+	network, addr, ok := parseStreamSocket(source)
+	if !ok {
+		return sg.processPipe(ctx, source, sourceChan)
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("Error listening for stream: %v", err)
+	}
+
+	// Accept doesn't know about ctx, but closing the listener stops it.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		listener.Close()
+	}()
+
+	for conn := 1; sg.MaxConnections == 0 || conn <= sg.MaxConnections; conn++ {
+		c, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Error accepting stream connection: %v", err)
+		}
+		info := &StreamSourceInfo{
+			Source:     source,
+			Connection: conn,
+			Remote:     c.RemoteAddr().String(),
+		}
+		if !sg.send(ctx, sourceChan, info, c) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Opening a named pipe waits for a writer, so it's done on the side. If the
+// run is canceled first, it's abandoned.
+func (sg *StreamSourceGenerator) processPipe(ctx context.Context, source string,
+	sourceChan chan<- *PipelineSourceInstance) error {
+
+	type result struct {
+		file *os.File
+		err  error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		file, err := os.Open(source)
+		opened <- result{file, err}
+	}()
+
+	select {
+	case res := <-opened:
+		if res.err != nil {
+			return fmt.Errorf("Error opening stream: %v", res.err)
+		}
+		sg.send(ctx, sourceChan, &StreamSourceInfo{Source: source}, res.file)
+		return nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-opened; res.file != nil {
+				res.file.Close()
+			}
+		}()
+		return nil
+	}
+}
@@ -0,0 +1,184 @@
+package phonelab
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Connect to a stream that may not be listening yet
+func dialStream(t *testing.T, network, addr string) net.Conn {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial(network, addr); err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Unable to connect to %v", addr)
+	return nil
+}
+
+// Send a file down a stream and hang up. These run alongside the Runner, so
+// they can't stop the test.
+func writeStream(t *testing.T, network, addr string, file string) {
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	if conn := dialStream(t, network, addr); conn != nil {
+		_, err = conn.Write(data)
+		assert.Nil(t, err)
+		assert.Nil(t, conn.Close())
+	}
+}
+
+func TestStreamSources(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	errHandler := func(err error) {
+		t.Error(err)
+	}
+
+	// stdin
+	r, w := io.Pipe()
+	gen := NewStreamSourceGenerator([]string{StreamSourceStdin}, errHandler)
+	gen.Stdin = r
+	go func() {
+		fmt.Fprintf(w, "a\nb\nc\n")
+		w.Close()
+	}()
+	assert.Equal(map[string]int{"-": 3}, countSourceLines(t, gen))
+
+	// Pipes, and files in general
+	gen = NewStreamSourceGenerator([]string{"test/test.log"}, errHandler)
+	assert.Equal(map[string]int{"test/test.log": 5000}, countSourceLines(t, gen))
+
+	// Each connection to a socket is its own source
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	source := "tcp://" + addr
+	gen = NewStreamSourceGenerator([]string{source}, errHandler)
+	gen.MaxConnections = 2
+	go func() {
+		for i := 0; i < 2; i++ {
+			if conn := dialStream(t, "tcp", addr); conn != nil {
+				fmt.Fprintf(conn, "%v\n", strings.Repeat("x\n", i))
+				conn.Close()
+			}
+		}
+	}()
+	counts := make(map[string]int)
+	for source := range gen.Process() {
+		info := source.Info.(*StreamSourceInfo)
+		assert.True(len(info.Remote) > 0)
+		for _ = range source.Processor.Process() {
+			counts[info.Context()] += 1
+		}
+	}
+	assert.Equal(map[string]int{source + "/1": 1, source + "/2": 2}, counts)
+
+	// There's only one go at a stream
+	errs := make([]error, 0)
+	proc := NewStreamProcessor(&StreamSourceInfo{Source: "-"}, ioutil.NopCloser(strings.NewReader("a\n")),
+		func(err error) { errs = append(errs, err) })
+	drain(proc.Process())
+	drain(proc.Process())
+	require.Equal(1, len(errs))
+	assert.Contains(errs[0].Error(), "Stream can only be read once")
+}
+
+func TestStreamSourceConf(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &PipelineSourceConf{
+		Type:    PipelineSourceStream,
+		Sources: []string{"-", "tcp://:5555", "unix:///tmp/logcat.sock", "/tmp/logcat.fifo"},
+	}
+	sources, err := conf.Expand()
+	assert.Nil(err)
+	assert.Equal(4, len(sources))
+
+	for _, bad := range []string{"tcp://localhost", "unix://", "ftp://example.com/fifo"} {
+		conf.Sources = []string{bad}
+		_, err = conf.Expand()
+		assert.NotNil(err, bad)
+	}
+
+	conf.Sources = []string{"-"}
+	conf.Args = map[string]interface{}{"max_connections": "2"}
+	_, err = conf.ToPipelineSourceGenerator()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Unexpected type for 'max_connections'")
+}
+
+// Streams can only be read once, so pipelines with more than one logstream
+// read them through a Tee.
+func TestStreamSourceRunner(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "phonelab-stream")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+	sock := filepath.Join(tmpDir, "logcat.sock")
+
+	manager := &countingResultsManager{
+		counts: make(map[string]int),
+	}
+
+	env := NewEnvironment()
+	env.Processors["passthrough"] = &passThroughProcessorGen{}
+	env.Processors["checker"] = &checkProcessorGen{t, manager}
+
+	confString := fmt.Sprintf(`
+source:
+  type: stream
+  sources: ["unix://%v"]
+  args:
+    max_connections: 2
+processors:
+  - name: checker
+    has_logstream: true
+    inputs:
+      - name: pp1
+      - name: pp2
+  - name: pp1
+    generator: "passthrough"
+    has_logstream: true
+  - name: pp2
+    generator: "passthrough"
+    has_logstream: true
+sink:
+  name: checker
+`, sock)
+	conf, err := RunnerConfFromString(confString)
+	require.Nil(err)
+
+	runner, err := conf.ToRunner(env)
+	require.Nil(err)
+
+	go func() {
+		writeStream(t, "unix", sock, "test/test.log")
+		writeStream(t, "unix", sock, "test/test.10000.log")
+	}()
+
+	errs := runner.Run()
+	require.Equal(0, len(errs), "%v", errs)
+
+	source := "unix://" + sock
+	assert.Equal(map[string]int{
+		source + "/1": 5000 * 3,
+		source + "/2": 10000 * 3,
+	}, manager.counts)
+}
@@ -1,5 +1,7 @@
 package phonelab
 
+import "context"
+
 // TimeweaverProcessor weaves together two streams of data based on timestamp.
 // The logs coming down the source channels must implement the
 // MonotonicTimestamper interface, otherwise there will be a panic on a bad
@@ -22,18 +24,20 @@ func NewTimeweaverProcessor(lhs, rhs Processor) *TimeweaverProcessor {
 
 // State for tracking timeweaver sources
 type timeweaverState struct {
-	source <-chan interface{}
-	get    bool
-	ok     bool
-	obj    interface{}
+	source  <-chan interface{}
+	get     bool
+	ok      bool
+	obj     interface{}
+	metrics *ProcessorMetrics
 }
 
-func newTimeweaverState(source Processor) *timeweaverState {
+func newTimeweaverState(ctx context.Context, source Processor) *timeweaverState {
 	return &timeweaverState{
-		source: source.Process(),
-		get:    true,
-		ok:     true,
-		obj:    nil,
+		source:  ProcessContext(ctx, source),
+		get:     true,
+		ok:      true,
+		obj:     nil,
+		metrics: nodeMetrics(ctx, "Timeweaver"),
 	}
 }
 
@@ -41,16 +45,26 @@ func (state *timeweaverState) updateIfneeded() {
 	if state.get {
 		state.obj, state.ok = <-state.source
 		state.get = false
+		if state.ok {
+			state.metrics.itemIn()
+		}
 	}
 }
 
-func (state *timeweaverState) drain(outChan chan interface{}) {
+// Send everything left on the source. Returns false if ctx is done first.
+func (state *timeweaverState) flush(ctx context.Context, outChan chan interface{}) bool {
 	if state.obj != nil {
-		outChan <- state.obj
+		if !state.metrics.send(ctx, outChan, state.obj) {
+			return false
+		}
 	}
 	for log := range state.source {
-		outChan <- log
+		state.metrics.itemIn()
+		if !state.metrics.send(ctx, outChan, log) {
+			return false
+		}
 	}
+	return true
 }
 
 func (state *timeweaverState) eof() bool {
@@ -61,15 +75,19 @@ func (state *timeweaverState) timestamp() float64 {
 	return (state.obj.(MonotonicTimestamper)).MonotonicTimestamp()
 }
 
-func (state *timeweaverState) send(outChan chan interface{}) {
-	outChan <- state.obj
+func (state *timeweaverState) send(ctx context.Context, outChan chan interface{}) bool {
 	state.get = true
+	return state.metrics.send(ctx, outChan, state.obj)
 }
 
 func (tw *TimeweaverProcessor) Process() <-chan interface{} {
+	return tw.ProcessContext(context.Background())
+}
+
+func (tw *TimeweaverProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
 
-	lhs := newTimeweaverState(tw.lhs)
-	rhs := newTimeweaverState(tw.rhs)
+	lhs := newTimeweaverState(ctx, tw.lhs)
+	rhs := newTimeweaverState(ctx, tw.rhs)
 
 	outChan := make(chan interface{})
 
@@ -80,20 +98,28 @@ func (tw *TimeweaverProcessor) Process() <-chan interface{} {
 			rhs.updateIfneeded()
 
 			if lhs.eof() {
-				rhs.drain(outChan)
+				rhs.flush(ctx, outChan)
 				break
 			} else if rhs.eof() {
-				lhs.drain(outChan)
+				lhs.flush(ctx, outChan)
 				break
 			} else {
+				var sent bool
 				if lhs.timestamp() <= rhs.timestamp() {
-					lhs.send(outChan)
+					sent = lhs.send(ctx, outChan)
 				} else {
-					rhs.send(outChan)
+					sent = rhs.send(ctx, outChan)
+				}
+				if !sent {
+					break
 				}
 			}
 		}
 
+		// Only has work to do if we were canceled
+		drain(lhs.source)
+		drain(rhs.source)
+
 		close(outChan)
 	}()
 
@@ -0,0 +1,541 @@
+package phonelab
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Conf validation
+//
+// ToRunner stops at the first thing wrong with a conf. ValidateRunnerConf
+// runs the same checks over the whole thing and reports everything it finds,
+// each with the line in the YAML it came from and, where it's likely a typo,
+// a suggestion. Like ToRunner, it accepts keys the conf structs don't have,
+// but warns about them.
+
+type DiagnosticSeverity string
+
+const (
+	SeverityError   DiagnosticSeverity = "error"
+	SeverityWarning DiagnosticSeverity = "warning"
+)
+
+// A problem found in a conf
+type ConfDiagnostic struct {
+	Severity DiagnosticSeverity `json:"severity"`
+	// Where in the conf, e.g. processors[1].parsers[0]
+	Path string `json:"path,omitempty"`
+	// 1-based position in the YAML. 0 if unknown.
+	Line       int    `json:"line,omitempty"`
+	Column     int    `json:"column,omitempty"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (d *ConfDiagnostic) String() string {
+	msg := d.Message
+	if len(d.Suggestion) > 0 {
+		msg += fmt.Sprintf(" (did you mean '%v'?)", d.Suggestion)
+	}
+	if d.Line > 0 {
+		return fmt.Sprintf("%v:%v: %v: %v", d.Line, d.Column, d.Severity, msg)
+	}
+	return fmt.Sprintf("%v: %v", d.Severity, msg)
+}
+
+type ValidateOptions struct {
+	// Don't resolve the source globs, so nothing on disk (or HDFS) is
+	// touched.
+	SkipSources bool
+}
+
+// Whether any of the diagnostics are errors
+func HasConfErrors(diags []*ConfDiagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a runner conf against the environment and report all of the problems
+// with it, in the order they appear in the conf. A conf with no errors
+// (warnings are OK) should make a working Runner.
+func ValidateRunnerConf(text string, env *Environment, opts *ValidateOptions) []*ConfDiagnostic {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+
+	v := &confValidator{
+		env:       env,
+		opts:      opts,
+		positions: locateConfPaths(text),
+	}
+
+	conf := &RunnerConf{}
+	typeErrors := make(map[string]bool)
+	if err := yaml.Unmarshal([]byte(text), conf); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			// The rest of the conf was still decoded.
+			for _, msg := range typeErr.Errors {
+				typeErrors[msg] = true
+				v.addYamlError(msg)
+			}
+		} else {
+			v.addYamlError(err.Error())
+			return v.diags
+		}
+	}
+
+	// Decoding strictly finds the keys that ToRunner ignores
+	if err := yaml.UnmarshalStrict([]byte(text), &RunnerConf{}); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, msg := range typeErr.Errors {
+				if !typeErrors[msg] {
+					v.addStrictYamlError(msg)
+				}
+			}
+		}
+	}
+
+	v.checkSource(conf.SourceConf)
+	v.checkProcessors(conf)
+	v.checkDataCollector(conf.DataCollector)
+
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		li, lj := v.diags[i].Line, v.diags[j].Line
+		if li == 0 || lj == 0 {
+			return li != 0 && lj == 0
+		}
+		if li != lj {
+			return li < lj
+		}
+		return v.diags[i].Column < v.diags[j].Column
+	})
+	return v.diags
+}
+
+type confValidator struct {
+	env  *Environment
+	opts *ValidateOptions
+	// The position of each path. For mapping entries, this is the key.
+	positions map[string]confPos
+	diags     []*ConfDiagnostic
+}
+
+func (v *confValidator) add(severity DiagnosticSeverity, path, suggestion string,
+	format string, args ...interface{}) {
+
+	d := &ConfDiagnostic{
+		Severity:   severity,
+		Path:       path,
+		Message:    fmt.Sprintf(format, args...),
+		Suggestion: suggestion,
+	}
+
+	// Use the closest thing we have a position for
+	for p := path; ; p = parentConfPath(p) {
+		if pos, ok := v.positions[p]; ok {
+			d.Line, d.Column = pos.Line, pos.Column
+			break
+		}
+		if len(p) == 0 {
+			break
+		}
+	}
+
+	v.diags = append(v.diags, d)
+}
+
+func (v *confValidator) errorf(path, suggestion string, format string, args ...interface{}) {
+	v.add(SeverityError, path, suggestion, format, args...)
+}
+
+func (v *confValidator) warnf(path, suggestion string, format string, args ...interface{}) {
+	v.add(SeverityWarning, path, suggestion, format, args...)
+}
+
+// Report an error from one of the builder's checks. Field errors are reported
+// at their field under path.
+func (v *confValidator) builderError(path string, err error) {
+	if fieldErr, ok := err.(*confFieldError); ok {
+		v.errorf(joinConfPath(path, fieldErr.Field), fieldErr.Suggestion, "%v", fieldErr.Err)
+	} else {
+		v.errorf(path, "", "%v", err)
+	}
+}
+
+var yamlErrorRegex = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+func (v *confValidator) addYamlError(msg string) {
+	d := &ConfDiagnostic{
+		Severity: SeverityError,
+		Message:  msg,
+	}
+	if m := yamlErrorRegex.FindStringSubmatch(msg); m != nil {
+		d.Line, _ = strconv.Atoi(m[1])
+		d.Message = m[2]
+	}
+	v.diags = append(v.diags, d)
+}
+
+func parentConfPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// The conf structs, by the name yaml.v2 gives their type in errors
+var confTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, conf := range []interface{}{
+		RunnerConf{}, PipelineSourceConf{}, DataCollectorConf{},
+		ProcessorConf{}, ProcessorInputConf{}, FilterConf{},
+	} {
+		t := reflect.TypeOf(conf)
+		confTypes[t.String()] = t
+	}
+}
+
+// The yaml field names of struct type t
+func yamlFields(t reflect.Type) []string {
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		} else if len(name) == 0 {
+			name = strings.ToLower(f.Name)
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+var yamlUnknownFieldRegex = regexp.MustCompile(`^line (\d+): field (.+) not found in type (\S+)$`)
+
+// Report something only a strict decode finds, e.g. an unknown key. These are
+// warnings, as ToRunner doesn't mind them.
+func (v *confValidator) addStrictYamlError(msg string) {
+	m := yamlUnknownFieldRegex.FindStringSubmatch(msg)
+	if m == nil {
+		v.addYamlError(msg)
+		v.diags[len(v.diags)-1].Severity = SeverityWarning
+		return
+	}
+
+	line, _ := strconv.Atoi(m[1])
+	key := m[2]
+	d := &ConfDiagnostic{
+		Severity: SeverityWarning,
+		Line:     line,
+		Message:  fmt.Sprintf("Unknown field '%v' is ignored", key),
+	}
+	if t, ok := confTypes[m[3]]; ok {
+		d.Suggestion = suggestName(key, yamlFields(t))
+	}
+
+	// Find the key, for its path and column
+	for path, pos := range v.positions {
+		if pos.Line == line && (path == key || strings.HasSuffix(path, "."+key)) {
+			d.Path, d.Column = path, pos.Column
+			d.Message = fmt.Sprintf("Unknown field '%v' in %v is ignored", key, confPathName(parentConfPath(path)))
+			break
+		}
+	}
+
+	v.diags = append(v.diags, d)
+}
+
+func confPathName(path string) string {
+	if len(path) == 0 {
+		return "the conf"
+	}
+	return "'" + path + "'"
+}
+
+// The position of something in a conf, both 1-based
+type confPos struct {
+	Line   int
+	Column int
+}
+
+var confKeyRegex = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"{\[][^:#]*?)\s*:(?:\s|$)`)
+
+// Find where the keys and sequence items of a conf are, by path, e.g.
+// processors[1].filters[0].type. yaml.v2 doesn't keep positions, so this
+// follows the indentation of block-style YAML. Anything in a flow-style
+// collection ({...} or [...]) is left out, and reported at the collection.
+func locateConfPaths(text string) map[string]confPos {
+	type entry struct {
+		col   int
+		path  string
+		item  bool
+		items int
+	}
+
+	positions := make(map[string]confPos)
+	stack := []*entry{{col: -1}}
+	// The indentation of the key of a block scalar we're in, if any
+	blockCol := -1
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		content := strings.TrimLeft(line, " ")
+		col := len(line) - len(content)
+
+		if blockCol >= 0 {
+			if len(strings.TrimSpace(content)) == 0 || col > blockCol {
+				continue
+			}
+			blockCol = -1
+		}
+		if len(content) == 0 || content[0] == '#' || strings.HasPrefix(content, "---") {
+			continue
+		}
+
+		// Sequence items. A sequence can be indented as much as the key
+		// it belongs to.
+		for content == "-" || strings.HasPrefix(content, "- ") {
+			for top := stack[len(stack)-1]; top.col > col || (top.col == col && top.item); top = stack[len(stack)-1] {
+				stack = stack[:len(stack)-1]
+			}
+			parent := stack[len(stack)-1]
+			path := indexConfPath(parent.path, parent.items)
+			parent.items += 1
+			positions[path] = confPos{i + 1, col + 1}
+			stack = append(stack, &entry{col: col, path: path, item: true})
+
+			rest := strings.TrimLeft(content[1:], " ")
+			col += len(content) - len(rest)
+			content = rest
+		}
+
+		m := confKeyRegex.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+		for top := stack[len(stack)-1]; top.col >= col; top = stack[len(stack)-1] {
+			stack = stack[:len(stack)-1]
+		}
+		path := joinConfPath(stack[len(stack)-1].path, strings.Trim(m[1], `"'`))
+		positions[path] = confPos{i + 1, col + 1}
+		stack = append(stack, &entry{col: col, path: path})
+
+		if value := strings.TrimSpace(content[len(m[0]):]); strings.HasPrefix(value, "|") ||
+			strings.HasPrefix(value, ">") {
+			blockCol = col
+		}
+	}
+
+	return positions
+}
+
+func (v *confValidator) checkSource(conf *PipelineSourceConf) {
+	if conf == nil {
+		v.errorf("source", "", "Missing source specification")
+		return
+	}
+
+	errs := conf.check()
+	for _, err := range errs {
+		v.builderError("source", err)
+	}
+	if len(errs) > 0 || v.opts.SkipSources {
+		return
+	}
+
+	total := 0
+	for i, source := range conf.Sources {
+		path := indexConfPath("source.sources", i)
+		single := *conf
+		single.Sources = []string{source}
+		if files, err := single.ExpandEnv(v.env); err != nil {
+			v.errorf(path, "", "%v", err)
+		} else if len(files) == 0 {
+			v.warnf(path, "", "No files match '%v'", source)
+		} else {
+			total += len(files)
+		}
+	}
+
+	if total == 0 {
+		v.errorf("source.sources", "", "No files resolved from sources")
+	}
+}
+
+func (v *confValidator) checkProcessors(conf *RunnerConf) {
+	byName := make(map[string]*ProcessorConf)
+	paths := make(map[*ProcessorConf]string)
+
+	for i, proc := range conf.Processors {
+		path := indexConfPath("processors", i)
+		if proc == nil {
+			v.errorf(path, "", "Empty processor")
+			continue
+		}
+		paths[proc] = path
+		if _, ok := byName[proc.Name]; ok {
+			// ToRunner only ever finds the first one
+			v.errorf(joinConfPath(path, "name"), "", "Duplicate processor '%v'", proc.Name)
+			continue
+		}
+		byName[proc.Name] = proc
+	}
+
+	for i, proc := range conf.Processors {
+		if proc == nil {
+			continue
+		}
+		path := indexConfPath("processors", i)
+		for _, err := range proc.check(v.env) {
+			v.builderError(path, err)
+		}
+		if conf.SourceConf != nil && conf.SourceConf.Type == PipelineSourceFtrace &&
+			proc.HasLogstream && len(proc.Filters) > 0 {
+			v.errorf(joinConfPath(path, "filters"), "", "Filters can't be used with ftrace sources")
+		}
+		for j, input := range proc.Inputs {
+			if input != nil {
+				v.checkArgs(indexConfPath(joinConfPath(path, "inputs"), j), input, byName)
+			}
+		}
+	}
+
+	// The sink and everything it depends on
+	graph, err := conf.buildDependencyGraph(func(proc *ProcessorConf, err *confFieldError) {
+		v.builderError(paths[proc], err)
+	})
+	if err != nil {
+		v.builderError("sink", err)
+		return
+	}
+	v.checkArgs("sink", conf.Sink, byName)
+
+	if _, err := graph.TopSort(); err != nil {
+		v.errorf("sink.name", "", "%v", errPipelineCycle)
+	}
+
+	for _, proc := range conf.Processors {
+		if proc == nil {
+			continue
+		}
+		if _, ok := graph.NodeMap[proc.Key()]; !ok {
+			v.warnf(joinConfPath(paths[proc], "name"), "", "Processor '%v' is not used by the sink", proc.Name)
+		}
+	}
+}
+
+// Check the args given to the processor input refers to, if its generator
+// knows how.
+func (v *confValidator) checkArgs(path string, input *ProcessorInputConf, byName map[string]*ProcessorConf) {
+	proc, ok := byName[input.Name]
+	if !ok {
+		return
+	}
+	checker, ok := v.env.Processors[proc.GeneratorName()].(ProcessorArgsChecker)
+	if !ok {
+		return
+	}
+	if err := checker.CheckArgs(input.Args); err != nil {
+		v.errorf(joinConfPath(path, "args"), "", "Invalid args for processor '%v': %v", proc.Name, err)
+	}
+}
+
+func (v *confValidator) checkDataCollector(conf *DataCollectorConf) {
+	if conf == nil || len(conf.Name) == 0 {
+		return
+	}
+	if _, err := conf.newDataCollector(v.env); err != nil {
+		v.builderError("data_collector", err)
+	}
+}
+
+// The keys of one of the Environment's maps
+func envNames(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find the candidate that name is most likely a typo of, or "" if none are
+// close enough.
+func suggestName(name string, candidates []string) string {
+	if len(name) == 0 {
+		return ""
+	}
+
+	// Allow about one edit per three characters
+	maxDist := len(name) / 3
+	if maxDist < 1 {
+		maxDist = 1
+	}
+
+	best := ""
+	bestDist := maxDist + 1
+	for _, candidate := range candidates {
+		dist := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if dist < bestDist || (dist == bestDist && candidate < best) {
+			best, bestDist = candidate, dist
+		}
+	}
+	if bestDist > maxDist {
+		return ""
+	}
+	return best
+}
+
+// The number of insertions, deletions, substitutions and transpositions of
+// adjacent characters needed to turn a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	min := func(vals ...int) int {
+		m := vals[0]
+		for _, v := range vals[1:] {
+			if v < m {
+				m = v
+			}
+		}
+		return m
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
@@ -0,0 +1,247 @@
+package phonelab
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuggestName(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	assert.Equal(0, editDistance("tag", "tag"))
+	assert.Equal(1, editDistance("tga", "tag"))
+	assert.Equal(1, editDistance("Kernel-Trce", "Kernel-Trace"))
+	assert.Equal(3, editDistance("", "abc"))
+
+	parsers := []string{"Kernel-Trace", "KernelPrintk", "PhoneLab-Power"}
+	assert.Equal("Kernel-Trace", suggestName("Kernel-Trce", parsers))
+	assert.Equal("Kernel-Trace", suggestName("kernel-trace", parsers))
+	assert.Equal("", suggestName("foo", parsers))
+	assert.Equal("", suggestName("", parsers))
+}
+
+func newValidateTestEnv() *Environment {
+	env := NewEnvironment()
+	env.Processors["passthrough"] = &passThroughProcessorGen{}
+	env.Filters["thermal"] = func(s string) bool { return true }
+	return env
+}
+
+func TestValidateRunnerConfOK(t *testing.T) {
+	t.Parallel()
+
+	conf := `
+source:
+  type: files
+  sources: ["./test/*.log"]
+  error_policy: skip_file
+processors:
+  - name: main
+    generator: passthrough
+    inputs:
+      - name: pre
+  - name: pre
+    generator: passthrough
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: custom
+        filter: thermal
+      - type: expr
+        filter: 'tag == "Kernel-Trace"'
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(conf, newValidateTestEnv(), nil)
+	assert.Equal(t, 0, len(diags), "%v", diags)
+}
+
+func TestValidateRunnerConfErrors(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	conf := `
+source:
+  type: file
+  sources: ["./test/*.log"]
+  error_polcy: skip_file
+processors:
+  - name: main
+    generator: passthrogh
+    inputs:
+      - name: pree
+  - name: pre
+    generator: passthrough
+    has_logstream: true
+    parsers: ["Kernel-Trce", "foo"]
+    filters:
+      - type: regexp
+        filter: "abc"
+      - type: regex
+        filter: "[abc"
+      - type: expr
+        filter: 'tga == "Kernel-Trace"'
+  - name: unused
+    generator: passthrough
+data_collector:
+  name: defualt
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(conf, newValidateTestEnv(), nil)
+
+	type expected struct {
+		line       int
+		severity   DiagnosticSeverity
+		contains   string
+		suggestion string
+	}
+
+	expect := []expected{
+		{3, SeverityError, "Invalid source type 'file'", "files"},
+		{5, SeverityWarning, "Unknown field 'error_polcy'", "error_policy"},
+		{8, SeverityError, "Unknown Processor 'passthrogh'", "passthrough"},
+		{10, SeverityError, "Cannot find input processor 'pree'", "pre"},
+		{11, SeverityWarning, "'pre' is not used", ""},
+		{14, SeverityError, "Unknown parser 'Kernel-Trce'", "Kernel-Trace"},
+		{14, SeverityError, "Unknown parser 'foo'", ""},
+		{16, SeverityError, "Invalid filter type 'regexp'", "regex"},
+		{19, SeverityError, "Invalid regex filter", ""},
+		{21, SeverityError, "Did you mean 'tag'?", ""},
+		{22, SeverityWarning, "'unused' is not used", ""},
+		{25, SeverityError, "Unknown DataCollector 'defualt'", "default"},
+	}
+
+	require.Equal(t, len(expect), len(diags), "%v", diags)
+	for i, e := range expect {
+		d := diags[i]
+		assert.Equal(e.line, d.Line, d.String())
+		assert.Equal(e.severity, d.Severity, d.String())
+		assert.True(strings.Contains(d.Message, e.contains), d.String())
+		assert.Equal(e.suggestion, d.Suggestion, d.String())
+	}
+	assert.True(HasConfErrors(diags))
+}
+
+func TestValidateRunnerConfGraph(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	conf := `
+source:
+  type: files
+  sources: ["./test/nothing-here-*.log", "./test/*.log"]
+processors:
+  - name: a
+    generator: passthrough
+    inputs:
+      - name: b
+  - name: b
+    generator: passthrough
+    inputs:
+      - name: a
+sink:
+  name: c
+`
+	diags := ValidateRunnerConf(conf, newValidateTestEnv(), nil)
+	require.Equal(t, 2, len(diags), "%v", diags)
+
+	assert.Equal(SeverityWarning, diags[0].Severity)
+	assert.Equal(4, diags[0].Line)
+	assert.Contains(diags[0].Message, "No files match")
+
+	assert.Equal(SeverityError, diags[1].Severity)
+	assert.Equal(15, diags[1].Line)
+	assert.Equal("a", diags[1].Suggestion)
+
+	diags = ValidateRunnerConf(strings.Replace(conf, "name: c", "name: a", 1),
+		newValidateTestEnv(), &ValidateOptions{SkipSources: true})
+	require.Equal(t, 1, len(diags), "%v", diags)
+	assert.Equal(15, diags[0].Line)
+	assert.Contains(diags[0].Message, "Cycle detected")
+
+	// Syntax errors stop everything else
+	diags = ValidateRunnerConf("source:\n  type: [files\n", newValidateTestEnv(), nil)
+	require.Equal(t, 1, len(diags))
+	assert.True(diags[0].Line > 0)
+	assert.True(HasConfErrors(diags))
+}
+
+func TestValidateRunnerConfUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// ToRunner ignores keys it doesn't know, so they're only warnings
+	conf := `
+source:
+  type: files
+  sources: ["./test/*.log"]
+processors:
+  - name: main
+    generator: passthrough
+    has_logstrem: true
+    notes: |
+      has_logstream: true
+sink:
+  name: main
+`
+	diags := ValidateRunnerConf(conf, newValidateTestEnv(), nil)
+	require.Equal(2, len(diags), "%v", diags)
+	assert.Equal(SeverityWarning, diags[0].Severity)
+	assert.Equal(8, diags[0].Line)
+	assert.Equal(5, diags[0].Column)
+	assert.Equal("processors[0].has_logstrem", diags[0].Path)
+	assert.Equal("has_logstream", diags[0].Suggestion)
+	assert.Equal(9, diags[1].Line)
+	assert.False(HasConfErrors(diags))
+
+	runnerConf, err := RunnerConfFromString(conf)
+	require.Nil(err)
+	_, err = runnerConf.ToRunner(newValidateTestEnv())
+	assert.Nil(err)
+}
+
+func TestLocateConfPaths(t *testing.T) {
+	t.Parallel()
+
+	positions := locateConfPaths(`
+# comment
+source:
+  type: files
+processors:
+- name: a
+  filters:
+    - type: simple
+      filter: "x: y"
+  parsers: [a, b]
+- name: b
+  description: >
+    name: c
+sink: {name: a}
+`)
+	assert.Equal(t, map[string]confPos{
+		"source":                          {3, 1},
+		"source.type":                     {4, 3},
+		"processors":                      {5, 1},
+		"processors[0]":                   {6, 1},
+		"processors[0].name":              {6, 3},
+		"processors[0].filters":           {7, 3},
+		"processors[0].filters[0]":        {8, 5},
+		"processors[0].filters[0].type":   {8, 7},
+		"processors[0].filters[0].filter": {9, 7},
+		"processors[0].parsers":           {10, 3},
+		"processors[1]":                   {11, 1},
+		"processors[1].name":              {11, 3},
+		"processors[1].description":       {12, 3},
+		"sink":                            {14, 1},
+	}, positions)
+}
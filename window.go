@@ -0,0 +1,804 @@
+package phonelab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window aggregation
+//
+// WindowProcessor groups the logs coming down its source into windows of
+// MonotonicTimestamp() (TraceTime, for Loglines) and emits one *WindowRecord
+// per window per group-by key, with the values of its reducers. There are
+// three kinds of window:
+//
+//	tumbling: back-to-back windows of size seconds, aligned to 0
+//	sliding:  windows of size seconds starting every slide seconds, so each
+//	          log lands in size/slide of them
+//	session:  a window per key that stays open until no log has arrived for
+//	          gap seconds. A late log joins the key's session if it is
+//	          within gap of its start, and is dropped otherwise.
+//
+// The source is expected to be (roughly) in time order, as the log streams
+// are. A window is emitted as soon as a log arrives that is past its end,
+// and the rest are emitted when the source is done. Logs that arrive after
+// their window has been emitted are dropped. Records are emitted in order of
+// End, which is what WindowRecord.MonotonicTimestamp returns, so the output
+// can be fed to a timeweaver.
+//
+// Group-by and reducer fields are dotted paths, resolved the same way as in
+// expr filters: tag, payload.Cpu, payload.State, etc. for Loglines, and struct
+// fields or map keys for anything else. Logs without one of the group-by
+// fields are skipped, and reducers skip logs without their field.
+//
+// From YAML, the window processor's args go on the input that refers to it:
+//
+//	processors:
+//	  - name: freq
+//	    generator: window
+//	    has_logstream: true
+//	    parsers: ["Kernel-Trace"]
+//	sink:
+//	  name: freq
+//	  args:
+//	    type: tumbling
+//	    size: 1s
+//	    group_by: [payload.CpuId]
+//	    reducers:
+//	      - count
+//	      - {op: mean, field: payload.State}
+//	      - {op: percentile, field: payload.State, p: 95, as: p95}
+
+const (
+	// The generator name the window processor is registered under in the
+	// Environment.
+	WindowProcessorName = "window"
+)
+
+type WindowType string
+
+const (
+	WindowTumbling WindowType = "tumbling"
+	WindowSliding  WindowType = "sliding"
+	WindowSession  WindowType = "session"
+)
+
+type WindowReducerOp string
+
+const (
+	ReducerCount      WindowReducerOp = "count"
+	ReducerSum        WindowReducerOp = "sum"
+	ReducerMin        WindowReducerOp = "min"
+	ReducerMax        WindowReducerOp = "max"
+	ReducerMean       WindowReducerOp = "mean"
+	ReducerPercentile WindowReducerOp = "percentile"
+	ReducerLast       WindowReducerOp = "last"
+)
+
+var windowReducerOps = []string{
+	string(ReducerCount), string(ReducerSum), string(ReducerMin), string(ReducerMax),
+	string(ReducerMean), string(ReducerPercentile), string(ReducerLast),
+}
+
+type WindowReducerConf struct {
+	Op WindowReducerOp
+	// The field to reduce. Optional for count, which then counts every log.
+	Field string
+	// The name of the value in WindowRecord.Values. Defaults to op_field,
+	// with dots replaced by underscores, or pNN_field for percentiles.
+	As string
+	// For percentile, in (0, 100]
+	Percentile float64
+}
+
+// The name of the reducer's value in WindowRecord.Values
+func (conf *WindowReducerConf) Name() string {
+	if len(conf.As) > 0 {
+		return conf.As
+	}
+	name := string(conf.Op)
+	if conf.Op == ReducerPercentile {
+		name = "p" + strconv.FormatFloat(conf.Percentile, 'f', -1, 64)
+	}
+	if len(conf.Field) > 0 {
+		name += "_" + strings.Replace(conf.Field, ".", "_", -1)
+	}
+	return name
+}
+
+type WindowConf struct {
+	Type WindowType
+	// Durations are in seconds, like MonotonicTimestamp().
+	Size  float64 // tumbling and sliding
+	Slide float64 // sliding
+	Gap   float64 // session
+
+	GroupBy  []string
+	Reducers []*WindowReducerConf
+}
+
+func (conf *WindowConf) validate() error {
+	switch conf.Type {
+	case WindowTumbling:
+		if conf.Size <= 0 {
+			return errors.New("tumbling windows need a size > 0")
+		}
+	case WindowSliding:
+		if conf.Size <= 0 || conf.Slide <= 0 {
+			return errors.New("sliding windows need a size and slide > 0")
+		}
+		if conf.Slide > conf.Size {
+			return fmt.Errorf("slide (%v) cannot be larger than size (%v)", conf.Slide, conf.Size)
+		}
+	case WindowSession:
+		if conf.Gap <= 0 {
+			return errors.New("session windows need a gap > 0")
+		}
+	default:
+		types := []string{string(WindowTumbling), string(WindowSliding), string(WindowSession)}
+		if suggestion := suggestName(string(conf.Type), types); len(suggestion) > 0 {
+			return fmt.Errorf("Unknown window type '%v'. Did you mean '%v'?", conf.Type, suggestion)
+		}
+		return fmt.Errorf("Unknown window type '%v'. Expected one of: %v", conf.Type, strings.Join(types, ", "))
+	}
+
+	for _, field := range conf.GroupBy {
+		if _, err := parseWindowField(field); err != nil {
+			return fmt.Errorf("Invalid group_by field '%v': %v", field, err)
+		}
+	}
+
+	if len(conf.Reducers) == 0 {
+		return errors.New("No reducers")
+	}
+
+	names := make(map[string]bool)
+	for _, reducer := range conf.Reducers {
+		switch reducer.Op {
+		case ReducerCount:
+		case ReducerSum, ReducerMin, ReducerMax, ReducerMean, ReducerLast:
+			if len(reducer.Field) == 0 {
+				return fmt.Errorf("%v reducer needs a field", reducer.Op)
+			}
+		case ReducerPercentile:
+			if len(reducer.Field) == 0 {
+				return fmt.Errorf("%v reducer needs a field", reducer.Op)
+			}
+			if reducer.Percentile <= 0 || reducer.Percentile > 100 {
+				return fmt.Errorf("percentile must be in (0, 100], got %v", reducer.Percentile)
+			}
+		default:
+			if suggestion := suggestName(string(reducer.Op), windowReducerOps); len(suggestion) > 0 {
+				return fmt.Errorf("Unknown reducer '%v'. Did you mean '%v'?", reducer.Op, suggestion)
+			}
+			return fmt.Errorf("Unknown reducer '%v'. Expected one of: %v",
+				reducer.Op, strings.Join(windowReducerOps, ", "))
+		}
+
+		if len(reducer.Field) > 0 {
+			if _, err := parseWindowField(reducer.Field); err != nil {
+				return fmt.Errorf("Invalid %v field '%v': %v", reducer.Op, reducer.Field, err)
+			}
+		}
+
+		name := reducer.Name()
+		if names[name] {
+			return fmt.Errorf("Duplicate reducer '%v'. Use 'as' to name it", name)
+		}
+		names[name] = true
+	}
+
+	return nil
+}
+
+var windowArgs = []string{"type", "size", "slide", "gap", "group_by", "reducers"}
+var windowReducerArgs = []string{"op", "field", "as", "p"}
+
+// Get a WindowConf from processor args, e.g. from YAML:
+//
+//	type: sliding
+//	size: 10s        # or seconds, e.g. 10 or 0.5
+//	slide: 1s
+//	group_by: [tag]  # or just tag
+//	reducers: [count, {op: max, field: payload.State}]
+func ParseWindowConf(kwargs map[string]interface{}) (*WindowConf, error) {
+	conf := &WindowConf{}
+
+	for k, v := range kwargs {
+		var err error
+		switch k {
+		case "type":
+			var s string
+			s, err = windowString(v)
+			conf.Type = WindowType(s)
+		case "size":
+			conf.Size, err = windowSeconds(v)
+		case "slide":
+			conf.Slide, err = windowSeconds(v)
+		case "gap":
+			conf.Gap, err = windowSeconds(v)
+		case "group_by":
+			conf.GroupBy, err = windowStrings(v)
+		case "reducers":
+			conf.Reducers, err = windowReducers(v)
+		default:
+			if suggestion := suggestName(k, windowArgs); len(suggestion) > 0 {
+				return nil, fmt.Errorf("Unknown arg '%v'. Did you mean '%v'?", k, suggestion)
+			}
+			return nil, fmt.Errorf("Unknown arg '%v'. Expected one of: %v", k, strings.Join(windowArgs, ", "))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %v", k, err)
+		}
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func windowString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("Expected a string, got %T", v)
+}
+
+// A duration in seconds, or a string time.ParseDuration understands.
+func windowSeconds(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	case string:
+		if d, err := time.ParseDuration(t); err == nil {
+			return d.Seconds(), nil
+		}
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f, nil
+		}
+		return 0, fmt.Errorf("Invalid duration '%v'", t)
+	}
+	return 0, fmt.Errorf("Expected a duration, got %T", v)
+}
+
+func windowNumber(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	case string:
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f, nil
+		}
+		return 0, fmt.Errorf("Invalid number '%v'", t)
+	}
+	return 0, fmt.Errorf("Expected a number, got %T", v)
+}
+
+// A string or list of strings
+func windowStrings(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case string:
+		return []string{t}, nil
+	case []string:
+		return t, nil
+	case []interface{}:
+		res := make([]string, 0, len(t))
+		for _, elem := range t {
+			s, err := windowString(elem)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, s)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("Expected a list of strings, got %T", v)
+}
+
+// Maps from YAML have interface{} keys.
+func windowMap(v interface{}) (map[string]interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, nil
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{})
+		for k, v := range t {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected string keys, got %T", k)
+			}
+			res[s] = v
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("Expected a map, got %T", v)
+}
+
+func windowReducers(v interface{}) ([]*WindowReducerConf, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a list, got %T", v)
+	}
+
+	res := make([]*WindowReducerConf, 0, len(list))
+	for _, elem := range list {
+		// Just the op
+		if op, ok := elem.(string); ok {
+			res = append(res, &WindowReducerConf{Op: WindowReducerOp(op)})
+			continue
+		}
+
+		m, err := windowMap(elem)
+		if err != nil {
+			return nil, err
+		}
+
+		reducer := &WindowReducerConf{}
+		for k, v := range m {
+			var s string
+			switch k {
+			case "op":
+				s, err = windowString(v)
+				reducer.Op = WindowReducerOp(s)
+			case "field":
+				reducer.Field, err = windowString(v)
+			case "as":
+				reducer.As, err = windowString(v)
+			case "p":
+				reducer.Percentile, err = windowNumber(v)
+			default:
+				if suggestion := suggestName(k, windowReducerArgs); len(suggestion) > 0 {
+					return nil, fmt.Errorf("Unknown reducer arg '%v'. Did you mean '%v'?", k, suggestion)
+				}
+				return nil, fmt.Errorf("Unknown reducer arg '%v'. Expected one of: %v",
+					k, strings.Join(windowReducerArgs, ", "))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid reducer %v: %v", k, err)
+			}
+		}
+		res = append(res, reducer)
+	}
+	return res, nil
+}
+
+// A dotted path to a value in a log
+type windowField []string
+
+func parseWindowField(src string) (windowField, error) {
+	path := strings.Split(src, ".")
+	for _, name := range path {
+		if len(name) == 0 {
+			return nil, errors.New("Empty field name")
+		}
+	}
+	return windowField(path), nil
+}
+
+// The value of the field in obj. Loglines have the same fields as in expr
+// filters.
+func (f windowField) get(obj interface{}) (interface{}, error) {
+	for _, name := range f {
+		if ll, ok := obj.(*Logline); ok && ll != nil {
+			if field, ok := loglineExprFields[strings.ToLower(name)]; ok {
+				obj = field.get(ll)
+				continue
+			}
+		}
+		v, err := selectExprField(obj, name)
+		if err != nil {
+			return nil, err
+		}
+		obj = v
+	}
+	return obj, nil
+}
+
+// One record per window per key
+type WindowRecord struct {
+	Start float64 `json:"start"`
+	// For session windows, the time of the last log plus the gap
+	End float64 `json:"end"`
+	// The group-by field values, by field
+	Key map[string]interface{} `json:"key,omitempty"`
+	// The reducer values, by WindowReducerConf.Name(). Values that no log
+	// had a field for are nil.
+	Values map[string]interface{} `json:"values"`
+}
+
+func (r *WindowRecord) MonotonicTimestamp() float64 {
+	return r.End
+}
+
+// The running state of a reducer
+type windowAcc struct {
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+	last   interface{}
+	values []float64
+}
+
+func (acc *windowAcc) add(op WindowReducerOp, v interface{}) {
+	acc.last = v
+	if op == ReducerCount || op == ReducerLast {
+		acc.count++
+		return
+	}
+
+	f, ok := toFloat(v)
+	if !ok {
+		return
+	}
+	if acc.count == 0 || f < acc.min {
+		acc.min = f
+	}
+	if acc.count == 0 || f > acc.max {
+		acc.max = f
+	}
+	acc.count++
+	acc.sum += f
+	if op == ReducerPercentile {
+		acc.values = append(acc.values, f)
+	}
+}
+
+func (acc *windowAcc) value(conf *WindowReducerConf) interface{} {
+	if conf.Op == ReducerCount {
+		return acc.count
+	} else if acc.count == 0 {
+		return nil
+	}
+
+	switch conf.Op {
+	case ReducerSum:
+		return acc.sum
+	case ReducerMin:
+		return acc.min
+	case ReducerMax:
+		return acc.max
+	case ReducerMean:
+		return acc.sum / float64(acc.count)
+	case ReducerLast:
+		return acc.last
+	case ReducerPercentile:
+		// Nearest rank
+		sort.Float64s(acc.values)
+		rank := int(math.Ceil(conf.Percentile / 100 * float64(len(acc.values))))
+		if rank < 1 {
+			rank = 1
+		}
+		return acc.values[rank-1]
+	}
+	return nil
+}
+
+type windowState struct {
+	start  float64
+	end    float64
+	key    []interface{}
+	keyStr string
+	accs   []*windowAcc
+}
+
+type WindowProcessor struct {
+	Source Processor
+	Conf   *WindowConf
+
+	groupBy  []windowField
+	reducers []windowField
+}
+
+func NewWindowProcessor(source Processor, conf *WindowConf) (*WindowProcessor, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	p := &WindowProcessor{
+		Source:   source,
+		Conf:     conf,
+		groupBy:  make([]windowField, 0, len(conf.GroupBy)),
+		reducers: make([]windowField, 0, len(conf.Reducers)),
+	}
+	for _, field := range conf.GroupBy {
+		f, _ := parseWindowField(field)
+		p.groupBy = append(p.groupBy, f)
+	}
+	for _, reducer := range conf.Reducers {
+		var f windowField
+		if len(reducer.Field) > 0 {
+			f, _ = parseWindowField(reducer.Field)
+		}
+		p.reducers = append(p.reducers, f)
+	}
+	return p, nil
+}
+
+func (p *WindowProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *WindowProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+	metrics := nodeMetrics(ctx, "WindowProcessor")
+
+	go func() {
+		inChan := ProcessContext(ctx, p.Source)
+		w := &windower{
+			p:          p,
+			open:       make(map[string][]*windowState),
+			nextExpiry: math.Inf(1),
+		}
+
+	loop:
+		for obj := range inChan {
+			if ctx.Err() != nil {
+				break
+			}
+			metrics.itemIn()
+
+			ts, ok := obj.(MonotonicTimestamper)
+			if !ok || reflect.ValueOf(obj).Kind() == reflect.Ptr && reflect.ValueOf(obj).IsNil() {
+				continue
+			}
+			for _, rec := range w.add(obj, ts.MonotonicTimestamp()) {
+				if !metrics.send(ctx, outChan, rec) {
+					break loop
+				}
+			}
+		}
+
+		if ctx.Err() == nil {
+			for _, rec := range w.flush(math.Inf(1)) {
+				if !metrics.send(ctx, outChan, rec) {
+					break
+				}
+			}
+		}
+
+		drain(inChan)
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+type windower struct {
+	p *WindowProcessor
+	// The open windows for each key, by keyStr
+	open map[string][]*windowState
+	// The latest timestamp we've seen
+	watermark float64
+	started   bool
+	// No window ends before this
+	nextExpiry float64
+}
+
+// Whether a window is done once we've seen t
+func (w *windower) expired(ws *windowState, t float64) bool {
+	if w.p.Conf.Type == WindowSession {
+		return ws.end < t
+	}
+	return ws.end <= t
+}
+
+// Add a log at time t and return the windows that are done.
+func (w *windower) add(obj interface{}, t float64) []*WindowRecord {
+	if !w.started || t > w.watermark {
+		w.watermark = t
+		w.started = true
+	}
+
+	var done []*WindowRecord
+	if w.nextExpiry <= w.watermark {
+		done = w.flush(w.watermark)
+	}
+
+	key := make([]interface{}, len(w.p.groupBy))
+	for i, field := range w.p.groupBy {
+		v, err := field.get(obj)
+		if err != nil {
+			return done
+		}
+		key[i] = v
+	}
+	keyStr := fmt.Sprintf("%#v", key)
+
+	conf := w.p.Conf
+	switch conf.Type {
+	case WindowTumbling:
+		start := math.Floor(t/conf.Size) * conf.Size
+		w.addTo(obj, key, keyStr, start, start+conf.Size)
+	case WindowSliding:
+		// Every window with start <= t < start+size
+		first := math.Floor((t-conf.Size)/conf.Slide) + 1
+		for k := first; k*conf.Slide <= t; k++ {
+			start := k * conf.Slide
+			w.addTo(obj, key, keyStr, start, start+conf.Size)
+		}
+	case WindowSession:
+		// A log past a session's end closes it, so there is at most one
+		// open session per key. Logs from more than gap before it would
+		// start a session that is already over, and are dropped.
+		windows := w.open[keyStr]
+		if len(windows) > 0 && t >= windows[0].start-conf.Gap {
+			ws := windows[0]
+			if t < ws.start {
+				ws.start = t
+			}
+			if end := t + conf.Gap; end > ws.end {
+				ws.end = end
+			}
+			w.reduce(ws, obj)
+		} else {
+			w.addTo(obj, key, keyStr, t, t+conf.Gap)
+		}
+	}
+
+	return done
+}
+
+// Add obj to the window for key at start, if it hasn't already been emitted.
+func (w *windower) addTo(obj interface{}, key []interface{}, keyStr string, start, end float64) {
+	windows := w.open[keyStr]
+	for _, ws := range windows {
+		if ws.start == start {
+			w.reduce(ws, obj)
+			return
+		}
+	}
+
+	ws := &windowState{
+		start:  start,
+		end:    end,
+		key:    key,
+		keyStr: keyStr,
+		accs:   make([]*windowAcc, len(w.p.reducers)),
+	}
+	if w.expired(ws, w.watermark) {
+		// Too late
+		return
+	}
+	for i := range ws.accs {
+		ws.accs[i] = &windowAcc{}
+	}
+
+	w.open[keyStr] = append(windows, ws)
+	if end < w.nextExpiry {
+		w.nextExpiry = end
+	}
+	w.reduce(ws, obj)
+}
+
+func (w *windower) reduce(ws *windowState, obj interface{}) {
+	for i, field := range w.p.reducers {
+		op := w.p.Conf.Reducers[i].Op
+		if field == nil {
+			ws.accs[i].add(op, nil)
+		} else if v, err := field.get(obj); err == nil {
+			ws.accs[i].add(op, v)
+		}
+	}
+}
+
+// Remove and return the windows that are done at time t, in order of end.
+func (w *windower) flush(t float64) []*WindowRecord {
+	done := make([]*windowState, 0)
+	w.nextExpiry = math.Inf(1)
+
+	for keyStr, windows := range w.open {
+		open := windows[:0]
+		for _, ws := range windows {
+			if w.expired(ws, t) {
+				done = append(done, ws)
+			} else {
+				open = append(open, ws)
+				if ws.end < w.nextExpiry {
+					w.nextExpiry = ws.end
+				}
+			}
+		}
+		if len(open) > 0 {
+			w.open[keyStr] = open
+		} else {
+			delete(w.open, keyStr)
+		}
+	}
+
+	sort.Slice(done, func(i, j int) bool {
+		if done[i].end != done[j].end {
+			return done[i].end < done[j].end
+		} else if done[i].start != done[j].start {
+			return done[i].start < done[j].start
+		}
+		return done[i].keyStr < done[j].keyStr
+	})
+
+	res := make([]*WindowRecord, 0, len(done))
+	for _, ws := range done {
+		rec := &WindowRecord{
+			Start:  ws.start,
+			End:    ws.end,
+			Values: make(map[string]interface{}),
+		}
+		if len(ws.key) > 0 {
+			rec.Key = make(map[string]interface{})
+			for i, field := range w.p.Conf.GroupBy {
+				rec.Key[field] = ws.key[i]
+			}
+		}
+		for i, reducer := range w.p.Conf.Reducers {
+			rec.Values[reducer.Name()] = ws.accs[i].value(reducer)
+		}
+		res = append(res, rec)
+	}
+	return res
+}
+
+// Generates WindowProcessors from processor args. See ParseWindowConf.
+type WindowProcessorGen struct{}
+
+func (g *WindowProcessorGen) GenerateProcessor(source *PipelineSourceInstance,
+	kwargs map[string]interface{}) Processor {
+
+	conf, err := ParseWindowConf(kwargs)
+	if err == nil {
+		var proc *WindowProcessor
+		if proc, err = NewWindowProcessor(source.Processor, conf); err == nil {
+			return proc
+		}
+	}
+
+	return &argsErrorProcessor{
+		Source: source.Processor,
+		Info:   source.Info,
+		Err:    fmt.Errorf("Invalid %v args: %v", WindowProcessorName, err),
+	}
+}
+
+func (g *WindowProcessorGen) CheckArgs(kwargs map[string]interface{}) error {
+	_, err := ParseWindowConf(kwargs)
+	return err
+}
+
+// Stands in for a processor that couldn't be created from its args. It
+// reports the error to the Runner and emits nothing.
+type argsErrorProcessor struct {
+	Source Processor
+	Info   PipelineSourceInfo
+	Err    error
+}
+
+func (p *argsErrorProcessor) Process() <-chan interface{} {
+	return p.ProcessContext(context.Background())
+}
+
+func (p *argsErrorProcessor) ProcessContext(ctx context.Context) <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		reportSourceError(ctx, nil, &SourceError{Info: p.Info, Err: p.Err})
+		// Whatever is upstream might be feeding other processors too.
+		drain(ProcessContext(ctx, p.Source))
+		close(outChan)
+	}()
+
+	return outChan
+}
@@ -0,0 +1,345 @@
+package phonelab
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+type windowSample struct {
+	Time float64
+	Cpu  int
+	Freq int
+}
+
+func (s *windowSample) MonotonicTimestamp() float64 {
+	return s.Time
+}
+
+type windowSampleEmitter struct {
+	samples []*windowSample
+}
+
+func (e *windowSampleEmitter) Process() <-chan interface{} {
+	outChan := make(chan interface{})
+
+	go func() {
+		for _, s := range e.samples {
+			outChan <- s
+		}
+		close(outChan)
+	}()
+
+	return outChan
+}
+
+func runWindow(t *testing.T, args string, samples []*windowSample) []*WindowRecord {
+	kwargs := make(map[string]interface{})
+	require.Nil(t, yaml.Unmarshal([]byte(args), &kwargs))
+
+	conf, err := ParseWindowConf(kwargs)
+	require.Nil(t, err)
+
+	proc, err := NewWindowProcessor(&windowSampleEmitter{samples}, conf)
+	require.Nil(t, err)
+
+	res := make([]*WindowRecord, 0)
+	for obj := range proc.Process() {
+		res = append(res, obj.(*WindowRecord))
+	}
+
+	// Always in order of end
+	for i := 1; i < len(res); i++ {
+		assert.True(t, res[i-1].End <= res[i].End)
+	}
+	return res
+}
+
+func TestWindowTumbling(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	samples := []*windowSample{
+		{0.0, 0, 100},
+		{0.5, 1, 300},
+		{0.9, 0, 200},
+		{1.2, 0, 400},
+		// Nothing in [2, 3)
+		{3.1, 1, 500},
+		// Late, but [3, 4) is still open
+		{3.0, 1, 600},
+		// Too late, [1, 2) is done
+		{1.5, 0, 1000},
+		{3.5, 0, 700},
+	}
+
+	res := runWindow(t, `
+type: tumbling
+size: 1s
+group_by: Cpu
+reducers:
+  - count
+  - {op: sum, field: Freq}
+  - {op: min, field: freq}
+  - {op: max, field: Freq}
+  - {op: mean, field: Freq}
+  - {op: percentile, field: Freq, p: 50}
+  - {op: last, field: Freq, as: final}
+  - {op: mean, field: NoSuchField, as: missing}
+  - {op: sum, field: NoSuchField, as: missing_sum}
+`, samples)
+
+	require.Equal(5, len(res))
+
+	type window struct {
+		start, end float64
+		cpu        int64
+		count      int64
+		sum        float64
+		last       int64
+	}
+	expected := []window{
+		{0, 1, 0, 2, 300, 200},
+		{0, 1, 1, 1, 300, 300},
+		{1, 2, 0, 1, 400, 400},
+		{3, 4, 0, 1, 700, 700},
+		{3, 4, 1, 2, 1100, 600},
+	}
+	for i, w := range expected {
+		rec := res[i]
+		assert.Equal(w.start, rec.Start, i)
+		assert.Equal(w.end, rec.End, i)
+		assert.Equal(map[string]interface{}{"Cpu": w.cpu}, rec.Key, i)
+		assert.Equal(w.count, rec.Values["count"], i)
+		assert.Equal(w.sum, rec.Values["sum_Freq"], i)
+		assert.Equal(w.last, rec.Values["final"], i)
+		assert.Nil(rec.Values["missing"], i)
+		assert.Contains(rec.Values, "missing")
+		assert.Nil(rec.Values["missing_sum"], i)
+		assert.Contains(rec.Values, "missing_sum")
+	}
+
+	first := res[0].Values
+	assert.Equal(100.0, first["min_freq"])
+	assert.Equal(200.0, first["max_Freq"])
+	assert.Equal(150.0, first["mean_Freq"])
+	assert.Equal(100.0, first["p50_Freq"])
+	assert.Equal(500.0, res[4].Values["min_freq"])
+}
+
+func TestWindowSliding(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	samples := []*windowSample{
+		{0.5, 0, 1},
+		{1.5, 0, 2},
+		{2.5, 0, 3},
+		{2.6, 0, 4},
+	}
+
+	res := runWindow(t, `
+type: sliding
+size: 2
+slide: 1
+reducers: [count, {op: percentile, field: Freq, p: 90}]
+`, samples)
+
+	require.Equal(4, len(res))
+
+	starts := []float64{-1, 0, 1, 2}
+	counts := []int64{1, 2, 3, 2}
+	p90s := []float64{1, 2, 4, 4}
+	for i := range res {
+		assert.Equal(starts[i], res[i].Start)
+		assert.Equal(starts[i]+2, res[i].End)
+		assert.Nil(res[i].Key)
+		assert.Equal(counts[i], res[i].Values["count"])
+		assert.Equal(p90s[i], res[i].Values["p90_Freq"])
+	}
+}
+
+func TestWindowSession(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	samples := []*windowSample{
+		{0.0, 0, 1},
+		{0.2, 1, 1},
+		{0.8, 0, 1},
+		{1.0, 1, 1},
+		{1.5, 0, 1},
+		// Late, but within the gap of cpu 0's session
+		{-0.5, 0, 1},
+		// cpu 1's session ended at 2.0
+		{2.1, 1, 1},
+		// Late, and too far before cpu 1's new session
+		{0.5, 1, 1},
+		// and cpu 0's at 2.5
+		{4.0, 0, 1},
+	}
+
+	res := runWindow(t, `
+type: session
+gap: 1s
+group_by: [Cpu]
+reducers: [count]
+`, samples)
+
+	require.Equal(4, len(res))
+
+	type window struct {
+		start, end float64
+		cpu        int64
+		count      int64
+	}
+	expected := []window{
+		{0.2, 2.0, 1, 2},
+		{-0.5, 2.5, 0, 4},
+		{2.1, 3.1, 1, 1},
+		{4.0, 5.0, 0, 1},
+	}
+	for i, w := range expected {
+		assert.InDelta(w.start, res[i].Start, 1e-9, i)
+		assert.InDelta(w.end, res[i].End, 1e-9, i)
+		assert.Equal(w.cpu, res[i].Key["Cpu"], i)
+		assert.Equal(w.count, res[i].Values["count"], i)
+	}
+}
+
+func TestParseWindowConfErrors(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		`{size: 1}`:                                                       "Unknown window type ''",
+		`{type: tumbling, reducers: [count]}`:                             "size > 0",
+		`{type: tumblng, size: 1, reducers: [count]}`:                     "Did you mean 'tumbling'?",
+		`{type: sliding, size: 1, slide: 2, reducers: [count]}`:           "cannot be larger",
+		`{type: session, gap: 1}`:                                         "No reducers",
+		`{type: session, gap: 1, reducers: [cout]}`:                       "Did you mean 'count'?",
+		`{type: session, gap: 1, reducers: [sum]}`:                        "sum reducer needs a field",
+		`{type: session, gap: 1, reducers: [{op: percentile, field: x}]}`: "percentile must be in (0, 100]",
+		`{type: session, gap: 1, reducers: [count, count]}`:               "Duplicate reducer 'count'",
+		`{type: session, gap: 1, reducers: [{op: max, feild: x}]}`:        "Did you mean 'field'?",
+		`{type: session, gap: 10 minutes, reducers: [count]}`:             "Invalid gap",
+		`{type: session, gap: 1, group_by: [a..b], reducers: [count]}`:    "Empty field name",
+		`{type: session, gap: 1, reducer: [count]}`:                       "Did you mean 'reducers'?",
+		`{type: session, gap: 1, reducers: [{op: sum, p: 1s}]}`:           "Invalid reducer p: Invalid number '1s'",
+	}
+
+	for args, expected := range tests {
+		kwargs := make(map[string]interface{})
+		require.Nil(t, yaml.Unmarshal([]byte(args), &kwargs))
+		_, err := ParseWindowConf(kwargs)
+		if assert.NotNil(err, args) {
+			assert.Contains(err.Error(), expected, args)
+		}
+	}
+}
+
+type windowCollector struct {
+	records []*WindowRecord
+	sync.Mutex
+}
+
+func (c *windowCollector) OnData(data interface{}, info PipelineSourceInfo) {
+	c.Lock()
+	c.records = append(c.records, data.(*WindowRecord))
+	c.Unlock()
+}
+
+func (c *windowCollector) Finish() {}
+
+func TestBuilderWindow(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	confString := `
+processors:
+  - name: freq
+    generator: window
+    has_logstream: true
+    parsers: ["Kernel-Trace"]
+    filters:
+      - type: simple
+        filter: "cpu_frequency"
+source:
+  type: files
+  sources: ["./test/test.log"]
+sink:
+  name: freq
+  args:
+    type: tumbling
+    size: 10
+    group_by: [payload.cpu_id]
+    reducers:
+      - count
+      - {op: max, field: payload.State}
+`
+	env := NewEnvironment()
+	assert.Equal(0, len(ValidateRunnerConf(confString, env, &ValidateOptions{})))
+
+	conf, err := RunnerConfFromString(confString)
+	require.Nil(err)
+
+	runner, err := conf.ToRunner(env)
+	require.Nil(err)
+	collector := &windowCollector{}
+	runner.Collector = collector
+
+	errs := runner.Run()
+	require.Equal(0, len(errs))
+
+	require.True(len(collector.records) > 0)
+	total := int64(0)
+	for _, rec := range collector.records {
+		assert.Equal(10.0, rec.End-rec.Start)
+		assert.Contains(rec.Key, "payload.cpu_id")
+		total += rec.Values["count"].(int64)
+		assert.True(rec.Values["max_payload_State"].(float64) > 0)
+	}
+	assert.Equal(int64(427), total)
+
+	// Bad args are caught by validate...
+	badConf := `
+processors:
+  - name: freq
+    generator: window
+    has_logstream: true
+source:
+  type: files
+  sources: ["./test/test.log"]
+sink:
+  name: freq
+  args:
+    type: tumbling
+    reducers: [count]
+`
+	diags := ValidateRunnerConf(badConf, env, &ValidateOptions{})
+	require.Equal(1, len(diags))
+	assert.Equal(11, diags[0].Line)
+	assert.Contains(diags[0].Message, "Invalid args for processor 'freq': tumbling windows need a size > 0")
+
+	// ...and reported by the Runner otherwise
+	conf, err = RunnerConfFromString(badConf)
+	require.Nil(err)
+	runner, err = conf.ToRunner(env)
+	require.Nil(err)
+	runner.Collector = &windowCollector{}
+	errs = runner.Run()
+	require.Equal(1, len(errs))
+	assert.Contains(errs[0].Error(), "Invalid window args")
+}